@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// ErrAccessDenied is reported to OnError for connection requests from visitors
+// that the access control lists do not admit.
+var ErrAccessDenied = errors.New("denied by access control")
+
+// AccessControl restricts which visitors may connect through the tunnel, by
+// the address the server reports for them. A visitor is admitted if it is in
+// no Deny prefix and, unless Allow is empty, in an Allow prefix. Deny takes
+// precedence, so a single address can be carved out of an allowed network.
+type AccessControl struct {
+	Allow []netip.Prefix // Networks admitted, empty to admit every visitor not denied.
+	Deny  []netip.Prefix // Networks refused.
+}
+
+// enabled reports whether any list is set.
+func (a AccessControl) enabled() bool {
+	return len(a.Allow) > 0 || len(a.Deny) > 0
+}
+
+// equal reports whether a and b admit the same visitors.
+func (a AccessControl) equal(b AccessControl) bool {
+	return slices.Equal(a.Allow, b.Allow) && slices.Equal(a.Deny, b.Deny)
+}
+
+// admits reports whether visitor, an address with or without a
+// port as sent by the server, may connect. A visitor whose address is unknown
+// is only admitted when there is no allowlist.
+func (a AccessControl) admits(visitor string) bool {
+	if !a.enabled() {
+		return true
+	}
+	addr, ok := visitorAddr(visitor)
+	if !ok {
+		return len(a.Allow) == 0
+	}
+	contains := func(p netip.Prefix) bool { return p.Contains(addr) }
+	if slices.ContainsFunc(a.Deny, contains) {
+		return false
+	}
+	return len(a.Allow) == 0 || slices.ContainsFunc(a.Allow, contains)
+}
+
+// visitorAddr parses the address of a visitor, mapping IPv4-mapped IPv6
+// addresses to IPv4 so they match IPv4 prefixes.
+func visitorAddr(visitor string) (netip.Addr, bool) {
+	if ap, err := netip.ParseAddrPort(visitor); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	if addr, err := netip.ParseAddr(strings.Trim(visitor, "[]")); err == nil {
+		return addr.Unmap(), true
+	}
+	return netip.Addr{}, false
+}
+
+// parsePrefixes parses the CIDRs of key. A bare address is taken as a prefix
+// of that single address.
+func parsePrefixes(key string, cidrs []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range cidrs {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, aerr := netip.ParseAddr(s)
+			if aerr != nil {
+				return nil, fmt.Errorf("invalid %s entry %q, use a CIDR such as 192.0.2.0/24", key, s)
+			}
+			p = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// readAccessControl fills config.Access from the allow-cidrs and deny-cidrs
+// keys.
+func readAccessControl(config *Config) error {
+	var err error
+	if config.Access.Allow, err = parsePrefixes("allow-cidrs", readStringList("allow-cidrs")); err != nil {
+		return err
+	}
+	config.Access.Deny, err = parsePrefixes("deny-cidrs", readStringList("deny-cidrs"))
+	return err
+}
+
+// SetAccessControl restricts the visitors whose connection requests are
+// accepted, see AccessControl. Denied requests are not accepted, so the server
+// drops the visitor, and are counted in Stats.Denied. It applies to new
+// connection requests only.
+func (c *Client) SetAccessControl(acl AccessControl) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.acl = acl
+}
+
+// admits reports whether the access control lists admit the visitor of pc.
+func (c *Client) admits(pc *proxyConn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.acl.admits(pc.visitor)
+}
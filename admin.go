@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// adminHeaderTimeout bounds reading the request head on the admin API.
+const adminHeaderTimeout = 10 * time.Second
+
+// adminServer is the optional HTTP API through which dashboards and scripts
+// inspect and control a running client. Every request must carry the admin
+// token as a bearer token.
+type adminServer struct {
+	srv  *http.Server
+	done chan struct{}
+}
+
+// connectionReport describes an active connection on the admin API.
+type connectionReport struct {
+	ID       uuid.UUID `json:"id"`
+	Visitor  string    `json:"visitor,omitempty"`
+	Started  time.Time `json:"started"`
+	LastSeen time.Time `json:"lastSeen"`
+	BytesIn  int64     `json:"bytesIn"`
+	BytesOut int64     `json:"bytesOut"`
+}
+
+// adminError is the body of a failed admin API request.
+type adminError struct {
+	Error string `json:"error"`
+}
+
+// startAdminServer serves the admin API for r on addr with token until Stop
+// is called. Listening on anything but a loopback address is allowed, since
+// every request is authenticated, but warned about.
+func startAdminServer(addr, token string, r *runner) (*adminServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open admin API: %w", err)
+	}
+	if ip := ln.Addr().(*net.TCPAddr).IP; !ip.IsLoopback() {
+		log.Printf("⚠️ Admin API listening on %s, which is not a loopback address", ln.Addr())
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /tunnels", func(w http.ResponseWriter, _ *http.Request) {
+		writeAdminJSON(w, http.StatusOK, r.statuses())
+	})
+	mux.HandleFunc("POST /tunnels", func(w http.ResponseWriter, req *http.Request) {
+		var body struct {
+			Name string `json:"name"`
+			TunnelSpec
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 1<<16)).Decode(&body); err != nil {
+			writeAdminJSON(w, http.StatusBadRequest, adminError{Error: "invalid tunnel: " + err.Error()})
+			return
+		}
+		if err := body.validate(body.Name); err != nil {
+			writeAdminJSON(w, http.StatusBadRequest, adminError{Error: err.Error()})
+			return
+		}
+		t, err := r.addTunnel(body.Name, body.TunnelSpec)
+		switch {
+		case errors.Is(err, errTunnelExists):
+			writeAdminJSON(w, http.StatusConflict, adminError{Error: err.Error()})
+		case err != nil:
+			writeAdminJSON(w, http.StatusBadGateway, adminError{Error: err.Error()})
+		default:
+			writeAdminJSON(w, http.StatusCreated, t.status())
+		}
+	})
+	mux.HandleFunc("DELETE /tunnels/{name}", func(w http.ResponseWriter, req *http.Request) {
+		if err := r.removeTunnel(req.PathValue("name")); err != nil {
+			writeAdminJSON(w, http.StatusNotFound, adminError{Error: err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /connections", func(w http.ResponseWriter, _ *http.Request) {
+		conns := r.current().Stats().Connections
+		reports := make([]connectionReport, 0, len(conns))
+		for _, ci := range conns {
+			reports = append(reports, connectionReport{ID: ci.ID, Visitor: ci.Visitor, Started: ci.Started.UTC(),
+				LastSeen: ci.LastSeen.UTC(), BytesIn: ci.BytesIn, BytesOut: ci.BytesOut})
+		}
+		writeAdminJSON(w, http.StatusOK, reports)
+	})
+	mux.HandleFunc("POST /reload", func(w http.ResponseWriter, _ *http.Request) {
+		log.Println("🔁 Reload requested on the admin API")
+		if err := r.reload(); err != nil {
+			writeAdminJSON(w, http.StatusUnprocessableEntity, adminError{Error: err.Error()})
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, r.status())
+	})
+	mux.HandleFunc("POST /pause", func(w http.ResponseWriter, _ *http.Request) {
+		r.setPaused(true)
+		writeAdminJSON(w, http.StatusOK, r.status())
+	})
+	mux.HandleFunc("POST /resume", func(w http.ResponseWriter, _ *http.Request) {
+		r.setPaused(false)
+		writeAdminJSON(w, http.StatusOK, r.status())
+	})
+	mux.HandleFunc("POST /debug", func(w http.ResponseWriter, req *http.Request) {
+		d := defaultDebugWindow
+		if s := req.URL.Query().Get("for"); s != "" {
+			var err error
+			if d, err = time.ParseDuration(s); err != nil {
+				writeAdminJSON(w, http.StatusBadRequest, adminError{Error: "invalid for: " + err.Error()})
+				return
+			}
+		}
+		report, err := r.startDebug(d)
+		switch {
+		case errors.Is(err, errDebugRunning):
+			writeAdminJSON(w, http.StatusConflict, adminError{Error: err.Error()})
+		case err != nil:
+			writeAdminJSON(w, http.StatusBadRequest, adminError{Error: err.Error()})
+		default:
+			writeAdminJSON(w, http.StatusAccepted, report)
+		}
+	})
+	mux.HandleFunc("POST /maintenance/{mode}", func(w http.ResponseWriter, req *http.Request) {
+		mode := req.PathValue("mode")
+		if mode != "on" && mode != "off" {
+			writeAdminJSON(w, http.StatusNotFound, adminError{Error: "use /maintenance/on or /maintenance/off"})
+			return
+		}
+		if _, err := r.setMaintenance(mode == "on"); err != nil {
+			writeAdminJSON(w, http.StatusUnprocessableEntity, adminError{Error: err.Error()})
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, r.status())
+	})
+
+	s := &adminServer{
+		srv: &http.Server{
+			Handler:           requireToken(token, mux),
+			ReadHeaderTimeout: adminHeaderTimeout,
+			ErrorLog:          log.New(logOutput, "", 0),
+		},
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(s.done)
+		if err := s.srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("⚠️ Admin API stopped: %v", err)
+		}
+	}()
+	log.Printf("🛠️ Admin API listening on http://%s", ln.Addr())
+	return s, nil
+}
+
+// requireToken rejects requests to next that do not carry token as a bearer
+// token.
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="jerusalem-client"`)
+			writeAdminJSON(w, http.StatusUnauthorized, adminError{Error: "missing or invalid admin token"})
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// writeAdminJSON answers with v as JSON.
+func writeAdminJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// Stop shuts the admin API down, waiting up to controlTimeout for requests
+// in progress.
+func (s *adminServer) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), controlTimeout)
+	defer cancel()
+	_ = s.srv.Shutdown(ctx)
+	<-s.done
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	// aeadSaltSize is the size of the random salt each direction of an
+	// encrypted connection starts with; the key of the direction is derived
+	// from it, so the two directions never share a nonce under a key.
+	aeadSaltSize = 16
+	// aeadMaxFrame is the largest amount of plain data sealed in one frame.
+	aeadMaxFrame = 16 * 1024
+)
+
+// aesGCMStage encrypts the connection end to end with AES-256-GCM, see
+// newAEADConn.
+func aesGCMStage(c *Client, conn net.Conn) (net.Conn, error) {
+	return newAEADConn(c, conn, AESGCMStage, newAESGCM)
+}
+
+// chaCha20Stage encrypts the connection end to end with ChaCha20-Poly1305,
+// which is faster than AES-GCM on CPUs without AES instructions, see
+// newAEADConn.
+func chaCha20Stage(c *Client, conn net.Conn) (net.Conn, error) {
+	return newAEADConn(c, conn, ChaCha20Stage, chacha20poly1305.New)
+}
+
+// newAESGCM returns AES-256-GCM under key.
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// newAEADConn encrypts conn for the pipeline stage name with the AEAD made by
+// newCipher, under a key derived from the pipeline secret or, without one, the
+// secret key of the client. The peer must apply the same stage with the same
+// secret. Each direction is a random salt followed by frames of a 4-byte
+// big-endian length and the sealed data, with the frame counter as nonce, so
+// frames cannot be dropped, reordered or replayed unnoticed.
+func newAEADConn(c *Client, conn net.Conn, name string, newCipher func(key []byte) (cipher.AEAD, error)) (net.Conn, error) {
+	secret := c.pipelineSecret
+	if auth := c.authenticator(); len(secret) == 0 && auth != nil {
+		// Public-key and token authenticators hold no secret key.
+		secret = auth.k
+	}
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("the %s stage requires a pipeline secret or a secret key", name)
+	}
+	key := sha256.Sum256(append([]byte("jerusalem pipeline "+name), secret...))
+	return &aeadConn{Conn: conn, key: key[:], newCipher: newCipher}, nil
+}
+
+// aeadConn is a connection encrypted by the aes-gcm or chacha20 pipeline
+// stage.
+type aeadConn struct {
+	net.Conn
+	key       []byte
+	newCipher func(key []byte) (cipher.AEAD, error)
+
+	rmu     sync.Mutex
+	open    cipher.AEAD // Set once the salt of the peer has been read.
+	rnonce  uint64
+	pending []byte // Decrypted data not returned by Read yet.
+
+	wmu    sync.Mutex
+	seal   cipher.AEAD // Set once the salt has been sent.
+	wnonce uint64
+}
+
+// newAEAD returns the cipher of c under its key derived for salt.
+func (c *aeadConn) newAEAD(salt []byte) (cipher.AEAD, error) {
+	key := sha256.Sum256(append(append([]byte(nil), c.key...), salt...))
+	return c.newCipher(key[:])
+}
+
+// nonce returns the GCM nonce of frame n.
+func nonce(aead cipher.AEAD, n uint64) []byte {
+	b := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(b[len(b)-8:], n)
+	return b
+}
+
+func (c *aeadConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	var out []byte
+	if c.seal == nil {
+		salt := make([]byte, aeadSaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return 0, err
+		}
+		aead, err := c.newAEAD(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.seal = aead
+		out = salt
+	}
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), aeadMaxFrame)]
+		frame := binary.BigEndian.AppendUint32(out, uint32(len(chunk)+c.seal.Overhead()))
+		frame = c.seal.Seal(frame, nonce(c.seal, c.wnonce), chunk, nil)
+		c.wnonce++
+		if _, err := c.Conn.Write(frame); err != nil {
+			return written, err
+		}
+		out = nil
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// CloseWrite half-closes the underlying connection. Every Write is sealed
+// and sent right away, so nothing is pending.
+func (c *aeadConn) CloseWrite() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return closeWrite(c.Conn)
+}
+
+func (c *aeadConn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for len(c.pending) == 0 {
+		if err := c.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// readFrame reads and decrypts the next frame into c.pending, reading the
+// salt of the peer first if this is the first frame.
+func (c *aeadConn) readFrame() error {
+	if c.open == nil {
+		salt := make([]byte, aeadSaltSize)
+		if _, err := io.ReadFull(c.Conn, salt); err != nil {
+			return err
+		}
+		aead, err := c.newAEAD(salt)
+		if err != nil {
+			return err
+		}
+		c.open = aead
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(c.Conn, size[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < uint32(c.open.Overhead()) || n > aeadMaxFrame+uint32(c.open.Overhead()) {
+		return fmt.Errorf("invalid encrypted frame size %d", n)
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(c.Conn, frame); err != nil {
+		return noEOF(err)
+	}
+	plain, err := c.open.Open(frame[:0], nonce(c.open, c.rnonce), frame, nil)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt frame: %w", err)
+	}
+	c.rnonce++
+	c.pending = plain
+	return nil
+}
+
+// noEOF turns an EOF in the middle of a frame into io.ErrUnexpectedEOF.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
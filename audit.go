@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Audit log events.
+const (
+	AuditOpen     = "open"
+	AuditClose    = "close"
+	AuditRejected = "rejected"
+)
+
+// AuditRecord is one line of the audit log. A connection is recorded when it
+// opens and again, with its end time, byte counts and the reason it ended, when
+// it closes. Connections turned away by the connection limit are recorded once,
+// as rejected.
+type AuditRecord struct {
+	Time       time.Time  `json:"time"`
+	Event      string     `json:"event"`
+	Connection string     `json:"connection"`
+	ClientID   string     `json:"clientId,omitempty"`
+	Label      string     `json:"label,omitempty"`
+	RemotePort uint16     `json:"remotePort,omitempty"`
+	Visitor    string     `json:"visitor,omitempty"`
+	Started    time.Time  `json:"started"`
+	Ended      *time.Time `json:"ended,omitempty"`
+	BytesIn    int64      `json:"bytesIn"`  // Bytes from the visitor to the local service.
+	BytesOut   int64      `json:"bytesOut"` // Bytes from the local service to the visitor.
+	Reason     string     `json:"reason,omitempty"`
+}
+
+// AuditLog is an append-only log of the connections relayed through the
+// tunnel, one JSON record per line, kept apart from the human-readable log for
+// compliance review. The client never truncates or rotates it. It may be
+// shared by several clients; a nil *AuditLog discards all records.
+type AuditLog struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// auditLog is the audit log of the CLI, nil unless audit-log is set.
+var auditLog *AuditLog
+
+// OpenAuditLog opens the audit log at path for appending, creating it, only
+// readable by the user, if it does not exist.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create audit log directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	return &AuditLog{f: f}, nil
+}
+
+// Record appends rec to the audit log, filling in its time.
+func (a *AuditLog) Record(rec AuditRecord) error {
+	if a == nil {
+		return nil
+	}
+	rec.Time = time.Now().UTC()
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	return nil
+}
+
+// Close closes the audit log.
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.f.Close()
+}
+
+// recordAudit writes the audit record of event for pc. err is the error that
+// ended the connection, for AuditClose, or why it was rejected, for
+// AuditRejected.
+func (c *Client) recordAudit(pc *proxyConn, event string, err error) {
+	if c.audit == nil {
+		return
+	}
+	rec := AuditRecord{
+		Event:      event,
+		Connection: pc.id.String(),
+		ClientID:   c.cid,
+		Label:      c.label,
+		RemotePort: c.rp,
+		Visitor:    pc.visitor,
+		Started:    pc.started.UTC(),
+	}
+	switch event {
+	case AuditClose:
+		ended := time.Now().UTC()
+		rec.Ended = &ended
+		rec.BytesIn, rec.BytesOut = pc.in.Load(), pc.out.Load()
+		switch {
+		case pc.closeReason() != "":
+			rec.Reason = pc.closeReason()
+		case err != nil:
+			rec.Reason = err.Error()
+		default:
+			rec.Reason = "closed"
+		}
+	case AuditRejected:
+		rec.Reason = err.Error()
+	}
+	if err := c.audit.Record(rec); err != nil {
+		c.logger.Printf("⚠️ %v\n", err)
+	}
+}
@@ -2,17 +2,75 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"slices"
+	"time"
+
 	"github.com/google/uuid"
 )
 
+// NonceCapability is announced by servers in the challenge message when they
+// accept answers that cover a client nonce and timestamp besides the challenge
+// and prove knowing the shared key when accepting them, see
+// PerformClientHandshake.
+const NonceCapability = "nonce"
+
+// TokenCapability is announced by servers in the challenge message when they
+// authenticate clients by an access token of an identity provider they trust,
+// see NewTokenAuthenticator.
+const TokenCapability = "token"
+
+// SessionCapability is announced by servers in the challenge message when they
+// issue session tokens on accepting an answer and accept answers keyed by them
+// instead of the credentials, see NewSessionAuthenticator.
+const SessionCapability = "session"
+
+// handshakeNonce is the fresh material a client adds to its answer, so an
+// answer recorded once cannot be replayed. With a shared key the server
+// accepting the answer also returns a proof over it (see serverProof), which a
+// relay cannot forge as the nonce and timestamp alone travel in clear. The
+// challenge announcing NonceCapability is not authenticated, so unless the
+// client is strict a relay can remove the capability and turn nonces off
+// without the client noticing.
+type handshakeNonce struct {
+	nonce     string // Random, hex encoded; empty with servers that do not support nonces.
+	timestamp int64  // Unix time in seconds.
+}
+
+// newHandshakeNonce returns a random nonce for the current time.
+func newHandshakeNonce() handshakeNonce {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return handshakeNonce{nonce: hex.EncodeToString(b), timestamp: time.Now().Unix()}
+}
+
+// material returns the bytes that are answered or signed: the challenge ch,
+// followed by the nonce and the timestamp as a big-endian 64-bit integer if
+// there is a nonce.
+func (n handshakeNonce) material(ch uuid.UUID) []byte {
+	b := append([]byte(nil), ch[:]...)
+	if n.nonce == "" {
+		return b
+	}
+	b = append(b, n.nonce...)
+	return binary.BigEndian.AppendUint64(b, uint64(n.timestamp))
+}
+
 // Authenticator represents an object responsible for handling client authentication and generating and validating answers.
 //
 // Fields:
 // - k []byte: the secret key used for generating answers and validating answers.
+// - key ed25519.PrivateKey: the private key challenges are signed with instead, nil with a secret key.
+// - strict bool: whether servers that do not support handshake nonces are refused.
+// - secondary *Authenticator: the secret tried when the server refuses k, nil if none.
+// - token func(context.Context) (string, error): returns the access token sent instead, nil without one.
+// - session bool: whether k is derived from a session token issued by the server.
 // - pr *RangeInclusive: the range of ports used for finding free ports during authentication.
 // - db *TcpClientRepository: the repository for accessing TCP client data.
 //
@@ -23,7 +81,12 @@ import (
 // - handleClientAuth(stream *Codec, id string) error: handles the client authentication process.
 // - findFreePort() (uint16, error): finds a free port within the specified range.
 type Authenticator struct {
-	k []byte
+	k         []byte
+	key       ed25519.PrivateKey
+	strict    bool
+	secondary *Authenticator
+	token     func(context.Context) (string, error)
+	session   bool
 }
 
 // NewAuthenticator creates a new instance of the Authenticator struct and initializes it with the provided parameters.
@@ -36,21 +99,71 @@ func NewAuthenticator(secret string) *Authenticator {
 	return &Authenticator{k: h[:]}
 }
 
+// NewRotatingAuthenticator creates an Authenticator that answers challenges
+// with primary and, if the server refuses it, with secondary, so clients keep
+// connecting while the secret of a fleet is rotated. ValidateAnswer accepts
+// answers made with either secret.
+func NewRotatingAuthenticator(primary, secondary string) *Authenticator {
+	a := NewAuthenticator(primary)
+	if secondary != "" && secondary != primary {
+		a.secondary = NewAuthenticator(secondary)
+	}
+	return a
+}
+
+// swapped returns a copy of a that answers with the secondary secret first and
+// falls back to the primary one. a must have a secondary secret.
+func (a *Authenticator) swapped() *Authenticator {
+	return &Authenticator{k: a.secondary.k, strict: a.strict, secondary: &Authenticator{k: a.k, strict: a.strict}}
+}
+
+// NewKeyAuthenticator creates an Authenticator that answers challenges with an
+// Ed25519 signature made with key instead of an HMAC, so the server only needs
+// to know the public key of the client.
+func NewKeyAuthenticator(key ed25519.PrivateKey) *Authenticator {
+	return &Authenticator{key: key}
+}
+
+// NewTokenAuthenticator creates an Authenticator that sends an access token of
+// an identity provider, as returned by token, which the server verifies with
+// the provider instead of a shared secret. The answer is an HMAC keyed by the
+// token, so it is bound to the challenge and nonce like a secret key answer.
+// Servers that do not announce TokenCapability are refused, so the token is
+// not disclosed to servers that would not accept it.
+func NewTokenAuthenticator(token func(context.Context) (string, error)) *Authenticator {
+	return &Authenticator{token: token}
+}
+
+// NewSessionAuthenticator creates an Authenticator that answers challenges
+// with token, a session token issued by the server in a previous handshake
+// (see SessionCapability), like a secret key. Servers that do not announce
+// SessionCapability are refused.
+func NewSessionAuthenticator(token string) *Authenticator {
+	a := NewAuthenticator(token)
+	a.session = true
+	return a
+}
+
 // GenerateAnswer generates an answer using the HMAC-SHA256 algorithm.
 // It takes a uuid.UUID as a challenge, appends it to the key provided during
 // Authenticator initialization, and computes the HMAC-SHA256 hash. The result
 // is then encoded to a hexadecimal string and returned.
 func (a *Authenticator) GenerateAnswer(ch uuid.UUID) string {
+	return a.answer(ch[:])
+}
+
+// answer returns the hex encoded HMAC-SHA256 of data.
+func (a *Authenticator) answer(data []byte) string {
 	m := hmac.New(sha256.New, a.k)
-	m.Write(ch[:])
+	m.Write(data)
 	return hex.EncodeToString(m.Sum(nil))
 }
 
 // ValidateAnswer validates the answer provided by the client for a challenge.
 // It decodes the answer from a hex-string to bytes and computes the HMAC of
 // the challenge using the provided key. Then it checks if the computed HMAC
-// is equal to the decoded answer. Returns true if the answer is valid, false
-// otherwise.
+// is equal to the decoded answer, or to that of the secondary secret if there
+// is one. Returns true if the answer is valid, false otherwise.
 func (a *Authenticator) ValidateAnswer(ch uuid.UUID, ans string) bool {
 	b, err := hex.DecodeString(ans)
 	if err != nil {
@@ -59,35 +172,136 @@ func (a *Authenticator) ValidateAnswer(ch uuid.UUID, ans string) bool {
 	m := hmac.New(sha256.New, a.k)
 	m.Write(ch[:])
 	em := m.Sum(nil)
-	return hmac.Equal(em, b)
+	return hmac.Equal(em, b) || (a.secondary != nil && a.secondary.ValidateAnswer(ch, ans))
+}
+
+// PerformClientHandshake answers a challenge to attempt to authenticate with
+// the server, giving up when ctx ends. If the server supports it, the answer
+// covers a fresh nonce and timestamp, and with a shared key the server must
+// prove on success that it knows the key too. Signatures made with a private
+// key have no such proof; the server is only authenticated by TLS then.
+// A server that skips the challenge is refused as a possible downgrade, and in
+// strict mode so is one that does not support nonces.
+func (a *Authenticator) PerformClientHandshake(ctx context.Context, stream *Codec, clientId string) (uint16, error) {
+	msg, err := a.handshake(ctx, stream, clientId)
+	if err != nil {
+		return 0, err
+	}
+	return msg.Port, nil
 }
 
-// PerformClientHandshake answers a challenge to attempt to authenticate with the server.
-func (a *Authenticator) PerformClientHandshake(stream *Codec, clientId string) (uint16, error) {
+// handshake performs the client handshake like PerformClientHandshake and
+// returns the message of the server accepting the answer, which carries the
+// offered port and any session token issued.
+func (a *Authenticator) handshake(ctx context.Context, stream *Codec, clientId string) (ServerMessage, error) {
 	var msg ServerMessage
-	ctx, cancel := context.WithTimeout(context.Background(), NetworkTimeout)
-	defer cancel()
 
 	if err := stream.Recv(ctx, &msg); err != nil {
-		return 0, err
+		return msg, err
 	}
 
-	if msg.Type != MtChallenge {
-		return 0, fmt.Errorf("no secret provided / invalid secret key")
+	switch msg.Type {
+	case MtChallenge:
+	case MtError:
+		return msg, newServerError(msg)
+	case MtHello, MtFreePort:
+		return msg, fmt.Errorf("%w: the server skipped the challenge although credentials are configured, refusing a possible downgrade", ErrAuthFailed)
+	default:
+		return msg, fmt.Errorf("%w: expected a challenge, got %s (the server may not use a secret key)", ErrProtocol, msg.Type)
 	}
 
-	answer := a.GenerateAnswer(msg.Challenge)
-	if err := stream.Send(ClientMessage{Type: MtAuthenticate, Authenticate: answer, ClientId: clientId}); err != nil {
-		return 0, err
+	var n handshakeNonce
+	if slices.Contains(msg.Capabilities, NonceCapability) {
+		n = newHandshakeNonce()
+	} else if a.strict {
+		return msg, fmt.Errorf("%w: the server does not support handshake nonces, refusing a possible downgrade", ErrAuthFailed)
+	}
+	if a.session && !slices.Contains(msg.Capabilities, SessionCapability) {
+		return msg, fmt.Errorf("%w: the server no longer accepts session tokens", ErrAuthFailed)
+	}
+	if a.token != nil && !slices.Contains(msg.Capabilities, TokenCapability) {
+		return msg, fmt.Errorf("%w: the server does not accept identity provider tokens", ErrAuthFailed)
+	}
+	ch := msg.Challenge
+	auth, err := a.authenticateMessage(ctx, ch, clientId, n)
+	if err != nil {
+		return msg, err
+	}
+	if err := stream.Send(auth); err != nil {
+		return msg, err
 	}
 
 	if err := stream.Recv(ctx, &msg); err != nil {
-		return 0, err
+		return msg, err
 	}
 
 	if msg.Type != MtFreePort {
-		return 0, fmt.Errorf("rejection response from server")
+		if msg.Error != "" {
+			return msg, fmt.Errorf("%w: %s", ErrAuthFailed, msg.Error)
+		}
+		return msg, fmt.Errorf("%w: rejection response from server", ErrAuthFailed)
+	}
+	if key := a.proofKey(auth); n.nonce != "" && key != nil && !validProof(key, ch, n, msg.Proof) {
+		return msg, fmt.Errorf("%w: the server did not prove knowing the key, refusing a possible man-in-the-middle", ErrAuthFailed)
 	}
 
-	return msg.Port, nil
+	return msg, nil
+}
+
+// proofKey returns the key the server proves knowing when it accepts auth,
+// the answer of a: the token the answer is keyed by, the secret key or
+// session token, or nil with a signature.
+func (a *Authenticator) proofKey(auth ClientMessage) []byte {
+	switch {
+	case a.token != nil:
+		h := sha256.Sum256([]byte(auth.Token))
+		return h[:]
+	case a.key != nil:
+		return nil
+	}
+	return a.k
+}
+
+// serverProof returns the proof a server sends when it accepts an answer to
+// the challenge ch covering n: the HMAC-SHA256 keyed by key of the same
+// material, prefixed with "server" so that it differs from the answer.
+func serverProof(key []byte, ch uuid.UUID, n handshakeNonce) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte("server"))
+	m.Write(n.material(ch))
+	return m.Sum(nil)
+}
+
+// validProof reports whether proof is the hex encoded serverProof of key, ch
+// and n.
+func validProof(key []byte, ch uuid.UUID, n handshakeNonce, proof string) bool {
+	b, err := hex.DecodeString(proof)
+	return err == nil && hmac.Equal(b, serverProof(key, ch, n))
+}
+
+// authenticateMessage returns the answer to the challenge ch and the nonce n:
+// the HMAC of the secret key, with a private key its signature and the
+// fingerprint of the public key, by which the server looks up the key to
+// verify it with, or with a token source the token and the HMAC keyed by it.
+func (a *Authenticator) authenticateMessage(ctx context.Context, ch uuid.UUID, clientId string, n handshakeNonce) (ClientMessage, error) {
+	msg := ClientMessage{Type: MtAuthenticate, ClientId: clientId, Nonce: n.nonce}
+	if n.nonce != "" {
+		msg.Timestamp = n.timestamp
+	}
+	switch {
+	case a.token != nil:
+		token, err := a.token(ctx)
+		if err != nil {
+			return msg, err
+		}
+		msg.Token = token
+		msg.Authenticate = NewAuthenticator(token).answer(n.material(ch))
+	case a.key != nil:
+		msg.Signature = hex.EncodeToString(ed25519.Sign(a.key, n.material(ch)))
+		msg.KeyFingerprint = keyFingerprint(a.key.Public().(ed25519.PublicKey))
+	default:
+		msg.Authenticate = a.answer(n.material(ch))
+		msg.Session = a.session
+	}
+	return msg, nil
 }
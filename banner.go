@@ -0,0 +1,16 @@
+//go:build !minimal
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/common-nighthawk/go-figure"
+)
+
+// displayWelcomeMessage prints the figlet banner shown when the client starts.
+func displayWelcomeMessage() {
+	art := figure.NewColorFigure("Jerusalem", "slant", "green", true)
+	art.Print()
+	fmt.Println("\n\n👋 Welcome to the Jerusalem Client Application!")
+}
@@ -0,0 +1,11 @@
+//go:build minimal
+
+package main
+
+import "fmt"
+
+// displayWelcomeMessage prints a plain one-line greeting; the minimal build
+// leaves out the figlet fonts.
+func displayWelcomeMessage() {
+	fmt.Println("👋 Welcome to the Jerusalem Client Application!")
+}
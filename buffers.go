@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+const (
+	// defaultRelayBufferSize is the size of the buffers used to copy data
+	// between visitors and the local service.
+	defaultRelayBufferSize = 32 << 10
+	// minRelayBufferSize and maxRelayBufferSize bound the configurable size.
+	minRelayBufferSize = 4 << 10
+	maxRelayBufferSize = 1 << 20
+)
+
+// busyRelayBytes is the amount of data after which a copy loop counts as busy
+// and is locked to its OS thread if thread pinning is enabled.
+const busyRelayBytes = 64 << 20
+
+// bufferPool recycles copy buffers of one size across connections, so relaying
+// thousands of connections a minute does not allocate two fresh buffers for
+// each of them.
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+var (
+	bufferPoolsMu sync.Mutex
+	bufferPools   = map[int]*bufferPool{}
+)
+
+// relayBuffers returns the pool of buffers of size bytes. Pools are shared by
+// all clients with the same buffer size, so a client replaced on reconnect or
+// reload reuses the buffers of its predecessor.
+func relayBuffers(size int) *bufferPool {
+	bufferPoolsMu.Lock()
+	defer bufferPoolsMu.Unlock()
+	p, ok := bufferPools[size]
+	if !ok {
+		p = &bufferPool{size: size}
+		p.pool.New = func() any {
+			b := make([]byte, size)
+			return &b
+		}
+		bufferPools[size] = p
+	}
+	return p
+}
+
+// readerOnly hides any WriterTo implementation of the wrapped reader, which would
+// make io.CopyBuffer ignore the pooled buffer and allocate one of its own.
+type readerOnly struct {
+	io.Reader
+}
+
+// relay copies from src to dst like io.Copy, using a buffer from buffers.
+func relay(dst *countingWriter, src io.Reader, buffers *bufferPool) (int64, error) {
+	buf := buffers.pool.Get().(*[]byte)
+	defer buffers.pool.Put(buf)
+	defer dst.unpin()
+	return io.CopyBuffer(dst, readerOnly{src}, *buf)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"slices"
+)
+
+// capabilities returns the optional protocol features the client offers to the
+// server in its hello message.
+func (c *Client) capabilities() []string {
+	var caps []string
+	if c.compression != "" {
+		caps = append(caps, c.compression)
+	}
+	if c.multiplex {
+		caps = append(caps, MuxCapability)
+	}
+	if c.codec != "" {
+		caps = append(caps, c.codec)
+	}
+	return append(caps, RTTCapability, RejectCapability)
+}
+
+// negotiate records which of the offered capabilities the server accepted in
+// its hello reply. Servers that do not know about capabilities reply without
+// any, so the client falls back to the behaviour of the original protocol.
+func (c *Client) negotiate(accepted []string) {
+	if c.compression != "" && slices.Contains(accepted, c.compression) {
+		c.compressed = true
+		c.logger.Printf("Data connections are compressed with %s\n", c.compression)
+	} else if c.compression != "" {
+		c.logger.Printf("⚠️ Server does not support %s compression, data connections are not compressed\n", c.compression)
+	}
+
+	if c.multiplex && slices.Contains(accepted, MuxCapability) {
+		c.muxed = true
+		c.logger.Println("Data connections are multiplexed over a single session")
+	} else if c.multiplex {
+		c.logger.Println("⚠️ Server does not support multiplexing, using a connection per visitor")
+	}
+
+	c.measureRTT = slices.Contains(accepted, RTTCapability)
+	c.rejects = slices.Contains(accepted, RejectCapability)
+
+	if c.codec != "" && slices.Contains(accepted, c.codec) {
+		// The hello reply is the last JSON message on the control connection.
+		c.cc.UseMsgpack()
+		c.logger.Printf("Control connection uses %s\n", c.codec)
+	} else if c.codec != "" {
+		c.logger.Printf("⚠️ Server does not support the %s codec, using JSON\n", c.codec)
+	}
+}
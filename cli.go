@@ -2,74 +2,1125 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"flag"
 	"fmt"
-	"github.com/common-nighthawk/go-figure"
 	"github.com/spf13/viper"
+	"golang.org/x/term"
+	"io"
 	"log"
+	"net"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
+const defaultShutdownTimeout = 30 * time.Second
+
+// envPrefix is the prefix of the environment variables that override config keys.
+const envPrefix = "JERUSALEM"
+
 type Config struct {
-	LocalHost  string
-	LocalPort  uint16
-	Server     string
-	ServerPort uint16
-	ClientID   string
-	SecretKey  string
+	LocalHost       string
+	LocalPort       uint16
+	Server          string // Comma-separated list of servers, each with an optional port.
+	ServerSelection string
+	SRVRefresh      time.Duration
+	ServerPort      uint16
+	ClientID        string
+	SecretKey       string
+	SecondaryKey    string             // Secret key accepted besides SecretKey while a fleet rotates its secret.
+	PrivateKey      ed25519.PrivateKey // Authenticates with a signature instead of SecretKey if set.
+	OIDC            OIDCSettings       // Authenticates with the access token of a login instead of SecretKey if enabled.
+	StrictHandshake bool
+	TLS             TLSSettings
+	ShutdownTimeout time.Duration
+	Maintenance     bool
+	MaintenancePage string
+	TranscriptDir   string
+	LogTimezone     string
+	NonInteractive  bool
+	Dashboard       bool
+	Plain           bool
+	Output          string // "json" to print the established tunnels as JSON lines, see output.go.
+	Tracing         TracingSettings
+	Log             LogRotation
+	NoSpinner       bool
+	Bandwidth       BandwidthLimits
+	MaxConnections  int
+	QueueTimeout    time.Duration
+	HealthCheck     HealthCheck
+	ProxyProtocol   string
+	Compression     string
+	Pipeline        []string
+	PipelineSecret  string // Secret the encrypting pipeline stages derive their key from, the secret key if empty.
+	Multiplex       bool
+	PreviewPort     string
+	Codec           string
+	DrainIdle       time.Duration
+	ReadyFile       string
+	RemotePort      uint16
+	PortFile        string
+	StatusDir       string
+	ControlSocket   string
+	AdminAddr       string
+	AdminToken      string
+	PinThreads      bool
+	BufferSize      int
+	NoSplice        bool
+	KeepAlive       time.Duration
+	NoDelay         bool
+	BindAddress     net.IP
+	PreferIP        string
+	PoolSize        int
+	PoolMaxIdle     time.Duration
+	LocalRetry      time.Duration
+	IdleTimeout     time.Duration
+	AuditLog        string
+	Access          AccessControl
+	Quota           Quota
+	quota           *TrafficQuota // Counts the traffic of the tunnel against Quota, see newClientFromConfig.
+	Schedule        Schedule
+	Duration        time.Duration
+	Notifications   Notifications
+	FastOpen        bool
+	Label           string
+	FaultRate       float64
+	FaultDelay      time.Duration
+	Timeouts        Timeouts
+	ReconnectDelay  time.Duration
+	ReconnectMax    time.Duration
+	ReconnectLimit  int                   // Consecutive failed reconnect attempts before giving up, 0 for no limit.
+	AuthCooldown    time.Duration         // Delay before retrying after the server refused the credentials, 0 to give up instead.
+	VaultLease      time.Duration         // Shortest lease of the secrets read from Vault, 0 if they do not expire.
+	Tunnels         map[string]TunnelSpec // Extra tunnels by name, see tunnelSet.
+	Tunnel          string                // Name of the extra tunnel this is the configuration of, empty for the main one.
+}
+
+// commands maps subcommand names to their implementations. Each receives the
+// arguments following the subcommand name.
+var commands = map[string]func(args []string){
+	"run":      runCommand,
+	"version":  versionCommand,
+	"validate": validateCommand,
+	"status":   statusCommand,
+	"stop":     stopCommand,
+	"service":  serviceCommand,
+	"login":    loginCommand,
+	"logout":   logoutCommand,
+	"config":   configCommand,
+	"ping":     pingCommand,
+	"init":     initCommand,
+	"keygen":   keygenCommand,
+	"pause":    pauseCommand,
+	"resume":   resumeCommand,
+
+	"maintenance": maintenanceCommand,
+	"debug":       debugCommand,
+
+	"healthcheck": healthcheckCommand,
+
+	"verify-transcript": verifyTranscriptCommand,
+}
+
+// configFlags lists the config keys that can be overridden on the run command
+// line, with their usage text. The flag names are the config keys; boolean keys
+// become flags that do not need a value.
+var configFlags = []struct {
+	key, usage string
+	boolean    bool
+}{
+	{"server", "server address, or a comma-separated list of servers to fail over between", false},
+	{"server-selection", "order in which to try the servers: order or latency", false},
+	{"srv-refresh", "how often srv+ server records are resolved again", false},
+	{"server-port", "server control port", false},
+	{"local-host", "local host to expose", false},
+	{"local-retry", "keep retrying an unreachable local service for this long before failing a visitor, e.g. 10s", false},
+	{"local-port", "local port to expose", false},
+	{"profile", "named profile of the config file to use", false},
+	{"client-id", "client ID", false},
+	{"label", "human-readable session label shown to the server operators", false},
+	{"secret-key", "secret key (prefer secret-key-file, --secret-stdin or JERUSALEM_SECRET_KEY)", false},
+	{"secret-key-file", "file containing the secret key", false},
+	{"secondary-secret-key", "secret key to fall back to while rotating secret-key", false},
+	{"tls", "connect to the server over TLS", true},
+	{"tls-server-name", "name to verify in the server certificate, the server host if empty", false},
+	{"tls-ca-file", "PEM file of CAs to trust for the server certificate instead of the system roots", false},
+	{"pin-sha256", "comma-separated base64 SHA-256 hashes of the public keys the server certificate may have", false},
+	{"strict-handshake", "refuse servers that do not support handshake nonces", true},
+	{"private-key-file", "Ed25519 private key to authenticate with instead of a secret key, see keygen", false},
+	{"oidc-issuer", "identity provider to log in to with login and authenticate with instead of a secret key", false},
+	{"oidc-client-id", "OAuth client ID at the identity provider", false},
+	{"oidc-scopes", "scopes requested at login (default \"openid offline_access\")", false},
+	{"vault-addr", "address of the Vault server for vault:// references", false},
+	{"vault-role-id", "AppRole role ID used to log in to Vault", false},
+	{"shutdown-timeout", "how long connections may drain on shutdown", false},
+	{"duration", "shut the tunnel down after this long, e.g. 2h", false},
+	{"dial-timeout", "how long dialing the server may take", false},
+	{"handshake-timeout", "how long to wait for the server during authentication and hello", false},
+	{"read-timeout", "consider the control connection lost after this long without a message", false},
+	{"write-timeout", "how long sending a control message may take", false},
+	{"reconnect-delay", "initial delay before reconnecting after the control connection is lost", false},
+	{"reconnect-max-delay", "upper bound of the delay between reconnect attempts", false},
+	{"reconnect-max-attempts", "give up after this many failed reconnect attempts in a row (default 0, no limit)", false},
+	{"auth-retry-cooldown", "retry this long after the server refused the credentials instead of giving up, e.g. 10m", false},
+	{"drain-idle-timeout", "close connections idle this long right away on shutdown", false},
+	{"idle-timeout", "close relayed connections without traffic in either direction for this long, e.g. 10m", false},
+	{"maintenance", "start in maintenance mode", true},
+	{"maintenance-page", "HTML page served in maintenance mode", false},
+	{"transcript-dir", "directory for signed session transcripts", false},
+	{"allow-cidrs", "only accept visitors from these comma-separated CIDRs, e.g. 198.51.100.0/24", false},
+	{"deny-cidrs", "refuse visitors from these comma-separated CIDRs", false},
+	{"max-bytes-per-day", "stop accepting connections once this much traffic was relayed today, e.g. 10GB", false},
+	{"max-bytes-total", "stop accepting connections once this much traffic was relayed since the start, e.g. 100GB", false},
+	{"quota-close-tunnel", "close the tunnel once a traffic quota is used up", true},
+	{"schedule", "only keep the tunnel open in these comma-separated windows, e.g. \"09:00-18:00 Mon-Fri\"", false},
+	{"schedule-timezone", "time zone of the schedule windows (IANA name or Local)", false},
+	{"audit-log", "append a JSON line per opened and closed connection to this file", false},
+	{"log-timezone", "time zone of log timestamps (IANA name, Local or UTC)", false},
+	{"log-file", "write the log to this file, rotated by size and age, instead of stderr", false},
+	{"log-max-size", "rotate the log file once it reaches this size, e.g. 100MB", false},
+	{"log-rotate-every", "also rotate the log file at this interval, e.g. 24h", false},
+	{"log-max-backups", "number of rotated log files to keep (0 keeps all)", false},
+	{"log-max-age", "remove rotated log files older than this, e.g. 720h", false},
+	{"log-compress", "gzip rotated log files", true},
+	{"non-interactive", "never prompt, fail if configuration is missing", true},
+	{"dashboard", "show a live dashboard instead of the scrolling log", true},
+	{"plain", "plain line-oriented output: no spinner, dashboard, banner or emoji", true},
+	{"otlp-endpoint", "OTLP/HTTP endpoint to export connection traces to, e.g. http://localhost:4318", false},
+	{"otlp-headers", "headers of the OTLP export requests, as name=value pairs", false},
+	{"trace-sample-ratio", "fraction of connections traced, from 0 to 1 (default 1)", false},
+	{"output", "text, or json to print a JSON line with the remote port, server and client ID on stdout once connected", false},
+	{"no-spinner", "do not draw the progress spinner", true},
+	{"ready-file", "file written once the tunnel is up, for the healthcheck command", false},
+	{"remote-port", "public port to ask the server for", false},
+	{"port-file", "file keeping the assigned public port, to ask for it again after a restart", false},
+	{"status-dir", "directory in which to publish the live status of the tunnel as plain files", false},
+	{"control-socket", "unix socket queried by the status command, or off", false},
+	{"admin-addr", "serve the admin HTTP API on this address, e.g. 127.0.0.1:7070", false},
+	{"admin-token", "bearer token required by the admin HTTP API", false},
+	{"bandwidth-limit", "tunnel rate limit in both directions, e.g. 5MBps", false},
+	{"upload-limit", "tunnel rate limit from the local service to visitors", false},
+	{"download-limit", "tunnel rate limit from visitors to the local service", false},
+	{"connection-bandwidth-limit", "per-connection rate limit in both directions", false},
+	{"connection-upload-limit", "per-connection rate limit from the local service", false},
+	{"connection-download-limit", "per-connection rate limit to the local service", false},
+	{"max-connections", "maximum number of connections relayed at once (0 for unlimited)", false},
+	{"connection-queue-timeout", "how long excess connections wait for a free slot before rejection", false},
+	{"health-check", "probe the local service: tcp or http", false},
+	{"health-check-path", "path requested by http health checks", false},
+	{"health-check-interval", "time between health checks", false},
+	{"health-check-reject", "turn visitors away while the local service is down", true},
+	{"proxy-protocol", "send a PROXY protocol header to the local service: v1 or v2", false},
+	{"compression", "compress data connections if the server supports it: zstd", false},
+	{"pipeline", "comma-separated data path stages, local side first, e.g. rate-limit,zstd,aes-gcm", false},
+	{"pipeline-secret", "secret the aes-gcm and chacha20 stages derive their key from, instead of the secret key", false},
+	{"multiplex", "multiplex data connections over one session if the server supports it", true},
+	{"data-pool-size", "number of authenticated data connections to keep ready for visitors (0 disables)", false},
+	{"data-pool-max-idle", "replace pooled data connections once they are this old, e.g. 30s", false},
+	{"preview-port", "open a localhost port (or auto) that behaves like the public port", false},
+	{"inject-faults", "testing only: fraction of control messages to delay, drop or corrupt", false},
+	{"inject-faults-delay", "testing only: maximum delay injected into control messages", false},
+	{"tcp-fast-open", "experimental: dial the server with TCP Fast Open", true},
+	{"bind-address", "local IP address or interface to connect to the server from", false},
+	{"prefer-ipv4", "connect over IPv4 first to hosts that also have IPv6 addresses", true},
+	{"prefer-ipv6", "connect over IPv6 first to hosts that also have IPv4 addresses", true},
+	{"tcp-keepalive", "interval of TCP keepalive probes on idle connections, or off", false},
+	{"tcp-nodelay", "send small writes right away (TCP_NODELAY); set to false to coalesce them", true},
+	{"lock-os-thread", "dedicate an OS thread to each busy copy loop", true},
+	{"relay-buffer-size", "size of the copy buffers of relayed connections, e.g. 64KiB", false},
+	{"no-splice", "copy relayed connections in user space instead of with splice on Linux", true},
+	{"codec", "control connection encoding if the server supports it: json or msgpack", false},
 }
 
 func main() {
-	displayWelcomeMessage()
+	cmd, args := "run", os.Args[1:]
+	if len(args) > 0 {
+		if _, ok := commands[args[0]]; ok {
+			cmd, args = args[0], args[1:]
+		} else if args[0] == "-version" || args[0] == "--version" {
+			cmd, args = "version", args[1:]
+		}
+	}
+	commands[cmd](args)
+}
 
-	var config Config
-	var configFile string
+// runCommand implements `run [flags] [config]`, which connects to the server and
+// relays traffic until it is stopped. The config file may be given either with
+// --config or as the first positional argument; flags override its values.
+func runCommand(args []string) {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	configPath := fs.String("config", "", "config file (.yaml, .toml or .json)")
+	daemon := fs.Bool("daemon", false, "run the client in the background")
+	detach := fs.Bool("detach", false, "like --daemon, but wait until the tunnel is established")
+	pidFile := fs.String("pid-file", defaultPidFile, "PID file used by --daemon and --detach")
+	secretStdin := fs.Bool("secret-stdin", false, "read the secret key from standard input")
+	registerConfigFlags(fs)
+	_ = fs.Parse(args)
+
+	configFile := *configPath
+	if configFile == "" && fs.NArg() > 0 {
+		configFile = fs.Arg(0)
+	}
+	applyConfigFlags(fs)
 
-	if len(os.Args) > 1 {
-		configFile = os.Args[1]
+	if *secretStdin && !isDaemonChild() {
+		secret, err := readSecretFromStdin()
+		if err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		viper.Set("secret-key", secret)
+		// A daemon child cannot read the parent's stdin; it picks the key up
+		// from its inherited environment instead.
+		os.Setenv(envPrefix+"_SECRET_KEY", secret)
 	}
 
+	if (*daemon || *detach) && !isDaemonChild() {
+		showWelcomeMessage()
+		if err := readConfigFile(configFile); err != nil {
+			configFatalf("❌ Failed to read config file: %v", err)
+		}
+		logFile := viper.GetString("log-file")
+		if logFile == "" {
+			// The background process rotates the default log file as well.
+			logFile = defaultDaemonLog
+			os.Setenv(envPrefix+"_LOG_FILE", logFile)
+		}
+		pid, port, err := startDaemon(logFile, *detach)
+		var exited *exec.ExitError
+		if errors.As(err, &exited) {
+			// Pass on why the background process gave up.
+			log.Printf("❌ Failed to start daemon: %v", err)
+			os.Exit(exited.ExitCode())
+		}
+		if err != nil {
+			log.Fatalf("❌ Failed to start daemon: %v", err)
+		}
+		if viper.GetString("output") == outputJSON {
+			printDetachedEvent(pid, port)
+			return
+		}
+		if port != "" {
+			fmt.Printf("🌍 Tunnel established on remote port %s\n", port)
+		}
+		fmt.Printf("🚀 Client running in the background (PID %d), logging to %s\n", pid, logFile)
+		return
+	}
+
+	if isDaemonChild() {
+		if err := writePidFile(*pidFile); err != nil {
+			log.Fatalf("❌ Failed to write PID file: %v", err)
+		}
+		defer os.Remove(*pidFile)
+	} else {
+		showWelcomeMessage()
+	}
+
+	var config Config
 	runApp(&config, configFile)
 }
 
-func displayWelcomeMessage() {
-	art := figure.NewColorFigure("Jerusalem", "slant", "green", true)
-	art.Print()
-	fmt.Println("\n\n👋 Welcome to the Jerusalem Client Application!")
+// showWelcomeMessage displays the welcome banner, unless stdout is not a
+// terminal or plain output was requested with a flag or the environment.
+func showWelcomeMessage() {
+	if isTerminal(os.Stdout) && !viper.GetBool("plain") && viper.GetString("output") != outputJSON {
+		displayWelcomeMessage()
+	}
+}
+
+// registerConfigFlags adds a flag for each of the configFlags to fs.
+func registerConfigFlags(fs *flag.FlagSet) {
+	for _, f := range configFlags {
+		if f.boolean {
+			fs.Bool(f.key, false, f.usage)
+		} else {
+			fs.String(f.key, "", f.usage)
+		}
+	}
+}
+
+// applyConfigFlags overrides the config keys whose flags were set explicitly.
+func applyConfigFlags(fs *flag.FlagSet) {
+	fs.Visit(func(f *flag.Flag) {
+		for _, cf := range configFlags {
+			if cf.key == f.Name {
+				viper.Set(cf.key, f.Value.String())
+			}
+		}
+	})
+}
+
+// versionCommand implements `version [--json]`.
+func versionCommand(args []string) {
+	fs := flag.NewFlagSet("version", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the build information as JSON")
+	_ = fs.Parse(args)
+
+	if err := printVersion(*asJSON); err != nil {
+		log.Fatalf("❌ Failed to print version: %v", err)
+	}
+}
+
+// stopCommand implements `stop`, which signals a background instance to shut down.
+func stopCommand(args []string) {
+	fs := flag.NewFlagSet("stop", flag.ExitOnError)
+	pidFile := fs.String("pid-file", defaultPidFile, "PID file of the background instance")
+	_ = fs.Parse(args)
+
+	if err := stopDaemon(*pidFile); err != nil {
+		log.Fatalf("❌ Failed to stop client: %v", err)
+	}
+	fmt.Println("🛑 Stop signal sent")
+}
+
+// verifyTranscriptCommand implements `verify-transcript [--config file] <transcript>`,
+// which checks a session transcript against the secret key of the configuration,
+// or its secondary secret key.
+func verifyTranscriptCommand(args []string) {
+	fs := flag.NewFlagSet("verify-transcript", flag.ExitOnError)
+	configPath := fs.String("config", "", "config file holding the secret key")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatalf("❌ Usage: verify-transcript [--config file] <transcript>")
+	}
+
+	var config Config
+	if err := loadConfig(&config, *configPath); err != nil {
+		configFatalf("❌ Failed to read config file: %v", err)
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("❌ Failed to open transcript: %v", err)
+	}
+	defer f.Close()
+
+	n, err := VerifyTranscript(f, config.SecretKey)
+	if err != nil && config.SecondaryKey != "" {
+		// The transcript may have been written before the secret was rotated.
+		if _, serr := f.Seek(0, io.SeekStart); serr == nil {
+			if m, serr := VerifyTranscript(f, config.SecondaryKey); serr == nil {
+				n, err = m, nil
+			}
+		}
+	}
+	if err != nil {
+		log.Fatalf("❌ Transcript is not valid after %d records: %v", n, err)
+	}
+	fmt.Printf("✅ Transcript is intact (%d records)\n", n)
+}
+
+// serviceCommand implements `service ...`, see runServiceCommand.
+func serviceCommand(args []string) {
+	if err := runServiceCommand(args); err != nil {
+		log.Fatalf("❌ Service command failed: %v", err)
+	}
 }
 
 func runApp(config *Config, configFile string) {
+	if err := loadConfig(config, configFile); err != nil {
+		configFatalf("❌ Failed to read config file: %v", err)
+	}
+	if config.Log.File != "" {
+		lf, err := openLogFile(config.Log)
+		if err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		defer lf.Close()
+		setLogOutput(lf)
+	}
+	notify = startNotifier(config)
+	tracer = NewTracer(config.Tracing)
+	if config.AuditLog != "" {
+		a, err := OpenAuditLog(config.AuditLog)
+		if err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		defer a.Close()
+		auditLog = a
+	}
+	if config.PortFile != "" {
+		if err := reservedPort.load(config.PortFile); err != nil {
+			log.Printf("⚠️ %v", err)
+		}
+	}
+
+	var pc *preconnect
+	if missing := missingConfigKeys(config); len(missing) > 0 {
+		if config.NonInteractive || !isTerminal(os.Stdin) {
+			configFatalf("❌ Configuration is incomplete, missing: %s (set them in the config file, as flags or as %s_* environment variables)",
+				strings.Join(missing, ", "), envPrefix)
+		}
+		if config.Server != "" && config.ServerPort != 0 && !strings.ContainsAny(config.Server, ",+") {
+			pc = startPreconnect(config)
+		}
+		promptForMissingConfig(config)
+	}
+
+	// Local listeners are opened before connecting, so a port conflict does not
+	// claim a public port first.
+	preview, err := listenPreview(config.PreviewPort)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+
+	if config.Schedule.enabled() {
+		waitForSchedule(func() Schedule { return config.Schedule }, nil)
+	}
+	r := newRunner(*config, startClient(config, pc), configFile)
+	r.setPreview(preview)
+	r.tunnels = newTunnelSet()
+	r.tunnels.apply(*config)
+
+	go handleShutdownSignals(r, config.ShutdownTimeout)
+	go r.handleReloadSignals()
+	go r.handlePauseSignals()
+	go r.renewVaultSecrets()
+	go r.watchSRV()
+	go r.watchSchedule()
+	if config.Duration > 0 {
+		go r.expireAfter(config.Duration, config.ShutdownTimeout)
+	}
+
+	var d *dashboard
+	if config.Dashboard && !config.Plain && config.Output != outputJSON {
+		if isTerminal(os.Stdout) {
+			d = startDashboard(os.Stdout, r.current)
+		} else {
+			log.Println("⚠️ stdout is not a terminal, dashboard disabled")
+		}
+	}
+
+	var cs *controlSocket
+	if config.ControlSocket != controlSocketOff {
+		if cs, err = startControlSocket(config.ControlSocket, r); err != nil {
+			log.Printf("⚠️ %v", err)
+		}
+	}
+
+	var as *adminServer
+	if config.AdminAddr != "" {
+		if as, err = startAdminServer(config.AdminAddr, config.AdminToken, r); err != nil {
+			log.Printf("⚠️ %v", err)
+		}
+	}
+
+	var sd *statusDir
+	if config.StatusDir != "" {
+		name := config.Label
+		if name == "" {
+			name = config.ClientID
+		}
+		if sd, err = startStatusDir(config.StatusDir, name, r); err != nil {
+			log.Printf("⚠️ %v", err)
+		}
+	}
+
+	r.run()
+	stopDebug()
+	if cs != nil {
+		cs.Stop()
+	}
+	if as != nil {
+		as.Stop()
+	}
+	if sd != nil {
+		sd.Stop()
+	}
+	if d != nil {
+		d.Stop()
+	}
+	notify.tunnel(EventTunnelDown, r.current(), nil)
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	notify.Close(ctx)
+	tracer.Close(ctx)
+	cancel()
+	stats := r.current().Stats()
+	log.Printf("👋 Client stopped after %s: %d connections, %s in, %s out",
+		stats.Uptime.Round(time.Second), stats.TotalConnections, formatBytes(stats.BytesIn), formatBytes(stats.BytesOut))
+	if stats.Handshakes > 0 {
+		log.Printf("⏱️ Data connection setup took %s on average over %d handshakes", stats.AvgHandshake.Round(time.Microsecond), stats.Handshakes)
+	}
+	if stats.Denied > 0 {
+		log.Printf("🚫 %d connection requests were denied by access control", stats.Denied)
+	}
+	if stats.Pooled > 0 {
+		log.Printf("♻️ %d of %d connections were accepted on a pooled data connection", stats.Pooled, stats.TotalConnections)
+	}
+	if err := r.gaveUpReason(); err != nil {
+		exitGaveUp(err)
+	}
+}
+
+// loadConfig reads configFile, if any, and fills config from it. The format is
+// detected from the file extension. Every key can also be set, or overridden,
+// through a JERUSALEM_ prefixed environment variable, e.g. JERUSALEM_LOCAL_PORT
+// for local-port, so the client can run without a config file at all.
+func loadConfig(config *Config, configFile string) error {
+	if err := readConfigFile(configFile); err != nil {
+		return err
+	}
+	readConfigFromViper(config)
+	if err := readVaultSecrets(config); err != nil {
+		return err
+	}
+	if err := readSecretKeyFile(config, viper.GetString("secret-key-file")); err != nil {
+		return err
+	}
+	if err := readPrivateKey(config, viper.GetString("private-key-file")); err != nil {
+		return err
+	}
+	if err := readOIDC(config); err != nil {
+		return err
+	}
+	readSecretFromKeychain(config)
+	if err := readBandwidthLimits(config); err != nil {
+		return err
+	}
+	if err := readHealthCheck(config); err != nil {
+		return err
+	}
+	if err := readLogRotation(config); err != nil {
+		return err
+	}
+	if err := readRelayBufferSize(config); err != nil {
+		return err
+	}
+	if err := readSocketOptions(config); err != nil {
+		return err
+	}
+	if err := readNotifications(config); err != nil {
+		return err
+	}
+	if err := readAccessControl(config); err != nil {
+		return err
+	}
+	if err := readQuota(config); err != nil {
+		return err
+	}
+	if err := readSchedule(config); err != nil {
+		return err
+	}
+	if err := readTunnels(config); err != nil {
+		return err
+	}
+	if err := readTLS(config); err != nil {
+		return err
+	}
+	switch config.ProxyProtocol {
+	case "", "v1", "v2":
+	default:
+		return fmt.Errorf("invalid proxy-protocol %q, use v1 or v2", config.ProxyProtocol)
+	}
+	if config.Compression != "" && config.Compression != ZstdCompression {
+		return fmt.Errorf("invalid compression %q, use %s", config.Compression, ZstdCompression)
+	}
+	if _, err := resolvePipeline(config.Pipeline); err != nil {
+		return err
+	}
+	if config.PipelineSecret == "" && (config.PrivateKey != nil || config.OIDC.enabled()) {
+		for _, name := range config.Pipeline {
+			if slices.Contains(encryptingStages, name) {
+				return fmt.Errorf("pipeline stage %s requires pipeline-secret with private-key-file or oidc-issuer, as there is no secret key to derive its key from", name)
+			}
+		}
+	}
+	if config.PoolSize < 0 || config.PoolMaxIdle < 0 {
+		return fmt.Errorf("data-pool-size and data-pool-max-idle must not be negative")
+	}
+	if config.AdminAddr != "" && config.AdminToken == "" {
+		return fmt.Errorf("admin-addr requires admin-token")
+	}
+	if config.ReconnectLimit < 0 || config.AuthCooldown < 0 {
+		return fmt.Errorf("reconnect-max-attempts and auth-retry-cooldown must not be negative")
+	}
+	if config.LocalRetry < 0 || config.IdleTimeout < 0 || config.Duration < 0 {
+		return fmt.Errorf("local-retry, idle-timeout and duration must not be negative")
+	}
+	for _, key := range []string{"local-port", "server-port", "remote-port"} {
+		if n := viper.GetInt(key); n < 0 || n > 65535 {
+			return fmt.Errorf("invalid %s %d, use a port number between 1 and 65535", key, n)
+		}
+	}
+	if err := validLocalPort("preview-port", config.PreviewPort); err != nil {
+		return err
+	}
+	if config.FaultRate < 0 || config.FaultRate > 1 {
+		return fmt.Errorf("invalid inject-faults %v, use a fraction between 0 and 1", config.FaultRate)
+	}
+	switch config.ServerSelection {
+	case "", SelectInOrder, SelectLowestLatency:
+	default:
+		return fmt.Errorf("invalid server-selection %q, use %s or %s", config.ServerSelection, SelectInOrder, SelectLowestLatency)
+	}
+	switch config.Codec {
+	case "", "json", MsgpackCodec:
+	default:
+		return fmt.Errorf("invalid codec %q, use json or %s", config.Codec, MsgpackCodec)
+	}
+	if err := readOutput(config); err != nil {
+		return err
+	}
+	if err := readTracing(config); err != nil {
+		return err
+	}
+	setLogPlain(config.Plain)
+	return setLogTimezone(config.LogTimezone)
+}
+
+// envKeyReplacer maps config keys to the names of their environment variables,
+// after the prefix: notifications.webhook-url is NOTIFICATIONS_WEBHOOK_URL.
+var envKeyReplacer = strings.NewReplacer("-", "_", ".", "_")
+
+// readConfigFile sets up the environment variable overrides and reads
+// configFile, if any, into viper, with the keys of the selected profile merged
+// over the top-level keys.
+func readConfigFile(configFile string) error {
+	viper.SetEnvPrefix(envPrefix)
+	viper.SetEnvKeyReplacer(envKeyReplacer)
+	viper.AutomaticEnv()
+
 	if configFile != "" {
-		viper.SetConfigType("yaml")
+		format, err := configFormat(configFile)
+		if err != nil {
+			return err
+		}
+		viper.SetConfigType(format)
 		viper.SetConfigFile(configFile)
 		if err := viper.ReadInConfig(); err != nil {
-			log.Fatalf("❌ Failed to read config file: %v", err)
+			return err
 		}
 	}
-	readConfigFromViper(config)
+	return applyProfile(viper.GetString("profile"))
+}
 
-	if configFile == "" || config.Server == "" || config.ClientID == "" || config.SecretKey == "" {
-		promptForMissingConfig(config)
+// configFormat returns the viper config type for the extension of configFile.
+func configFormat(configFile string) (string, error) {
+	switch ext := strings.ToLower(filepath.Ext(configFile)); ext {
+	case ".yaml", ".yml":
+		return "yaml", nil
+	case ".toml":
+		return "toml", nil
+	case ".json":
+		return "json", nil
+	default:
+		return "", fmt.Errorf("unsupported config format %q, use .yaml, .toml or .json", ext)
 	}
+}
 
-	client, err := NewClient(config.ServerPort, config.LocalHost, config.LocalPort, config.Server, config.ClientID, config.SecretKey)
+// missingConfigKeys returns the config keys needed to connect that are still unset.
+func missingConfigKeys(config *Config) []string {
+	var missing []string
+	check := func(key string, unset bool) {
+		if unset {
+			missing = append(missing, key)
+		}
+	}
+	check("server", config.Server == "")
+	check("server-port", config.ServerPort == 0 && needsServerPort(config.Server))
+	check("client-id", config.ClientID == "")
+	check("secret-key", config.SecretKey == "" && config.PrivateKey == nil && !config.OIDC.enabled())
+	check("local-host", config.LocalHost == "")
+	check("local-port", config.LocalPort == 0)
+	return missing
+}
+
+// startClient connects to the server described by config and reports readiness.
+// If pc is not nil, its connection is used as the control connection; should the
+// handshake on it fail (for instance because the server gave up waiting while
+// the user was typing) a fresh connection is dialed.
+// It exits the process if the client cannot be created.
+func startClient(config *Config, pc *preconnect) *Client {
+	var client *Client
+	var err error
+	if conn := pc.take(); conn != nil {
+		client, err = newClientFromConfig(config, WithConn(conn))
+		if err != nil {
+			log.Printf("⚠️ Pre-established connection failed, reconnecting: %v", err)
+		}
+	}
+	if client == nil {
+		client, err = newClientFromConfig(config)
+	}
 	if err != nil {
-		log.Fatalf("❌ Failed to create client: %v", err)
+		event := EventTunnelDown
+		if errors.Is(err, ErrAuthFailed) {
+			event = EventAuthFailed
+		}
+		notify.tunnel(event, nil, err)
+		ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+		notify.Close(ctx)
+		cancel()
+		log.Printf("❌ Failed to create client: %v", err)
+		os.Exit(exitCode(err))
 	}
+	notify.tunnel(EventTunnelUp, client, nil)
+	printTunnelEvent(config, "connected", client)
 
-	if err := client.Listen(); err != nil {
-		log.Fatalf("❌ Failed to listen: %v", err)
+	if err := sdNotify(sdReady); err != nil {
+		log.Printf("⚠️ %v", err)
+	}
+	if err := notifyDetachedParent(client.RemotePort()); err != nil {
+		log.Printf("⚠️ Failed to notify parent process: %v", err)
 	}
+	if err := writeReadyFile(config.ReadyFile, client.RemotePort()); err != nil {
+		log.Printf("⚠️ %v", err)
+	}
+	return client
+}
+
+// newClientFromConfig connects to the server described by config and applies
+// the runtime settings to the new client. Unless config names a remote port,
+// it asks for the one assigned last, see reservedPort. The traffic quota of
+// the tunnel is created on the first call and stored in config, so the clients
+// that replace this one keep counting against it.
+func newClientFromConfig(config *Config, opts ...Option) (*Client, error) {
+	if config.TranscriptDir != "" {
+		opts = append(opts, WithTranscript(NewTranscript(config.TranscriptDir, config.ClientID, config.SecretKey)))
+	}
+	if tracer != nil {
+		opts = append(opts, WithTracer(tracer))
+	}
+	if auditLog != nil {
+		opts = append(opts, WithAuditLog(auditLog))
+	}
+	if config.quota == nil && config.Quota.enabled() {
+		config.quota = NewTrafficQuota(config.Quota)
+	}
+	if config.quota != nil {
+		opts = append(opts, WithTrafficQuota(config.quota))
+	}
+	if port := config.RemotePort; port != 0 {
+		opts = append(opts, WithRemotePort(port))
+	} else if port := reservedPort.get(config.Tunnel); port != 0 {
+		opts = append(opts, WithRemotePort(port))
+	}
+	if config.Dashboard || config.Plain || config.NoSpinner || config.Output == outputJSON || !isTerminal(os.Stdout) {
+		opts = append(opts, WithoutSpinner())
+	}
+	opts = append(opts, WithTimeouts(config.Timeouts), WithBandwidthLimits(config.Bandwidth), WithMaxConnections(config.MaxConnections, config.QueueTimeout),
+		WithHealthCheck(config.HealthCheck), WithProxyProtocol(config.ProxyProtocol))
+	if config.Compression != "" {
+		opts = append(opts, WithCompression(config.Compression))
+	}
+	if len(config.Pipeline) > 0 {
+		opts = append(opts, WithPipeline(config.Pipeline...))
+	}
+	if config.PipelineSecret != "" {
+		opts = append(opts, WithPipelineSecret(config.PipelineSecret))
+	}
+	if config.Multiplex {
+		opts = append(opts, WithMultiplexing())
+	}
+	if config.Codec == MsgpackCodec {
+		opts = append(opts, WithCodec(config.Codec))
+	}
+	if config.DrainIdle > 0 {
+		opts = append(opts, WithDrainIdleTimeout(config.DrainIdle))
+	}
+	if config.IdleTimeout > 0 {
+		opts = append(opts, WithIdleTimeout(config.IdleTimeout))
+	}
+	if config.Access.enabled() {
+		opts = append(opts, WithAccessControl(config.Access))
+	}
+	if config.PinThreads {
+		opts = append(opts, WithOSThreadPinning())
+	}
+	if config.BufferSize > 0 {
+		opts = append(opts, WithRelayBufferSize(config.BufferSize))
+	}
+	if config.NoSplice {
+		opts = append(opts, WithoutSplice())
+	}
+	if config.KeepAlive != 0 {
+		opts = append(opts, WithTCPKeepAlive(config.KeepAlive))
+	}
+	if !config.NoDelay {
+		opts = append(opts, WithTCPNoDelay(false))
+	}
+	if config.BindAddress != nil {
+		opts = append(opts, WithBindAddress(config.BindAddress))
+	}
+	if config.PreferIP != "" {
+		opts = append(opts, WithPreferredIPFamily(config.PreferIP))
+	}
+	if config.PoolSize > 0 {
+		opts = append(opts, WithDataConnectionPool(config.PoolSize, config.PoolMaxIdle))
+	}
+	if config.LocalRetry > 0 {
+		opts = append(opts, WithLocalRetry(config.LocalRetry))
+	}
+	if config.FastOpen {
+		opts = append(opts, WithTCPFastOpen())
+	}
+	if notify != nil {
+		opts = append(opts, OnNewProxyConnection(notify.connectionOpened), OnProxyConnectionClosed(notify.connectionClosed))
+	}
+	if config.FaultRate > 0 {
+		log.Printf("🧪 Injecting faults into %.0f%% of the control messages", config.FaultRate*100)
+		opts = append(opts, WithFaultInjection(config.FaultRate, config.FaultDelay))
+	}
+
+	if config.Tunnel != "" {
+		opts = append(opts, WithLogger(log.New(log.Writer(), "["+config.Tunnel+"] ", log.Flags())))
+	}
+
+	opts = append(opts, WithLocalTarget(config.LocalHost, config.LocalPort), WithClientID(config.ClientID), WithLabel(config.Label))
+	if config.StrictHandshake {
+		opts = append(opts, WithStrictHandshake())
+	}
+	if cfg := config.TLS.clientConfig(); cfg != nil {
+		opts = append(opts, WithTLS(cfg))
+	}
+	if config.PrivateKey != nil {
+		opts = append(opts, WithPrivateKey(config.PrivateKey))
+	} else if config.OIDC.enabled() {
+		opts = append(opts, WithToken(tokenSourceFor(config.OIDC).Token))
+	} else {
+		opts = append(opts, WithRotatingSecret(config.SecretKey, config.SecondaryKey))
+	}
+	client, err := connectFailover(config, func(addr string) (*Client, error) {
+		return NewClient(addr, opts...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	reservedPort.assigned(config.Tunnel, client.RemotePort())
+
+	if err := applyMaintenance(client, config); err != nil {
+		client.cc.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// handleShutdownSignals waits for SIGINT or SIGTERM and gracefully shuts the
+// client down, giving in-flight connections up to timeout to drain. On Windows
+// these also cover Ctrl+Break and console close, logoff and shutdown events.
+// A second signal while draining exits immediately.
+func handleShutdownSignals(client interface{ Shutdown(context.Context) error }, timeout time.Duration) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	sig := <-sigs
+	timeout = shutdownDeadline(sig, timeout)
+	log.Printf("🛑 Received %v, draining connections (up to %v)", sig, timeout)
+	if err := sdNotify(sdStopping); err != nil {
+		log.Printf("⚠️ %v", err)
+	}
+
+	go func() {
+		<-sigs
+		log.Fatalf("❌ Received second signal, exiting immediately")
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := client.Shutdown(ctx); err != nil {
+		log.Printf("⚠️ Shutdown: %v", err)
+	}
+}
+
+// applyMaintenance switches the client in or out of maintenance mode according
+// to config, loading the optional 503 page from disk.
+func applyMaintenance(client *Client, config *Config) error {
+	page, err := maintenancePage(config)
+	if err != nil {
+		return err
+	}
+	setMaintenance(client, config, page)
+	return nil
+}
+
+// maintenancePage loads the 503 page of config from disk, nil if maintenance
+// mode is off or there is no page.
+func maintenancePage(config *Config) ([]byte, error) {
+	if !config.Maintenance || config.MaintenancePage == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(config.MaintenancePage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read maintenance page: %w", err)
+	}
+	return b, nil
+}
+
+// setMaintenance switches the client in or out of maintenance mode according
+// to config, serving page, as loaded by maintenancePage.
+func setMaintenance(client *Client, config *Config, page []byte) {
+	if !config.Maintenance {
+		client.SetMaintenance(false, nil)
+		return
+	}
+	client.SetMaintenance(true, page)
+	log.Println("🚧 Maintenance mode enabled, the local service will not be contacted")
 }
 
 func readConfigFromViper(config *Config) {
 	config.LocalHost = viper.GetString("local-host")
 	config.Server = viper.GetString("server")
+	config.ServerSelection = viper.GetString("server-selection")
+	config.SRVRefresh = viper.GetDuration("srv-refresh")
+	if config.SRVRefresh <= 0 {
+		config.SRVRefresh = defaultSRVRefresh
+	}
 	config.ClientID = viper.GetString("client-id")
 	config.SecretKey = viper.GetString("secret-key")
+	config.SecondaryKey = viper.GetString("secondary-secret-key")
 	config.LocalPort = uint16(viper.GetInt("local-port"))
 	config.ServerPort = uint16(viper.GetInt("server-port"))
+	config.ShutdownTimeout = viper.GetDuration("shutdown-timeout")
+	config.Duration = viper.GetDuration("duration")
+	if config.ShutdownTimeout <= 0 {
+		config.ShutdownTimeout = defaultShutdownTimeout
+	}
+	config.Timeouts = Timeouts{
+		Dial:      viper.GetDuration("dial-timeout"),
+		Handshake: viper.GetDuration("handshake-timeout"),
+		Read:      viper.GetDuration("read-timeout"),
+		Write:     viper.GetDuration("write-timeout"),
+	}
+	config.ReconnectDelay = viper.GetDuration("reconnect-delay")
+	if config.ReconnectDelay <= 0 {
+		config.ReconnectDelay = defaultReconnectDelay
+	}
+	config.ReconnectMax = viper.GetDuration("reconnect-max-delay")
+	if config.ReconnectMax <= 0 {
+		config.ReconnectMax = defaultReconnectMaxDelay
+	}
+	config.ReconnectLimit = viper.GetInt("reconnect-max-attempts")
+	config.AuthCooldown = viper.GetDuration("auth-retry-cooldown")
+	config.Maintenance = viper.GetBool("maintenance")
+	config.MaintenancePage = viper.GetString("maintenance-page")
+	config.TranscriptDir = viper.GetString("transcript-dir")
+	config.AuditLog = viper.GetString("audit-log")
+	config.LogTimezone = viper.GetString("log-timezone")
+	config.NonInteractive = viper.GetBool("non-interactive")
+	config.Dashboard = viper.GetBool("dashboard")
+	config.Plain = viper.GetBool("plain")
+	config.Output = viper.GetString("output")
+	config.NoSpinner = viper.GetBool("no-spinner")
+	config.MaxConnections = viper.GetInt("max-connections")
+	config.QueueTimeout = viper.GetDuration("connection-queue-timeout")
+	config.ProxyProtocol = viper.GetString("proxy-protocol")
+	config.Compression = viper.GetString("compression")
+	config.Pipeline = readStringList("pipeline")
+	config.PipelineSecret = viper.GetString("pipeline-secret")
+	config.Multiplex = viper.GetBool("multiplex")
+	config.PoolSize = viper.GetInt("data-pool-size")
+	config.LocalRetry = viper.GetDuration("local-retry")
+	config.PoolMaxIdle = viper.GetDuration("data-pool-max-idle")
+	config.PreviewPort = viper.GetString("preview-port")
+	config.Codec = viper.GetString("codec")
+	config.DrainIdle = viper.GetDuration("drain-idle-timeout")
+	config.IdleTimeout = viper.GetDuration("idle-timeout")
+	config.ReadyFile = viper.GetString("ready-file")
+	config.RemotePort = uint16(viper.GetInt("remote-port"))
+	config.PortFile = viper.GetString("port-file")
+	config.StatusDir = viper.GetString("status-dir")
+	config.ControlSocket = viper.GetString("control-socket")
+	config.AdminAddr = viper.GetString("admin-addr")
+	config.AdminToken = viper.GetString("admin-token")
+	if config.ControlSocket == "" {
+		config.ControlSocket = defaultControlSocket
+	}
+	config.PinThreads = viper.GetBool("lock-os-thread")
+	config.FastOpen = viper.GetBool("tcp-fast-open")
+	config.StrictHandshake = viper.GetBool("strict-handshake")
+	config.NoSplice = viper.GetBool("no-splice")
+	config.Label = viper.GetString("label")
+	config.FaultRate = viper.GetFloat64("inject-faults")
+	config.FaultDelay = viper.GetDuration("inject-faults-delay")
+}
+
+// readStringList reads a list key, which is either a list in the config file or
+// a comma-separated string, as set by flags and environment variables.
+func readStringList(key string) []string {
+	if s, ok := viper.Get(key).(string); ok {
+		var list []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		return list
+	}
+	return viper.GetStringSlice(key)
+}
+
+// readBandwidthLimits parses the rate limit keys into config.Bandwidth. The
+// upload-limit and download-limit keys override bandwidth-limit for their
+// direction, and likewise for the per-connection keys.
+func readBandwidthLimits(config *Config) error {
+	rate := func(key, fallback string) (int64, error) {
+		v := viper.GetString(key)
+		if v == "" {
+			v = viper.GetString(fallback)
+		}
+		r, err := parseRate(v)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse %s: %w", key, err)
+		}
+		return r, nil
+	}
+
+	var err error
+	b := &config.Bandwidth
+	if b.TunnelUpload, err = rate("upload-limit", "bandwidth-limit"); err != nil {
+		return err
+	}
+	if b.TunnelDownload, err = rate("download-limit", "bandwidth-limit"); err != nil {
+		return err
+	}
+	if b.ConnectionUpload, err = rate("connection-upload-limit", "connection-bandwidth-limit"); err != nil {
+		return err
+	}
+	if b.ConnectionDownload, err = rate("connection-download-limit", "connection-bandwidth-limit"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// readRelayBufferSize parses relay-buffer-size, a size such as 64KiB.
+func readRelayBufferSize(config *Config) error {
+	s := viper.GetString("relay-buffer-size")
+	n, err := parseRate(s)
+	if err != nil || (n != 0 && (n < minRelayBufferSize || n > maxRelayBufferSize)) {
+		return fmt.Errorf("invalid relay-buffer-size %q, use a size between 4KiB and 1MiB", s)
+	}
+	config.BufferSize = int(n)
+	return nil
+}
+
+// readHealthCheck reads the health check keys into config.HealthCheck.
+func readHealthCheck(config *Config) error {
+	hc := HealthCheck{
+		Type:     viper.GetString("health-check"),
+		Path:     viper.GetString("health-check-path"),
+		Interval: viper.GetDuration("health-check-interval"),
+		Reject:   viper.GetBool("health-check-reject"),
+	}
+	switch hc.Type {
+	case "", "tcp", "http":
+	default:
+		return fmt.Errorf("invalid health-check %q, use tcp or http", hc.Type)
+	}
+	if hc.Path == "" {
+		hc.Path = "/"
+	} else if !strings.HasPrefix(hc.Path, "/") {
+		hc.Path = "/" + hc.Path
+	}
+	config.HealthCheck = hc
+	return nil
 }
 
 func promptForMissingConfig(config *Config) {
@@ -79,8 +1130,12 @@ func promptForMissingConfig(config *Config) {
 	if config.ClientID == "" {
 		config.ClientID = getEnvOrPrompt("CLIENT_ID", "Client ID 🆔")
 	}
-	if config.SecretKey == "" {
-		config.SecretKey = getEnvOrPrompt("SECRET_KEY", "Secret key 🔑 (64 chars)")
+	if config.SecretKey == "" && config.PrivateKey == nil && !config.OIDC.enabled() {
+		secret, err := promptSecretInput("Secret key 🔑 (64 chars)")
+		if err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		config.SecretKey = secret
 	}
 	if config.LocalHost == "" {
 		config.LocalHost = getEnvOrPrompt("LOCAL_HOST", "Local host 💻 (default is 127.0.0.1)", config.LocalHost)
@@ -93,6 +1148,11 @@ func promptForMissingConfig(config *Config) {
 	}
 }
 
+// isTerminal reports whether f is an interactive terminal.
+func isTerminal(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
+}
+
 func getEnvOrPrompt(envVar, prompt string, def ...string) string {
 	value := viper.GetString(envVar)
 	if value == "" {
@@ -112,7 +1172,7 @@ func getEnvOrPromptUint16(envVar, prompt string) uint16 {
 func parseUint16(s string) uint16 {
 	val, err := strconv.ParseUint(s, 10, 16)
 	if err != nil {
-		log.Fatalf("❌ Invalid port: %v", err)
+		configFatalf("❌ Invalid port: %v", err)
 	}
 	return uint16(val)
 }
@@ -2,19 +2,84 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/briandowns/spinner"
-	"io"
 	"log"
 	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/hashicorp/yamux"
 	"golang.org/x/sync/errgroup"
 )
 
-const networkTimeout = 2 * time.Minute
+var (
+	// ErrAlreadyListening is returned by Listen if it has been called before.
+	ErrAlreadyListening = errors.New("client is already listening")
+	// ErrClientClosed is returned by Listen once Shutdown has been called.
+	ErrClientClosed = errors.New("client is shut down")
+	// ErrTooManyConnections is reported to OnError for connection requests
+	// rejected because of the connection limit.
+	ErrTooManyConnections = errors.New("too many connections")
+)
+
+// Errors classifying why connecting or relaying failed, to be tested with
+// errors.Is. The errors returned by the client wrap one of them where the
+// class is known, together with the underlying cause.
+var (
+	// ErrAuthFailed means the server did not accept the client ID and secret
+	// key, or requires a secret key that was not configured. Retrying with
+	// the same credentials does not help.
+	ErrAuthFailed = errors.New("authentication failed")
+	// ErrServerRejected means the server refused or ended the session with an
+	// error message; the error is a *ServerError, which may carry a hint on
+	// when to retry.
+	ErrServerRejected = errors.New("rejected by server")
+	// ErrLocalUnreachable is reported to OnError when the local service could
+	// not be connected to for a visitor.
+	ErrLocalUnreachable = errors.New("local service unreachable")
+	// ErrProtocol means the server sent a message the client does not
+	// understand, such as from an incompatible version.
+	ErrProtocol = errors.New("protocol error")
+)
+
+// ServerError is returned by Listen when the server ends the session with an
+// error message, and when connecting if the server refuses the session.
+// RetryAfter is how long the server asked the client to wait before
+// reconnecting, or zero if it gave no hint. It matches ErrServerRejected.
+type ServerError struct {
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *ServerError) Error() string {
+	return "server error: " + e.Message
+}
+
+// Unwrap returns ErrServerRejected.
+func (e *ServerError) Unwrap() error {
+	return ErrServerRejected
+}
+
+// newServerError returns the *ServerError of an error message of the server.
+func newServerError(msg ServerMessage) *ServerError {
+	return &ServerError{Message: msg.Error, RetryAfter: time.Duration(msg.RetryAfter) * time.Second}
+}
+
+// Dialer opens connections to the server. It is implemented by *net.Dialer and
+// can be replaced with WithDialer, for example by in-memory pipes in tests, a
+// proxy chain or another transport.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
 
 // Client is a type that represents a client in a client-server communication system.
 //
@@ -27,25 +92,73 @@ const networkTimeout = 2 * time.Minute
 // - rp uint16: the port that is publicly available on the remote server.
 // - auth *Authenticator: an optional secret used to authenticate clients.
 // - cid string: the client ID.
+// - tls *tls.Config: the TLS configuration of server connections, nil for plain TCP.
+// - session *Authenticator: the session token data connections authenticate with, nil without one.
+// - strictAuth bool: refuse servers that do not support handshake nonces, see WithStrictHandshake.
+// - transcript *Transcript: optional tamper-evident record of the session.
+// - wg sync.WaitGroup: tracks the in-flight proxied connections.
+// - conns map[uuid.UUID]*proxyConn: the in-flight proxied connections and their counters.
+// - started time.Time: when the control connection was established.
+// - totals totals: counters of the proxied connections that have finished.
+// - spinner bool: whether Listen shows a progress spinner.
+// - draining bool: set once Shutdown is called; new connections are refused.
+// - listening bool: set once Listen is called, so it cannot run twice.
+// - shutdownDone chan struct{}, shutdownErr error: completion and result of Shutdown.
+// - drainIdle time.Duration: connections idle this long are closed on shutdown.
+// - pinThreads bool: whether busy copy loops get an OS thread of their own.
+// - buffers *bufferPool: copy buffers of the relay, see WithRelayBufferSize.
+// - splice bool: whether plain TCP connections are copied with splice.
+// - keepAlive time.Duration: TCP keepalive interval, 0 for the default and negative to disable.
+// - noDelay bool: whether TCP_NODELAY is left enabled on connections.
+// - bindAddr net.IP: local address server connections are dialed from, if set.
+// - preferIP string: IP family dialed first, PreferIPv4, PreferIPv6 or empty.
+// - pool *dataPool: pre-authenticated data connections, if enabled.
+// - localRetry time.Duration: how long to keep retrying an unreachable local service.
+// - idleTimeout time.Duration: how long a relayed connection may go without traffic.
+// - audit *AuditLog: the log every relayed connection is recorded in, if any.
+// - tracer *Tracer: exports spans of the phases of relayed connections, if set.
+// - acl AccessControl: the visitors whose connection requests are accepted.
+// - quota *TrafficQuota: the traffic quota the relayed bytes count against, if any.
+// - requestPort uint16: remote port asked for in the hello message, if any.
+// - paused bool: whether new proxied connections are refused.
+// - timeouts Timeouts: bounds of dialing, the handshakes and control connection I/O.
+// - dialer Dialer: dialer of the control and data connections, if set.
+// - logger *log.Logger: destination of the client's log messages.
+// - faults *faultInjector: tampers with control messages, for testing only.
+// - fastOpen bool: whether server connections use TCP Fast Open.
+// - hooks hooks: lifecycle callbacks registered by the embedder.
+// - label string: human-readable label of the session sent to the server.
+// - released sync.Once: ensures the goodbye message is sent at most once.
+// - slots connLimiter: caps the number of connections relayed at once.
+// - compression string: compression offered to the server for data connections.
+// - compressed bool: whether the server accepted the compression.
+// - measureRTT bool, rtt rttProbe: round-trip time measurement on heartbeats.
+// - rejects bool: whether refused connection requests are refused to the server.
+// - pipeline []string, stages []PipelineStage: the data path stages of relayed connections.
+// - pipelineSecret []byte: what the encrypting stages derive their key from, if not the secret key.
+// - multiplex, muxed bool: whether multiplexing was offered and accepted.
+// - codec string: binary codec offered for the control connection, if any.
+// - serverVersion int: the ProtocolVersion announced by the server, 0 if none.
+// - mux *yamux.Session: the multiplexed data session, guarded by muxMu.
+// - maintenance bool: when set, visitors are answered without touching the local service.
+// - maintenancePage []byte: optional HTML body served with a 503 in maintenance mode.
+// - health HealthCheck: how the local service is probed.
+// - degraded bool: set while the last health check of the local service failed.
+// - proxyProtocol string: PROXY protocol version sent to the local service, if any.
+// - limits BandwidthLimits: the configured upload and download rate limits.
+// - uploadLimiter, downloadLimiter *rateLimiter: token buckets shared by the whole tunnel.
 //
-// Usage example:
+// A Client is safe for concurrent use. Listen may be called only once, and not
+// after Shutdown. Shutdown may be called any number of times from any
+// goroutine; every call waits for the first one to finish and returns its
+// result. Close stops the client without draining. Accessors such as
+// RemotePort, LocalTarget and Stats and the Set methods can be called at any
+// time, before, during and after Listen.
 //
-//	// Create a new client
-//	client, err := NewClient(sp, lh, lp, da, cid, s)
-//
-//	if err != nil {
-//	  log.Fatal(err)
-//	}
-//
-//	// Get the remote port
-//	rp := client.RemotePort()
-//
-//	// Listen for server messages
-//	err := client.Listen()
-//
-//	if err != nil {
-//	  log.Fatal(err)
-//	}
+// ExampleNewClient in example_test.go shows a client exposing a local service
+// end to end, ExampleClient_ServeConn the local processing of a connection and
+// Example_tunnels the extra tunnels of examples/tunnels.yaml; all run with go
+// test.
 type Client struct {
 	sp   uint16
 	cc   *Codec         // Control connection to the server.
@@ -53,11 +166,82 @@ type Client struct {
 	lh   string         // Local host that is forwarded.
 	lp   uint16         // Local port that is forwarded.
 	rp   uint16         // Port that is publicly available on the remote.
-	auth *Authenticator // Optional secret used to authenticate clients.
+	auth *Authenticator // Optional secret used to authenticate clients, nil without one. Guarded by mu.
 	cid  string
+
+	session        *Authenticator // Session token of data connections, see session.go. Guarded by mu.
+	sessionExpiry  time.Time      // When session expires, zero if it does not. Guarded by mu.
+	strictAuth     bool           // Refuse servers without handshake nonces.
+	tls            *tls.Config    // TLS of server connections, see WithTLS.
+	transcript     *Transcript    // Optional session transcript.
+	started        time.Time      // When the control connection was established.
+	spinner        bool           // Show a progress spinner while listening.
+	totals         totals         // Counters of finished proxied connections.
+	released       sync.Once      // Guards sending the goodbye message.
+	slots          connLimiter    // Limit on concurrently relayed connections.
+	compression    string         // Offered data connection compression, if any.
+	compressed     bool           // The server accepted the compression.
+	measureRTT     bool           // The server echoes heartbeat pings.
+	rejects        bool           // The server accepts reject messages.
+	rtt            rttProbe
+	pipelineSecret []byte   // Key material of the encrypting stages, the secret key if empty.
+	pipeline       []string // Names of the data path stages, local side first.
+	stages         []PipelineStage
+	multiplex      bool           // Offer multiplexed data connections.
+	muxed          bool           // The server accepted multiplexing.
+	codec          string         // Offered control connection codec, if any.
+	serverVersion  int            // Protocol version announced by the server.
+	serverErr      *ServerError   // Last session error of the server, only used by Listen.
+	drainIdle      time.Duration  // Idle time after which connections are closed on shutdown.
+	pinThreads     bool           // Lock busy copy loops to their OS thread.
+	buffers        *bufferPool    // Copy buffers of the relay.
+	splice         bool           // Copy plain TCP connections inside the kernel.
+	keepAlive      time.Duration  // TCP keepalive interval, see WithTCPKeepAlive.
+	noDelay        bool           // Leave Nagle's algorithm disabled, see WithTCPNoDelay.
+	bindAddr       net.IP         // Local address of server connections, see WithBindAddress.
+	preferIP       string         // IP family dialed first, see WithPreferredIPFamily.
+	poolSize       int            // Idle data connections to keep, see WithDataConnectionPool.
+	poolMaxIdle    time.Duration  // Maximum age of pooled data connections.
+	pool           *dataPool      // Pooled data connections, nil if disabled or multiplexed.
+	localRetry     time.Duration  // Retry window of local dials, see WithLocalRetry.
+	idleTimeout    time.Duration  // Guarded by mu, see SetIdleTimeout.
+	audit          *AuditLog      // Connection audit log, see WithAuditLog.
+	tracer         *Tracer        // Connection lifecycle spans, see WithTracer.
+	acl            AccessControl  // Guarded by mu, see SetAccessControl.
+	quota          *TrafficQuota  // Traffic quota, see WithTrafficQuota.
+	requestPort    uint16         // Remote port to ask for, see WithRemotePort.
+	paused         bool           // Guarded by mu, see SetPaused.
+	timeouts       Timeouts       // Dial, handshake and control connection timeouts.
+	dialer         Dialer         // Dialer of server connections, nil for the default.
+	logger         *log.Logger    // Destination of log messages.
+	faults         *faultInjector // Fault injection on the control connection, if enabled.
+	fastOpen       bool           // Dial the server with TCP Fast Open.
+	hooks          hooks          // Lifecycle callbacks.
+	label          string         // Session label announced in the hello message.
+
+	muxMu sync.Mutex     // Guards mux.
+	mux   *yamux.Session // Multiplexed data session, dialed on first use.
+
+	mu              sync.Mutex               // Guards the local target, conns, the lifecycle and the runtime settings.
+	wg              sync.WaitGroup           // In-flight proxied connections.
+	conns           map[uuid.UUID]*proxyConn // Registry of in-flight proxied connections.
+	draining        bool                     // Set once Shutdown has been requested.
+	listening       bool                     // Set once Listen has been called.
+	shutdownDone    chan struct{}            // Closed when the first Shutdown call has finished.
+	shutdownErr     error                    // Result of the first Shutdown call.
+	maintenance     bool                     // Answer visitors locally instead of proxying.
+	maintenancePage []byte                   // Body of the 503 served in maintenance mode.
+	health          HealthCheck              // Health check of the local service.
+	degraded        bool                     // The local service failed its last health check.
+	proxyProtocol   string                   // PROXY protocol version for local connections.
+	limits          BandwidthLimits          // Configured rate limits.
+	uploadLimiter   *rateLimiter             // Tunnel-wide limit from the local service to visitors.
+	downloadLimiter *rateLimiter             // Tunnel-wide limit from visitors to the local service.
 }
 
-// NewClient creates a new instance of the Client struct and initializes it with the provided parameters.
+// NewClient creates a new instance of the Client struct for the server at addr,
+// a host:port pair, and configures it with opts, usually at least
+// WithLocalTarget, WithClientID and WithSecret.
 // It establishes a connection with the server at the specified destination address and port
 // and performs a client handshake to authenticate with the server.
 // If the handshake is successful, it sends a hello message to the server.
@@ -65,51 +249,164 @@ type Client struct {
 // is publicly available on the remote server.
 // If all steps are successful, it returns a pointer to the newly created Client instance.
 // Otherwise, it returns an error.
-func NewClient(sp uint16, lh string, lp uint16, da, cid, s string) (*Client, error) {
-	conn, err := establishConnectionWithTimeout(da, sp)
+func NewClient(addr string, opts ...Option) (*Client, error) {
+	return NewClientContext(context.Background(), addr, opts...)
+}
+
+// NewClientContext is like NewClient, but gives up connecting and
+// authenticating with the server as soon as ctx ends and returns its error.
+// Once the client is created, ctx has no further effect.
+func NewClientContext(ctx context.Context, addr string, opts ...Option) (*Client, error) {
+	da, port, err := net.SplitHostPort(addr)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to %s: %w", da, err)
+		return nil, fmt.Errorf("invalid server address %q: %w", addr, err)
 	}
+	sp, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server port %q: %w", port, err)
+	}
+	c := &Client{
+		sp: uint16(sp),
+		da: da,
 
-	cc := NewCodec(conn)
-	auth := NewAuthenticator(s)
+		spinner: true,
+		logger:  log.Default(),
+		conns:   make(map[uuid.UUID]*proxyConn),
+		buffers: relayBuffers(defaultRelayBufferSize),
+		splice:  spliceSupported,
+		noDelay: true,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.pipeline = pipelineNames(c.pipeline, c.compression)
+	if c.stages, err = resolvePipeline(c.pipeline); err != nil {
+		if c.cc != nil {
+			c.cc.Close()
+		}
+		return nil, err
+	}
+
+	if c.tls != nil {
+		c.tls = tlsFor(c.tls, da)
+	}
+	if c.cc == nil {
+		conn, err := c.dial(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to %s: %w", da, err)
+		}
+		c.cc = NewCodec(conn)
+	} else {
+		c.tuneConn(c.cc.conn)
+		if c.tls != nil {
+			conn, err := startTLS(ctx, c.cc.conn, c.tls)
+			if err != nil {
+				return nil, err
+			}
+			c.cc = NewCodec(conn)
+		}
+	}
+	if c.fastOpen && !fastOpenSupported {
+		c.logger.Println("⚠️ TCP Fast Open is not supported on this platform, using normal connections")
+		c.fastOpen = false
+	}
+	if c.auth != nil {
+		c.auth.strict = c.strictAuth
+		if c.auth.secondary != nil {
+			c.auth.secondary.strict = c.strictAuth
+		}
+	}
+	if c.faults != nil {
+		c.faults.logger = c.logger
+		c.cc.faults = c.faults
+	}
 
-	destPort, err := auth.PerformClientHandshake(cc, cid)
+	stop := context.AfterFunc(ctx, func() { c.cc.Close() })
+	rp, err := c.hello()
+	if !stop() {
+		if err == nil {
+			c.cc.Close()
+		}
+		return nil, fmt.Errorf("failed to connect to %s: %w", da, ctx.Err())
+	}
 	if err != nil {
-		return nil, fmt.Errorf("client handshake failed: %w", err)
+		c.cc.Close()
+		return nil, err
 	}
+	c.rp = rp
+	c.started = time.Now()
+	if c.poolSize > 0 && !c.muxed {
+		c.pool = newDataPool(c.poolSize, c.poolMaxIdle)
+	}
+	c.cc.readTimeout, c.cc.writeTimeout = c.timeouts.Read, c.timeouts.Write
+
+	c.recordTranscript(TranscriptRecord{
+		Event:  EvSessionStart,
+		Detail: fmt.Sprintf("server=%s:%d client-id=%s remote-port=%d local=%s:%d label=%q", c.da, c.sp, c.cid, rp, c.lh, c.lp, c.label),
+	})
 
-	if err := cc.Send(ClientMessage{Type: MtHello, Port: destPort}); err != nil {
-		return nil, fmt.Errorf("failed to send hello message: %w", err)
+	c.logger.Printf("Connected to server at %s:%d\n", da, rp)
+	if c.label != "" {
+		c.logger.Printf("🏷️ Session label: %s\n", c.label)
 	}
+	c.logger.Printf("Listening for connection to redirect\n\n")
+	c.hooks.onConnected(rp)
 
-	var msg ServerMessage
-	ctx, cancel := context.WithTimeout(context.Background(), NetworkTimeout)
+	return c, nil
+}
+
+// hello authenticates the control connection and announces the client to the
+// server, offering its optional capabilities and asking for the remote port
+// set with WithRemotePort, if any, instead of the one the server offered. It
+// returns the remote port assigned by the server, warning if it is not the one
+// asked for.
+func (c *Client) hello() (uint16, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeouts.handshake())
 	defer cancel()
 
-	err = cc.Recv(ctx, &msg)
-	if err != nil {
-		return nil, fmt.Errorf("failed to receive server message: %w", err)
+	var destPort uint16
+	if auth := c.authenticator(); auth != nil {
+		cc, port, err := c.authenticate(ctx, auth, c.cc)
+		if err != nil {
+			return 0, fmt.Errorf("client handshake failed: %w", err)
+		}
+		c.cc, destPort = cc, port
+	}
+
+	if c.requestPort != 0 {
+		destPort = c.requestPort
+	}
+	hello := ClientMessage{Type: MtHello, Port: destPort, Version: ProtocolVersion, Capabilities: c.capabilities(), Label: c.label}
+	if err := c.cc.Send(hello); err != nil {
+		return 0, fmt.Errorf("failed to send hello message: %w", err)
+	}
+
+	var msg ServerMessage
+	if err := c.cc.Recv(ctx, &msg); err != nil {
+		return 0, fmt.Errorf("failed to receive server message: %w", err)
 	}
 
 	rp, err := processInitialServerMessage(msg)
 	if err != nil {
-		return nil, err
+		return 0, err
+	}
+	if c.requestPort != 0 && rp != c.requestPort {
+		c.logger.Printf("⚠️ Asked for remote port %d, but the server assigned %d; links to port %d no longer reach this tunnel\n", c.requestPort, rp, c.requestPort)
 	}
+	c.serverVersion = msg.Version
+	c.negotiate(msg.Capabilities)
+	return rp, nil
+}
 
-	log.Printf("Connected to server at %s:%d\n", da, rp)
-	log.Printf("Listening for connection to redirect\n\n")
+// Label returns the session label announced to the server, if any.
+func (c *Client) Label() string {
+	return c.label
+}
 
-	return &Client{
-		sp:   sp,
-		cc:   cc,
-		da:   da,
-		lh:   lh,
-		lp:   lp,
-		rp:   rp,
-		auth: auth,
-		cid:  cid,
-	}, nil
+// ServerAddr returns the host:port address of the server the client is
+// connected to.
+func (c *Client) ServerAddr() string {
+	return net.JoinHostPort(c.da, strconv.Itoa(int(c.sp)))
 }
 
 // RemotePort returns the port that is publicly available on the remote server.
@@ -117,6 +414,28 @@ func (c *Client) RemotePort() uint16 {
 	return c.rp
 }
 
+// LocalTarget returns the local host and port that proxied connections are forwarded to.
+func (c *Client) LocalTarget() (string, uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lh, c.lp
+}
+
+// SetLocalTarget changes the local host and port that new proxied connections are
+// forwarded to. Connections that are already established are not affected.
+func (c *Client) SetLocalTarget(lh string, lp uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lh = lh
+	c.lp = lp
+}
+
+// progressSpinner is the progress indicator drawn by Listen, see newSpinner.
+type progressSpinner interface {
+	Start()
+	Stop()
+}
+
 // Listen listens for server messages and processes them accordingly.
 // It continuously receives messages from the server using the connection's Recv method.
 // If there is an error receiving a message, it returns an error message.
@@ -124,13 +443,89 @@ func (c *Client) RemotePort() uint16 {
 // The method runs indefinitely until there is an error or the connection is closed.
 // The method uses the processServerMessage method to handle the different types of server messages.
 // If there is an error receiving a message or processing a server message, the method exits and returns the error.
-// The method returns nil if the connection is closed gracefully.
-func (c *Client) Listen() error {
+// The method returns nil if the connection is closed gracefully, which includes
+// the control connection being closed by Shutdown.
+// When Listen returns, the end of the session is recorded in the transcript.
+// A panic while listening releases the public port before it is propagated.
+// The local service is health checked in the background while Listen runs.
+// Listen returns ErrAlreadyListening if it is called again, and ErrClientClosed
+// if Shutdown has already been called.
+func (c *Client) Listen() (err error) {
+	return c.ListenContext(context.Background())
+}
+
+// ListenContext is like Listen, but stops the client with Close as soon as ctx
+// ends. It then returns the error of ctx.
+func (c *Client) ListenContext(ctx context.Context) (err error) {
+	unwatch := context.AfterFunc(ctx, func() {
+		if err := c.Close(); err != nil {
+			c.logger.Printf("⚠️ Shutdown: %v", err)
+		}
+	})
+	defer func() {
+		if !unwatch() {
+			// Wait for the shutdown started when ctx ended.
+			_ = c.Shutdown(context.Background())
+			err = ctx.Err()
+		}
+	}()
+
+	c.mu.Lock()
+	switch {
+	case c.listening:
+		c.mu.Unlock()
+		return ErrAlreadyListening
+	case c.draining:
+		c.mu.Unlock()
+		return ErrClientClosed
+	}
+	c.listening = true
+	c.mu.Unlock()
+
+	defer c.releaseOnPanic()
+	defer func() {
+		reason := "closed"
+		if err != nil {
+			reason = err.Error()
+		}
+		c.recordTranscript(TranscriptRecord{Event: EvSessionEnd, Detail: reason})
+		c.transcript.Close()
+		if err != nil {
+			c.hooks.onError(err)
+		}
+		c.hooks.onDisconnected(err)
+	}()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go c.runHealthChecks(stop)
+	go c.runIdleTimeouts(stop)
+	if c.pool != nil {
+		go c.pool.run(c, stop)
+	}
+
+	s := newSpinner()
 	for {
-		s := spinner.New(spinner.CharSets[39], 100*time.Millisecond)
-		s.Start()
+		if c.spinner {
+			s.Start()
+		}
 		var msg ServerMessage
 		if err := c.cc.Recv(context.Background(), &msg); err != nil {
+			s.Stop()
+			if c.isDraining() {
+				return nil
+			}
+			// A message of the wrong shape was read completely, so the
+			// stream is still in sync and the next message can be read.
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &typeErr) {
+				c.logger.Printf("⚠️ Ignoring malformed server message: %v\n", err)
+				continue
+			}
+			if c.serverErr != nil {
+				// The server explained why it closed the session.
+				return c.serverErr
+			}
 			return fmt.Errorf("failed to receive server message: %w", err)
 		}
 
@@ -141,105 +536,516 @@ func (c *Client) Listen() error {
 	}
 }
 
+// Shutdown gracefully stops the client. It stops accepting new MtConnection
+// requests, waits for the in-flight proxied connections to finish and then
+// sends a goodbye message so the server can free the public port at once, then
+// closes the control connection, which tells the server the client is gone and
+// makes Listen return nil.
+// If ctx expires before the connections have drained, the control connection is
+// closed anyway and the context error is returned.
+// With a drain idle timeout, connections that have been idle that long are
+// closed right away, so keepalive connections do not hold up the shutdown while
+// active transfers get the whole of ctx to finish.
+// Shutdown is idempotent: later calls wait, within their own ctx, for the first
+// call to finish and return its result.
+func (c *Client) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	if c.shutdownDone != nil {
+		done := c.shutdownDone
+		c.mu.Unlock()
+		select {
+		case <-done:
+			return c.shutdownErr
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for shutdown: %w", ctx.Err())
+		}
+	}
+	c.draining = true
+	c.shutdownDone = make(chan struct{})
+	c.mu.Unlock()
+	defer close(c.shutdownDone)
+
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	var idle <-chan time.Time
+	if c.drainIdle > 0 {
+		ticker := time.NewTicker(drainCheckInterval)
+		defer ticker.Stop()
+		idle = ticker.C
+		c.closeIdleConnections()
+	}
+waiting:
+	for {
+		select {
+		case <-done:
+			break waiting
+		case <-idle:
+			c.closeIdleConnections()
+		case <-ctx.Done():
+			err = fmt.Errorf("connections did not drain in time: %w", ctx.Err())
+			break waiting
+		}
+	}
+
+	c.release()
+	if cerr := c.cc.Close(); cerr != nil && err == nil {
+		err = fmt.Errorf("failed to close control connection: %w", cerr)
+	}
+	c.closeMux()
+	c.shutdownErr = err
+	return err
+}
+
+// Close stops the client at once: unlike Shutdown it does not let in-flight
+// connections finish but closes every connection in the registry, then the
+// control connection. Connections that are still being set up are closed as
+// soon as their relay starts. Close waits up to NetworkTimeout for their
+// goroutines to return and, like Shutdown, may be called more than once.
+func (c *Client) Close() error {
+	c.abortConnections()
+	ctx, cancel := context.WithTimeout(context.Background(), NetworkTimeout)
+	defer cancel()
+	return c.Shutdown(ctx)
+}
+
+// isDraining reports whether Shutdown has been requested.
+func (c *Client) isDraining() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.draining
+}
+
+// trackConnection registers a new in-flight proxied connection from visitor,
+// which may be empty if the server does not report it. It returns nil
+// if the client is shutting down and the connection must not be started.
+func (c *Client) trackConnection(id uuid.UUID, visitor string) *proxyConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.draining {
+		return nil
+	}
+	pc := newProxyConn(id, visitor)
+	c.conns[id] = pc
+	c.totals.conns.Add(1)
+	c.wg.Add(1)
+	return pc
+}
+
+// untrackConnection removes a finished proxied connection from the registry and
+// adds its counters to the totals.
+func (c *Client) untrackConnection(pc *proxyConn) {
+	c.mu.Lock()
+	delete(c.conns, pc.id)
+	c.totals.in.Add(pc.in.Load())
+	c.totals.out.Add(pc.out.Load())
+	c.mu.Unlock()
+	c.wg.Done()
+}
+
+// connectionInfosLocked returns a snapshot of the in-flight proxied connections,
+// oldest first. c.mu must be held.
+func (c *Client) connectionInfosLocked() []ConnectionInfo {
+	infos := make([]ConnectionInfo, 0, len(c.conns))
+	for _, pc := range c.conns {
+		infos = append(infos, pc.info())
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Started.Before(infos[j].Started)
+	})
+	return infos
+}
+
 // processServerMessage processes a server message received by the client.
 // Depending on the message type, it performs different actions:
 //
 //   - MtHello: Prints an unexpected hello message.
 //   - MtChallenge: Prints an unexpected challenge message.
-//   - MtHeartbeat: Does nothing.
+//   - MtHeartbeat: Pings the systemd watchdog, if any, and measures the round-trip time.
 //   - MtConnection: Establishes a connection with the server in a separate goroutine using the received connection ID.
 //     If the connection is established successfully, it prints "Connection closed gracefully" when it's closed.
 //     If there is an error, it prints "Connection exited with error: <error>".
-//   - MtError: Returns an error with the server error message.
-//   - Default: Returns an error with the unexpected message type.
+//     The request is ignored once the client is shutting down, and rejected
+//     without spawning a goroutine if the client is paused, the access control
+//     lists deny the visitor, a traffic quota is used up or neither a
+//     connection slot nor a place in the queue is free; a queued request is
+//     rejected if no slot becomes free within the queue timeout. A panic in
+//     the goroutine releases the public port before crashing the process.
+//   - MtError: An error about a single connection, identified by msg.Connection,
+//     aborts that connection and is reported to OnError. Any other error is
+//     logged and kept and the session goes on; should the server close the
+//     control connection, Listen returns that *ServerError.
+//   - Default: Returns an error with the unexpected message type, unless the
+//     server speaks a newer protocol version, in which case it is ignored.
 //
 // It returns nil if the message is processed successfully.
 func (c *Client) processServerMessage(msg ServerMessage) error {
 	switch msg.Type {
 	case MtHello:
-		log.Println("Received an unexpected hello message")
+		c.logger.Println("Received an unexpected hello message")
 	case MtChallenge:
-		log.Println("Received an unexpected challenge message")
+		c.logger.Println("Received an unexpected challenge message")
 	case MtHeartbeat:
-		// Do nothing
+		if err := sdNotify(sdWatchdog); err != nil {
+			c.logger.Printf("Failed to ping watchdog: %v\n", err)
+		}
+		c.serverErr = nil // The session survived the error reported before.
+		c.onHeartbeat(msg)
 	case MtConnection:
-		id := msg.Connection
-		go func() {
-			if err := c.establishConnectionRoutine(id); err != nil {
-				log.Printf("Connection exited with error: %v\n", err)
-			} else {
-				log.Println("Connection closed gracefully")
-			}
-		}()
+		pc := c.trackConnection(msg.Connection, msg.Visitor)
+		if pc == nil {
+			c.logger.Println("Shutting down, ignoring new connection request")
+			return nil
+		}
+		ticket, err := c.admit(pc)
+		if err != nil {
+			c.traceConnection(pc).end(err)
+			c.rejectConnection(pc, err)
+			c.untrackConnection(pc)
+			return nil
+		}
+		go c.handleConnection(pc, ticket, func() error {
+			return c.establishConnectionRoutine(pc)
+		})
 	case MtError:
-		return fmt.Errorf("server error: %s", msg.Error)
+		c.onServerError(msg)
 	default:
-		return fmt.Errorf("received unexpected message type: %s", msg.Type)
+		if c.serverVersion > ProtocolVersion {
+			c.logger.Printf("Ignoring message of unknown type %s from protocol version %d\n", msg.Type, c.serverVersion)
+			return nil
+		}
+		return fmt.Errorf("%w: received unexpected message type: %s", ErrProtocol, msg.Type)
 	}
 	return nil
 }
 
+// onServerError handles an error message of the server during the session.
+// Errors about a connection only end that connection; other errors do not end
+// the session by themselves, servers close the control connection after a
+// fatal one.
+func (c *Client) onServerError(msg ServerMessage) {
+	serr := newServerError(msg)
+	if msg.Connection != uuid.Nil {
+		c.mu.Lock()
+		pc := c.conns[msg.Connection]
+		c.mu.Unlock()
+		c.logger.Printf("⚠️ Server reported an error on connection %s: %s\n", msg.Connection, msg.Error)
+		if pc != nil {
+			pc.abort("server error: " + msg.Error)
+		}
+		c.hooks.onError(serr)
+		return
+	}
+	c.logger.Printf("⚠️ Server reported an error: %s\n", msg.Error)
+	c.serverErr = serr
+	c.hooks.onError(serr)
+}
+
+// admit decides on the connection request pc: it is rejected if the client is
+// paused, the access control lists deny the visitor, a traffic quota is used
+// up or the connection limit is reached and the queue full. Otherwise admit
+// returns the ticket to wait for a connection slot with, see
+// connLimiter.enter. It does not block, so it is called before the goroutine
+// of the connection is spawned.
+func (c *Client) admit(pc *proxyConn) (*slotTicket, error) {
+	if c.Paused() {
+		c.logger.Println("⏸️ Paused, refusing connection request")
+		return nil, ErrPaused
+	}
+	if !c.admits(pc) {
+		c.totals.denied.Add(1)
+		c.logger.Printf("🚫 Denied connection from %s by access control\n", pc.visitorOrID())
+		return nil, ErrAccessDenied
+	}
+	if err := c.quota.Exceeded(); err != nil {
+		c.logger.Printf("🚫 Rejecting connection request: %v\n", err)
+		return nil, err
+	}
+	ticket, ok := c.slots.enter()
+	if !ok {
+		c.totals.rejected.Add(1)
+		c.logger.Println("⚠️ Too many connections, rejecting connection request")
+		return nil, ErrTooManyConnections
+	}
+	return ticket, nil
+}
+
+// traceConnection starts the root span of the trace of pc, whose children are
+// the phases of the relay, if there is a tracer.
+func (c *Client) traceConnection(pc *proxyConn) *span {
+	pc.span = c.tracer.start("tunnel.connection")
+	pc.span.set("jerusalem.connection.id", pc.id.String())
+	pc.span.set("jerusalem.client_id", c.cid)
+	pc.span.set("jerusalem.remote_port", c.rp)
+	pc.span.set("server.address", c.da)
+	if pc.visitor != "" {
+		pc.span.set("client.address", pc.visitor)
+	}
+	return pc.span
+}
+
+// handleConnection runs the relay of a tracked connection admitted with
+// ticket: it waits for its connection slot, records the connection in the
+// transcript and logs how it ended. A panic releases the public port before
+// crashing the process.
+func (c *Client) handleConnection(pc *proxyConn, ticket *slotTicket, relay func() error) {
+	defer c.releaseOnPanic()
+	defer c.untrackConnection(pc)
+	var err error
+	sp := c.traceConnection(pc)
+	defer func() { sp.end(err) }()
+	if !ticket.wait() {
+		err = ErrTooManyConnections
+		c.totals.rejected.Add(1)
+		c.logger.Println("⚠️ No connection slot became free in time, rejecting connection request")
+		c.rejectConnection(pc, err)
+		return
+	}
+	defer c.slots.release()
+	id := pc.id.String()
+	c.recordTranscript(TranscriptRecord{Event: EvConnectionOpen, Connection: id})
+	c.hooks.onConnectionOpened(pc.info())
+	c.recordAudit(pc, AuditOpen, nil)
+	err = relay()
+	rec := TranscriptRecord{Event: EvConnectionClose, Connection: id, BytesIn: pc.in.Load(), BytesOut: pc.out.Load()}
+	if err != nil {
+		rec.Detail = err.Error()
+		c.logger.Printf("Connection exited with error: %v\n", err)
+		c.hooks.onError(err)
+	} else {
+		c.logger.Println("Connection closed gracefully")
+	}
+	c.recordTranscript(rec)
+	c.recordAudit(pc, AuditClose, err)
+	c.hooks.onConnectionClosed(pc.info(), err)
+}
+
 // establishConnectionRoutine establishes a connection with the server and performs
-// the necessary handshakes for authentication. It then sends an "Accept" message
-// with the provided ID to the server. It also establishes a connection with the
-// local host and sets up bidirectional data transfer between the server and the
-// local host. This function returns an error if any step in the process fails.
-func (c *Client) establishConnectionRoutine(id uuid.UUID) error {
-	conn, err := establishConnectionWithTimeout(c.da, c.sp)
+// the necessary handshakes for authentication, or opens a stream on the
+// multiplexed session. It then sends an "Accept" message
+// with the provided ID to the server. It then hands the connection to serve,
+// which sets up bidirectional data transfer between the server and the local
+// host. If the server accepted compression, the data connection is a zstd
+// stream after the "Accept" message.
+// This function returns an error if any step in the process fails.
+func (c *Client) establishConnectionRoutine(pc *proxyConn) error {
+	handshake := pc.span.child("tunnel.handshake", spanKindClient)
+	rc, err := c.openDataConn(handshake)
+	handshake.end(err)
 	if err != nil {
-		return fmt.Errorf("failed to connect to %s: %w", c.da, err)
+		return err
 	}
-	defer conn.Close()
+	defer rc.Close()
 
-	rc := NewCodec(conn)
-	if c.auth != nil {
-		if _, err := c.auth.PerformClientHandshake(rc, c.cid); err != nil {
-			return fmt.Errorf("client handshake failed: %w", err)
-		}
+	accept := pc.span.child("tunnel.accept", spanKindClient)
+	if err := rc.Send(ClientMessage{Type: "Accept", Accept: pc.id}); err != nil {
+		err = fmt.Errorf("failed to send accept message: %w", err)
+		accept.end(err)
+		return err
 	}
 
-	if err := rc.Send(ClientMessage{Type: "Accept", Accept: id}); err != nil {
-		return fmt.Errorf("failed to send accept message: %w", err)
+	remote, err := c.wrapPipeline(rc.conn, true)
+	accept.end(err)
+	defer remote.Close()
+	if err != nil {
+		return err
 	}
 
-	lconn, err := establishConnectionWithTimeout(c.lh, c.lp)
+	dst := netip.AddrPortFrom(tcpAddrPort(rc.conn.RemoteAddr()).Addr(), c.rp)
+	return c.serve(pc, remote, dst)
+}
+
+// serve relays the visitor connection remote, which was made to dst, to the
+// local host. In maintenance mode the local host is not contacted and the
+// visitor is answered by serveMaintenance instead; likewise the visitor is
+// turned away while the local service is failing its health check, if the
+// health check is configured to reject. If enabled, a PROXY protocol header
+// carrying the visitor's address is sent to the local host first.
+// The bytes relayed in each direction are counted on pc and throttled by the
+// tunnel and per-connection bandwidth limits.
+func (c *Client) serve(pc *proxyConn, remote net.Conn, dst netip.AddrPort) error {
+	if enabled, page := c.maintenanceState(); enabled {
+		return serveMaintenance(remote, page)
+	}
+	if reject, page := c.rejectWhileDegraded(); reject {
+		return serveErrorPage(remote, http.StatusBadGateway, page)
+	}
+
+	lh, lp := c.LocalTarget()
+	dial := pc.span.child("tunnel.local_dial", spanKindClient)
+	dial.set("server.address", lh)
+	dial.set("server.port", lp)
+	lconn, err := c.dialLocal(pc, lh, lp)
 	if err != nil {
-		return fmt.Errorf("failed to connect to local host %s:%d: %w", c.lh, c.lp, err)
+		err = fmt.Errorf("%w: failed to connect to local host %s:%d: %w", ErrLocalUnreachable, lh, lp, err)
+		dial.end(err)
+		return err
 	}
+	dial.end(nil)
 	defer lconn.Close()
+	c.tuneConn(lconn)
+	pc.setCloser(func() {
+		remote.Close()
+		lconn.Close()
+	})
 
+	if version := c.proxyProtocolVersion(); version != "" {
+		if err := sendProxyHeader(version, lconn, pc.visitor, dst); err != nil {
+			return err
+		}
+	}
+
+	// Each direction is half-closed when it ends; the connections are closed
+	// once both have ended, or at once if one fails.
+	abort := func() {
+		remote.Close()
+		lconn.Close()
+	}
+	relay := pc.span.child("tunnel.relay", spanKindInternal)
 	eg := new(errgroup.Group)
 	eg.Go(func() error {
-		_, err := io.Copy(lconn, rc.conn)
-		return err
+		return c.relayOneWay(&countingWriter{w: lconn, n: &pc.in, pc: pc, quota: c.quota, pin: c.pinThreads}, lconn, remote, abort)
 	})
 	eg.Go(func() error {
-		_, err := io.Copy(rc.conn, lconn)
-		return err
+		return c.relayOneWay(&countingWriter{w: remote, n: &pc.out, pc: pc, quota: c.quota, pin: c.pinThreads}, remote, lconn, abort)
 	})
 
-	if err := eg.Wait(); err != nil {
-		return fmt.Errorf("data transfer failed: %w", err)
+	err = eg.Wait()
+	relay.set("jerusalem.bytes_in", pc.in.Load())
+	relay.set("jerusalem.bytes_out", pc.out.Load())
+	if err != nil {
+		err = fmt.Errorf("data transfer failed: %w", err)
 	}
-	return nil
+	relay.end(err)
+	return err
+}
+
+// recordTranscript appends rec to the session transcript, if one is configured.
+func (c *Client) recordTranscript(rec TranscriptRecord) {
+	if err := c.transcript.Record(rec); err != nil {
+		c.logger.Printf("Failed to write transcript: %v\n", err)
+	}
+}
+
+// openDataConn returns a new authenticated data connection to the server, on
+// which the "Accept" message for a visitor can be sent. It is a stream of the
+// multiplexed session if the server supports multiplexing, an idle connection
+// from the pool if there is one, and a new TCP connection otherwise; which one
+// is recorded on sp.
+func (c *Client) openDataConn(sp *span) (*Codec, error) {
+	if c.muxed {
+		sp.set("jerusalem.data_conn", "stream")
+		return c.openStream()
+	}
+	if c.pool != nil {
+		if rc := c.pool.take(); rc != nil {
+			sp.set("jerusalem.data_conn", "pooled")
+			c.totals.pooled.Add(1)
+			return rc, nil
+		}
+	}
+	sp.set("jerusalem.data_conn", "dialed")
+	return c.dialServer()
+}
+
+// dialServer opens a new TCP connection to the server and authenticates it,
+// with the session token issued by the server if there is one. The time this
+// takes is added to the handshake statistics.
+func (c *Client) dialServer() (*Codec, error) {
+	start := time.Now()
+	conn, err := c.dial(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", c.da, err)
+	}
+
+	rc := NewCodec(conn)
+	if auth := c.authenticator(); auth != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeouts.handshake())
+		defer cancel()
+		if rc, err = c.authenticateData(ctx, auth, rc); err != nil {
+			return nil, fmt.Errorf("client handshake failed: %w", err)
+		}
+	}
+	c.totals.handshakes.Add(1)
+	c.totals.handshakeTime.Add(int64(time.Since(start)))
+	return rc, nil
 }
 
-// establishConnectionWithTimeout establishes a TCP connection to the specified address (host:port) with a timeout of 30 seconds.
+// establishConnectionWithTimeout establishes a TCP connection to the specified address (host:port) within
+// defaultDialTimeout; the dial-timeout setting only bounds dialing the server, see Timeouts.
+// host may be a name, an IPv4 address or an IPv6 address; a name with addresses of both IP families is dialed
+// over the family prefer first, if set, racing the other one as in Happy Eyeballs. The dial is abandoned when ctx ends.
 // It returns a net.Conn object representing the established connection and an error if connection establishment fails.
-func establishConnectionWithTimeout(host string, port uint16) (net.Conn, error) {
-	address := fmt.Sprintf("%s:%d", host, port)
-	conn, err := net.DialTimeout("tcp", address, networkTimeout)
+func establishConnectionWithTimeout(ctx context.Context, host string, port uint16, prefer string) (net.Conn, error) {
+	address := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	d := preferFamily(&net.Dialer{Timeout: defaultDialTimeout}, prefer)
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to %s: %w", address, err)
+	}
+	return conn, nil
+}
+
+// dial opens a connection to the server with the configured dialer, giving up
+// when ctx ends or the dial timeout expires. With WithTLS, the TLS handshake
+// is part of it.
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeouts.dial())
+	defer cancel()
+
+	address := c.ServerAddr()
+	conn, err := c.serverDialer().DialContext(ctx, "tcp", address)
 	if err != nil {
 		return nil, fmt.Errorf("could not connect to %s: %w", address, err)
 	}
+	c.tuneConn(conn)
+	if c.tls != nil {
+		return startTLS(ctx, conn, c.tls)
+	}
 	return conn, nil
 }
 
+// serverDialer returns the dialer of server connections: the one set with
+// WithDialer or a net.Dialer, bound to the address set with WithBindAddress,
+// preferring the IP family set with WithPreferredIPFamily and with TCP Fast
+// Open enabled if requested and the dialer is a net.Dialer.
+func (c *Client) serverDialer() Dialer {
+	d := &net.Dialer{}
+	switch cd := c.dialer.(type) {
+	case nil:
+	case *net.Dialer:
+		copied := *cd
+		d = &copied
+	default:
+		return cd
+	}
+	if c.bindAddr != nil {
+		d.LocalAddr = &net.TCPAddr{IP: c.bindAddr}
+	}
+	if c.fastOpen {
+		control := d.Control
+		d.Control = func(network, address string, rc syscall.RawConn) error {
+			if control != nil {
+				if err := control(network, address, rc); err != nil {
+					return err
+				}
+			}
+			return fastOpenControl(network, address, rc)
+		}
+	}
+	return preferFamily(d, c.preferIP)
+}
+
 // processInitialServerMessage processes the initial server message and handles different message types.
 // It takes a ServerMessage as input and returns the remote port if the message type is MtHello.
-// If the message type is MtError, it returns an error message with the server error.
-// If the message type is MtChallenge, it returns an error indicating that the server requires authentication but no client secret was provided.
-// For any other message type, it returns an error message with the unexpected message type.
+// If the message type is MtError, it returns a *ServerError with the server error.
+// If the message type is MtChallenge, it returns an ErrAuthFailed error indicating that the server requires authentication but no client secret was provided.
+// For any other message type, it returns an ErrProtocol error with the unexpected message type.
 // The function returns both the remote port and an error, if any.
 func processInitialServerMessage(msg ServerMessage) (uint16, error) {
 	var rp uint16
@@ -247,11 +1053,11 @@ func processInitialServerMessage(msg ServerMessage) (uint16, error) {
 	case MtHello:
 		rp = msg.Port
 	case MtError:
-		return 0, fmt.Errorf("server error: %s", msg.Error)
+		return 0, newServerError(msg)
 	case MtChallenge:
-		return 0, errors.New("server requires authentication, but no client secret was provided")
+		return 0, fmt.Errorf("%w: server requires authentication, but no client secret was provided", ErrAuthFailed)
 	default:
-		return 0, fmt.Errorf("unexpected initial non-hello message of type: %s", msg.Type)
+		return 0, fmt.Errorf("%w: unexpected initial non-hello message of type: %s", ErrProtocol, msg.Type)
 	}
 	return rp, nil
 }
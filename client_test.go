@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"client/tunneltest"
+
+	"github.com/google/uuid"
+)
+
+// testTimeout bounds every wait of the tests on the network.
+const testTimeout = 5 * time.Second
+
+// startEcho starts a local service that echoes what it receives and returns
+// its port.
+func startEcho(t testing.TB) uint16 {
+	return startService(t, func(conn net.Conn) { _, _ = io.Copy(conn, conn) })
+}
+
+// startService starts a local service that serves each connection with serve
+// and then closes it, and returns its port.
+func startService(t testing.TB, serve func(conn net.Conn)) uint16 {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serve(conn)
+			}()
+		}
+	}()
+	return uint16(ln.Addr().(*net.TCPAddr).Port)
+}
+
+// connect connects a client to srv that forwards to a new echo service and
+// listens until the test ends.
+func connect(t testing.TB, srv *tunneltest.Server, opts ...Option) *Client {
+	t.Helper()
+	opts = append([]Option{WithLocalTarget("127.0.0.1", startEcho(t)), WithClientID("test"),
+		WithoutSpinner(), WithLogger(log.New(io.Discard, "", 0))}, opts...)
+	c, err := NewClient(srv.Addr(), opts...)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- c.Listen() }()
+	t.Cleanup(func() {
+		c.Close()
+		<-done
+	})
+	return c
+}
+
+// newServer starts a server with newServer, closed when the test ends.
+func newServer(t testing.TB, newServer func() (*tunneltest.Server, error)) *tunneltest.Server {
+	t.Helper()
+	srv, err := newServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	return srv
+}
+
+// visit connects a visitor to the tunnel of c.
+func visit(t testing.TB, srv *tunneltest.Server, c *Client) net.Conn {
+	t.Helper()
+	conn, err := srv.DialVisitor(c.RemotePort())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(testTimeout))
+	return conn
+}
+
+// echo checks that msg sent on conn comes back.
+func echo(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(buf) != msg {
+		t.Fatalf("got %q back, want %q", buf, msg)
+	}
+}
+
+func TestSecretAuthentication(t *testing.T) {
+	srv := newServer(t, func() (*tunneltest.Server, error) { return tunneltest.NewServer("secret") })
+	c := connect(t, srv, WithSecret("secret"), WithLabel("web"))
+	tunnels := srv.Tunnels()
+	if len(tunnels) != 1 || tunnels[0].Port != c.RemotePort() || tunnels[0].ClientID != "test" || tunnels[0].Label != "web" {
+		t.Fatalf("server has tunnels %+v, want one on port %d", tunnels, c.RemotePort())
+	}
+	echo(t, visit(t, srv, c), "hello")
+}
+
+func TestWrongSecret(t *testing.T) {
+	srv := newServer(t, func() (*tunneltest.Server, error) { return tunneltest.NewServer("secret") })
+	_, err := NewClient(srv.Addr(), WithSecret("wrong"), WithClientID("test"), WithoutSpinner(),
+		WithLogger(log.New(io.Discard, "", 0)))
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("got %v, want ErrAuthFailed", err)
+	}
+}
+
+func TestKeyAuthentication(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(t, func() (*tunneltest.Server, error) { return tunneltest.NewKeyServer(pub) })
+	c := connect(t, srv, WithPrivateKey(priv))
+	echo(t, visit(t, srv, c), "signed")
+
+	_, other, _ := ed25519.GenerateKey(nil)
+	if _, err := NewClient(srv.Addr(), WithPrivateKey(other), WithoutSpinner(), WithLogger(log.New(io.Discard, "", 0))); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("unknown key: got %v, want ErrAuthFailed", err)
+	}
+}
+
+func TestTokenAuthentication(t *testing.T) {
+	srv := newServer(t, func() (*tunneltest.Server, error) {
+		return tunneltest.NewTokenServer(func(token string) bool { return token == "access-token" })
+	})
+	c := connect(t, srv, WithToken(func(context.Context) (string, error) { return "access-token", nil }))
+	echo(t, visit(t, srv, c), "token")
+}
+
+func TestSessionAuthentication(t *testing.T) {
+	srv := newServer(t, func() (*tunneltest.Server, error) { return tunneltest.NewServer("secret") })
+	srv.SessionTTL = time.Minute
+	c := connect(t, srv, WithSecret("secret"))
+	for range 3 {
+		echo(t, visit(t, srv, c), "session")
+	}
+	if n := srv.SessionAuthentications(); n != 3 {
+		t.Fatalf("%d data connections authenticated with the session token, want 3", n)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	srv := newServer(t, func() (*tunneltest.Server, error) { return tunneltest.NewServer("secret") })
+	srv.Compression = true
+	c := connect(t, srv, WithSecret("secret"), WithCompression(ZstdCompression))
+	if !c.compressed {
+		t.Fatal("the server accepted compression, but the client does not compress")
+	}
+	echo(t, visit(t, srv, c), "compressed")
+}
+
+func TestMultiplexing(t *testing.T) {
+	srv := newServer(t, func() (*tunneltest.Server, error) { return tunneltest.NewServer("secret") })
+	srv.Multiplex = true
+	srv.Compression = true
+	c := connect(t, srv, WithSecret("secret"), WithMultiplexing(), WithCompression(ZstdCompression))
+	if !c.muxed {
+		t.Fatal("the server accepted multiplexing, but the client does not multiplex")
+	}
+	a, b := visit(t, srv, c), visit(t, srv, c)
+	echo(t, a, "first")
+	echo(t, b, "second")
+	echo(t, a, "again")
+}
+
+func TestEncryptingStages(t *testing.T) {
+	for _, tc := range []struct {
+		stage   string
+		options []Option
+		peer    *Client // Applies the stage on the visitor side.
+	}{
+		{AESGCMStage, nil, &Client{auth: NewAuthenticator("secret")}},
+		{AESGCMStage, []Option{WithPipelineSecret("pipe")}, &Client{pipelineSecret: []byte("pipe")}},
+		{ChaCha20Stage, nil, &Client{auth: NewAuthenticator("secret")}},
+		{ChecksumStage, nil, &Client{}},
+	} {
+		t.Run(tc.stage, func(t *testing.T) {
+			srv := newServer(t, func() (*tunneltest.Server, error) { return tunneltest.NewServer("secret") })
+			opts := append([]Option{WithSecret("secret"), WithPipeline(RateLimitStage, tc.stage)}, tc.options...)
+			c := connect(t, srv, opts...)
+			stage, err := resolvePipeline([]string{tc.stage})
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := stage[0].Wrap(tc.peer, visit(t, srv, c))
+			if err != nil {
+				t.Fatal(err)
+			}
+			echo(t, conn, "end to end")
+		})
+	}
+}
+
+func TestEncryptionNeedsKey(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(nil)
+	c := &Client{auth: NewKeyAuthenticator(priv)}
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if _, err := aesGCMStage(c, a); err == nil {
+		t.Fatal("aes-gcm set up without key material")
+	}
+}
+
+func TestMaxConnectionsRejects(t *testing.T) {
+	srv := newServer(t, func() (*tunneltest.Server, error) { return tunneltest.NewServer("secret") })
+	c := connect(t, srv, WithSecret("secret"), WithMaxConnections(1, 0))
+	first := visit(t, srv, c)
+	echo(t, first, "holds the slot")
+
+	second := visit(t, srv, c)
+	if n, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("second visitor read %d, %v, want EOF as it was rejected", n, err)
+	}
+	if got := c.Stats().Rejected; got != 1 {
+		t.Fatalf("%d connections rejected, want 1", got)
+	}
+}
+
+func TestPausedRejects(t *testing.T) {
+	srv := newServer(t, func() (*tunneltest.Server, error) { return tunneltest.NewServer("secret") })
+	c := connect(t, srv, WithSecret("secret"))
+	c.SetPaused(true)
+	if n, err := visit(t, srv, c).Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("visitor read %d, %v while paused, want EOF", n, err)
+	}
+	c.SetPaused(false)
+	echo(t, visit(t, srv, c), "resumed")
+}
+
+func TestForgedAcceptance(t *testing.T) {
+	// A relay sees the nonce in clear but cannot prove knowing the secret.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		enc, dec := json.NewEncoder(conn), json.NewDecoder(conn)
+		_ = enc.Encode(ServerMessage{Type: MtChallenge, Challenge: uuid.New(), Capabilities: []string{NonceCapability}})
+		var auth ClientMessage
+		_ = dec.Decode(&auth)
+		_ = enc.Encode(map[string]any{"type": MtFreePort, "hello": 4000, "nonce": auth.Nonce, "timestamp": auth.Timestamp})
+	}()
+	_, err = NewClient(ln.Addr().String(), WithSecret("secret"), WithoutSpinner(), WithLogger(log.New(io.Discard, "", 0)))
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("got %v, want ErrAuthFailed", err)
+	}
+}
+
+// BenchmarkRelay measures the throughput of one visitor uploading to a local
+// service through the tunnel, with the copy loops running freely, locked to
+// their OS threads once busy (lock-os-thread) and, where supported, spliced.
+func BenchmarkRelay(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		opts []Option
+	}{
+		{"copy", []Option{WithoutSplice()}},
+		{"lock-os-thread", []Option{WithoutSplice(), WithOSThreadPinning()}},
+		{"splice", nil},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			srv := newServer(b, func() (*tunneltest.Server, error) { return tunneltest.NewServer("secret") })
+			sink := startService(b, func(conn net.Conn) { _, _ = io.Copy(io.Discard, conn) })
+			c := connect(b, srv, append([]Option{WithSecret("secret"), WithLocalTarget("127.0.0.1", sink)}, bc.opts...)...)
+			conn := visit(b, srv, c)
+			_ = conn.SetDeadline(time.Time{})
+			chunk := make([]byte, 256<<10)
+			b.SetBytes(int64(len(chunk)))
+			b.ResetTimer()
+			for range b.N {
+				if _, err := conn.Write(chunk); err != nil {
+					b.Fatal(err)
+				}
+			}
+			// The sink closes once it has read everything.
+			if err := conn.(interface{ CloseWrite() error }).CloseWrite(); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := io.Copy(io.Discard, conn); err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
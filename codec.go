@@ -1,9 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -37,6 +42,12 @@ type Codec struct {
 	decoder *json.Decoder
 	encoder *json.Encoder
 	conn    net.Conn
+	binary  *msgpackFraming // Set once the connection has switched to MessagePack.
+	faults  *faultInjector  // Tampers with received messages, for testing.
+
+	readTimeout  time.Duration // Deadline of receiving each message, if set.
+	writeTimeout time.Duration // Deadline of sending each message, if set.
+	sendMu       sync.Mutex    // Serialises Send, which several goroutines call.
 }
 
 // NewCodec creates a new instance of the Codec struct using the provided net.Conn connection.
@@ -54,12 +65,18 @@ func NewCodec(conn net.Conn) *Codec {
 // Recv reads a message from the codec's decoder and assigns it to the provided variable.
 // It uses a separate goroutine to decode the message, so it can be cancelled using the provided context.
 // If the context is cancelled, Recv returns the context error.
-// If decoding the message fails, Recv returns the decoding error.
+// If decoding the message fails, Recv returns the decoding error; a panic while
+// decoding a malformed message is returned as an error as well.
+// A context that can never be cancelled, such as the one of the control loop,
+// decodes on the calling goroutine and so does not allocate per message.
 // Usage example: st.Recv(ctx, &msg)
 func (d *Codec) Recv(ctx context.Context, v interface{}) error {
+	if ctx.Done() == nil {
+		return d.decode(v)
+	}
 	errChan := make(chan error, 1)
 	go func() {
-		errChan <- d.decoder.Decode(v)
+		errChan <- d.decode(v)
 	}()
 	select {
 	case <-ctx.Done():
@@ -69,6 +86,34 @@ func (d *Codec) Recv(ctx context.Context, v interface{}) error {
 	}
 }
 
+// decode reads the next message into v, turning a panic into an error. Malformed
+// messages are reported as ErrProtocol.
+func (d *Codec) decode(v interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: failed to decode message: %v", ErrProtocol, r)
+		} else if err == nil {
+			debugging.Load().message("received", d.conn, v)
+		}
+	}()
+	if d.readTimeout > 0 {
+		_ = d.conn.SetReadDeadline(time.Now().Add(d.readTimeout))
+	}
+	if d.faults != nil {
+		return d.decodeWithFaults(v)
+	}
+	if d.binary != nil {
+		return d.binary.decode(v)
+	}
+	err = d.decoder.Decode(v)
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+		return fmt.Errorf("%w: failed to decode message: %w", ErrProtocol, err)
+	}
+	return err
+}
+
 func (d *Codec) RecvTimeout(v interface{}) error {
 	ctx, cancel := context.WithTimeout(context.Background(), NetworkTimeout)
 	defer cancel()
@@ -76,11 +121,31 @@ func (d *Codec) RecvTimeout(v interface{}) error {
 }
 
 // Send sends the given value to the remote connection using the encoder of the Codec.
-// It returns an error if the encoding process fails.
+// It returns an error if the encoding process fails. It is safe to call Send
+// from several goroutines.
 func (d *Codec) Send(v interface{}) error {
+	d.sendMu.Lock()
+	defer d.sendMu.Unlock()
+	debugging.Load().message("sent", d.conn, v)
+	if d.writeTimeout > 0 {
+		_ = d.conn.SetWriteDeadline(time.Now().Add(d.writeTimeout))
+	}
+	if d.binary != nil {
+		return d.binary.encode(v)
+	}
 	return d.encoder.Encode(v)
 }
 
+// remainder returns a reader of the data the codec has not consumed yet: the
+// bytes the JSON decoder buffered past the last message, without the newline
+// that terminates every message, followed by the connection. It is used when
+// the connection switches to another protocol.
+func (d *Codec) remainder() io.Reader {
+	rest, _ := io.ReadAll(d.decoder.Buffered())
+	rest = bytes.TrimLeft(rest, " \t\r\n")
+	return io.MultiReader(bytes.NewReader(rest), d.conn)
+}
+
 // Close closes the underlying network connection of the Codec and releases any resources associated with it.
 // It returns an error if there was a problem closing the connection.
 func (d *Codec) Close() error {
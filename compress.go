@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ZstdCompression is the capability offered in the hello message to compress
+// data connections with zstd.
+const ZstdCompression = "zstd"
+
+// zstdConn compresses everything written to a data connection and decompresses
+// everything read from it. Each Write is flushed immediately, so interactive
+// protocols are not delayed waiting for a full compression block.
+// The relay reads and writes from other goroutines than the one closing the
+// connection, so the streams are guarded: neither may be used once closed.
+type zstdConn struct {
+	net.Conn
+	wmu    sync.Mutex // Guards enc.
+	enc    *zstd.Encoder
+	rmu    sync.Mutex // Guards dec; wmu and rmu guard closed.
+	dec    *zstd.Decoder
+	closed bool
+}
+
+// newZstdConn wraps conn in a zstd stream in each direction.
+func newZstdConn(conn net.Conn) (*zstdConn, error) {
+	enc, err := zstd.NewWriter(conn, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd encoder: %w", err)
+	}
+	dec, err := zstd.NewReader(conn, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		enc.Close()
+		return nil, fmt.Errorf("failed to create zstd decoder: %w", err)
+	}
+	return &zstdConn{Conn: conn, enc: enc, dec: dec}, nil
+}
+
+func (zc *zstdConn) Read(p []byte) (int, error) {
+	zc.rmu.Lock()
+	defer zc.rmu.Unlock()
+	if zc.closed {
+		return 0, net.ErrClosed
+	}
+	return zc.dec.Read(p)
+}
+
+func (zc *zstdConn) Write(p []byte) (int, error) {
+	zc.wmu.Lock()
+	defer zc.wmu.Unlock()
+	if zc.closed {
+		return 0, net.ErrClosed
+	}
+	n, err := zc.enc.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, zc.enc.Flush()
+}
+
+// CloseWrite ends the compressed stream and half-closes the underlying
+// connection, so the peer decodes everything written before it reads EOF.
+func (zc *zstdConn) CloseWrite() error {
+	zc.wmu.Lock()
+	defer zc.wmu.Unlock()
+	if err := zc.enc.Close(); err != nil {
+		return err
+	}
+	return closeWrite(zc.Conn)
+}
+
+// Close closes the underlying connection, which makes a Read or Write in
+// progress return, and then releases the streams. Unlike CloseWrite it does
+// not end the compressed stream first, as that could block on a peer that
+// stopped reading.
+func (zc *zstdConn) Close() error {
+	err := zc.Conn.Close()
+	zc.wmu.Lock()
+	defer zc.wmu.Unlock()
+	zc.rmu.Lock()
+	defer zc.rmu.Unlock()
+	if !zc.closed {
+		zc.closed = true
+		_ = zc.enc.Close()
+		zc.dec.Close()
+	}
+	return err
+}
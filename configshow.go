@@ -0,0 +1,148 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/viper"
+)
+
+// redacted replaces the values of secret keys in the output of `config show`.
+const redacted = "<redacted>"
+
+// extraConfigKeys are the config keys that have no flag, because their values
+// are secrets or rarely needed, but are shown by `config show` as well.
+var extraConfigKeys = []string{"vault-namespace", "vault-token", "vault-secret-id",
+	"notifications.webhook-url", "notifications.connection-threshold"}
+
+// secretConfigKeys are the config keys whose values `config show` never prints.
+var secretConfigKeys = map[string]bool{
+	"secret-key":           true,
+	"secondary-secret-key": true,
+	"pipeline-secret":      true,
+	"vault-token":          true,
+	"vault-secret-id":      true,
+	"admin-token":          true,
+	// Webhook URLs of chat services carry their token in the path.
+	"notifications.webhook-url": true,
+}
+
+// configDefaults are the values the client uses for keys that are not set.
+var configDefaults = map[string]string{
+	"shutdown-timeout":       defaultShutdownTimeout.String(),
+	"server-selection":       SelectInOrder,
+	"srv-refresh":            defaultSRVRefresh.String(),
+	"dial-timeout":           defaultDialTimeout.String(),
+	"handshake-timeout":      NetworkTimeout.String(),
+	"reconnect-delay":        defaultReconnectDelay.String(),
+	"reconnect-max-delay":    defaultReconnectMaxDelay.String(),
+	"reconnect-max-attempts": "0",
+	"auth-retry-cooldown":    "0s",
+	"log-timezone":           "UTC",
+	"log-max-size":           "100MB",
+	"log-max-backups":        strconv.Itoa(defaultLogMaxBackups),
+	"max-connections":        "0",
+	"health-check-path":      "/",
+	"health-check-interval":  defaultHealthCheckInterval.String(),
+	"inject-faults":          "0",
+	"inject-faults-delay":    defaultFaultDelay.String(),
+	"codec":                  "json",
+	"relay-buffer-size":      "32KiB",
+	"data-pool-size":         "0",
+	"data-pool-max-idle":     defaultDataPoolMaxIdle.String(),
+	"tcp-keepalive":          "15s",
+	"tcp-nodelay":            "true",
+	"pipeline":               strings.Join(defaultPipeline, ","),
+	"control-socket":         defaultControlSocket,
+	"trace-sample-ratio":     "1",
+}
+
+// configCommand implements `config show [--resolved] [flags] [config]`, which
+// prints the keys set in the config file, or with --resolved the configuration
+// the client would run with after merging the file, the selected profile,
+// environment variables, flags and defaults, each annotated with its source.
+// Secret values are redacted. It does not contact the server or Vault.
+func configCommand(args []string) {
+	if len(args) == 0 || args[0] != "show" {
+		log.Fatalf("❌ Usage: config show [--resolved] [--config file] [flags] [config]")
+	}
+	fs := flag.NewFlagSet("config show", flag.ExitOnError)
+	configPath := fs.String("config", "", "config file (.yaml, .toml or .json)")
+	resolved := fs.Bool("resolved", false, "show the merged configuration including environment, flags and defaults")
+	registerConfigFlags(fs)
+	_ = fs.Parse(args[1:])
+
+	configFile := *configPath
+	if configFile == "" && fs.NArg() > 0 {
+		configFile = fs.Arg(0)
+	}
+	flags := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		flags[f.Name] = true
+	})
+	applyConfigFlags(fs)
+	if err := readConfigFile(configFile); err != nil {
+		configFatalf("❌ Failed to read config file: %v", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tVALUE\tSOURCE")
+	for _, key := range configKeys() {
+		value, source := configValue(key, flags)
+		if source == "" || !*resolved && source != "file" && !strings.HasPrefix(source, "profile") {
+			continue
+		}
+		if secretConfigKeys[key] && !strings.HasPrefix(value, vaultScheme) {
+			value = redacted
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", key, value, source)
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatalf("❌ Failed to print config: %v", err)
+	}
+}
+
+// configKeys returns all config keys in the order of configFlags.
+func configKeys() []string {
+	keys := make([]string, 0, len(configFlags)+len(extraConfigKeys))
+	for _, f := range configFlags {
+		keys = append(keys, f.key)
+	}
+	return append(keys, extraConfigKeys...)
+}
+
+// configValue returns the effective value of key and where it comes from: a
+// flag, an environment variable, the selected profile, the config file or the
+// defaults, in the order viper gives them precedence. The source is empty if
+// the key is not set and has no default. A secret key without a value of its
+// own is reported as coming from secret-key-file if that is set.
+func configValue(key string, flags map[string]bool) (value, source string) {
+	value = viper.GetString(key)
+	if _, ok := viper.Get(key).([]interface{}); ok {
+		value = strings.Join(viper.GetStringSlice(key), ",")
+	}
+	env := envPrefix + "_" + strings.ToUpper(envKeyReplacer.Replace(key))
+	profile := viper.GetString("profile")
+	switch {
+	case flags[key]:
+		source = "flag --" + key
+	case os.Getenv(env) != "":
+		source = "env " + env
+	case profile != "" && viper.Get("profiles."+profile+"."+key) != nil:
+		source = "profile " + profile
+	case viper.InConfig(key):
+		source = "file"
+	case key == "secret-key" && viper.GetString("secret-key-file") != "":
+		value, source = redacted, "secret-key-file"
+	default:
+		if def, ok := configDefaults[key]; ok {
+			value, source = def, "default"
+		}
+	}
+	return value, source
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// connLimiter caps the number of proxied connections relayed at once. Requests
+// beyond the cap wait in FIFO order for a free slot; at most as many requests
+// wait as there are slots, further ones are rejected at once. A zero
+// connLimiter does not limit. The cap can be changed while connections are
+// running.
+type connLimiter struct {
+	mu      sync.Mutex
+	max     int             // Maximum concurrent connections, 0 for unlimited.
+	timeout time.Duration   // How long a request may wait for a slot, 0 to reject at once.
+	active  int             // Slots currently held.
+	waiters []chan struct{} // Requests waiting for a slot, oldest first.
+}
+
+// slotTicket is a place in the queue of a connLimiter. A nil ticket stands
+// for a slot that is already held.
+type slotTicket struct {
+	l       *connLimiter
+	ch      chan struct{} // Closed when the slot is handed over.
+	timeout time.Duration
+}
+
+// enter takes a free slot or, if there is none, a place in the queue, without
+// blocking, so it can be called before a goroutine is spawned for the
+// request. It reports false if the queue is full too. Otherwise the returned
+// ticket must be waited for, and release called once the connection is done
+// if that obtained a slot.
+func (l *connLimiter) enter() (*slotTicket, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max <= 0 || l.active < l.max {
+		l.active++
+		return nil, true
+	}
+	if l.timeout <= 0 || len(l.waiters) >= l.max {
+		return nil, false
+	}
+	t := &slotTicket{l: l, ch: make(chan struct{}), timeout: l.timeout}
+	l.waiters = append(l.waiters, t.ch)
+	return t, true
+}
+
+// wait waits up to the queue timeout for the slot of the ticket and reports
+// whether it was obtained. It returns true at once for a nil ticket.
+func (t *slotTicket) wait() bool {
+	if t == nil {
+		return true
+	}
+	timer := time.NewTimer(t.timeout)
+	defer timer.Stop()
+	select {
+	case <-t.ch:
+		return true
+	case <-timer.C:
+	}
+
+	l := t.l
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, w := range l.waiters {
+		if w == t.ch {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			return false
+		}
+	}
+	// The slot was handed over just as the timer fired.
+	return true
+}
+
+// release gives a slot back, handing it to the oldest waiter if there is one.
+func (l *connLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	l.grantLocked()
+}
+
+// set changes the cap and the queue timeout. Raising the cap admits waiting
+// requests immediately; lowering it lets running connections finish.
+func (l *connLimiter) set(max int, timeout time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.max = max
+	l.timeout = timeout
+	l.grantLocked()
+}
+
+// grantLocked hands free slots to waiters. l.mu must be held.
+func (l *connLimiter) grantLocked() {
+	for len(l.waiters) > 0 && (l.max <= 0 || l.active < l.max) {
+		l.active++
+		close(l.waiters[0])
+		l.waiters = l.waiters[1:]
+	}
+}
+
+// SetMaxConnections caps the number of proxied connections relayed at once to
+// max, or removes the cap if max is 0. Connection requests beyond the cap wait
+// up to queueTimeout for a free slot, at most max of them at a time, and are
+// rejected after that; with a zero queueTimeout they are rejected immediately.
+// A rejected request is refused to the server, see rejectConnection.
+// It is safe to call SetMaxConnections while the client is listening.
+func (c *Client) SetMaxConnections(max int, queueTimeout time.Duration) {
+	c.slots.set(max, queueTimeout)
+}
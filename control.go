@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// controlSocketOff disables the control socket when set as control-socket.
+	controlSocketOff = "off"
+	// controlTimeout bounds a request on the control socket from both ends.
+	controlTimeout = 5 * time.Second
+)
+
+// defaultControlSocket is where the client opens its control socket and the
+// status command looks for it by default.
+var defaultControlSocket = filepath.Join(os.TempDir(), "jerusalem-client.sock")
+
+// controlSocket is the local socket through which commands such as status
+// query a running client, and pause, resume, maintenance and debug control it. A
+// request is one line naming the command, answered with one line of JSON,
+// after which the connection is closed. Unix sockets
+// are also used on Windows, which supports them since Windows 10.
+type controlSocket struct {
+	ln   net.Listener
+	path string
+	r    *runner
+	done chan struct{}
+}
+
+// statusReport is the answer to the status command of the control socket.
+type statusReport struct {
+	Name              string  `json:"name,omitempty"`
+	State             string  `json:"state"`
+	PID               int     `json:"pid"`
+	Version           string  `json:"version"`
+	ClientID          string  `json:"clientId,omitempty"`
+	Label             string  `json:"label,omitempty"`
+	Server            string  `json:"server,omitempty"`
+	RemotePort        uint16  `json:"remotePort,omitempty"`
+	UptimeSeconds     float64 `json:"uptimeSeconds"`
+	ActiveConnections int     `json:"activeConnections"`
+	TotalConnections  int64   `json:"totalConnections"`
+	Rejected          int64   `json:"rejectedConnections"`
+	BytesIn           int64   `json:"bytesIn"`
+	BytesOut          int64   `json:"bytesOut"`
+	RTTMicroseconds   int64   `json:"rttMicroseconds,omitempty"`
+	Error             string  `json:"error,omitempty"`
+}
+
+// startControlSocket listens on the unix socket at path, answering requests
+// about r until Stop is called. A socket left behind by a client that did not
+// shut down cleanly is replaced, one still in use by another client is not.
+func startControlSocket(path string, r *runner) (*controlSocket, error) {
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("control socket %s is in use by another client", path)
+	}
+	_ = os.Remove(path)
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open control socket: %w", err)
+	}
+	// Only the user running the client may query it.
+	if err := os.Chmod(path, 0o600); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("failed to restrict control socket: %w", err)
+	}
+	s := &controlSocket{ln: ln, path: path, r: r, done: make(chan struct{})}
+	go s.serve()
+	return s, nil
+}
+
+// serve accepts control connections until the listener is closed.
+func (s *controlSocket) serve() {
+	defer close(s.done)
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("⚠️ Control socket stopped: %v", err)
+			}
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+// handle answers the request on conn.
+func (s *controlSocket) handle(conn net.Conn) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(controlTimeout))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+	var reply any
+	switch cmd := strings.TrimSpace(line); cmd {
+	case "status":
+		reply = s.r.status()
+	case "pause", "resume":
+		s.r.setPaused(cmd == "pause")
+		reply = s.r.status()
+	case "maintenance on", "maintenance off":
+		if _, err := s.r.setMaintenance(cmd == "maintenance on"); err != nil {
+			reply = statusReport{Error: err.Error()}
+		} else {
+			reply = s.r.status()
+		}
+	default:
+		if window, ok := strings.CutPrefix(cmd, "debug "); ok {
+			reply = s.debug(window)
+			break
+		}
+		reply = statusReport{Error: fmt.Sprintf("unknown command %q", cmd)}
+	}
+	_ = json.NewEncoder(conn).Encode(reply)
+}
+
+// debug starts a debug capture for window, a duration, answering with where
+// the bundle will be written.
+func (s *controlSocket) debug(window string) debugReport {
+	d, err := time.ParseDuration(window)
+	if err != nil {
+		return debugReport{Error: fmt.Sprintf("invalid debug window %q", window)}
+	}
+	report, err := s.r.startDebug(d)
+	if err != nil {
+		return debugReport{Error: err.Error()}
+	}
+	return report
+}
+
+// Stop closes the control socket and removes it.
+func (s *controlSocket) Stop() {
+	s.ln.Close()
+	<-s.done
+	_ = os.Remove(s.path)
+}
+
+// status returns the status of the tunnel run by r.
+func (r *runner) status() statusReport {
+	r.mu.Lock()
+	clientID, name := r.config.ClientID, r.config.Tunnel
+	r.mu.Unlock()
+	c := r.current()
+	stats := c.Stats()
+	return statusReport{
+		Name:              name,
+		State:             r.state(),
+		PID:               os.Getpid(),
+		Version:           version,
+		ClientID:          clientID,
+		Label:             c.Label(),
+		Server:            c.ServerAddr(),
+		RemotePort:        c.RemotePort(),
+		UptimeSeconds:     stats.Uptime.Seconds(),
+		ActiveConnections: stats.ActiveConnections,
+		TotalConnections:  stats.TotalConnections,
+		Rejected:          stats.Rejected,
+		BytesIn:           stats.BytesIn,
+		BytesOut:          stats.BytesOut,
+		RTTMicroseconds:   stats.RTT.Microseconds(),
+	}
+}
+
+// statuses returns the status of the main tunnel run by r followed by those of
+// the extra tunnels.
+func (r *runner) statuses() []statusReport {
+	reports := []statusReport{r.status()}
+	for _, t := range r.tunnels.runners() {
+		reports = append(reports, t.status())
+	}
+	return reports
+}
+
+// queryControl sends cmd to the client listening on the control socket at path
+// and decodes its answer into reply.
+func queryControl(path, cmd string, reply any) error {
+	conn, err := net.DialTimeout("unix", path, controlTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to control socket: %w", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(controlTimeout))
+	if _, err := fmt.Fprintln(conn, cmd); err != nil {
+		return fmt.Errorf("failed to send %s request: %w", cmd, err)
+	}
+	if err := json.NewDecoder(conn).Decode(reply); err != nil {
+		return fmt.Errorf("failed to read %s reply: %w", cmd, err)
+	}
+	return nil
+}
+
+// statusCommand implements `status [--socket path] [--output json]`, which prints the
+// state, remote port, connections and transfer totals of the client running
+// on the control socket. If no client answers, it falls back to reporting
+// whether a background instance started with --daemon is running, and exits
+// with a non-zero status if none is.
+func statusCommand(args []string) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	socket := fs.String("socket", defaultControlSocket, "control socket of the running client")
+	asJSON := fs.Bool("json", false, "print the status as JSON, like --output json")
+	output := fs.String("output", outputText, "output format: text or json")
+	pidFile := fs.String("pid-file", defaultPidFile, "PID file of the background instance")
+	_ = fs.Parse(args)
+	switch *output {
+	case outputText:
+	case outputJSON:
+		*asJSON = true
+	default:
+		configFatalf("❌ Invalid output %q, use %s or %s", *output, outputText, outputJSON)
+	}
+
+	var report statusReport
+	err := queryControl(*socket, "status", &report)
+	if err == nil && report.Error != "" {
+		err = errors.New(report.Error)
+	}
+	if err != nil {
+		report = statusReport{State: "stopped", Error: err.Error()}
+		if pid, perr := daemonStatus(*pidFile); perr == nil {
+			report = statusReport{State: "running", PID: pid, Error: err.Error()}
+		}
+	}
+
+	if *asJSON {
+		out, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		printStatus(report)
+	}
+	if report.State == "stopped" {
+		os.Exit(1)
+	}
+}
+
+// printStatus prints report for humans.
+func printStatus(report statusReport) {
+	switch report.State {
+	case "stopped":
+		fmt.Printf("⚪ Not running: %s\n", report.Error)
+		return
+	case "running":
+		fmt.Printf("🟢 Running (PID %d), no status available: %s\n", report.PID, report.Error)
+		return
+	case "connected":
+		fmt.Printf("🟢 Connected (PID %d, version %s)\n", report.PID, report.Version)
+	case "paused":
+		fmt.Printf("⏸️ Paused, refusing new connections (PID %d, version %s)\n", report.PID, report.Version)
+	case "reconnecting":
+		fmt.Printf("🔁 Reconnecting (PID %d, version %s)\n", report.PID, report.Version)
+	case "scheduled":
+		fmt.Printf("🌙 Closed until the next schedule window (PID %d, version %s)\n", report.PID, report.Version)
+	case "":
+		fmt.Printf("⚠️ Unknown state (PID %d, version %s)\n", report.PID, report.Version)
+	default:
+		fmt.Printf("⚠️ %s%s (PID %d, version %s)\n", strings.ToUpper(report.State[:1]), report.State[1:], report.PID, report.Version)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if report.Label != "" {
+		fmt.Fprintf(w, "Label:\t%s\n", report.Label)
+	}
+	fmt.Fprintf(w, "Client ID:\t%s\n", report.ClientID)
+	fmt.Fprintf(w, "Server:\t%s\n", report.Server)
+	fmt.Fprintf(w, "Remote port:\t%d\n", report.RemotePort)
+	fmt.Fprintf(w, "Uptime:\t%s\n", time.Duration(report.UptimeSeconds*float64(time.Second)).Round(time.Second))
+	fmt.Fprintf(w, "Connections:\t%d active, %d total, %d rejected\n", report.ActiveConnections, report.TotalConnections, report.Rejected)
+	fmt.Fprintf(w, "Transferred:\t%s in, %s out\n", formatBytes(report.BytesIn), formatBytes(report.BytesOut))
+	if report.RTTMicroseconds > 0 {
+		fmt.Fprintf(w, "RTT:\t%s\n", time.Duration(report.RTTMicroseconds)*time.Microsecond)
+	}
+	_ = w.Flush()
+}
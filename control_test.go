@@ -0,0 +1,31 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPrintStatusStates(t *testing.T) {
+	for state, want := range map[string]string{
+		"":         "⚠️ Unknown state (PID 42",
+		"degraded": "⚠️ Degraded (PID 42",
+		"paused":   "⏸️ Paused",
+	} {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stdout := os.Stdout
+		os.Stdout = w
+		printStatus(statusReport{State: state, PID: 42, Version: "test"})
+		os.Stdout = stdout
+		w.Close()
+		out, _ := io.ReadAll(r)
+		r.Close()
+		if !strings.HasPrefix(string(out), want) {
+			t.Errorf("state %q: got %q, want it to start with %q", state, out, want)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// daemonEnv marks a process that was started by startDaemon, so it does not fork again.
+	daemonEnv = "JERUSALEM_DAEMON_CHILD"
+	// readyFileEnv names the file a detached child writes once its tunnel is up.
+	// It must not be the variable of a config key: JERUSALEM_READY_FILE would
+	// make the child write its ready file there as well, in another format.
+	readyFileEnv = "JERUSALEM_DETACH_READY_FILE"
+	// detachTimeout bounds how long --detach waits for the tunnel to come up.
+	detachTimeout = 2 * time.Minute
+)
+
+var (
+	defaultPidFile   = filepath.Join(os.TempDir(), "jerusalem-client.pid")
+	defaultDaemonLog = filepath.Join(os.TempDir(), "jerusalem-client.log")
+)
+
+// isDaemonChild reports whether the current process is the background copy
+// started by startDaemon.
+func isDaemonChild() bool {
+	return os.Getenv(daemonEnv) == "1"
+}
+
+// startDaemon re-executes the current binary with the same arguments in the
+// background, detached from the terminal, with stdout and stderr redirected to
+// logFile. It returns the PID of the background process.
+// If wait is set, startDaemon only returns once the background process reports
+// that its tunnel is established, returning the remote port as well, or fails
+// if the process exits or does not become ready within detachTimeout.
+func startDaemon(logFile string, wait bool) (pid int, port string, err error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to locate executable: %w", err)
+	}
+
+	out, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to open log file %s: %w", logFile, err)
+	}
+	defer out.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.SysProcAttr = detachedProcAttr()
+
+	var readyFile string
+	if wait {
+		readyFile = filepath.Join(os.TempDir(), fmt.Sprintf("jerusalem-ready-%d-%d", os.Getpid(), time.Now().UnixNano()))
+		cmd.Env = append(cmd.Env, readyFileEnv+"="+readyFile)
+		defer os.Remove(readyFile)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return 0, "", fmt.Errorf("failed to start background process: %w", err)
+	}
+	pid = cmd.Process.Pid
+	if !wait {
+		return pid, "", cmd.Process.Release()
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	deadline := time.After(detachTimeout)
+	for {
+		select {
+		case err := <-exited:
+			return pid, "", fmt.Errorf("background process exited before the tunnel was up (%w), see %s", err, logFile)
+		case <-deadline:
+			return pid, "", fmt.Errorf("tunnel not established after %v, see %s", detachTimeout, logFile)
+		case <-tick.C:
+			if b, err := os.ReadFile(readyFile); err == nil && len(b) > 0 {
+				return pid, strings.TrimSpace(string(b)), nil
+			}
+		}
+	}
+}
+
+// notifyDetachedParent tells the process waiting in startDaemon that the tunnel
+// is established on the given remote port. It is a no-op unless the process was
+// started with --detach.
+func notifyDetachedParent(port uint16) error {
+	readyFile := os.Getenv(readyFileEnv)
+	if readyFile == "" {
+		return nil
+	}
+	return os.WriteFile(readyFile, []byte(strconv.Itoa(int(port))), 0o600)
+}
+
+// writePidFile records the current process ID in path.
+func writePidFile(path string) error {
+	return os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644)
+}
+
+// readPidFile returns the process ID stored in path.
+func readPidFile(path string) (int, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid PID file %s: %w", path, err)
+	}
+	return pid, nil
+}
+
+// daemonStatus returns the PID of the instance recorded in pidFile if that
+// process is still alive.
+func daemonStatus(pidFile string) (int, error) {
+	pid, err := readPidFile(pidFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, fmt.Errorf("%s not found", pidFile)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !processAlive(pid) {
+		return 0, fmt.Errorf("process %d from %s is gone", pid, pidFile)
+	}
+	return pid, nil
+}
+
+// stopDaemon signals the instance recorded in pidFile to shut down gracefully
+// and removes the PID file if the process no longer exists.
+func stopDaemon(pidFile string) error {
+	pid, err := readPidFile(pidFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("no running instance (%s not found)", pidFile)
+	}
+	if err != nil {
+		return err
+	}
+
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return fmt.Errorf("failed to find process %d: %w", pid, err)
+	}
+	if err := terminateProcess(proc); err != nil {
+		_ = os.Remove(pidFile)
+		return fmt.Errorf("failed to signal process %d: %w", pid, err)
+	}
+	return nil
+}
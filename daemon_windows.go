@@ -0,0 +1,34 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// detachedProcess is the DETACHED_PROCESS process creation flag.
+const detachedProcess = 0x00000008
+
+// detachedProcAttr starts the background process without a console so it
+// survives the terminal being closed.
+func detachedProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP | detachedProcess}
+}
+
+// terminateProcess stops proc. Windows has no SIGTERM for detached processes,
+// so the process is killed.
+func terminateProcess(proc *os.Process) error {
+	return proc.Kill()
+}
+
+// processAlive reports whether a process with the given PID exists.
+// On Windows FindProcess opens a handle to the process and fails if it is gone.
+func processAlive(pid int) bool {
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	_ = proc.Release()
+	return true
+}
@@ -0,0 +1,149 @@
+//go:build !minimal
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dashboardRefresh  = time.Second // How often the dashboard is redrawn.
+	dashboardLogLines = 8           // Number of recent log lines shown.
+	dashboardMaxConns = 15          // Number of connections listed individually.
+)
+
+// dashboard renders a live view of the tunnel on the terminal: its state, the
+// remote port, and the active connections with their byte counters and
+// durations. While it runs it replaces the spinner and receives the log output,
+// showing the most recent lines below the connection table.
+type dashboard struct {
+	out     io.Writer
+	current func() *Client
+
+	mu   sync.Mutex // Guards logs and serialises drawing.
+	logs []string
+	prev io.Writer // Log output before the dashboard started.
+	tee  io.Writer // Where log lines are copied to as well, if prev is not the terminal.
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startDashboard draws the dashboard for the client returned by current on out
+// and redirects the log output into it until Stop is called.
+func startDashboard(out io.Writer, current func() *Client) *dashboard {
+	d := &dashboard{
+		out:     out,
+		current: current,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	d.prev = setLogOutput(d)
+	if f, ok := d.prev.(*os.File); !ok || !isTerminal(f) {
+		d.tee = d.prev
+	}
+
+	go func() {
+		defer close(d.done)
+		t := time.NewTicker(dashboardRefresh)
+		defer t.Stop()
+		for {
+			d.render()
+			select {
+			case <-t.C:
+			case <-d.stop:
+				return
+			}
+		}
+	}()
+	return d
+}
+
+// Write receives log output and redraws the dashboard so that the new lines,
+// including a fatal error just before the process exits, are visible at once.
+func (d *dashboard) Write(p []byte) (int, error) {
+	if d.tee != nil {
+		_, _ = d.tee.Write(p)
+	}
+	d.mu.Lock()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		d.logs = append(d.logs, line)
+	}
+	if len(d.logs) > dashboardLogLines {
+		d.logs = d.logs[len(d.logs)-dashboardLogLines:]
+	}
+	d.mu.Unlock()
+
+	d.render()
+	return len(p), nil
+}
+
+// Stop stops redrawing and sends the log output back to where it went before.
+func (d *dashboard) Stop() {
+	close(d.stop)
+	<-d.done
+	setLogOutput(d.prev)
+}
+
+// render redraws the whole dashboard.
+func (d *dashboard) render() {
+	c := d.current()
+	lh, lp := c.LocalTarget()
+	stats := c.Stats()
+	conns := stats.Connections
+	maintenance, _ := c.maintenanceState()
+
+	state := "🟢 connected"
+	switch {
+	case c.isDraining():
+		state = "🟠 draining"
+	case maintenance:
+		state = "🚧 maintenance"
+	case c.isDegraded():
+		state = "🔴 degraded, local service down"
+	}
+
+	var b bytes.Buffer
+	b.WriteString("\x1b[H\x1b[2J")
+	fmt.Fprintf(&b, "Jerusalem tunnel  %s\n\n", state)
+	fmt.Fprintf(&b, "  Server        %s:%d\n", c.da, c.sp)
+	if c.Label() != "" {
+		fmt.Fprintf(&b, "  Label         %s\n", c.Label())
+	}
+	fmt.Fprintf(&b, "  Remote port   %d\n", c.RemotePort())
+	fmt.Fprintf(&b, "  Local target  %s:%d\n", lh, lp)
+	fmt.Fprintf(&b, "  Uptime        %s\n", stats.Uptime.Round(time.Second))
+	fmt.Fprintf(&b, "  Connections   %d active, %d total, %d rejected\n", stats.ActiveConnections, stats.TotalConnections, stats.Rejected)
+	fmt.Fprintf(&b, "  Traffic       %s in, %s out\n", formatBytes(stats.BytesIn), formatBytes(stats.BytesOut))
+	if stats.RTT > 0 {
+		fmt.Fprintf(&b, "  RTT           %s\n", stats.RTT.Round(time.Microsecond))
+	}
+	if stats.Handshakes > 0 {
+		fmt.Fprintf(&b, "  Setup         %s average over %d handshakes\n", stats.AvgHandshake.Round(time.Microsecond), stats.Handshakes)
+	}
+	b.WriteString("\n")
+
+	fmt.Fprintf(&b, "  %-8s  %10s  %10s  %10s\n", "ID", "DURATION", "IN", "OUT")
+	for i, ci := range conns {
+		if i == dashboardMaxConns {
+			fmt.Fprintf(&b, "  … and %d more\n", len(conns)-i)
+			break
+		}
+		fmt.Fprintf(&b, "  %-8s  %10s  %10s  %10s\n", ci.ID.String()[:8],
+			time.Since(ci.Started).Round(time.Second), formatBytes(ci.BytesIn), formatBytes(ci.BytesOut))
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	b.WriteString("\nRecent log\n")
+	for _, line := range d.logs {
+		fmt.Fprintf(&b, "  %s\n", line)
+	}
+	_, _ = d.out.Write(b.Bytes())
+}
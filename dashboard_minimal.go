@@ -0,0 +1,20 @@
+//go:build minimal
+
+package main
+
+import (
+	"io"
+	"log"
+)
+
+// dashboard is not part of the minimal build.
+type dashboard struct{}
+
+// startDashboard logs that the dashboard is unavailable and returns nil.
+func startDashboard(io.Writer, func() *Client) *dashboard {
+	log.Println("⚠️ The dashboard is not available in the minimal build")
+	return nil
+}
+
+// Stop does nothing.
+func (d *dashboard) Stop() {}
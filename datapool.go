@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	// defaultDataPoolMaxIdle is how long a pooled data connection is kept
+	// before it is replaced by a fresh one.
+	defaultDataPoolMaxIdle = 30 * time.Second
+	// dataPoolRetryMax caps the delay between attempts to refill the pool while
+	// the server cannot be reached.
+	dataPoolRetryMax = 30 * time.Second
+)
+
+// dataPool keeps a few authenticated data connections open, so a visitor can
+// be accepted on one of them right away instead of waiting for a new TCP
+// connection and handshake to the server. Connections taken from the pool are
+// replaced in the background.
+type dataPool struct {
+	conns   chan pooledConn // Idle connections, oldest first.
+	refill  chan struct{}   // Signalled when a connection has been taken.
+	maxIdle time.Duration
+}
+
+// pooledConn is an idle data connection and the time it was opened.
+type pooledConn struct {
+	rc     *Codec
+	opened time.Time
+}
+
+// newDataPool returns an empty pool of size connections, each kept for at
+// most maxIdle.
+func newDataPool(size int, maxIdle time.Duration) *dataPool {
+	if maxIdle <= 0 {
+		maxIdle = defaultDataPoolMaxIdle
+	}
+	return &dataPool{
+		conns:   make(chan pooledConn, size),
+		refill:  make(chan struct{}, 1),
+		maxIdle: maxIdle,
+	}
+}
+
+// take returns an idle connection that is still open, or nil if the pool has
+// none. Connections that have expired or been closed by the server are
+// discarded on the way.
+func (p *dataPool) take() *Codec {
+	defer p.signal()
+	for {
+		select {
+		case pc := <-p.conns:
+			if time.Since(pc.opened) < p.maxIdle && alive(pc.rc.conn) {
+				return pc.rc
+			}
+			pc.rc.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// signal wakes up the goroutine refilling the pool.
+func (p *dataPool) signal() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+// alive reports whether conn, an idle data connection, is still open. The
+// server sends nothing on it before the "Accept" message, so any data or EOF
+// means the connection is no longer usable.
+func alive(conn net.Conn) bool {
+	if err := conn.SetReadDeadline(time.Now()); err != nil {
+		return false
+	}
+	var b [1]byte
+	_, err := conn.Read(b[:])
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		return false
+	}
+	return conn.SetReadDeadline(time.Time{}) == nil
+}
+
+// run keeps the pool of c filled until stop is closed, then closes the idle
+// connections. Expired connections are replaced as they age.
+func (p *dataPool) run(c *Client, stop <-chan struct{}) {
+	defer c.releaseOnPanic()
+	defer func() {
+		for {
+			select {
+			case pc := <-p.conns:
+				pc.rc.Close()
+			default:
+				return
+			}
+		}
+	}()
+
+	sweep := time.NewTicker(p.maxIdle / 2)
+	defer sweep.Stop()
+	var retry time.Duration
+	for {
+		for len(p.conns) < cap(p.conns) {
+			rc, err := c.dialServer()
+			if err != nil {
+				if retry == 0 {
+					c.logger.Printf("⚠️ Failed to open pooled data connection: %v\n", err)
+					retry = time.Second
+				} else {
+					retry = min(2*retry, dataPoolRetryMax)
+				}
+				break
+			}
+			retry = 0
+			// Only this goroutine adds connections, so there is room.
+			p.conns <- pooledConn{rc: rc, opened: time.Now()}
+		}
+
+		var wait <-chan time.Time
+		if retry > 0 {
+			wait = time.After(retry)
+		}
+		select {
+		case <-p.refill:
+		case <-wait:
+		case <-sweep.C:
+			p.expire()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// expire closes the idle connections that have reached their maximum age.
+func (p *dataPool) expire() {
+	for range len(p.conns) {
+		select {
+		case pc := <-p.conns:
+			if time.Since(pc.opened) >= p.maxIdle {
+				pc.rc.Close()
+				continue
+			}
+			p.conns <- pc
+		default:
+			return
+		}
+	}
+}
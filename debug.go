@@ -0,0 +1,256 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// defaultDebugWindow is how long the debug command captures by default.
+	defaultDebugWindow = 5 * time.Minute
+	// maxDebugWindow bounds a debug capture, so a forgotten one cannot keep
+	// the logs noisy for good.
+	maxDebugWindow = time.Hour
+	// debugLimit bounds each file of a debug bundle; what does not fit is
+	// dropped and counted in info.json.
+	debugLimit = 16 << 20
+)
+
+// errDebugRunning is returned when a debug capture is requested while one is
+// in progress.
+var errDebugRunning = errors.New("a debug capture is already in progress")
+
+// debugSecrets are the message fields left out of protocol dumps.
+var debugSecrets = []string{"authenticate", "signature", "token", "sessionToken", "proof"}
+
+// debugging is the debug capture in progress, nil when there is none.
+var debugging atomic.Pointer[debugCapture]
+
+// debugCapture collects the log, every control message and the timing of
+// every connection of all tunnels for a bounded window, and then writes them
+// to a zip bundle. Its methods do nothing on a nil *debugCapture.
+type debugCapture struct {
+	r     *runner
+	start time.Time
+	until time.Time
+	path  string
+
+	mu          sync.Mutex // Guards the buffers and timer.
+	log         cappedBuffer
+	protocol    cappedBuffer
+	connections cappedBuffer
+	timer       *time.Timer
+}
+
+// cappedBuffer is a buffer that drops writes past debugLimit.
+type cappedBuffer struct {
+	buf     bytes.Buffer
+	dropped int64
+}
+
+func (b *cappedBuffer) write(p []byte) {
+	if b.buf.Len()+len(p) > debugLimit {
+		b.dropped += int64(len(p))
+		return
+	}
+	b.buf.Write(p)
+}
+
+// debugReport is the answer to the debug command of the control socket and
+// of the admin API.
+type debugReport struct {
+	Bundle string    `json:"bundle,omitempty"`
+	Until  time.Time `json:"until,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// startDebug starts capturing for d, after which the bundle is written to a
+// file in the temporary directory. Only one capture runs at a time.
+func (r *runner) startDebug(d time.Duration) (debugReport, error) {
+	if d <= 0 || d > maxDebugWindow {
+		return debugReport{}, fmt.Errorf("debug window %s out of range, use up to %s", d, maxDebugWindow)
+	}
+	now := time.Now()
+	dc := &debugCapture{
+		r:     r,
+		start: now,
+		until: now.Add(d),
+		path:  filepath.Join(os.TempDir(), "jerusalem-debug-"+now.UTC().Format("20060102T150405Z")+".zip"),
+	}
+	if !debugging.CompareAndSwap(nil, dc) {
+		return debugReport{}, errDebugRunning
+	}
+	dc.mu.Lock()
+	dc.timer = time.AfterFunc(d, dc.finish)
+	dc.mu.Unlock()
+	log.Printf("🐞 Debug capture started until %s, logging every control message and connection", dc.until.Format(time.TimeOnly))
+	return debugReport{Bundle: dc.path, Until: dc.until.UTC()}, nil
+}
+
+// stopDebug ends the debug capture in progress early, writing its bundle, as
+// when the client stops.
+func stopDebug() {
+	debugging.Load().finish()
+}
+
+// finish ends the capture and writes the bundle, once.
+func (dc *debugCapture) finish() {
+	if dc == nil || !debugging.CompareAndSwap(dc, nil) {
+		return
+	}
+	dc.mu.Lock()
+	if dc.timer != nil {
+		dc.timer.Stop()
+	}
+	dc.mu.Unlock()
+	if err := dc.write(time.Now()); err != nil {
+		log.Printf("⚠️ Failed to write debug bundle: %v", err)
+		return
+	}
+	log.Printf("🐞 Debug capture finished, bundle written to %s", dc.path)
+}
+
+// write writes the bundle of a capture that ended at end. It holds the log,
+// the control messages, the connection spans, the status of every tunnel and
+// a description of the capture.
+func (dc *debugCapture) write(end time.Time) error {
+	status, _ := json.MarshalIndent(dc.r.statuses(), "", "  ")
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	info, _ := json.MarshalIndent(map[string]any{
+		"version":             version,
+		"goVersion":           runtime.Version(),
+		"os":                  runtime.GOOS,
+		"arch":                runtime.GOARCH,
+		"pid":                 os.Getpid(),
+		"start":               dc.start.UTC(),
+		"end":                 end.UTC(),
+		"droppedLogBytes":     dc.log.dropped,
+		"droppedMessageBytes": dc.protocol.dropped,
+		"droppedSpanBytes":    dc.connections.dropped,
+	}, "", "  ")
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{
+		{"info.json", info},
+		{"status.json", status},
+		{"log.txt", dc.log.buf.Bytes()},
+		{"protocol.jsonl", dc.protocol.buf.Bytes()},
+		{"connections.jsonl", dc.connections.buf.Bytes()},
+	} {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(f.data); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	// The bundle holds the log, so only the user running the client may read it.
+	return os.WriteFile(dc.path, buf.Bytes(), 0o600)
+}
+
+// logLine records a line written to the log, stamped with ts.
+func (dc *debugCapture) logLine(ts string, line []byte) {
+	if dc == nil {
+		return
+	}
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.log.write([]byte(ts + " "))
+	dc.log.write(line)
+}
+
+// message records and logs v, a message sent or received on conn, without
+// the fields in debugSecrets and the unset connection IDs.
+func (dc *debugCapture) message(dir string, conn net.Conn, v any) {
+	if dc == nil {
+		return
+	}
+	peer := conn.RemoteAddr().String()
+	var fields map[string]any
+	if b, err := json.Marshal(v); err != nil || json.Unmarshal(b, &fields) != nil {
+		fields = map[string]any{"type": fmt.Sprintf("%T", v)}
+	}
+	for key, value := range fields {
+		if value == uuid.Nil.String() {
+			delete(fields, key)
+		}
+	}
+	for _, key := range debugSecrets {
+		if _, ok := fields[key]; ok {
+			fields[key] = redacted
+		}
+	}
+	msg := marshalDebug(fields)
+	log.Printf("🐞 %s %s: %s", dir, peer, msg)
+
+	line := append(marshalDebug(map[string]any{"time": time.Now().UTC(), "dir": dir, "peer": peer, "message": json.RawMessage(msg)}), '\n')
+	dc.mu.Lock()
+	dc.protocol.write(line)
+	dc.mu.Unlock()
+}
+
+// marshalDebug encodes v as JSON, leaving the characters HTML escapes alone
+// so that the dumps read like the messages.
+func marshalDebug(v any) []byte {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(v)
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+}
+
+// span records and logs sp, a phase of a connection that took d.
+func (dc *debugCapture) span(sp otlpSpan, d time.Duration) {
+	if dc == nil {
+		return
+	}
+	line, _ := json.Marshal(sp)
+	dc.mu.Lock()
+	dc.connections.write(append(line, '\n'))
+	dc.mu.Unlock()
+	log.Printf("🐞 %s of trace %s took %s", sp.Name, sp.TraceID, d.Round(time.Microsecond))
+}
+
+// debugCommand implements `debug [--socket path] [--for duration]`, which
+// makes the client running on the control socket capture its log, control
+// messages and connection timings for a while and then write them to a
+// bundle.
+func debugCommand(args []string) {
+	fs := flag.NewFlagSet("debug", flag.ExitOnError)
+	socket := fs.String("socket", defaultControlSocket, "control socket of the running client")
+	window := fs.Duration("for", defaultDebugWindow, "how long to capture, up to "+maxDebugWindow.String())
+	_ = fs.Parse(args)
+
+	var report debugReport
+	err := queryControl(*socket, "debug "+window.String(), &report)
+	if err == nil && report.Error != "" {
+		err = errors.New(report.Error)
+	}
+	if err != nil {
+		log.Fatalf("❌ Failed to start debug capture: %v", err)
+	}
+	fmt.Printf("🐞 Capturing until %s, the bundle will be written to %s\n", report.Until.Local().Format(time.TimeOnly), report.Bundle)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"client/tunneltest"
+)
+
+func TestDebugCapture(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	srv := newServer(t, func() (*tunneltest.Server, error) { return tunneltest.NewServer("secret") })
+	c := connect(t, srv, WithSecret("secret"))
+	host, port := c.LocalTarget()
+	r := newRunner(Config{SecretKey: "secret", LocalHost: host, LocalPort: port}, c, "")
+
+	report, err := r.startDebug(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopDebug()
+	if _, err := r.startDebug(time.Minute); !errors.Is(err, errDebugRunning) {
+		t.Fatalf("second capture: got %v, want errDebugRunning", err)
+	}
+	conn := visit(t, srv, c)
+	echo(t, conn, "captured")
+	conn.Close()
+	dc := debugging.Load()
+	deadline := time.Now().Add(testTimeout)
+	for time.Now().Before(deadline) {
+		dc.mu.Lock()
+		done := strings.Contains(dc.connections.buf.String(), "tunnel.connection")
+		dc.mu.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stopDebug()
+	if debugging.Load() != nil {
+		t.Fatal("the capture is still in progress after stopDebug")
+	}
+
+	zr, err := zip.OpenReader(report.Bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(b)
+	}
+	for name, want := range map[string]string{
+		"info.json":         `"version"`,
+		"status.json":       `"state"`,
+		"log.txt":           "Debug capture started",
+		"protocol.jsonl":    `"authenticate":"` + redacted + `"`,
+		"connections.jsonl": `"tunnel.connection"`,
+	} {
+		if !strings.Contains(files[name], want) {
+			t.Errorf("%s does not contain %s:\n%s", name, want, files[name])
+		}
+	}
+}
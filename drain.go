@@ -0,0 +1,40 @@
+package main
+
+import (
+	"time"
+)
+
+// drainCheckInterval is how often Shutdown looks for connections that have
+// become idle while draining.
+const drainCheckInterval = 500 * time.Millisecond
+
+// closeIdleConnections closes the relayed connections that have not transferred
+// any data for the drain idle timeout. Connections that are still transferring
+// are left to finish.
+func (c *Client) closeIdleConnections() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	closed := 0
+	for _, pc := range c.conns {
+		if time.Since(time.Unix(0, pc.lastSeen.Load())) >= c.drainIdle && pc.close("idle while draining") {
+			closed++
+		}
+	}
+	if closed > 0 {
+		c.logger.Printf("🛑 Closed %d idle connections, %d still draining", closed, len(c.conns)-closed)
+	}
+}
+
+// abortConnections refuses new connection requests, like Shutdown, and closes
+// all relayed connections, including those still being set up.
+func (c *Client) abortConnections() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.draining = true
+	for _, pc := range c.conns {
+		pc.abort("client closed")
+	}
+	if len(c.conns) > 0 {
+		c.logger.Printf("🛑 Closed %d active connections", len(c.conns))
+	}
+}
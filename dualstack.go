@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// IP families that can be preferred when a host has both IPv4 and IPv6
+// addresses, see WithPreferredIPFamily.
+const (
+	PreferIPv4 = "ipv4"
+	PreferIPv6 = "ipv6"
+)
+
+// defaultFallbackDelay is how long the preferred IP family is given to connect
+// before the other one is tried as well, as recommended by RFC 8305.
+const defaultFallbackDelay = 300 * time.Millisecond
+
+// familyDialer dials hosts that have addresses of both IP families in the
+// manner of Happy Eyeballs, trying the preferred family first. net.Dialer on
+// its own races the families as well, but starts with the family of the first
+// address the resolver returns.
+type familyDialer struct {
+	*net.Dialer
+	prefer string // PreferIPv4 or PreferIPv6.
+}
+
+// DialContext connects to address, a host and port, over the preferred IP
+// family, and over the other one as well if the first attempt has neither
+// succeeded nor failed within the fallback delay of the dialer. The first
+// connection established wins; the other one is closed.
+func (d *familyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "tcp" {
+		return d.Dialer.DialContext(ctx, network, address)
+	}
+	first, second := "tcp4", "tcp6"
+	if d.prefer == PreferIPv6 {
+		first, second = second, first
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, 2)
+	dial := func(network string) {
+		conn, err := d.Dialer.DialContext(ctx, network, address)
+		results <- result{conn, err}
+	}
+	go dial(first)
+	var fallback <-chan time.Time
+	if delay := d.FallbackDelay; delay >= 0 {
+		if delay == 0 {
+			delay = defaultFallbackDelay
+		}
+		t := time.NewTimer(delay)
+		defer t.Stop()
+		fallback = t.C
+	}
+
+	started, pending := 1, 1
+	var errs []error
+	for {
+		select {
+		case <-fallback:
+			if started == 1 {
+				started, pending = 2, pending+1
+				go dial(second)
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				if pending > 0 {
+					// The other attempt is cancelled, but may connect before it notices.
+					go func() {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}()
+				}
+				return res.conn, nil
+			}
+			errs = append(errs, res.err)
+			if started == 1 {
+				started, pending = 2, pending+1
+				go dial(second)
+			} else if pending == 0 {
+				return nil, errors.Join(errs...)
+			}
+		}
+	}
+}
+
+// preferFamily returns d dialing the preferred IP family prefer first, or d as
+// it is if prefer is empty.
+func preferFamily(d *net.Dialer, prefer string) Dialer {
+	if prefer == "" {
+		return d
+	}
+	return &familyDialer{Dialer: d, prefer: prefer}
+}
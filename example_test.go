@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"client/tunneltest"
+)
+
+// echoService starts a local service that echoes what it receives, standing
+// in for the service an example exposes.
+func echoService() net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln
+}
+
+// Expose a local service through a tunnel server and reach it from the
+// public port. A real server takes the place of tunneltest.
+func ExampleNewClient() {
+	srv, err := tunneltest.NewServer("secret")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer srv.Close()
+	local := echoService()
+	defer local.Close()
+
+	client, err := NewClient(srv.Addr(),
+		WithLocalTarget("127.0.0.1", uint16(local.Addr().(*net.TCPAddr).Port)),
+		WithClientID("example"), WithSecret("secret"),
+		WithoutSpinner(), WithLogger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		log.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- client.Listen() }()
+
+	// Visitors connect to the remote port the server assigned.
+	visitor, err := srv.DialVisitor(client.RemotePort())
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprint(visitor, "hello")
+	reply := make([]byte, 5)
+	if _, err := io.ReadFull(visitor, reply); err != nil {
+		log.Fatal(err)
+	}
+	visitor.Close()
+	fmt.Println(string(reply))
+
+	client.Close()
+	<-done
+	// Output: hello
+}
+
+// Try the tunnel-side processing of a connection locally, without a visitor
+// on the public port.
+func ExampleClient_ServeConn() {
+	srv, err := tunneltest.NewServer("secret")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer srv.Close()
+	local := echoService()
+	defer local.Close()
+
+	client, err := NewClient(srv.Addr(),
+		WithLocalTarget("127.0.0.1", uint16(local.Addr().(*net.TCPAddr).Port)),
+		WithClientID("example"), WithSecret("secret"),
+		WithoutSpinner(), WithLogger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
+
+	visitor, conn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		client.ServeConn(conn)
+		close(done)
+	}()
+	fmt.Fprint(visitor, "ping")
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(visitor, reply); err != nil {
+		log.Fatal(err)
+	}
+	visitor.Close()
+	<-done
+
+	stats := client.Stats()
+	fmt.Println(string(reply), stats.TotalConnections, stats.BytesIn, stats.BytesOut)
+	// Output: ping 1 4 4
+}
+
+// Run extra tunnels next to the main one from a config file with a tunnels
+// section, examples/tunnels.yaml. The server and the local services of the
+// file are replaced with stand-ins, so the example runs anywhere.
+func Example_tunnels() {
+	srv, err := tunneltest.NewServer("change-me")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer srv.Close()
+
+	var config Config
+	if err := loadConfig(&config, "examples/tunnels.yaml"); err != nil {
+		log.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(srv.Addr())
+	serverPort, _ := strconv.Atoi(port)
+	config.Server, config.ServerPort, config.NoSpinner = host, uint16(serverPort), true
+	for _, name := range []string{"", "api", "db"} {
+		local := echoService()
+		defer local.Close()
+		localPort := uint16(local.Addr().(*net.TCPAddr).Port)
+		if name == "" {
+			config.LocalPort = localPort
+		} else {
+			spec := config.Tunnels[name]
+			spec.LocalPort = localPort
+			config.Tunnels[name] = spec
+		}
+	}
+
+	client, err := newClientFromConfig(&config, WithLogger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		log.Fatal(err)
+	}
+	r := newRunner(config, client, "")
+	r.tunnels = newTunnelSet()
+	r.tunnels.apply(config)
+	go r.run()
+
+	// Every tunnel has its own public port on the server.
+	tunnels := srv.Tunnels()
+	sort.Slice(tunnels, func(i, j int) bool { return tunnels[i].Label < tunnels[j].Label })
+	for _, t := range tunnels {
+		visitor, err := srv.DialVisitor(t.Port)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprint(visitor, "hi")
+		reply := make([]byte, 2)
+		if _, err := io.ReadFull(visitor, reply); err != nil {
+			log.Fatal(err)
+		}
+		visitor.Close()
+		fmt.Printf("%q answers %s\n", t.Label, reply)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_ = r.Shutdown(ctx)
+	// Output:
+	// "" answers hi
+	// "api" answers hi
+	// "staging-db" answers hi
+}
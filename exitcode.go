@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+)
+
+// Exit codes of the CLI, a stable interface for wrapper scripts and
+// supervisors. Other failures, such as a local port that is already in use,
+// exit with status 1; flag parsing errors exit with status 2 like config
+// errors.
+const (
+	// exitOK is a clean shutdown: on a signal, after duration or `stop`.
+	exitOK = 0
+	// exitConfigError means the configuration is invalid or incomplete.
+	exitConfigError = 2
+	// exitAuthFailed means the server refused the credentials.
+	exitAuthFailed = 3
+	// exitNetwork means the server could not be reached, or the connection
+	// kept failing, within the reconnect attempts allowed.
+	exitNetwork = 4
+	// exitRejected means the server refused the session for another reason
+	// than the credentials, such as a port that is taken or a ban, or it does
+	// not speak a compatible protocol.
+	exitRejected = 5
+)
+
+// exitCode returns the exit code of giving up after err.
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, ErrAuthFailed):
+		return exitAuthFailed
+	case errors.Is(err, ErrServerRejected), errors.Is(err, ErrProtocol):
+		return exitRejected
+	}
+	return exitNetwork
+}
+
+// exitGaveUp logs that the client gave up after err and exits with its code.
+func exitGaveUp(err error) {
+	log.Printf("❌ Gave up: %v", err)
+	os.Exit(exitCode(err))
+}
+
+// configFatalf logs a configuration error like log.Fatalf and exits with
+// exitConfigError.
+func configFatalf(format string, args ...any) {
+	log.Print(fmt.Sprintf(format, args...))
+	os.Exit(exitConfigError)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// expiryWarning is how long before a temporary tunnel expires a warning is
+// logged, for durations long enough to make it worthwhile.
+const expiryWarning = time.Minute
+
+// expireAfter shuts the tunnel down once it has been open for d, warning
+// shortly before and giving relayed connections up to timeout to drain like
+// on SIGTERM. It returns early if the runner is shut down first.
+func (r *runner) expireAfter(d, timeout time.Duration) {
+	expires := time.Now().Add(d)
+	log.Printf("⏳ Temporary tunnel, closing it at %s", expires.Format(time.RFC1123))
+	if d > 2*expiryWarning {
+		select {
+		case <-time.After(time.Until(expires) - expiryWarning):
+			log.Printf("⏳ Tunnel closes in %s", expiryWarning)
+		case <-r.stop:
+			return
+		}
+	}
+	select {
+	case <-time.After(time.Until(expires)):
+	case <-r.stop:
+		return
+	}
+
+	log.Printf("⏳ Tunnel expired after %s, draining connections (up to %v)", d, timeout)
+	if err := sdNotify(sdStopping); err != nil {
+		log.Printf("⚠️ %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := r.Shutdown(ctx); err != nil {
+		log.Printf("⚠️ Shutdown: %v", err)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// SelectInOrder tries the servers in the order they are configured,
+	// starting with the one that worked last.
+	SelectInOrder = "order"
+	// SelectLowestLatency tries the servers in the order of the time it takes
+	// to open a TCP connection to them.
+	SelectLowestLatency = "latency"
+)
+
+// failover remembers which of several configured servers is healthy, so
+// reconnects and config reloads go back to it, and which one was lost last,
+// so the next attempt moves on to another.
+type failover struct {
+	mu      sync.Mutex
+	healthy string // Address connected to last, cleared when it is lost.
+	lost    string // Address of the server whose connection was lost last.
+}
+
+// servers is the failover state of the CLI.
+var servers failover
+
+// connected records addr as the healthy server.
+func (f *failover) connected(addr string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.healthy, f.lost = addr, ""
+}
+
+// disconnected records that the control connection to addr was lost.
+func (f *failover) disconnected(addr string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.healthy == addr {
+		f.healthy = ""
+	}
+	f.lost = addr
+}
+
+// order returns addrs in the order to try them. In SelectInOrder mode the
+// healthy server comes first, else the one after the lost server; in
+// SelectLowestLatency mode the fastest server comes first. A lost server is
+// tried last either way.
+func (f *failover) order(addrs []string, selection string) []string {
+	f.mu.Lock()
+	healthy, lost := f.healthy, f.lost
+	f.mu.Unlock()
+	if len(addrs) < 2 {
+		return addrs
+	}
+	if selection == SelectLowestLatency {
+		addrs = byLatency(addrs)
+		for i, addr := range addrs {
+			if addr == lost {
+				addrs = append(append(addrs[:i:i], addrs[i+1:]...), lost)
+				break
+			}
+		}
+		return addrs
+	}
+	start := 0
+	for i, addr := range addrs {
+		switch addr {
+		case healthy:
+			start = i
+		case lost:
+			if healthy == "" {
+				start = i + 1
+			}
+		}
+	}
+	start %= len(addrs)
+	return append(addrs[start:len(addrs):len(addrs)], addrs[:start]...)
+}
+
+// byLatency returns addrs sorted by the time it takes to open a TCP connection
+// to them, probed in parallel. Servers that cannot be reached come last.
+func byLatency(addrs []string) []string {
+	latency := make([]time.Duration, len(addrs))
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			conn, err := net.DialTimeout("tcp", addr, NetworkTimeout)
+			if err != nil {
+				latency[i] = NetworkTimeout + 1
+				return
+			}
+			latency[i] = time.Since(start)
+			conn.Close()
+		}()
+	}
+	wg.Wait()
+
+	idx := make([]int, len(addrs))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool { return latency[idx[a]] < latency[idx[b]] })
+	sorted := make([]string, len(addrs))
+	for i, j := range idx {
+		sorted[i] = addrs[j]
+	}
+	return sorted
+}
+
+// serverEndpoints returns the host:port addresses of the comma-separated
+// server list of config. Entries without a port use server-port; srv+ entries
+// are resolved to the targets of their SRV records.
+func serverEndpoints(config *Config) ([]string, error) {
+	var addrs []string
+	for _, entry := range strings.Split(config.Server, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if name, ok := strings.CutPrefix(entry, srvScheme); ok {
+			targets, err := resolveSRV(name)
+			if err != nil {
+				return nil, err
+			}
+			addrs = append(addrs, targets...)
+			continue
+		}
+		if _, _, err := net.SplitHostPort(entry); err == nil {
+			addrs = append(addrs, entry)
+			continue
+		}
+		if config.ServerPort == 0 {
+			return nil, fmt.Errorf("server %q has no port and server-port is not set", entry)
+		}
+		// An IPv6 address without port may be written in brackets, [2001:db8::1].
+		host := strings.TrimSuffix(strings.TrimPrefix(entry, "["), "]")
+		addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(int(config.ServerPort))))
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("no server configured")
+	}
+	return addrs, nil
+}
+
+// needsServerPort reports whether an entry of the server list has no port of
+// its own, so server-port must be set.
+func needsServerPort(server string) bool {
+	for _, entry := range strings.Split(server, ",") {
+		entry = strings.TrimSpace(entry)
+		if strings.HasPrefix(entry, srvScheme) {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(entry); err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// connectFailover connects with newClient to the servers of config in the
+// order chosen by servers, moving on to the next one when a connection fails.
+// The errors of all servers are returned if none can be reached.
+func connectFailover(config *Config, newClient func(addr string) (*Client, error)) (*Client, error) {
+	addrs, err := serverEndpoints(config)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	for _, addr := range servers.order(addrs, config.ServerSelection) {
+		client, err := newClient(addr)
+		if err == nil {
+			servers.connected(addr)
+			return client, nil
+		}
+		if len(addrs) == 1 {
+			return nil, err
+		}
+		log.Printf("⚠️ Server %s failed, trying the next one: %v", addr, err)
+		errs = append(errs, fmt.Errorf("%s: %w", addr, err))
+	}
+	return nil, errors.Join(errs...)
+}
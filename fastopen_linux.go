@@ -0,0 +1,25 @@
+//go:build linux
+
+package main
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// fastOpenSupported reports whether TCP Fast Open can be used for dials.
+const fastOpenSupported = true
+
+// fastOpenControl enables TCP Fast Open on a socket before it connects, so the
+// first data sent on it travels with the SYN once the kernel has a cookie for
+// the server. Without a cookie, the connection falls back to a normal handshake.
+func fastOpenControl(network, address string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import "syscall"
+
+// fastOpenSupported reports whether TCP Fast Open can be used for dials. It is
+// only implemented on Linux.
+const fastOpenSupported = false
+
+// fastOpenControl does nothing on platforms without TCP Fast Open support.
+func fastOpenControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
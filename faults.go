@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// faultInjector delays, drops or corrupts messages received on the control
+// connection before they are decoded, to test how the client copes with an
+// unreliable server or network. It is meant for testing only.
+type faultInjector struct {
+	rate     float64       // Probability that a message is tampered with.
+	maxDelay time.Duration // Upper bound of injected delays.
+	logger   *log.Logger
+}
+
+// defaultFaultDelay bounds injected delays if no maximum is configured.
+const defaultFaultDelay = 5 * time.Second
+
+// tamper applies a randomly chosen fault to msg with the configured
+// probability. It returns the message to decode, or false if it is dropped.
+func (f *faultInjector) tamper(msg []byte) ([]byte, bool) {
+	if rand.Float64() >= f.rate {
+		return msg, true
+	}
+	switch rand.Intn(3) {
+	case 0:
+		d := time.Duration(rand.Int63n(int64(f.maxDelay))) + 1
+		f.logger.Printf("🧪 Fault injection: delaying control message by %s", d.Round(time.Millisecond))
+		time.Sleep(d)
+	case 1:
+		f.logger.Println("🧪 Fault injection: dropping control message")
+		return nil, false
+	default:
+		if len(msg) > 0 {
+			msg[rand.Intn(len(msg))] ^= 0xff
+		}
+		f.logger.Println("🧪 Fault injection: corrupting control message")
+	}
+	return msg, true
+}
+
+// decodeWithFaults reads the next message that is not dropped by the fault
+// injector and decodes it into v.
+func (d *Codec) decodeWithFaults(v interface{}) error {
+	for {
+		var msg []byte
+		if d.binary != nil {
+			frame, err := d.binary.readFrame()
+			if err != nil {
+				return err
+			}
+			msg = frame
+		} else {
+			var raw json.RawMessage
+			if err := d.decoder.Decode(&raw); err != nil {
+				return err
+			}
+			msg = raw
+		}
+		msg, ok := d.faults.tamper(msg)
+		if !ok {
+			continue
+		}
+		if d.binary != nil {
+			return d.binary.unmarshal(msg, v)
+		}
+		return json.Unmarshal(msg, v)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net"
+
+	"github.com/hashicorp/yamux"
+)
+
+// closeWriter is implemented by connections that can be half-closed, such as
+// *net.TCPConn and the wrappers of the data pipeline.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// closeWrite shuts down the writing side of conn, so its peer reads EOF while
+// data can still be read from conn. A multiplexed stream is half-closed by
+// Close. Connections that cannot be half-closed are left open until the
+// relay ends in the other direction as well.
+func closeWrite(conn net.Conn) error {
+	switch c := conn.(type) {
+	case *yamux.Stream:
+		return c.Close()
+	case closeWriter:
+		return c.CloseWrite()
+	}
+	return nil
+}
+
+// relayOneWay copies src to dst, the connection written to by w, and then
+// half-closes dst, so protocols that signal the end of a request with a TCP
+// half-close keep working while the reply is relayed in the other direction.
+// If copying or half-closing fails, abort is called to tear down both
+// directions. Plain TCP connections are copied with splice where supported.
+func (c *Client) relayOneWay(w *countingWriter, dst net.Conn, src net.Conn, abort func()) error {
+	spliced := false
+	var err error
+	if c.splice {
+		spliced, err = spliceRelay(w, dst, src)
+	}
+	if !spliced {
+		_, err = relay(w, src, c.buffers)
+	}
+	if err == nil {
+		err = closeWrite(dst)
+	}
+	if err != nil {
+		abort()
+	}
+	return err
+}
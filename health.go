@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultHealthCheckInterval is the time between probes when none is configured.
+	defaultHealthCheckInterval = 10 * time.Second
+	// healthCheckTimeout bounds a single probe of the local service.
+	healthCheckTimeout = 5 * time.Second
+)
+
+// unavailablePage is served to HTTP visitors while the local service is down
+// and health-check-reject is enabled.
+var unavailablePage = []byte("<html><body><h1>502 Bad Gateway</h1><p>The service behind this tunnel is not responding.</p></body></html>\n")
+
+// HealthCheck configures periodic probing of the local service.
+//   - Type is "tcp" to check that the local port accepts connections, "http" to
+//     also require a non-5xx response to a GET of Path, or "" to disable checks.
+//   - Interval is the time between probes.
+//   - Reject makes the client turn visitors away while the service is down
+//     instead of relaying them to a dead port: HTTP checks answer with a 502,
+//     TCP checks close the connection immediately.
+type HealthCheck struct {
+	Type     string
+	Path     string
+	Interval time.Duration
+	Reject   bool
+}
+
+// SetHealthCheck replaces the health check of the local service. Disabling it
+// clears the degraded state.
+// It is safe to call SetHealthCheck while the client is listening.
+func (c *Client) SetHealthCheck(hc HealthCheck) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.health = hc
+	if hc.Type == "" {
+		c.degraded = false
+	}
+}
+
+// isDegraded reports whether the last health check of the local service failed.
+func (c *Client) isDegraded() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.degraded
+}
+
+// rejectWhileDegraded reports whether visitors should be turned away because the
+// local service is down, and the page to answer them with, if any.
+func (c *Client) rejectWhileDegraded() (bool, []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.degraded || !c.health.Reject {
+		return false, nil
+	}
+	if c.health.Type == "http" {
+		return true, unavailablePage
+	}
+	return true, nil
+}
+
+// runHealthChecks probes the local service until stop is closed, updating the
+// degraded state and logging every change of it.
+func (c *Client) runHealthChecks(stop <-chan struct{}) {
+	defer c.releaseOnPanic()
+	for {
+		c.mu.Lock()
+		hc, lh, lp := c.health, c.lh, c.lp
+		c.mu.Unlock()
+
+		interval := hc.Interval
+		if interval <= 0 {
+			interval = defaultHealthCheckInterval
+		}
+		if hc.Type != "" {
+			c.setDegraded(probeLocalService(hc, lh, lp))
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// setDegraded records the result of a health check.
+func (c *Client) setDegraded(err error) {
+	c.mu.Lock()
+	was := c.degraded
+	c.degraded = err != nil
+	c.mu.Unlock()
+
+	switch {
+	case err != nil && !was:
+		c.logger.Printf("⚠️ Local service is down, tunnel degraded: %v", err)
+	case err == nil && was:
+		c.logger.Println("✅ Local service is healthy again")
+	}
+}
+
+// probeLocalService runs a single health check against lh:lp.
+func probeLocalService(hc HealthCheck, lh string, lp uint16) error {
+	address := net.JoinHostPort(lh, strconv.Itoa(int(lp)))
+	if hc.Type == "tcp" {
+		conn, err := net.DialTimeout("tcp", address, healthCheckTimeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	client := http.Client{Timeout: healthCheckTimeout}
+	resp, err := client.Get("http://" + address + hc.Path)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("GET %s returned %s", hc.Path, resp.Status)
+	}
+	return nil
+}
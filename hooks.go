@@ -0,0 +1,43 @@
+package main
+
+// hooks holds the lifecycle callbacks registered with the On... options. The
+// callbacks are called synchronously from the goroutine where the event
+// happens, so they must not block; events that may happen concurrently, such
+// as those of different proxied connections, call them concurrently.
+type hooks struct {
+	connected        func(remotePort uint16)
+	disconnected     func(err error)
+	connectionOpened func(ConnectionInfo)
+	connectionClosed func(ConnectionInfo, error)
+	failed           func(error)
+}
+
+func (h *hooks) onConnected(remotePort uint16) {
+	if h.connected != nil {
+		h.connected(remotePort)
+	}
+}
+
+func (h *hooks) onDisconnected(err error) {
+	if h.disconnected != nil {
+		h.disconnected(err)
+	}
+}
+
+func (h *hooks) onConnectionOpened(ci ConnectionInfo) {
+	if h.connectionOpened != nil {
+		h.connectionOpened(ci)
+	}
+}
+
+func (h *hooks) onConnectionClosed(ci ConnectionInfo, err error) {
+	if h.connectionClosed != nil {
+		h.connectionClosed(ci, err)
+	}
+}
+
+func (h *hooks) onError(err error) {
+	if h.failed != nil {
+		h.failed(err)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"time"
+)
+
+// idleCheckInterval is how often relayed connections are checked against the
+// idle timeout.
+const idleCheckInterval = time.Second
+
+// SetIdleTimeout closes relayed connections once neither direction has
+// transferred any data for d, so sockets of visitors that vanished without
+// closing them do not accumulate. Zero disables the timeout. It applies to
+// established connections as well.
+func (c *Client) SetIdleTimeout(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.idleTimeout = d
+}
+
+// runIdleTimeouts enforces the idle timeout until stop is closed.
+func (c *Client) runIdleTimeouts(stop <-chan struct{}) {
+	t := time.NewTicker(idleCheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			c.closeTimedOutConnections()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// closeTimedOutConnections closes the relayed connections that have been idle
+// for the idle timeout.
+func (c *Client) closeTimedOutConnections() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.idleTimeout <= 0 {
+		return
+	}
+	for _, pc := range c.conns {
+		idle := time.Since(time.Unix(0, pc.lastSeen.Load()))
+		if idle >= c.idleTimeout && pc.close("idle timeout") {
+			c.logger.Printf("⏱️ Closed connection from %s after %s without traffic\n", pc.visitorOrID(), idle.Round(time.Second))
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// defaultInitFile is the file init writes unless told otherwise.
+const defaultInitFile = "client.yaml"
+
+// wizard asks for config values on stdin, repeating a question until the
+// answer is valid.
+type wizard struct {
+	in *bufio.Reader
+}
+
+// ask prompts for a value, returning def if the answer is empty. check, if not
+// nil, validates the answer; the question is repeated while it fails.
+func (w *wizard) ask(prompt, def string, check func(string) error) string {
+	for {
+		if def != "" {
+			fmt.Printf("➡️ %s [%s]: ", prompt, def)
+		} else {
+			fmt.Printf("➡️ %s: ", prompt)
+		}
+		line, err := w.in.ReadString('\n')
+		if err != nil && (!errors.Is(err, io.EOF) || line == "") {
+			fmt.Println()
+			log.Fatalf("❌ Failed to read %s: %v", prompt, err)
+		}
+		v := strings.TrimSpace(line)
+		if v == "" {
+			v = def
+		}
+		if check == nil {
+			return v
+		}
+		if err := check(v); err != nil {
+			fmt.Printf("⚠️ %v\n", err)
+			continue
+		}
+		return v
+	}
+}
+
+// askSecret prompts for the secret key, without echo on a terminal.
+func (w *wizard) askSecret() string {
+	for {
+		var secret string
+		if isTerminal(os.Stdin) {
+			var err error
+			if secret, err = promptSecretInput("Secret key 🔑"); err != nil {
+				log.Fatalf("❌ %v", err)
+			}
+		} else {
+			secret = w.ask("Secret key 🔑", "", nil)
+		}
+		if len(secret) < minSecretLength {
+			fmt.Printf("⚠️ The secret key must be at least %d characters long\n", minSecretLength)
+			continue
+		}
+		return secret
+	}
+}
+
+// confirm asks a yes/no question, returning def on an empty answer.
+func (w *wizard) confirm(prompt string, def bool) bool {
+	hint := "y/N"
+	if def {
+		hint = "Y/n"
+	}
+	answer := w.ask(prompt+" ("+hint+")", "", func(s string) error {
+		switch strings.ToLower(s) {
+		case "", "y", "yes", "n", "no":
+			return nil
+		}
+		return errors.New("answer y or n")
+	})
+	if answer == "" {
+		return def
+	}
+	return strings.HasPrefix(strings.ToLower(answer), "y")
+}
+
+// required rejects empty answers.
+func required(s string) error {
+	if s == "" {
+		return errors.New("a value is required")
+	}
+	return nil
+}
+
+// portNumber rejects answers that are not a port number.
+func portNumber(s string) error {
+	if n, err := strconv.ParseUint(s, 10, 16); err != nil || n == 0 {
+		return fmt.Errorf("%q is not a port number between 1 and 65535", s)
+	}
+	return nil
+}
+
+// initCommand implements `init [--output file] [--force]`, which walks through
+// the settings needed to connect, validating each answer, and writes them as a
+// ready-to-use YAML config. The secret key is either written to the file,
+// which is then only readable by the user, or saved in the OS keychain.
+func initCommand(args []string) {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	output := fs.String("output", defaultInitFile, "config file to write")
+	force := fs.Bool("force", false, "overwrite the config file if it exists")
+	_ = fs.Parse(args)
+	if _, err := os.Stat(*output); err == nil && !*force {
+		log.Fatalf("❌ %s already exists, use --force to overwrite it", *output)
+	}
+
+	w := &wizard{in: bufio.NewReader(os.Stdin)}
+	var config Config
+	config.Server = w.ask("Server address 🛠️ (or a comma-separated list)", "", required)
+	if needsServerPort(config.Server) {
+		port := w.ask("Server port 🌐", "", portNumber)
+		config.ServerPort = parseUint16(port)
+	}
+	config.ClientID = w.ask("Client ID 🆔", "", required)
+	config.SecretKey = w.askSecret()
+	config.LocalHost = w.ask("Local host 💻", "127.0.0.1", required)
+	config.LocalPort = parseUint16(w.ask("Local port 🔌", "", portNumber))
+	config.Label = w.ask("Session label 🏷️ (optional)", "", nil)
+
+	inKeychain := false
+	if keychainSupported && w.confirm("Save the secret key in the OS keychain instead of the config file?", false) {
+		if err := saveSecretToKeychain(&config); err != nil {
+			log.Printf("⚠️ %v, writing it to the config file instead", err)
+		} else {
+			inKeychain = true
+		}
+	}
+
+	for _, problem := range validateConfig(&config) {
+		fmt.Printf("⚠️ %s\n", problem)
+	}
+	if err := os.WriteFile(*output, []byte(configYAML(&config, inKeychain)), 0o600); err != nil {
+		log.Fatalf("❌ Failed to write config file: %v", err)
+	}
+	fmt.Printf("✅ Configuration written to %s, start the tunnel with: %s run %s\n", *output, os.Args[0], *output)
+}
+
+// configYAML renders the keys set by init as YAML. The secret key is left out
+// if it is saved in the keychain.
+func configYAML(config *Config, secretInKeychain bool) string {
+	var b strings.Builder
+	line := func(key, value string) {
+		if value != "" {
+			fmt.Fprintf(&b, "%s: %s\n", key, strconv.Quote(value))
+		}
+	}
+	line("local-host", config.LocalHost)
+	line("local-port", strconv.Itoa(int(config.LocalPort)))
+	line("server", config.Server)
+	if config.ServerPort != 0 {
+		line("server-port", strconv.Itoa(int(config.ServerPort)))
+	}
+	line("client-id", config.ClientID)
+	if !secretInKeychain {
+		line("secret-key", config.SecretKey)
+	}
+	line("label", config.Label)
+	return b.String()
+}
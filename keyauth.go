@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+// readPrivateKey loads config.PrivateKey from the private-key-file key. The
+// file is read again on every reload, which allows the key to be rotated.
+func readPrivateKey(config *Config, path string) error {
+	config.PrivateKey = nil
+	if path == "" {
+		return nil
+	}
+	key, err := loadPrivateKey(path)
+	if err != nil {
+		return err
+	}
+	config.PrivateKey = key
+	return nil
+}
+
+// loadPrivateKey reads an Ed25519 private key in PKCS #8 PEM form, as written
+// by keygen or `openssl genpkey -algorithm ed25519`, from path.
+func loadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private-key-file: %w", err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("private-key-file %s does not contain a PEM encoded PRIVATE KEY", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private-key-file %s: %w", path, err)
+	}
+	ed, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private-key-file %s holds a %T, only Ed25519 keys are supported", path, key)
+	}
+	return ed, nil
+}
+
+// configAuthenticator returns the Authenticator of config: one signing with
+// its private key if it has one, else one sending the access token of its
+// identity provider if one is configured, else one answering with its secret
+// key, or nil if it has none of them.
+func configAuthenticator(config *Config) *Authenticator {
+	var a *Authenticator
+	switch {
+	case config.PrivateKey != nil:
+		a = NewKeyAuthenticator(config.PrivateKey)
+	case config.OIDC.enabled():
+		a = NewTokenAuthenticator(tokenSourceFor(config.OIDC).Token)
+	case config.SecretKey != "":
+		a = NewAuthenticator(config.SecretKey)
+	default:
+		return nil
+	}
+	a.strict = config.StrictHandshake
+	return a
+}
+
+// keyFingerprint identifies pub as "SHA256:" followed by the unpadded base64
+// of the SHA-256 hash of the raw public key.
+func keyFingerprint(pub ed25519.PublicKey) string {
+	h := sha256.Sum256(pub)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(h[:])
+}
+
+// keygenCommand implements `keygen [--force] <file>`, which creates an Ed25519
+// key pair for public-key authentication. The private key is written to file,
+// readable by the owner only, and the public key to file.pub, to be registered
+// with the server operators together with the printed fingerprint.
+func keygenCommand(args []string) {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	force := fs.Bool("force", false, "overwrite an existing key")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		log.Fatalf("❌ Usage: keygen [--force] <file>")
+	}
+	path := fs.Arg(0)
+
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		log.Fatalf("❌ Failed to generate key: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		log.Fatalf("❌ Failed to encode private key: %v", err)
+	}
+	pubDer, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		log.Fatalf("❌ Failed to encode public key: %v", err)
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if *force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, 0o600)
+	if err != nil {
+		log.Fatalf("❌ Failed to create private key file: %v", err)
+	}
+	if err := pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der}); err != nil {
+		log.Fatalf("❌ Failed to write private key file: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatalf("❌ Failed to write private key file: %v", err)
+	}
+	pubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDer})
+	if err := os.WriteFile(path+".pub", pubPEM, 0o644); err != nil {
+		log.Fatalf("❌ Failed to write public key file: %v", err)
+	}
+
+	fmt.Printf("🔑 Private key written to %s, public key to %s.pub\n", path, path)
+	fmt.Printf("Fingerprint: %s\n\n%s", keyFingerprint(pub), pubPEM)
+	fmt.Println("Register the public key with the server, then set private-key-file instead of secret-key.")
+}
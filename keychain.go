@@ -0,0 +1,90 @@
+//go:build !minimal
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/zalando/go-keyring"
+)
+
+// keychainSupported reports whether the build can store secret keys in the
+// OS keychain.
+const keychainSupported = true
+
+// keychainService is the service name the secret keys are stored under in the
+// macOS Keychain, the Windows Credential Manager or the Secret Service (libsecret).
+const keychainService = "jerusalem-client"
+
+// keychainAccount identifies the secret of a client ID on a server.
+func keychainAccount(config *Config) string {
+	if config.Server == "" {
+		return config.ClientID
+	}
+	return config.ClientID + "@" + config.Server
+}
+
+// readSecretFromKeychain loads config.SecretKey from the OS keychain if no
+// secret key is configured otherwise. A missing entry is not an error, and an
+// unavailable keychain, such as on a headless server without a Secret Service,
+// is only logged.
+func readSecretFromKeychain(config *Config) {
+	if config.SecretKey != "" || config.PrivateKey != nil || config.OIDC.enabled() || config.ClientID == "" {
+		return
+	}
+	secret, err := keyring.Get(keychainService, keychainAccount(config))
+	switch {
+	case errors.Is(err, keyring.ErrNotFound):
+	case err != nil:
+		log.Printf("⚠️ Failed to read secret key from the keychain: %v", err)
+	default:
+		config.SecretKey = secret
+	}
+}
+
+// loginCommand implements `login`, which saves the secret key of the configured
+// client ID and server in the OS keychain, so it does not have to be stored in
+// a plaintext file. The key is read from stdin, or prompted for without echo.
+// With an identity provider configured, it signs in there instead.
+func loginCommand(args []string) {
+	config := loginConfig("login", args)
+	if config.OIDC.enabled() {
+		oidcLogin(config)
+		return
+	}
+	secret, err := readSecretFromStdin()
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	config.SecretKey = secret
+	if err := saveSecretToKeychain(config); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	fmt.Printf("✅ Secret key for %s saved to the keychain\n", keychainAccount(config))
+}
+
+// saveSecretToKeychain stores config.SecretKey in the OS keychain, where
+// readSecretFromKeychain finds it for the client ID and server of config.
+func saveSecretToKeychain(config *Config) error {
+	if err := keyring.Set(keychainService, keychainAccount(config), config.SecretKey); err != nil {
+		return fmt.Errorf("failed to save secret key to the keychain: %w", err)
+	}
+	return nil
+}
+
+// logoutCommand implements `logout`, which removes the secret key or the
+// login to the identity provider saved by login.
+func logoutCommand(args []string) {
+	config := loginConfig("logout", args)
+	if config.OIDC.enabled() {
+		oidcLogout(config)
+		return
+	}
+	err := keyring.Delete(keychainService, keychainAccount(config))
+	if err != nil && !errors.Is(err, keyring.ErrNotFound) {
+		log.Fatalf("❌ Failed to remove secret key from the keychain: %v", err)
+	}
+	fmt.Printf("✅ Secret key for %s removed from the keychain\n", keychainAccount(config))
+}
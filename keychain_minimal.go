@@ -0,0 +1,40 @@
+//go:build minimal
+
+package main
+
+import (
+	"errors"
+	"log"
+)
+
+// keychainSupported reports whether the build can store secret keys in the
+// OS keychain.
+const keychainSupported = false
+
+// readSecretFromKeychain does nothing; the minimal build has no keychain
+// support, so the secret key must come from the config, a file or Vault.
+func readSecretFromKeychain(*Config) {}
+
+// saveSecretToKeychain fails, the minimal build has no keychain support.
+func saveSecretToKeychain(*Config) error {
+	return errors.New("the keychain is not available in the minimal build")
+}
+
+// loginCommand signs in to the configured identity provider; saving a secret
+// key in the keychain is not available in the minimal build.
+func loginCommand(args []string) {
+	config := loginConfig("login", args)
+	if !config.OIDC.enabled() {
+		log.Fatal("❌ login is not available in the minimal build, set secret-key-file or oidc-issuer instead")
+	}
+	oidcLogin(config)
+}
+
+// logoutCommand removes the login to the configured identity provider.
+func logoutCommand(args []string) {
+	config := loginConfig("logout", args)
+	if !config.OIDC.enabled() {
+		log.Fatal("❌ logout is not available in the minimal build")
+	}
+	oidcLogout(config)
+}
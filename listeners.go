@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// autoPort can be configured instead of a port number for local listeners to
+// let the operating system pick a free port, which is then logged.
+const autoPort = "auto"
+
+// localListener is a listener the client opens on the loopback interface.
+type localListener struct {
+	component string // Name of the component, used in errors.
+	port      string // Configured port, a number or autoPort.
+	l         net.Listener
+}
+
+// openLocalListeners opens the given listeners up front, before the tunnel is
+// established. All of them are tried, so that every port conflict is reported
+// in a single error that names the conflicting components; if any of them
+// fails, the ones that were opened are closed again.
+func openLocalListeners(listeners ...*localListener) error {
+	var errs []error
+	for _, ll := range listeners {
+		port := ll.port
+		if port == autoPort {
+			port = "0"
+		}
+		l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", port))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s on port %s: %w", ll.component, ll.port, err))
+			continue
+		}
+		ll.l = l
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	for _, ll := range listeners {
+		if ll.l != nil {
+			ll.l.Close()
+			ll.l = nil
+		}
+	}
+	return fmt.Errorf("local port conflict: %w", errors.Join(errs...))
+}
+
+// validLocalPort reports an error if port is neither empty, autoPort nor a
+// port number.
+func validLocalPort(key, port string) error {
+	if port == "" || port == autoPort {
+		return nil
+	}
+	if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+		return fmt.Errorf("invalid %s %q, use a port number or %s", key, port, autoPort)
+	}
+	return nil
+}
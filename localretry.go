@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Bounds of the delay between attempts to reach the local service, see
+// WithLocalRetry.
+const (
+	localRetryMinDelay = 100 * time.Millisecond
+	localRetryMaxDelay = 2 * time.Second
+)
+
+// dialLocal connects to the local service host:port for pc. With a retry
+// window set, failed attempts are repeated with backoff until the window has
+// passed, so visitors arriving while the service restarts wait for it instead
+// of failing. Aborting pc cancels the retries.
+func (c *Client) dialLocal(pc *proxyConn, host string, port uint16) (net.Conn, error) {
+	if c.localRetry <= 0 {
+		return establishConnectionWithTimeout(context.Background(), host, port, c.preferIP)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.localRetry)
+	defer cancel()
+	pc.setCloser(cancel)
+
+	delay := localRetryMinDelay
+	var lastErr error
+	for attempt := 1; ; attempt++ {
+		conn, err := establishConnectionWithTimeout(ctx, host, port, c.preferIP)
+		if err == nil {
+			if attempt > 1 {
+				c.logger.Printf("🔁 Reached the local service after %d attempts\n", attempt)
+			}
+			return conn, nil
+		}
+		if ctx.Err() == nil || lastErr == nil {
+			lastErr = err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("gave up after %d attempts: %w", attempt, lastErr)
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, localRetryMaxDelay)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultLogMaxSize    = 100 * 1000 * 1000 // Bytes after which the log file is rotated.
+	defaultLogMaxBackups = 7                 // Rotated log files kept.
+
+	// logBackupTime is the timestamp format in the names of rotated log files.
+	logBackupTime = "2006-01-02T15-04-05.000"
+)
+
+// LogRotation configures the log file of the client and when it is rotated.
+// A rotated file is renamed to the name of the log file with the time of the
+// rotation appended, e.g. client-2024-05-01T10-00-00.000.log.
+type LogRotation struct {
+	File       string        // Log file, empty to log to stderr.
+	MaxSize    int64         // Rotate once the file would grow beyond this many bytes, 0 for no limit.
+	Every      time.Duration // Rotate at this interval, 0 to rotate on size only.
+	MaxBackups int           // Rotated files kept, 0 to keep all.
+	MaxAge     time.Duration // Remove rotated files older than this, 0 to keep them regardless of age.
+	Compress   bool          // Gzip rotated files.
+}
+
+// readLogRotation fills config.Log from the log-* keys.
+func readLogRotation(config *Config) error {
+	config.Log = LogRotation{
+		File:       viper.GetString("log-file"),
+		MaxSize:    defaultLogMaxSize,
+		Every:      viper.GetDuration("log-rotate-every"),
+		MaxBackups: defaultLogMaxBackups,
+		MaxAge:     viper.GetDuration("log-max-age"),
+		Compress:   viper.GetBool("log-compress"),
+	}
+	if s := viper.GetString("log-max-size"); s != "" {
+		n, err := parseRate(s)
+		if err != nil {
+			return fmt.Errorf("invalid log-max-size %q, use a size such as 100MB", s)
+		}
+		config.Log.MaxSize = n
+	}
+	if viper.IsSet("log-max-backups") {
+		config.Log.MaxBackups = viper.GetInt("log-max-backups")
+	}
+	if config.Log.MaxBackups < 0 || config.Log.Every < 0 || config.Log.MaxAge < 0 {
+		return fmt.Errorf("log-max-backups, log-rotate-every and log-max-age must not be negative")
+	}
+	return nil
+}
+
+// rotatingFile is a log file that rotates itself by size and age and removes
+// old rotated files, so a long-running client does not fill the disk.
+type rotatingFile struct {
+	cfg LogRotation
+
+	mu     sync.Mutex // Guards f, size and opened.
+	f      *os.File
+	size   int64
+	opened time.Time
+
+	cleanup sync.Mutex     // Serialises compressing and removing rotated files.
+	tidying sync.WaitGroup // Background cleanups, waited for by Close.
+}
+
+// openLogFile opens the log file of cfg for appending.
+func openLogFile(cfg LogRotation) (*rotatingFile, error) {
+	r := &rotatingFile{cfg: cfg}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open opens or creates the log file.
+func (r *rotatingFile) open() error {
+	if dir := filepath.Dir(r.cfg.File); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("failed to create log directory: %w", err)
+		}
+	}
+	f, err := os.OpenFile(r.cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	r.f, r.size, r.opened = f, info.Size(), time.Now()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.due(len(p)) {
+		if err := r.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "⚠️ Failed to rotate log file: %v\n", err)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// due reports whether the file must be rotated before writing n more bytes.
+func (r *rotatingFile) due(n int) bool {
+	if r.cfg.MaxSize > 0 && r.size > 0 && r.size+int64(n) > r.cfg.MaxSize {
+		return true
+	}
+	return r.cfg.Every > 0 && time.Since(r.opened) >= r.cfg.Every
+}
+
+// rotate renames the current file and starts a new one. The rotated files
+// are compressed and pruned in the background.
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	backup := r.backupName(time.Now())
+	if err := os.Rename(r.cfg.File, backup); err != nil {
+		// Keep logging to the file that could not be renamed.
+		return errors.Join(err, r.open())
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	r.tidying.Add(1)
+	go func() {
+		defer r.tidying.Done()
+		r.tidy(backup)
+	}()
+	return nil
+}
+
+// backupName returns the name of the file rotated at t.
+func (r *rotatingFile) backupName(t time.Time) string {
+	ext := filepath.Ext(r.cfg.File)
+	return strings.TrimSuffix(r.cfg.File, ext) + "-" + t.Format(logBackupTime) + ext
+}
+
+// tidy compresses the rotated file backup if configured and removes the
+// rotated files beyond the retention limits.
+func (r *rotatingFile) tidy(backup string) {
+	r.cleanup.Lock()
+	defer r.cleanup.Unlock()
+	if r.cfg.Compress {
+		if err := gzipFile(backup); err != nil {
+			fmt.Fprintf(os.Stderr, "⚠️ Failed to compress rotated log file: %v\n", err)
+		}
+	}
+
+	ext := filepath.Ext(r.cfg.File)
+	prefix := strings.TrimSuffix(r.cfg.File, ext) + "-"
+	matches, _ := filepath.Glob(prefix + "*")
+	type rotated struct {
+		path string
+		t    time.Time
+	}
+	var backups []rotated
+	for _, path := range matches {
+		stamp := strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(path, prefix), ".gz"), ext)
+		if t, err := time.ParseInLocation(logBackupTime, stamp, time.Local); err == nil {
+			backups = append(backups, rotated{path, t})
+		}
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].t.After(backups[j].t) })
+	for i, b := range backups {
+		expired := r.cfg.MaxAge > 0 && time.Since(b.t) > r.cfg.MaxAge
+		if (r.cfg.MaxBackups > 0 && i >= r.cfg.MaxBackups) || expired {
+			_ = os.Remove(b.path)
+		}
+	}
+}
+
+// gzipFile replaces path with a gzip-compressed path.gz.
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Close closes the log file once the rotated files are cleaned up.
+func (r *rotatingFile) Close() error {
+	r.tidying.Wait()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
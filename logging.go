@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// logOutput is the destination of the standard logger. It stamps every line with
+// an RFC 3339 timestamp (nanosecond precision) in the configured time zone, UTC
+// by default, so client logs can be correlated with server and external logs.
+var logOutput = &timestampWriter{w: os.Stderr, loc: time.UTC}
+
+func init() {
+	log.SetFlags(0)
+	log.SetOutput(logOutput)
+}
+
+// timestampWriter prefixes each write with the current time.
+type timestampWriter struct {
+	mu    sync.Mutex
+	w     io.Writer
+	loc   *time.Location
+	plain bool // Strip emoji from the lines.
+}
+
+func (t *timestampWriter) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ts := time.Now().In(t.loc).Format(time.RFC3339Nano)
+	line := p
+	if t.plain {
+		line = stripEmoji(p)
+	}
+	debugging.Load().logLine(ts, line)
+	if _, err := fmt.Fprintf(t.w, "%s %s", ts, line); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// setLogOutput changes where log lines are written to and returns where they
+// were written to before.
+func setLogOutput(w io.Writer) (prev io.Writer) {
+	logOutput.mu.Lock()
+	defer logOutput.mu.Unlock()
+	prev, logOutput.w = logOutput.w, w
+	return prev
+}
+
+// setLogPlain enables or disables stripping emoji from log lines, for log
+// collectors such as the systemd journal or Docker that expect plain text.
+func setLogPlain(plain bool) {
+	logOutput.mu.Lock()
+	defer logOutput.mu.Unlock()
+	logOutput.plain = plain
+}
+
+// stripEmoji removes the emoji from p, along with the space following each.
+func stripEmoji(p []byte) []byte {
+	out := make([]byte, 0, len(p))
+	skipSpace := false
+	for _, r := range string(p) {
+		if isEmoji(r) {
+			skipSpace = true
+			continue
+		}
+		if skipSpace && r == ' ' {
+			skipSpace = false
+			continue
+		}
+		skipSpace = false
+		out = utf8.AppendRune(out, r)
+	}
+	return out
+}
+
+// isEmoji reports whether r is an emoji or a modifier that is part of one.
+func isEmoji(r rune) bool {
+	switch {
+	case r >= 0x1F000 && r <= 0x1FAFF, // Pictographs, emoticons, transport and map symbols.
+		r >= 0x2300 && r <= 0x23FF, // Miscellaneous technical, such as ⏱.
+		r >= 0x2600 && r <= 0x27BF, // Miscellaneous symbols and dingbats, such as ⚠ and ✅.
+		r >= 0x2B00 && r <= 0x2BFF, // Arrows and shapes, such as ⬆.
+		r == 0x200D, r == 0xFE0F:   // Zero width joiner and emoji presentation selector.
+		return true
+	}
+	return false
+}
+
+// setLogTimezone sets the time zone of the log timestamps. tz is an IANA zone
+// name such as "Europe/Berlin", "Local" for the system zone, or empty for UTC.
+func setLogTimezone(tz string) error {
+	loc := time.UTC
+	switch {
+	case tz == "" || strings.EqualFold(tz, "utc"):
+	case strings.EqualFold(tz, "local"):
+		loc = time.Local
+	default:
+		l, err := time.LoadLocation(tz)
+		if err != nil {
+			return fmt.Errorf("invalid log-timezone %q: %w", tz, err)
+		}
+		loc = l
+	}
+
+	logOutput.mu.Lock()
+	defer logOutput.mu.Unlock()
+	logOutput.loc = loc
+	return nil
+}
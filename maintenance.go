@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// maintenanceReadTimeout bounds how long the client waits for a visitor's request
+// before answering it with the maintenance page.
+const maintenanceReadTimeout = 5 * time.Second
+
+// SetMaintenance switches the tunnel in or out of maintenance mode. While enabled,
+// proxied connections are answered by the client itself and the local service is
+// never contacted. If page is non-empty it is served as the body of an HTTP 503
+// response; otherwise the connection is closed immediately.
+// It is safe to call SetMaintenance while the client is listening.
+func (c *Client) SetMaintenance(enabled bool, page []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maintenance = enabled
+	c.maintenancePage = page
+}
+
+// maintenanceState returns whether maintenance mode is enabled and the page to serve.
+func (c *Client) maintenanceState() (bool, []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.maintenance, c.maintenancePage
+}
+
+// serveMaintenance answers a visitor connection while the tunnel is in maintenance
+// mode. Without a page the connection is simply left for the caller to close.
+// With a page, the visitor's request head is read (best effort, so closing the
+// socket does not reset the response) and a 503 Service Unavailable is written.
+func serveMaintenance(conn net.Conn, page []byte) error {
+	return serveErrorPage(conn, http.StatusServiceUnavailable, page)
+}
+
+// serveErrorPage answers a visitor connection with an HTTP error status and
+// page instead of relaying it, as described for serveMaintenance.
+func serveErrorPage(conn net.Conn, status int, page []byte) error {
+	if len(page) == 0 {
+		return nil
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(maintenanceReadTimeout))
+	if req, err := http.ReadRequest(bufio.NewReader(conn)); err == nil {
+		_ = req.Body.Close()
+	}
+
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	fmt.Fprintf(w, "Content-Type: text/html; charset=utf-8\r\n")
+	fmt.Fprintf(w, "Content-Length: %d\r\n", len(page))
+	fmt.Fprintf(w, "Connection: close\r\n\r\n")
+	w.Write(page)
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write %d page: %w", status, err)
+	}
+	return nil
+}
+
+// setMaintenance switches the active client, the clients that replace it and
+// the extra tunnels in or out of maintenance mode, serving the configured
+// maintenance page. The next reload applies the maintenance setting of the
+// config file again. It reports whether that changed anything.
+func (r *runner) setMaintenance(enabled bool) (bool, error) {
+	r.mu.Lock()
+	next, client := r.config, r.client
+	r.mu.Unlock()
+	if next.Maintenance == enabled {
+		return false, nil
+	}
+	next.Maintenance = enabled
+	if err := applyMaintenance(client, &next); err != nil {
+		return false, err
+	}
+	r.mu.Lock()
+	r.config.Maintenance = enabled
+	r.mu.Unlock()
+	if !enabled {
+		log.Println("🚧 Maintenance mode disabled, proxying to the local service again")
+	}
+	for _, t := range r.tunnels.runners() {
+		if _, err := t.setMaintenance(enabled); err != nil {
+			log.Printf("⚠️ Tunnel %s: %v", t.config.Tunnel, err)
+		}
+	}
+	return true, nil
+}
+
+// maintenanceCommand implements `maintenance [--socket path] on|off`, which
+// switches the client running on the control socket in or out of maintenance
+// mode.
+func maintenanceCommand(args []string) {
+	fs := flag.NewFlagSet("maintenance", flag.ExitOnError)
+	socket := fs.String("socket", defaultControlSocket, "control socket of the running client")
+	_ = fs.Parse(args)
+	mode := fs.Arg(0)
+	if fs.NArg() != 1 || mode != "on" && mode != "off" {
+		configFatalf("❌ Usage: maintenance [--socket path] on|off")
+	}
+	sendControlCommand(*socket, "maintenance "+mode, "switch maintenance mode "+mode)
+}
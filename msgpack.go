@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	// MsgpackCodec is the capability offered in the hello message to switch the
+	// control connection to length-prefixed MessagePack.
+	MsgpackCodec = "msgpack"
+	// maxFrameSize bounds the size of a single MessagePack message.
+	maxFrameSize = 1 << 20
+)
+
+// msgpackFraming encodes messages as MessagePack, each preceded by its length
+// as a 4-byte big-endian integer. Field names are taken from the json struct
+// tags, so both encodings share the same schema. The encoder, decoder and their
+// buffers are reused for every message.
+type msgpackFraming struct {
+	r *bufio.Reader
+	w io.Writer
+
+	mu  sync.Mutex // Guards buf and enc, as messages may be sent concurrently.
+	buf bytes.Buffer
+	enc *msgpack.Encoder
+
+	payload []byte
+	src     bytes.Reader
+	dec     *msgpack.Decoder
+}
+
+// UseMsgpack switches the codec to MessagePack framing. Data the JSON decoder
+// has already buffered is not lost.
+func (d *Codec) UseMsgpack() {
+	f := &msgpackFraming{r: bufio.NewReader(d.remainder()), w: d.conn}
+	f.enc = msgpack.NewEncoder(&f.buf)
+	f.enc.SetCustomStructTag("json")
+	f.dec = msgpack.NewDecoder(&f.src)
+	f.dec.SetCustomStructTag("json")
+	d.binary = f
+}
+
+func (f *msgpackFraming) encode(v interface{}) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.buf.Reset()
+	f.buf.Write([]byte{0, 0, 0, 0})
+	if err := f.enc.Encode(v); err != nil {
+		return err
+	}
+	b := f.buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	_, err := f.w.Write(b)
+	return err
+}
+
+func (f *msgpackFraming) decode(v interface{}) error {
+	payload, err := f.readFrame()
+	if err != nil {
+		return err
+	}
+	return f.unmarshal(payload, v)
+}
+
+// readFrame reads the payload of the next message. It is only valid until the
+// next call.
+func (f *msgpackFraming) readFrame() ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(f.r, header[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(header[:])
+	if n > maxFrameSize {
+		return nil, fmt.Errorf("message of %d bytes exceeds the limit of %d", n, maxFrameSize)
+	}
+	if cap(f.payload) < int(n) {
+		f.payload = make([]byte, n)
+	}
+	payload := f.payload[:n]
+	if _, err := io.ReadFull(f.r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// unmarshal decodes a message payload into v.
+func (f *msgpackFraming) unmarshal(payload []byte, v interface{}) error {
+	f.src.Reset(payload)
+	f.dec.ResetReader(&f.src)
+	return f.dec.Decode(v)
+}
+
+// DecodeMsgpack decodes a server message like UnmarshalJSON, accepting the
+// port under "port" as well as "hello".
+func (m *ServerMessage) DecodeMsgpack(dec *msgpack.Decoder) error {
+	type schema ServerMessage // Same fields without this method.
+	var w struct {
+		schema
+		AltPort uint16 `json:"port,omitempty"`
+	}
+	if err := dec.Decode(&w); err != nil {
+		return err
+	}
+	*m = ServerMessage(w.schema)
+	if m.Port == 0 {
+		m.Port = w.AltPort
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/hashicorp/yamux"
+)
+
+// MuxCapability is the capability offered in the hello message to multiplex
+// data connections over a single session.
+const MuxCapability = "yamux"
+
+// bufferedConn is a net.Conn whose reads come from r, typically the remainder
+// of a Codec.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (bc *bufferedConn) Read(p []byte) (int, error) {
+	return bc.r.Read(p)
+}
+
+// openStream opens a new stream for a visitor on the multiplexed session. The
+// stream is authenticated by the session, so no handshake is needed.
+func (c *Client) openStream() (*Codec, error) {
+	sess, err := c.muxSession()
+	if err != nil {
+		return nil, err
+	}
+	stream, err := sess.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stream: %w", err)
+	}
+	return NewCodec(stream), nil
+}
+
+// muxSession returns the multiplexed data session, establishing it on first
+// use and again after it has failed. The session is an authenticated
+// connection to the server on which the client sends a "Multiplex" message
+// and then speaks yamux, opening one stream per visitor.
+func (c *Client) muxSession() (*yamux.Session, error) {
+	c.muxMu.Lock()
+	defer c.muxMu.Unlock()
+	if c.mux != nil && !c.mux.IsClosed() {
+		return c.mux, nil
+	}
+
+	rc, err := c.dialServer()
+	if err != nil {
+		return nil, err
+	}
+	if err := rc.Send(ClientMessage{Type: MtMultiplex}); err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("failed to send multiplex message: %w", err)
+	}
+
+	cfg := yamux.DefaultConfig()
+	cfg.LogOutput = c.logger.Writer()
+	conn := &bufferedConn{Conn: rc.conn, r: rc.remainder()}
+	sess, err := yamux.Client(conn, cfg)
+	if err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("failed to start multiplexed session: %w", err)
+	}
+	c.mux = sess
+	return sess, nil
+}
+
+// closeMux closes the multiplexed session, if any, along with its streams.
+func (c *Client) closeMux() {
+	c.muxMu.Lock()
+	defer c.muxMu.Unlock()
+	if c.mux != nil {
+		c.mux.Close()
+		c.mux = nil
+	}
+}
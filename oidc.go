@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	// deviceCodeGrant is the grant type of the OAuth device authorization flow
+	// (RFC 8628).
+	deviceCodeGrant = "urn:ietf:params:oauth:grant-type:device_code"
+	// defaultOIDCScopes are requested unless oidc-scopes is set; offline_access
+	// asks for a refresh token, so the login outlives the access token.
+	defaultOIDCScopes = "openid offline_access"
+	// tokenExpiryMargin is how long before it expires an access token is
+	// refreshed, so it does not expire during a handshake.
+	tokenExpiryMargin = time.Minute
+)
+
+// OIDCSettings names the identity provider that `login` signs users in with,
+// whose access token then authenticates the client instead of a secret key.
+type OIDCSettings struct {
+	Issuer   string // Issuer URL, whose discovery document names the endpoints.
+	ClientID string // OAuth client ID of the jerusalem client at the provider.
+	Scopes   string // Space-separated scopes to request.
+}
+
+// readOIDC reads oidc-issuer, oidc-client-id and oidc-scopes into config.
+func readOIDC(config *Config) error {
+	s := OIDCSettings{
+		Issuer:   strings.TrimSuffix(viper.GetString("oidc-issuer"), "/"),
+		ClientID: viper.GetString("oidc-client-id"),
+		Scopes:   strings.Join(readStringList("oidc-scopes"), " "),
+	}
+	if s.Scopes == "" {
+		s.Scopes = defaultOIDCScopes
+	}
+	if (s.Issuer == "") != (s.ClientID == "") {
+		return fmt.Errorf("oidc-issuer and oidc-client-id must be set together")
+	}
+	if s.Issuer != "" {
+		if u, err := url.Parse(s.Issuer); err != nil || u.Scheme != "https" && u.Hostname() != "localhost" && u.Hostname() != "127.0.0.1" {
+			return fmt.Errorf("invalid oidc-issuer %q, use an https URL", s.Issuer)
+		}
+	}
+	config.OIDC = s
+	return nil
+}
+
+// enabled reports whether an identity provider is configured.
+func (s OIDCSettings) enabled() bool {
+	return s.Issuer != ""
+}
+
+// oidcToken is the cached result of a login.
+type oidcToken struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	Expiry       time.Time `json:"expiry,omitempty"`
+}
+
+// valid reports whether the access token can still be used.
+func (t oidcToken) valid() bool {
+	return t.AccessToken != "" && (t.Expiry.IsZero() || time.Until(t.Expiry) > tokenExpiryMargin)
+}
+
+// tokenResponse is the answer of the token endpoint.
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	RefreshToken     string `json:"refresh_token"`
+	ExpiresIn        int    `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// token converts r into the token to cache, keeping refresh, the refresh
+// token used, if the provider did not issue a new one.
+func (r tokenResponse) token(refresh string) oidcToken {
+	t := oidcToken{AccessToken: r.AccessToken, RefreshToken: r.RefreshToken}
+	if t.RefreshToken == "" {
+		t.RefreshToken = refresh
+	}
+	if r.ExpiresIn > 0 {
+		t.Expiry = time.Now().Add(time.Duration(r.ExpiresIn) * time.Second)
+	}
+	return t
+}
+
+// err returns the error the provider answered with, nil if there is none.
+func (r tokenResponse) err() error {
+	if r.Error == "" {
+		return nil
+	}
+	if r.ErrorDescription != "" {
+		return fmt.Errorf("%s: %s", r.Error, r.ErrorDescription)
+	}
+	return errors.New(r.Error)
+}
+
+// oidcProvider talks to the endpoints of an identity provider.
+type oidcProvider struct {
+	settings OIDCSettings
+	http     http.Client
+
+	once      sync.Once
+	discovery struct {
+		DeviceEndpoint string `json:"device_authorization_endpoint"`
+		TokenEndpoint  string `json:"token_endpoint"`
+	}
+	discoveryErr error
+}
+
+// newOIDCProvider returns the provider of s.
+func newOIDCProvider(s OIDCSettings) *oidcProvider {
+	return &oidcProvider{settings: s, http: http.Client{Timeout: NetworkTimeout}}
+}
+
+// discover fetches the discovery document of the provider, once.
+func (p *oidcProvider) discover(ctx context.Context) error {
+	p.once.Do(func() {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.settings.Issuer+"/.well-known/openid-configuration", nil)
+		if err != nil {
+			p.discoveryErr = err
+			return
+		}
+		resp, err := p.http.Do(req)
+		if err != nil {
+			p.discoveryErr = fmt.Errorf("failed to fetch the OIDC discovery document: %w", err)
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			p.discoveryErr = fmt.Errorf("failed to fetch the OIDC discovery document: %s", resp.Status)
+			return
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&p.discovery); err != nil {
+			p.discoveryErr = fmt.Errorf("invalid OIDC discovery document: %w", err)
+			return
+		}
+		if p.discovery.TokenEndpoint == "" {
+			p.discoveryErr = errors.New("the OIDC discovery document names no token_endpoint")
+		}
+	})
+	return p.discoveryErr
+}
+
+// post sends form to endpoint and decodes the JSON answer into v. Error
+// answers of the OAuth endpoints are decoded too, so their error field can be
+// inspected.
+func (p *oidcProvider) post(ctx context.Context, endpoint string, form url.Values, v any) error {
+	form.Set("client_id", p.settings.ClientID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("invalid answer from %s (%s): %w", endpoint, resp.Status, err)
+	}
+	return nil
+}
+
+// deviceLogin signs the user in with the device authorization flow: it shows
+// the code to enter in a browser, on any device, and polls the token endpoint
+// until the user has approved the login, denied it or the code expired.
+func (p *oidcProvider) deviceLogin(ctx context.Context) (oidcToken, error) {
+	if err := p.discover(ctx); err != nil {
+		return oidcToken{}, err
+	}
+	if p.discovery.DeviceEndpoint == "" {
+		return oidcToken{}, errors.New("the identity provider does not support the device authorization flow")
+	}
+	var auth struct {
+		DeviceCode              string `json:"device_code"`
+		UserCode                string `json:"user_code"`
+		VerificationURI         string `json:"verification_uri"`
+		VerificationURIComplete string `json:"verification_uri_complete"`
+		ExpiresIn               int    `json:"expires_in"`
+		Interval                int    `json:"interval"`
+		tokenResponse
+	}
+	if err := p.post(ctx, p.discovery.DeviceEndpoint, url.Values{"scope": {p.settings.Scopes}}, &auth); err != nil {
+		return oidcToken{}, fmt.Errorf("failed to start the login: %w", err)
+	}
+	if err := auth.err(); err != nil {
+		return oidcToken{}, fmt.Errorf("failed to start the login: %w", err)
+	}
+
+	fmt.Printf("🔐 To sign in, open %s and enter the code %s\n", auth.VerificationURI, auth.UserCode)
+	if auth.VerificationURIComplete != "" {
+		fmt.Printf("   or open %s\n", auth.VerificationURIComplete)
+	}
+	interval := time.Duration(max(auth.Interval, 5)) * time.Second
+	deadline := time.Now().Add(time.Duration(auth.ExpiresIn) * time.Second)
+	for auth.ExpiresIn == 0 || time.Now().Before(deadline) {
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return oidcToken{}, ctx.Err()
+		}
+		var resp tokenResponse
+		form := url.Values{"grant_type": {deviceCodeGrant}, "device_code": {auth.DeviceCode}}
+		if err := p.post(ctx, p.discovery.TokenEndpoint, form, &resp); err != nil {
+			return oidcToken{}, fmt.Errorf("failed to complete the login: %w", err)
+		}
+		switch resp.Error {
+		case "":
+			return resp.token(""), nil
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		default:
+			return oidcToken{}, fmt.Errorf("login failed: %w", resp.err())
+		}
+	}
+	return oidcToken{}, errors.New("login failed: the code expired before it was entered")
+}
+
+// refresh exchanges the refresh token of t for a new access token.
+func (p *oidcProvider) refresh(ctx context.Context, t oidcToken) (oidcToken, error) {
+	if err := p.discover(ctx); err != nil {
+		return oidcToken{}, err
+	}
+	var resp tokenResponse
+	form := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {t.RefreshToken}}
+	if err := p.post(ctx, p.discovery.TokenEndpoint, form, &resp); err != nil {
+		return oidcToken{}, fmt.Errorf("failed to refresh the login: %w", err)
+	}
+	if err := resp.err(); err != nil {
+		return oidcToken{}, fmt.Errorf("failed to refresh the login, run `jerusalem-client login` again: %w", err)
+	}
+	return resp.token(t.RefreshToken), nil
+}
+
+// tokenCachePath returns the file the token of a login with s is kept in,
+// below the user cache directory and named after the provider and client.
+func tokenCachePath(s OIDCSettings) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find the cache directory: %w", err)
+	}
+	h := sha256.Sum256([]byte(s.Issuer + "\x00" + s.ClientID))
+	return filepath.Join(dir, "jerusalem-client", "oidc-"+hex.EncodeToString(h[:8])+".json"), nil
+}
+
+// loadToken reads the cached token of a login with s.
+func loadToken(s OIDCSettings) (oidcToken, error) {
+	var t oidcToken
+	path, err := tokenCachePath(s)
+	if err != nil {
+		return t, err
+	}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return t, fmt.Errorf("%w: not logged in to %s, run `jerusalem-client login` first", ErrAuthFailed, s.Issuer)
+	}
+	if err != nil {
+		return t, fmt.Errorf("failed to read the cached login: %w", err)
+	}
+	if err := json.Unmarshal(b, &t); err != nil {
+		return t, fmt.Errorf("invalid cached login %s: %w", path, err)
+	}
+	return t, nil
+}
+
+// saveToken caches t for a login with s, readable by the user only.
+func saveToken(s OIDCSettings, t oidcToken) error {
+	path, err := tokenCachePath(s)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("failed to create the login cache directory: %w", err)
+	}
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return fmt.Errorf("failed to cache the login: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to cache the login: %w", err)
+	}
+	return nil
+}
+
+// tokenSource hands out the cached access token of a login, refreshing it
+// shortly before it expires. It is shared by every client of the process, so
+// a refresh token is only used once.
+type tokenSource struct {
+	provider *oidcProvider
+
+	mu  sync.Mutex
+	tok oidcToken
+}
+
+// tokenSources are the token sources of the process, by provider and client.
+var tokenSources struct {
+	mu      sync.Mutex
+	sources map[OIDCSettings]*tokenSource
+}
+
+// tokenSourceFor returns the token source of logins with s.
+func tokenSourceFor(s OIDCSettings) *tokenSource {
+	tokenSources.mu.Lock()
+	defer tokenSources.mu.Unlock()
+	if ts, ok := tokenSources.sources[s]; ok {
+		return ts
+	}
+	if tokenSources.sources == nil {
+		tokenSources.sources = make(map[OIDCSettings]*tokenSource)
+	}
+	ts := &tokenSource{provider: newOIDCProvider(s)}
+	tokenSources.sources[s] = ts
+	return ts
+}
+
+// Token returns a valid access token, refreshing and caching it again if
+// needed. Errors wrap ErrAuthFailed if the user has to log in again.
+func (ts *tokenSource) Token(ctx context.Context) (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	s := ts.provider.settings
+	if !ts.tok.valid() {
+		// Another process, or a new login, may have refreshed it in the meantime.
+		t, err := loadToken(s)
+		if err != nil {
+			return "", err
+		}
+		ts.tok = t
+	}
+	if ts.tok.valid() {
+		return ts.tok.AccessToken, nil
+	}
+	if ts.tok.RefreshToken == "" {
+		return "", fmt.Errorf("%w: the login to %s expired, run `jerusalem-client login` again", ErrAuthFailed, s.Issuer)
+	}
+	t, err := ts.provider.refresh(ctx, ts.tok)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrAuthFailed, err)
+	}
+	if err := saveToken(s, t); err != nil {
+		log.Printf("⚠️ %v", err)
+	}
+	ts.tok = t
+	return t.AccessToken, nil
+}
+
+// oidcLogin implements `login` with an identity provider configured: it signs
+// the user in with the device authorization flow and caches the token, which
+// `run` then authenticates with.
+func oidcLogin(config *Config) {
+	p := newOIDCProvider(config.OIDC)
+	t, err := p.deviceLogin(context.Background())
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	if err := saveToken(config.OIDC, t); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	fmt.Printf("✅ Logged in to %s\n", config.OIDC.Issuer)
+}
+
+// oidcLogout implements `logout` with an identity provider configured, which
+// removes the cached token.
+func oidcLogout(config *Config) {
+	path, err := tokenCachePath(config.OIDC)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Fatalf("❌ Failed to remove the cached login: %v", err)
+	}
+	fmt.Printf("✅ Logged out of %s\n", config.OIDC.Issuer)
+}
+
+// loginConfig parses the arguments of login and logout and returns the
+// configuration naming the keychain entry or the identity provider.
+func loginConfig(name string, args []string) *Config {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	configPath := fs.String("config", "", "config file (.yaml, .toml or .json)")
+	server := fs.String("server", "", "server address")
+	clientID := fs.String("client-id", "", "client ID")
+	_ = fs.Parse(args)
+	if *server != "" {
+		viper.Set("server", *server)
+	}
+	if *clientID != "" {
+		viper.Set("client-id", *clientID)
+	}
+
+	var config Config
+	if err := loadConfig(&config, *configPath); err != nil {
+		configFatalf("❌ Failed to read config file: %v", err)
+	}
+	if config.ClientID == "" && !config.OIDC.enabled() {
+		log.Fatalf("❌ Usage: %s [--config file] [--server host] --client-id id", name)
+	}
+	return &config
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"log"
+	"net"
+	"time"
+)
+
+// Option configures optional behaviour of a Client created by NewClient.
+type Option func(*Client)
+
+// WithLocalTarget sets the local host and port that visitors are forwarded to.
+// It can be changed later with SetLocalTarget.
+func WithLocalTarget(host string, port uint16) Option {
+	return func(c *Client) {
+		c.lh, c.lp = host, port
+	}
+}
+
+// WithClientID sets the client ID the client authenticates as.
+func WithClientID(id string) Option {
+	return func(c *Client) {
+		c.cid = id
+	}
+}
+
+// WithSecret authenticates the control and data connections with the answer
+// to the server's challenge derived from secret. Without it the client does
+// not authenticate, which only servers without a secret accept.
+func WithSecret(secret string) Option {
+	return func(c *Client) {
+		c.auth = NewAuthenticator(secret)
+	}
+}
+
+// WithRotatingSecret authenticates like WithSecret with primary, falling back
+// to secondary for a connection whose handshake the server refuses. After a
+// fallback succeeds, secondary is tried first. An empty secondary disables the
+// fallback.
+func WithRotatingSecret(primary, secondary string) Option {
+	return func(c *Client) {
+		c.auth = NewRotatingAuthenticator(primary, secondary)
+	}
+}
+
+// WithPrivateKey authenticates the control and data connections with an
+// Ed25519 signature of the server's challenge made with key, instead of a
+// shared secret. The server must know the public key of the client.
+func WithPrivateKey(key ed25519.PrivateKey) Option {
+	return func(c *Client) {
+		c.auth = NewKeyAuthenticator(key)
+	}
+}
+
+// WithToken authenticates the control and data connections with an access
+// token of an identity provider, as returned by token for each handshake,
+// instead of a shared secret. The server must trust the provider.
+func WithToken(token func(context.Context) (string, error)) Option {
+	return func(c *Client) {
+		c.auth = NewTokenAuthenticator(token)
+	}
+}
+
+// WithStrictHandshake refuses servers that do not support handshake nonces,
+// instead of answering their challenge alone. This protects against a
+// man-in-the-middle that strips the nonce capability from the challenge, once
+// all servers support it.
+func WithStrictHandshake() Option {
+	return func(c *Client) {
+		c.strictAuth = true
+	}
+}
+
+// WithLabel announces a human-readable label for the session, such as
+// "mahin-laptop staging api", in the hello message, so operators of the server
+// can tell which tunnel belongs to whom.
+func WithLabel(label string) Option {
+	return func(c *Client) {
+		c.label = label
+	}
+}
+
+// WithTimeout bounds dialing the server, for the control connection and every
+// data connection, and waiting for the server's hello reply. By default dialing
+// may take up to two minutes and the reply NetworkTimeout.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.timeouts.Dial, c.timeouts.Handshake = d, d
+	}
+}
+
+// WithTimeouts sets the dial, handshake and read and write timeouts of the
+// client individually, see Timeouts.
+func WithTimeouts(t Timeouts) Option {
+	return func(c *Client) {
+		c.timeouts = t
+	}
+}
+
+// WithDialer dials the control and data connections with d, for example a
+// *net.Dialer bound to a local address or with tuned TCP keepalives, a proxy
+// chain or an in-memory transport for tests. The address passed to d is the
+// host:port of the server and the network is always "tcp"; the dial is
+// cancelled after the WithTimeout timeout. TCP Fast Open is only applied to a
+// *net.Dialer.
+func WithDialer(d Dialer) Option {
+	return func(c *Client) {
+		c.dialer = d
+	}
+}
+
+// WithLogger sends the log messages of the client to l instead of the
+// standard logger.
+func WithLogger(l *log.Logger) Option {
+	return func(c *Client) {
+		c.logger = l
+	}
+}
+
+// WithConn makes NewClient use conn as the control connection instead of dialing
+// the server itself. conn must be a fresh connection to the server on which no
+// messages have been exchanged yet; it is closed if the handshake fails.
+func WithConn(conn net.Conn) Option {
+	return func(c *Client) {
+		c.cc = NewCodec(conn)
+	}
+}
+
+// WithAuditLog records the start and end, byte counts and end reason of every
+// relayed connection in a. The log is not closed with the client, so it can be
+// shared with the clients that replace it.
+func WithAuditLog(a *AuditLog) Option {
+	return func(c *Client) {
+		c.audit = a
+	}
+}
+
+// WithTracer records the phases of relayed connections, the handshake of the
+// data connection, the accept message, the local dial and the relay, as
+// OpenTelemetry spans exported by t. The tracer is not closed with the client,
+// so it can be shared with the clients that replace it.
+func WithTracer(t *Tracer) Option {
+	return func(c *Client) {
+		c.tracer = t
+	}
+}
+
+// WithAccessControl only accepts connection requests from the visitors acl
+// admits, see SetAccessControl.
+func WithAccessControl(acl AccessControl) Option {
+	return func(c *Client) {
+		c.acl = acl
+	}
+}
+
+// WithTrafficQuota counts the traffic of the client against q and rejects
+// connection requests while one of its limits is reached. The quota is not
+// reset with the client, so it can be shared with the clients that replace it.
+func WithTrafficQuota(q *TrafficQuota) Option {
+	return func(c *Client) {
+		c.quota = q
+	}
+}
+
+// WithRemotePort asks the server for port as the public port of the tunnel,
+// instead of the free port it offers. The server may assign another port, in
+// which case a warning is logged; RemotePort reports the port assigned.
+func WithRemotePort(port uint16) Option {
+	return func(c *Client) {
+		c.requestPort = port
+	}
+}
+
+// WithTranscript records the session, its connections and their byte counts in t.
+func WithTranscript(t *Transcript) Option {
+	return func(c *Client) {
+		c.transcript = t
+	}
+}
+
+// WithoutSpinner disables the progress spinner Listen draws on the terminal.
+func WithoutSpinner() Option {
+	return func(c *Client) {
+		c.spinner = false
+	}
+}
+
+// WithBandwidthLimits throttles proxied traffic to the given limits.
+func WithBandwidthLimits(l BandwidthLimits) Option {
+	return func(c *Client) {
+		c.SetBandwidthLimits(l)
+	}
+}
+
+// WithMaxConnections limits the number of concurrently relayed connections,
+// see SetMaxConnections.
+func WithMaxConnections(max int, queueTimeout time.Duration) Option {
+	return func(c *Client) {
+		c.SetMaxConnections(max, queueTimeout)
+	}
+}
+
+// WithHealthCheck probes the local service while the client listens, see
+// SetHealthCheck.
+func WithHealthCheck(hc HealthCheck) Option {
+	return func(c *Client) {
+		c.SetHealthCheck(hc)
+	}
+}
+
+// WithProxyProtocol sends a PROXY protocol header to the local service, see
+// SetProxyProtocol.
+func WithProxyProtocol(version string) Option {
+	return func(c *Client) {
+		c.SetProxyProtocol(version)
+	}
+}
+
+// WithCompression offers the server to compress data connections with the
+// given algorithm. Only ZstdCompression is supported. Compression is used only
+// if the server accepts it in its hello reply.
+func WithCompression(algorithm string) Option {
+	return func(c *Client) {
+		c.compression = algorithm
+	}
+}
+
+// WithPipeline sets the stages relayed connections pass through on their way
+// between the server and the local service, local side first, as registered
+// with RegisterPipelineStage; see wrapPipeline. By default connections are
+// rate limited and, if the server accepts it, compressed.
+func WithPipeline(stages ...string) Option {
+	return func(c *Client) {
+		c.pipeline = stages
+	}
+}
+
+// WithPipelineSecret sets the secret the aes-gcm and chacha20 pipeline stages
+// derive their key from. By default they use the secret key, so they need
+// this with WithPrivateKey or WithToken.
+func WithPipelineSecret(secret string) Option {
+	return func(c *Client) {
+		c.pipelineSecret = []byte(secret)
+	}
+}
+
+// WithMultiplexing offers the server to carry all data connections as streams
+// of a single session instead of a new TCP connection and handshake per
+// visitor. It is used only if the server accepts it in its hello reply.
+func WithMultiplexing() Option {
+	return func(c *Client) {
+		c.multiplex = true
+	}
+}
+
+// WithCodec offers the server to switch the control connection to a binary
+// codec once the hello exchange is done. Only MsgpackCodec is supported.
+// Without it, or if the server does not accept it, JSON is used throughout.
+func WithCodec(codec string) Option {
+	return func(c *Client) {
+		c.codec = codec
+	}
+}
+
+// WithDrainIdleTimeout makes Shutdown close connections that have not
+// transferred data for d immediately instead of waiting for them to finish.
+func WithDrainIdleTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.drainIdle = d
+	}
+}
+
+// WithIdleTimeout closes relayed connections on which neither direction has
+// transferred data for d, see SetIdleTimeout.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.idleTimeout = d
+	}
+}
+
+// WithOSThreadPinning dedicates an OS thread to each copy loop once it has
+// relayed more than busyRelayBytes, so the scheduler does not move it between
+// threads. This helps to approach line rate on 10Gbps links at the cost of one
+// thread per busy connection direction.
+func WithOSThreadPinning() Option {
+	return func(c *Client) {
+		c.pinThreads = true
+	}
+}
+
+// WithRelayBufferSize sets the size of the buffers used to copy data between
+// visitors and the local service, 32 KiB by default. Larger buffers raise the
+// throughput of bulk transfers at the cost of memory per active connection.
+// Sizes outside 4 KiB to 1 MiB are clamped.
+func WithRelayBufferSize(size int) Option {
+	return func(c *Client) {
+		c.buffers = relayBuffers(min(max(size, minRelayBufferSize), maxRelayBufferSize))
+	}
+}
+
+// WithoutSplice makes the client copy relayed connections through its own
+// buffers even where both ends are plain TCP connections that could be copied
+// inside the kernel with splice, which is done on Linux by default.
+func WithoutSplice() Option {
+	return func(c *Client) {
+		c.splice = false
+	}
+}
+
+// WithFaultInjection makes the client delay by up to maxDelay, drop or corrupt
+// the given fraction of the messages it receives on the control connection,
+// to test the error handling against an unreliable server. A zero maxDelay
+// means five seconds. It must not be used in production.
+func WithFaultInjection(rate float64, maxDelay time.Duration) Option {
+	return func(c *Client) {
+		if maxDelay <= 0 {
+			maxDelay = defaultFaultDelay
+		}
+		c.faults = &faultInjector{rate: rate, maxDelay: maxDelay}
+	}
+}
+
+// WithTCPFastOpen dials the control and data connections with TCP Fast Open
+// where the platform supports it, which saves a round trip per data connection
+// once the kernel holds a Fast Open cookie for the server. This is
+// experimental; compare Stats.AvgHandshake with and without it.
+func WithTCPFastOpen() Option {
+	return func(c *Client) {
+		c.fastOpen = true
+	}
+}
+
+// WithTCPKeepAlive sends TCP keepalive probes on the connections to the server
+// and the local service every interval once they are idle, so NAT gateways and
+// firewalls do not silently drop the state of a quiet tunnel and dead peers
+// are noticed. Connections use the keepalives of the Go runtime, currently
+// every 15 seconds, by default; an interval of zero or less disables them.
+func WithTCPKeepAlive(interval time.Duration) Option {
+	return func(c *Client) {
+		c.keepAlive = interval
+		if interval <= 0 {
+			c.keepAlive = -1
+		}
+	}
+}
+
+// WithBindAddress dials the control and data connections from the local
+// address ip, so on a host with several interfaces the tunnel leaves through
+// the one that owns it. It replaces the local address of a *net.Dialer set with
+// WithDialer and has no effect on other dialers.
+func WithBindAddress(ip net.IP) Option {
+	return func(c *Client) {
+		c.bindAddr = ip
+	}
+}
+
+// WithPreferredIPFamily makes the client connect to hosts that have both IPv4
+// and IPv6 addresses, the server as well as the local service, over family,
+// PreferIPv4 or PreferIPv6, and fall back to the other family if that fails or
+// takes longer than the FallbackDelay of the dialer, 300ms by default. Without
+// it the order of the resolver is used. It has no effect on dialers set with
+// WithDialer other than a *net.Dialer.
+func WithPreferredIPFamily(family string) Option {
+	return func(c *Client) {
+		c.preferIP = family
+	}
+}
+
+// WithDataConnectionPool keeps size authenticated data connections to the
+// server open, so a visitor is accepted on one of them without waiting for a
+// TCP connection and handshake. Connections taken from the pool are replaced
+// in the background, and idle ones are replaced once they are maxIdle old, 30
+// seconds if maxIdle is zero; set it below the idle timeout of the server.
+// The pool is not used if data connections are multiplexed.
+func WithDataConnectionPool(size int, maxIdle time.Duration) Option {
+	return func(c *Client) {
+		c.poolSize, c.poolMaxIdle = size, maxIdle
+	}
+}
+
+// WithLocalRetry makes the client retry connecting to the local service for up
+// to window, with a backoff from 100ms to 2s between attempts, before giving up
+// on a visitor. Visitors arriving while the local service restarts then wait
+// for it to come back instead of failing at once.
+func WithLocalRetry(window time.Duration) Option {
+	return func(c *Client) {
+		c.localRetry = window
+	}
+}
+
+// WithTCPNoDelay sets whether TCP_NODELAY is enabled on the connections to the
+// server and the local service. It is by default, which sends small writes
+// right away as latency-sensitive protocols such as SSH need; disabling it lets
+// the kernel coalesce them into fewer packets.
+func WithTCPNoDelay(enabled bool) Option {
+	return func(c *Client) {
+		c.noDelay = enabled
+	}
+}
+
+// OnConnected calls fn with the public port once the client has connected and
+// been assigned it by the server.
+func OnConnected(fn func(remotePort uint16)) Option {
+	return func(c *Client) {
+		c.hooks.connected = fn
+	}
+}
+
+// OnDisconnected calls fn when Listen returns, with the error it returns; err
+// is nil if the client was shut down.
+func OnDisconnected(fn func(err error)) Option {
+	return func(c *Client) {
+		c.hooks.disconnected = fn
+	}
+}
+
+// OnNewProxyConnection calls fn when a visitor connection has been given a
+// connection slot and is about to be relayed.
+func OnNewProxyConnection(fn func(ConnectionInfo)) Option {
+	return func(c *Client) {
+		c.hooks.connectionOpened = fn
+	}
+}
+
+// OnProxyConnectionClosed calls fn with the final counters of a visitor
+// connection once it has been relayed, and the error that ended it, if any.
+func OnProxyConnectionClosed(fn func(ConnectionInfo, error)) Option {
+	return func(c *Client) {
+		c.hooks.connectionClosed = fn
+	}
+}
+
+// OnError calls fn with every error the client runs into: failed proxied
+// connections, rejected connection requests and the error that ends Listen.
+func OnError(fn func(error)) Option {
+	return func(c *Client) {
+		c.hooks.failed = fn
+	}
+}
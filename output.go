@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// Values of the output key. With outputJSON, `run` prints a JSON line on
+// stdout whenever a tunnel is established, and nothing else, so automation can
+// read the assigned public port without parsing the log.
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// tunnelEvent is the JSON line printed when a tunnel is established.
+type tunnelEvent struct {
+	Event      string `json:"event"`            // "connected" or "reconnected".
+	Tunnel     string `json:"tunnel,omitempty"` // Name of the extra tunnel, empty for the main one.
+	RemotePort uint16 `json:"remotePort"`
+	Server     string `json:"server"`
+	ClientID   string `json:"clientId"`
+	Label      string `json:"label,omitempty"`
+	PID        int    `json:"pid,omitempty"` // Background process, with --detach only.
+}
+
+// eventOutputMu serializes the lines of concurrent tunnels on stdout.
+var eventOutputMu sync.Mutex
+
+// readOutput validates the output key of config.
+func readOutput(config *Config) error {
+	switch config.Output {
+	case "", outputText, outputJSON:
+		return nil
+	}
+	return fmt.Errorf("invalid output %q, use %s or %s", config.Output, outputText, outputJSON)
+}
+
+// printTunnelEvent prints event for client, a tunnel of config, as a JSON
+// line on stdout if config asks for JSON output.
+func printTunnelEvent(config *Config, event string, client *Client) {
+	if config.Output != outputJSON {
+		return
+	}
+	printJSONLine(tunnelEvent{
+		Event:      event,
+		Tunnel:     config.Tunnel,
+		RemotePort: client.RemotePort(),
+		Server:     client.ServerAddr(),
+		ClientID:   config.ClientID,
+		Label:      client.Label(),
+	})
+}
+
+// printJSONLine writes v to stdout as a single line of JSON.
+func printJSONLine(v any) {
+	eventOutputMu.Lock()
+	defer eventOutputMu.Unlock()
+	_ = json.NewEncoder(os.Stdout).Encode(v)
+}
+
+// printDetachedEvent prints the connected event of the tunnel a background
+// process started with --detach established on port, as far as the waiting
+// foreground process knows it.
+func printDetachedEvent(pid int, port string) {
+	p, _ := strconv.ParseUint(port, 10, 16)
+	printJSONLine(tunnelEvent{
+		Event:      "connected",
+		RemotePort: uint16(p),
+		Server:     viper.GetString("server"),
+		ClientID:   viper.GetString("client-id"),
+		Label:      viper.GetString("label"),
+		PID:        pid,
+	})
+}
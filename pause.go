@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+)
+
+// ErrPaused is reported to OnError for connection requests refused while the
+// client is paused.
+var ErrPaused = errors.New("tunnel is paused")
+
+// SetPaused stops accepting new proxied connections, or resumes accepting
+// them. The control connection stays up and connections already relayed are
+// not affected, so the local service can be maintained without losing the
+// public port.
+func (c *Client) SetPaused(paused bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paused = paused
+}
+
+// Paused reports whether the client refuses new proxied connections.
+func (c *Client) Paused() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.paused
+}
+
+// setPaused pauses or resumes the active client, the clients that replace it
+// and the extra tunnels, including those opened while paused. It reports
+// whether that changed anything for the tunnel of r.
+func (r *runner) setPaused(paused bool) bool {
+	r.mu.Lock()
+	changed := r.paused != paused
+	r.paused = paused
+	r.client.SetPaused(paused)
+	name := r.config.Tunnel
+	r.mu.Unlock()
+	r.tunnels.setPaused(paused)
+	if !changed {
+		return false
+	}
+	switch {
+	case name != "" && paused:
+		log.Printf("⏸️ Tunnel %s paused, refusing new connections", name)
+	case name != "":
+		log.Printf("▶️ Tunnel %s resumed, accepting new connections", name)
+	case paused:
+		log.Println("⏸️ Tunnel paused, refusing new connections")
+	default:
+		log.Println("▶️ Tunnel resumed, accepting new connections")
+	}
+	return true
+}
+
+// handlePauseSignals pauses the tunnel on SIGUSR1 and resumes it on SIGUSR2.
+// It returns at once where these signals do not exist.
+func (r *runner) handlePauseSignals() {
+	if pauseSignal == nil {
+		return
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, pauseSignal, resumeSignal)
+	for sig := range sigs {
+		r.setPaused(sig == pauseSignal)
+	}
+}
+
+// pauseCommand implements `pause [--socket path]`, which makes the client
+// running on the control socket refuse new connections.
+func pauseCommand(args []string) {
+	controlCommand("pause", args)
+}
+
+// resumeCommand implements `resume [--socket path]`, which makes the client
+// running on the control socket accept new connections again.
+func resumeCommand(args []string) {
+	controlCommand("resume", args)
+}
+
+// controlCommand sends cmd to the client running on the control socket and
+// prints the state it reports.
+func controlCommand(cmd string, args []string) {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	socket := fs.String("socket", defaultControlSocket, "control socket of the running client")
+	_ = fs.Parse(args)
+	sendControlCommand(*socket, cmd, cmd+" the tunnel")
+}
+
+// sendControlCommand sends cmd to the client running on socket and prints the
+// state it reports; action describes cmd in the error message.
+func sendControlCommand(socket, cmd, action string) {
+	var report statusReport
+	err := queryControl(socket, cmd, &report)
+	if err == nil && report.Error != "" {
+		err = errors.New(report.Error)
+	}
+	if err != nil {
+		log.Fatalf("❌ Failed to %s: %v", action, err)
+	}
+	fmt.Printf("✅ Tunnel is %s\n", report.State)
+}
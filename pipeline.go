@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// Names of the built-in pipeline stages.
+const (
+	RateLimitStage = "rate-limit"
+	ZstdStage      = ZstdCompression
+	AESGCMStage    = "aes-gcm"
+	ChaCha20Stage  = "chacha20"
+	ChecksumStage  = "crc32"
+)
+
+// encryptingStages are the built-in stages that derive their key from the
+// pipeline secret or the secret key.
+var encryptingStages = []string{AESGCMStage, ChaCha20Stage}
+
+// defaultPipeline is the pipeline of clients that do not configure one: rate
+// limiting and, if the server accepts it, compression.
+var defaultPipeline = []string{RateLimitStage, ZstdStage}
+
+// PipelineStage is a wrapper of the data path of relayed connections, such as
+// compression, encryption, rate limiting or checksums.
+type PipelineStage struct {
+	// Wrap returns conn, the visitor side of a relayed connection for client c,
+	// wrapped by the stage. Closing the returned connection must close conn.
+	Wrap func(c *Client, conn net.Conn) (net.Conn, error)
+	// Wire reports whether the stage changes the bytes exchanged with the
+	// server, so the other end must apply the inverse stage. Such stages are
+	// skipped for preview connections, which come straight from a visitor.
+	Wire bool
+}
+
+var (
+	stagesMu sync.Mutex
+	stages   = map[string]PipelineStage{
+		RateLimitStage: {Wrap: rateLimitStage},
+		ZstdStage:      {Wrap: zstdStage, Wire: true},
+		AESGCMStage:    {Wrap: aesGCMStage, Wire: true},
+		ChaCha20Stage:  {Wrap: chaCha20Stage, Wire: true},
+		ChecksumStage:  {Wrap: checksumStage, Wire: true},
+	}
+)
+
+// RegisterPipelineStage makes stage available under name for WithPipeline and
+// the pipeline config key. Registering a name again replaces the stage.
+func RegisterPipelineStage(name string, stage PipelineStage) {
+	stagesMu.Lock()
+	defer stagesMu.Unlock()
+	stages[name] = stage
+}
+
+// resolvePipeline looks up the stages of the pipeline names.
+func resolvePipeline(names []string) ([]PipelineStage, error) {
+	stagesMu.Lock()
+	defer stagesMu.Unlock()
+	resolved := make([]PipelineStage, len(names))
+	for i, name := range names {
+		stage, ok := stages[name]
+		if !ok {
+			known := make([]string, 0, len(stages))
+			for n := range stages {
+				known = append(known, n)
+			}
+			sort.Strings(known)
+			return nil, fmt.Errorf("unknown pipeline stage %q, available stages: %v", name, known)
+		}
+		resolved[i] = stage
+	}
+	return resolved, nil
+}
+
+// pipelineNames returns the stages the client applies: names, or the default
+// pipeline if names is empty. Compression, when offered, must be applied by a
+// zstd stage, which is added next to the wire if names lacks one.
+func pipelineNames(names []string, compression string) []string {
+	if len(names) == 0 {
+		return defaultPipeline
+	}
+	if compression != "" && !slices.Contains(names, ZstdStage) {
+		names = append(slices.Clip(names), ZstdStage)
+	}
+	return names
+}
+
+// wrapPipeline passes conn through the stages of the pipeline. The first
+// stage is closest to the local service and the last one closest to the
+// server, so `[rate-limit, zstd, aes-gcm]` limits the plain data, then
+// compresses and then encrypts it. Without wire only the stages that do not
+// change the bytes on the wire are applied. If a stage fails, conn is
+// returned with the stages applied so far, to be closed by the caller.
+func (c *Client) wrapPipeline(conn net.Conn, wire bool) (net.Conn, error) {
+	for i := len(c.stages) - 1; i >= 0; i-- {
+		stage := c.stages[i]
+		if stage.Wire && !wire {
+			continue
+		}
+		wrapped, err := stage.Wrap(c, conn)
+		if err != nil {
+			return conn, fmt.Errorf("failed to set up pipeline stage %s: %w", c.pipeline[i], err)
+		}
+		conn = wrapped
+	}
+	return conn, nil
+}
+
+// zstdStage compresses the connection if the server accepted compression.
+func zstdStage(c *Client, conn net.Conn) (net.Conn, error) {
+	if !c.compressed {
+		return conn, nil
+	}
+	return newZstdConn(conn)
+}
+
+// rateLimitStage applies the bandwidth limits of the client, see
+// SetBandwidthLimits. Without limits conn is returned as is, so it can still
+// be spliced.
+func rateLimitStage(c *Client, conn net.Conn) (net.Conn, error) {
+	download, upload := c.connectionLimiters()
+	if slices.IndexFunc(download, isLimit) < 0 && slices.IndexFunc(upload, isLimit) < 0 {
+		return conn, nil
+	}
+	return &rateLimitedConn{Conn: conn, download: download, w: newRateLimitedWriter(conn, upload...)}, nil
+}
+
+// isLimit reports whether l limits the rate, rather than being nil.
+func isLimit(l *rateLimiter) bool {
+	return l != nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// portReservation remembers the remote port the server assigned last to each
+// tunnel, so that reconnects, and with a port file restarts, ask for the same
+// port again and shared links keep working.
+type portReservation struct {
+	mu    sync.Mutex
+	ports map[string]uint16 // By tunnel name, empty for the main tunnel.
+	file  string            // File the port of the main tunnel is kept in, if any.
+}
+
+// reservedPort is the port reservation of the CLI.
+var reservedPort portReservation
+
+// load reads the port assigned to the main tunnel before the client was
+// restarted from file, if it exists, and keeps later assignments in it.
+func (p *portReservation) load(file string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.file = file
+	b, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read port file: %w", err)
+	}
+	port, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port file %s: %w", file, err)
+	}
+	p.set("", uint16(port))
+	return nil
+}
+
+// get returns the port to ask the server for on behalf of tunnel, 0 if none
+// was assigned yet.
+func (p *portReservation) get(tunnel string) uint16 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.ports[tunnel]
+}
+
+// set records port for tunnel. p.mu must be held.
+func (p *portReservation) set(tunnel string, port uint16) {
+	if p.ports == nil {
+		p.ports = make(map[string]uint16)
+	}
+	p.ports[tunnel] = port
+}
+
+// assigned records port as assigned by the server to tunnel.
+func (p *portReservation) assigned(tunnel string, port uint16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if port == p.ports[tunnel] {
+		return
+	}
+	p.set(tunnel, port)
+	if tunnel != "" || p.file == "" {
+		return
+	}
+	if dir := filepath.Dir(p.file); dir != "" {
+		_ = os.MkdirAll(dir, 0o755)
+	}
+	if err := os.WriteFile(p.file, []byte(strconv.Itoa(int(port))+"\n"), 0o644); err != nil {
+		log.Printf("⚠️ Failed to write port file: %v", err)
+	}
+}
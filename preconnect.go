@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+)
+
+// preconnect dials the server in the background, so the control connection is
+// already open by the time the user has finished answering the interactive
+// prompts.
+type preconnect struct {
+	done chan struct{}
+	conn net.Conn
+	err  error
+}
+
+// startPreconnect begins resolving and connecting to the server of config in
+// the background, with its bind address and preferred IP family.
+func startPreconnect(config *Config) *preconnect {
+	p := &preconnect{done: make(chan struct{})}
+	address := net.JoinHostPort(config.Server, strconv.Itoa(int(config.ServerPort)))
+	d := &net.Dialer{Timeout: defaultDialTimeout}
+	if config.BindAddress != nil {
+		d.LocalAddr = &net.TCPAddr{IP: config.BindAddress}
+	}
+	go func() {
+		defer close(p.done)
+		p.conn, p.err = preferFamily(d, config.PreferIP).DialContext(context.Background(), "tcp", address)
+	}()
+	return p
+}
+
+// take waits for the background dial to finish and returns the connection, or
+// nil if it failed or p is nil. It must be called at most once.
+func (p *preconnect) take() net.Conn {
+	if p == nil {
+		return nil
+	}
+	<-p.done
+	if p.err != nil {
+		return nil
+	}
+	return p.conn
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+
+	"github.com/google/uuid"
+)
+
+// ServeConn handles conn exactly like a visitor connection arriving on the
+// public port: it is subject to the same connection and bandwidth limits,
+// maintenance mode, health check and PROXY protocol header, and it shows up in
+// Stats and the transcript. This allows the tunnel-side processing to be tried
+// locally. ServeConn blocks until the connection is done and closes it.
+func (c *Client) ServeConn(conn net.Conn) {
+	defer conn.Close()
+	pc := c.trackConnection(uuid.New(), conn.RemoteAddr().String())
+	if pc == nil {
+		c.logger.Println("Shutting down, ignoring new preview connection")
+		return
+	}
+	pc.preview = true
+	ticket, err := c.admit(pc)
+	if err != nil {
+		c.traceConnection(pc).end(err)
+		c.rejectConnection(pc, err)
+		c.untrackConnection(pc)
+		return
+	}
+	dst := tcpAddrPort(conn.LocalAddr())
+	c.handleConnection(pc, ticket, func() error {
+		remote, err := c.wrapPipeline(conn, false)
+		if err != nil {
+			return err
+		}
+		return c.serve(pc, remote, dst)
+	})
+}
+
+// tcpAddrPort returns the address and port of addr, or the zero value if addr is
+// not a TCP address.
+func tcpAddrPort(addr net.Addr) netip.AddrPort {
+	if a, ok := addr.(*net.TCPAddr); ok {
+		ap := a.AddrPort()
+		return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+	}
+	return netip.AddrPort{}
+}
+
+// listenPreview opens the local preview listener on port of the loopback
+// interface. It returns nil if port is empty, which disables it.
+func listenPreview(port string) (net.Listener, error) {
+	if port == "" {
+		return nil, nil
+	}
+	ll := &localListener{component: "preview listener", port: port}
+	if err := openLocalListeners(ll); err != nil {
+		return nil, err
+	}
+	return ll.l, nil
+}
+
+// setPreviewPort opens the local preview listener on port, replacing a previous
+// one, or closes it if port is empty.
+func (r *runner) setPreviewPort(port string) error {
+	r.setPreview(nil)
+	l, err := listenPreview(port)
+	if err != nil {
+		return err
+	}
+	r.setPreview(l)
+	return nil
+}
+
+// setPreview serves the preview listener l, replacing and closing a previous
+// one; l may be nil. Connections to it are served by the active client with
+// ServeConn, so the listener keeps working across reconnects.
+func (r *runner) setPreview(l net.Listener) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.preview != nil {
+		r.preview.Close()
+		r.preview = nil
+	}
+	if l == nil {
+		return
+	}
+	r.preview = l
+	log.Printf("🔍 Preview listener on %s mirrors the public port", l.Addr())
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				log.Printf("⚠️ Preview listener: %v", err)
+				continue
+			}
+			go r.current().ServeConn(conn)
+		}
+	}()
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// applyProfile merges the keys of the named profile, defined under "profiles"
+// in the config file, over the top-level keys, so one file can hold the
+// settings of several environments that share most of their configuration.
+// Environment variables and flags still take precedence over the profile.
+func applyProfile(name string) error {
+	if name == "" {
+		return nil
+	}
+	profile := viper.Sub("profiles." + name)
+	if profile == nil {
+		var names []string
+		for n := range viper.GetStringMap("profiles") {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		if len(names) == 0 {
+			return fmt.Errorf("profile %q not found, the config file defines no profiles", name)
+		}
+		return fmt.Errorf("profile %q not found, available profiles: %s", name, strings.Join(names, ", "))
+	}
+	if err := viper.MergeConfigMap(profile.AllSettings()); err != nil {
+		return fmt.Errorf("failed to apply profile %q: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/google/uuid"
+)
+
+// ProtocolVersion is the version of the message schema implemented by this
+// client. Version 0 is the original protocol, whose messages carry no version.
+// Version 1 adds the version and capabilities fields to the hello exchange;
+// every later addition is optional, so peers of different versions interoperate.
+//
+// Compatibility rules for both versions:
+//   - Unknown fields are ignored when decoding, so a newer peer may add fields.
+//   - Fields are omitted when empty, so an older peer never sees fields it does
+//     not know about unless the feature was negotiated.
+//   - Messages of unknown types are errors, unless the server announced a newer
+//     version in its hello reply; then they are logged and skipped.
+const ProtocolVersion = 1
+
+const (
+	MtChallenge    = "Challenge"
+	MtHeartbeat    = "Heartbeat"
+	MtConnection   = "Connection"
+	MtAuthenticate = "Authenticate"
+	MtFreePort     = "FreePort"
+	MtHello        = "Hello"
+	MtError        = "Error"
+	MtGoodbye      = "Goodbye"
+	MtMultiplex    = "Multiplex"
+	MtReject       = "Reject"
+)
+
+// ClientMessage is a message sent by the client, identified by Type. Only the
+// fields that belong to the message type are set.
+type ClientMessage struct {
+	Type           string    `json:"type"`
+	Authenticate   string    `json:"authenticate,omitempty"`   // Authenticate: answer to the challenge.
+	Signature      string    `json:"signature,omitempty"`      // Authenticate: Ed25519 signature of the challenge, instead of an answer.
+	KeyFingerprint string    `json:"keyFingerprint,omitempty"` // Authenticate: fingerprint of the key that made the signature.
+	Token          string    `json:"token,omitempty"`          // Authenticate: access token of an identity provider, the answer is keyed by it.
+	Session        bool      `json:"session,omitempty"`        // Authenticate: the answer is keyed by the session token instead of the credentials.
+	Nonce          string    `json:"nonce,omitempty"`          // Authenticate: random value covered by the answer.
+	Timestamp      int64     `json:"timestamp,omitempty"`      // Authenticate: Unix time covered by the answer.
+	Port           uint16    `json:"port,omitempty"`           // Hello: requested public port.
+	Accept         uuid.UUID `json:"accept,omitempty"`         // Accept: connection being accepted.
+	Reject         uuid.UUID `json:"reject,omitempty"`         // Reject: connection being refused.
+	Error          string    `json:"error,omitempty"`          // Reject: why the connection was refused.
+	ClientId       string    `json:"clientId,omitempty"`       // Authenticate: the client ID.
+	Goodbye        uint16    `json:"goodbye,omitempty"`        // Goodbye: public port being released.
+	Version        int       `json:"version,omitempty"`        // Hello: ProtocolVersion of the client.
+	Capabilities   []string  `json:"capabilities,omitempty"`   // Hello: optional features offered.
+	Label          string    `json:"label,omitempty"`          // Hello: human-readable label of the session.
+	Ping           uint64    `json:"ping,omitempty"`           // Heartbeat: sequence number for the server to echo.
+}
+
+// ServerMessage is a message sent by the server, identified by Type. Only the
+// fields that belong to the message type are set.
+type ServerMessage struct {
+	Type         string    `json:"type"`
+	Challenge    uuid.UUID `json:"challenge,omitempty"`    // Challenge: value to answer.
+	Port         uint16    `json:"hello,omitempty"`        // FreePort and Hello: the public port.
+	Heartbeat    bool      `json:"heartbeat,omitempty"`    // Heartbeat.
+	Connection   uuid.UUID `json:"connection,omitempty"`   // Connection: ID of the visitor connection.
+	Visitor      string    `json:"visitor,omitempty"`      // Connection: address of the visitor.
+	Error        string    `json:"error,omitempty"`        // Error: description.
+	Version      int       `json:"version,omitempty"`      // Hello: ProtocolVersion of the server.
+	Capabilities []string  `json:"capabilities,omitempty"` // Hello: offered features accepted. Challenge: answer formats supported.
+	Proof        string    `json:"proof,omitempty"`        // FreePort: HMAC proving the server knows the key, see serverProof.
+	SessionToken string    `json:"sessionToken,omitempty"` // FreePort: token data connections may authenticate with instead.
+	SessionTTL   int       `json:"sessionTtl,omitempty"`   // FreePort: seconds SessionToken is valid for, zero if unlimited.
+	RetryAfter   int       `json:"retryAfter,omitempty"`   // Error: seconds to wait before reconnecting.
+	Pong         uint64    `json:"pong,omitempty"`         // Heartbeat: echoed ping sequence number.
+}
+
+// UnmarshalJSON decodes a server message, accepting the port under its
+// historical name "hello" as well as under "port", the name used by the client
+// and by servers that have moved to the consistent spelling.
+func (m *ServerMessage) UnmarshalJSON(b []byte) error {
+	type schema ServerMessage // Same fields without this method.
+	var w struct {
+		schema
+		AltPort uint16 `json:"port,omitempty"`
+	}
+	if err := json.Unmarshal(b, &w); err != nil {
+		return err
+	}
+	*m = ServerMessage(w.schema)
+	if m.Port == 0 {
+		m.Port = w.AltPort
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// codecPair returns the two ends of a connection, switched to MessagePack if
+// packed is set.
+func codecPair(t *testing.T, packed bool) (*Codec, *Codec) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	ca, cb := NewCodec(a), NewCodec(b)
+	if packed {
+		ca.UseMsgpack()
+		cb.UseMsgpack()
+	}
+	return ca, cb
+}
+
+// roundTrip sends msg from one end of a codec pair and decodes it into got on
+// the other.
+func roundTrip(t *testing.T, packed bool, msg, got any) {
+	t.Helper()
+	src, dst := codecPair(t, packed)
+	errc := make(chan error, 1)
+	go func() { errc <- src.Send(msg) }()
+	if err := dst.RecvTimeout(got); err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+}
+
+// sendRaw writes v as one message, as MessagePack if packed is set and else as
+// JSON, bypassing the message types, and decodes it into a ServerMessage.
+func sendRaw(t *testing.T, packed bool, v map[string]any) ServerMessage {
+	t.Helper()
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	dst := NewCodec(b)
+	var payload []byte
+	if packed {
+		dst.UseMsgpack()
+		body, err := msgpack.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload = append(binary.BigEndian.AppendUint32(nil, uint32(len(body))), body...)
+	} else {
+		body, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload = append(body, '\n')
+	}
+	go func() { _, _ = a.Write(payload) }()
+	var msg ServerMessage
+	if err := dst.RecvTimeout(&msg); err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+	return msg
+}
+
+func TestClientMessageRoundTrip(t *testing.T) {
+	messages := []ClientMessage{
+		{Type: MtAuthenticate, Authenticate: "ab12", ClientId: "web", Nonce: "0011", Timestamp: 1700000000, Session: true},
+		{Type: MtAuthenticate, Signature: "cd34", KeyFingerprint: "SHA256:abc", Nonce: "0011", Timestamp: 1700000000},
+		{Type: MtAuthenticate, Token: "access-token", Authenticate: "ef56"},
+		{Type: MtHello, Port: 8080, Version: ProtocolVersion, Capabilities: []string{MsgpackCodec, RejectCapability}, Label: "api"},
+		{Type: "Accept", Accept: uuid.New()},
+		{Type: MtReject, Reject: uuid.New(), Error: "too many connections"},
+		{Type: MtHeartbeat, Ping: 42},
+		{Type: MtGoodbye, Goodbye: 8080},
+		{Type: MtMultiplex},
+	}
+	for _, packed := range []bool{false, true} {
+		for _, msg := range messages {
+			var got ClientMessage
+			roundTrip(t, packed, msg, &got)
+			if !reflect.DeepEqual(got, msg) {
+				t.Errorf("msgpack %v: got %+v, want %+v", packed, got, msg)
+			}
+		}
+	}
+}
+
+func TestServerMessageRoundTrip(t *testing.T) {
+	messages := []ServerMessage{
+		{Type: MtChallenge, Challenge: uuid.New(), Capabilities: []string{NonceCapability, SessionCapability}},
+		{Type: MtFreePort, Port: 4000, Proof: "ab12", SessionToken: "token", SessionTTL: 3600},
+		{Type: MtHello, Port: 4000, Version: ProtocolVersion, Capabilities: []string{MsgpackCodec}},
+		{Type: MtHeartbeat, Heartbeat: true, Pong: 42},
+		{Type: MtConnection, Connection: uuid.New(), Visitor: "203.0.113.7:50000"},
+		{Type: MtError, Error: "rate limited", RetryAfter: 30},
+		{Type: MtError, Error: "connection refused", Connection: uuid.New()},
+	}
+	for _, packed := range []bool{false, true} {
+		for _, msg := range messages {
+			var got ServerMessage
+			roundTrip(t, packed, msg, &got)
+			if !reflect.DeepEqual(got, msg) {
+				t.Errorf("msgpack %v: got %+v, want %+v", packed, got, msg)
+			}
+		}
+	}
+}
+
+func TestServerMessageCompatibility(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		raw  map[string]any
+		want ServerMessage
+	}{
+		{"historical port", map[string]any{"type": MtHello, "hello": 4000}, ServerMessage{Type: MtHello, Port: 4000}},
+		{"port alias", map[string]any{"type": MtHello, "port": 4000}, ServerMessage{Type: MtHello, Port: 4000}},
+		{"both names", map[string]any{"type": MtFreePort, "hello": 4000, "port": 5000}, ServerMessage{Type: MtFreePort, Port: 4000}},
+		{"unknown fields", map[string]any{"type": MtHeartbeat, "heartbeat": true, "load": 0.5, "region": map[string]any{"name": "eu"}},
+			ServerMessage{Type: MtHeartbeat, Heartbeat: true}},
+		{"unknown type", map[string]any{"type": "Migrate", "version": ProtocolVersion + 1, "target": "eu.example.com"},
+			ServerMessage{Type: "Migrate", Version: ProtocolVersion + 1}},
+	} {
+		for _, packed := range []bool{false, true} {
+			if got := sendRaw(t, packed, tc.raw); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("%s, msgpack %v: got %+v, want %+v", tc.name, packed, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestUnknownMessageTypes(t *testing.T) {
+	c := &Client{logger: log.New(io.Discard, "", 0), serverVersion: ProtocolVersion}
+	if err := c.processServerMessage(ServerMessage{Type: "Migrate"}); !errors.Is(err, ErrProtocol) {
+		t.Fatalf("unknown type from the same version: got %v, want ErrProtocol", err)
+	}
+	c.serverVersion = ProtocolVersion + 1
+	if err := c.processServerMessage(ServerMessage{Type: "Migrate"}); err != nil {
+		t.Fatalf("unknown type from a newer version: got %v, want it skipped", err)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// proxyConn is a proxied visitor connection, tracked by the client from the
+// moment the server announces it until the relay has finished.
+type proxyConn struct {
+	id       uuid.UUID
+	visitor  string // Address of the visitor as reported by the server, if any.
+	started  time.Time
+	in       atomic.Int64 // Bytes relayed from the visitor to the local service.
+	out      atomic.Int64 // Bytes relayed from the local service to the visitor.
+	lastSeen atomic.Int64 // Unix nanoseconds of the last transfer in either direction.
+	span     *span        // Root span of the trace of the connection, nil if it is not traced.
+	preview  bool         // Arrived on the preview listener rather than from the server.
+
+	mu      sync.Mutex // Guards closer, aborted and reason.
+	closer  func()     // Aborts the relay, set once it has started.
+	aborted bool       // Set by abort, so a relay that starts later is aborted at once.
+	reason  string     // Why the client closed the connection, if it did.
+}
+
+// newProxyConn creates the tracking record of connection id from visitor.
+func newProxyConn(id uuid.UUID, visitor string) *proxyConn {
+	pc := &proxyConn{id: id, visitor: visitor, started: time.Now()}
+	pc.lastSeen.Store(pc.started.UnixNano())
+	return pc
+}
+
+// visitorOrID returns the address of the visitor for log messages, or the
+// connection ID if the server did not send the address.
+func (pc *proxyConn) visitorOrID() string {
+	if pc.visitor != "" {
+		return pc.visitor
+	}
+	return pc.id.String()
+}
+
+// ConnectionInfo is a point-in-time view of an active proxied connection.
+type ConnectionInfo struct {
+	ID       uuid.UUID
+	Visitor  string // Address of the visitor, empty if the server did not send it.
+	Started  time.Time
+	BytesIn  int64 // Bytes relayed from the visitor to the local service.
+	BytesOut int64 // Bytes relayed from the local service to the visitor.
+	LastSeen time.Time
+}
+
+// info returns a snapshot of pc.
+func (pc *proxyConn) info() ConnectionInfo {
+	return ConnectionInfo{
+		ID:       pc.id,
+		Visitor:  pc.visitor,
+		Started:  pc.started,
+		BytesIn:  pc.in.Load(),
+		BytesOut: pc.out.Load(),
+		LastSeen: time.Unix(0, pc.lastSeen.Load()),
+	}
+}
+
+// countingWriter adds the number of bytes written to w to n and to the traffic
+// quota, if any, and records the time of the transfer on the connection. With pin set, it locks the copy loop
+// writing to it to its OS thread once the connection has become busy; unpin
+// must then be called on the same goroutine when the copy is done.
+type countingWriter struct {
+	w      io.Writer
+	n      *atomic.Int64
+	pc     *proxyConn
+	quota  *TrafficQuota
+	pin    bool
+	pinned bool
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	total := cw.count(int64(n))
+	if cw.pin && !cw.pinned && total > busyRelayBytes {
+		runtime.LockOSThread()
+		cw.pinned = true
+	}
+	return n, err
+}
+
+// count records the transfer of n bytes and returns the bytes counted so far.
+func (cw *countingWriter) count(n int64) int64 {
+	total := cw.n.Add(n)
+	cw.pc.lastSeen.Store(time.Now().UnixNano())
+	cw.quota.add(n)
+	return total
+}
+
+// unpin releases the OS thread locked by Write, if any.
+func (cw *countingWriter) unpin() {
+	if cw.pinned {
+		runtime.UnlockOSThread()
+		cw.pinned = false
+	}
+}
+
+// setCloser registers how to abort the relay of pc. If pc has been aborted
+// already, closer is called right away.
+func (pc *proxyConn) setCloser(closer func()) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.aborted {
+		closer()
+		return
+	}
+	pc.closer = closer
+}
+
+// close aborts the relay of pc for reason, such as "idle timeout". It reports
+// false if the relay has not started yet, and therefore cannot be aborted, or
+// has already been aborted.
+func (pc *proxyConn) close(reason string) bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.closer == nil {
+		return false
+	}
+	pc.closer()
+	pc.closer = nil
+	if pc.reason == "" {
+		pc.reason = reason
+	}
+	return true
+}
+
+// abort closes pc like close, and also a relay that has not started yet as
+// soon as it does.
+func (pc *proxyConn) abort(reason string) {
+	pc.mu.Lock()
+	pc.aborted = true
+	if pc.reason == "" {
+		pc.reason = reason
+	}
+	pc.mu.Unlock()
+	pc.close(reason)
+}
+
+// closeReason returns why the client closed pc, or "" if it did not.
+func (pc *proxyConn) closeReason() string {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.reason
+}
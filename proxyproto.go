@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// proxyProtocolV2Signature starts every PROXY protocol version 2 header.
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// SetProxyProtocol makes the client prepend a PROXY protocol header to every
+// connection to the local service, so a reverse proxy such as nginx or HAProxy
+// behind the tunnel sees the visitor's address. version is "v1", "v2" or "" to
+// disable. The visitor's address is only known if the server includes it in
+// the connection request; otherwise the header says the source is unknown and
+// the local service falls back to the connection's own address.
+// It is safe to call SetProxyProtocol while the client is listening.
+func (c *Client) SetProxyProtocol(version string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.proxyProtocol = version
+}
+
+// proxyProtocolVersion returns the PROXY protocol version to send, if any.
+func (c *Client) proxyProtocolVersion() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.proxyProtocol
+}
+
+// proxyHeader builds a PROXY protocol header of the given version for a
+// visitor connecting from src to dst. Invalid addresses produce a header for
+// an unknown source.
+func proxyHeader(version string, src, dst netip.AddrPort) []byte {
+	known := src.IsValid() && dst.IsValid()
+	if known && src.Addr().Is4() != dst.Addr().Is4() {
+		// Both addresses must be of the same family; map IPv4 into IPv6.
+		src = netip.AddrPortFrom(netip.AddrFrom16(src.Addr().As16()), src.Port())
+		dst = netip.AddrPortFrom(netip.AddrFrom16(dst.Addr().As16()), dst.Port())
+	}
+
+	if version == "v1" {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family := "TCP4"
+		if !src.Addr().Is4() {
+			family = "TCP6"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, src.Addr(), dst.Addr(), src.Port(), dst.Port()))
+	}
+
+	header := append([]byte{}, proxyProtocolV2Signature...)
+	if !known {
+		// Version 2, LOCAL command, unspecified family and no addresses.
+		return append(header, 0x20, 0x00, 0x00, 0x00)
+	}
+	var addrs []byte
+	family := byte(0x11) // TCP over IPv4.
+	if src.Addr().Is4() {
+		s, d := src.Addr().As4(), dst.Addr().As4()
+		addrs = append(append(addrs, s[:]...), d[:]...)
+	} else {
+		family = 0x21 // TCP over IPv6.
+		s, d := src.Addr().As16(), dst.Addr().As16()
+		addrs = append(append(addrs, s[:]...), d[:]...)
+	}
+	addrs = binary.BigEndian.AppendUint16(addrs, src.Port())
+	addrs = binary.BigEndian.AppendUint16(addrs, dst.Port())
+
+	// Version 2 with the PROXY command.
+	header = append(header, 0x21, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+// sendProxyHeader writes the PROXY protocol header for a visitor connecting
+// from visitor to dst to the local connection.
+func sendProxyHeader(version string, lconn net.Conn, visitor string, dst netip.AddrPort) error {
+	src, _ := netip.ParseAddrPort(visitor)
+	src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+	if _, err := lconn.Write(proxyHeader(version, src, dst)); err != nil {
+		return fmt.Errorf("failed to send PROXY protocol header: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// ErrQuotaExceeded is reported to OnError for connection requests rejected
+// because a traffic quota has been used up.
+var ErrQuotaExceeded = errors.New("traffic quota exceeded")
+
+// Quota limits the traffic relayed through the tunnel, counting both
+// directions together.
+type Quota struct {
+	PerDay int64 // Bytes per calendar day in local time, 0 for no limit.
+	Total  int64 // Bytes since the client was started, 0 for no limit.
+	Close  bool  // Close the tunnel once a limit is reached instead of only rejecting new connections.
+}
+
+// enabled reports whether any limit is set.
+func (q Quota) enabled() bool {
+	return q.PerDay > 0 || q.Total > 0
+}
+
+// readQuota fills config.Quota from the max-bytes-per-day, max-bytes-total and
+// quota-close-tunnel keys.
+func readQuota(config *Config) error {
+	config.Quota = Quota{Close: viper.GetBool("quota-close-tunnel")}
+	for _, limit := range []struct {
+		key string
+		n   *int64
+	}{
+		{"max-bytes-per-day", &config.Quota.PerDay},
+		{"max-bytes-total", &config.Quota.Total},
+	} {
+		n, err := parseRate(viper.GetString(limit.key))
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid %s %q, use a size such as 10GB", limit.key, viper.GetString(limit.key))
+		}
+		*limit.n = n
+	}
+	return nil
+}
+
+// TrafficQuota counts the traffic relayed by the clients it is passed to with
+// WithTrafficQuota, usually those of one tunnel, which stop accepting
+// connection requests while a limit is reached. Connections already relayed run on. The daily count starts over at
+// local midnight, the total count never does.
+type TrafficQuota struct {
+	limits Quota
+	total  atomic.Int64
+	today  atomic.Int64
+	dayEnd atomic.Int64 // Unix nanoseconds at which today's count starts over.
+
+	mu         sync.Mutex // Guards reached and onExceeded, and serialises the start of a new day.
+	reached    bool
+	onExceeded func(error)
+}
+
+// NewTrafficQuota creates a traffic quota with the given limits.
+func NewTrafficQuota(limits Quota) *TrafficQuota {
+	q := &TrafficQuota{limits: limits}
+	q.dayEnd.Store(nextMidnight(time.Now()).UnixNano())
+	return q
+}
+
+// nextMidnight returns the start of the day after t, in local time.
+func nextMidnight(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, time.Local)
+}
+
+// OnExceeded registers fn to be called with the error of Exceeded each time a
+// limit is reached, so the traffic can be reported or the tunnel closed.
+func (q *TrafficQuota) OnExceeded(fn func(err error)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.onExceeded = fn
+}
+
+// add counts n relayed bytes. It does nothing on a nil quota.
+func (q *TrafficQuota) add(n int64) {
+	if q == nil {
+		return
+	}
+	total, today := q.total.Add(n), q.today.Add(n)
+	if (q.limits.Total > 0 && total >= q.limits.Total) || (q.limits.PerDay > 0 && today >= q.limits.PerDay) ||
+		time.Now().UnixNano() >= q.dayEnd.Load() {
+		_ = q.Exceeded()
+	}
+}
+
+// Exceeded returns an error wrapping ErrQuotaExceeded that names the limit
+// reached, or nil while there is traffic left. It returns nil on a nil quota.
+func (q *TrafficQuota) Exceeded() error {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	if now := time.Now(); now.UnixNano() >= q.dayEnd.Load() {
+		q.today.Store(0)
+		q.dayEnd.Store(nextMidnight(now).UnixNano())
+	}
+	var err error
+	switch {
+	case q.limits.Total > 0 && q.total.Load() >= q.limits.Total:
+		err = fmt.Errorf("%w: relayed %s in total", ErrQuotaExceeded, formatBytes(q.limits.Total))
+	case q.limits.PerDay > 0 && q.today.Load() >= q.limits.PerDay:
+		err = fmt.Errorf("%w: relayed %s today", ErrQuotaExceeded, formatBytes(q.limits.PerDay))
+	}
+	newly := err != nil && !q.reached
+	q.reached = err != nil
+	fn := q.onExceeded
+	q.mu.Unlock()
+
+	if newly && fn != nil {
+		fn(err)
+	}
+	return err
+}
+
+// watchQuota makes r handle the traffic quota of config being used up, see
+// quotaExceeded. It does nothing without a quota.
+func (r *runner) watchQuota(config *Config) {
+	if config.quota == nil {
+		return
+	}
+	name, closeTunnel, timeout := config.Tunnel, config.Quota.Close, config.ShutdownTimeout
+	config.quota.OnExceeded(func(err error) { r.quotaExceeded(name, err, closeTunnel, timeout) })
+}
+
+// quotaExceeded reports that the traffic quota of the tunnel name, empty for
+// the main one, was used up and, with closeTunnel set, shuts the tunnel down,
+// giving relayed connections up to timeout to finish.
+func (r *runner) quotaExceeded(name string, err error, closeTunnel bool, timeout time.Duration) {
+	notify.quotaExceeded(r.current(), err, closeTunnel)
+	tunnel := "the tunnel"
+	if name != "" {
+		tunnel = "tunnel " + name
+	}
+	if !closeTunnel {
+		log.Printf("🚫 Stopped accepting new connections on %s: %v", tunnel, err)
+		return
+	}
+	log.Printf("🚫 Closing %s: %v", tunnel, err)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := r.Shutdown(ctx); err != nil {
+			log.Printf("⚠️ Shutdown: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// rateChunk is the largest write that is passed through a rate limiter at once,
+// so that throttled transfers are smooth rather than bursty.
+const rateChunk = 16 * 1024
+
+// BandwidthLimits configures the rate limits of a tunnel in bytes per second.
+// Upload is traffic from the local service to visitors, download is traffic
+// from visitors to the local service. Tunnel limits are shared by all
+// connections, connection limits apply to each connection separately.
+// Zero means unlimited.
+type BandwidthLimits struct {
+	TunnelUpload       int64
+	TunnelDownload     int64
+	ConnectionUpload   int64
+	ConnectionDownload int64
+}
+
+// rateLimiter is a token bucket shared by all writers that use it. A nil
+// *rateLimiter does not limit.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // Bytes per second.
+	burst  float64 // Maximum number of tokens that can accumulate.
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter for bytesPerSec, or nil if it is not positive.
+func newRateLimiter(bytesPerSec int64) *rateLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	rate := float64(bytesPerSec)
+	return &rateLimiter{rate: rate, burst: rate, tokens: rate, last: time.Now()}
+}
+
+// wait blocks until n bytes may be transferred. Tokens are taken immediately,
+// so concurrent writers queue up behind each other instead of racing.
+func (l *rateLimiter) wait(n int) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+// rateLimitedWriter throttles writes to w by all of its limiters.
+type rateLimitedWriter struct {
+	w        io.Writer
+	limiters []*rateLimiter
+}
+
+// newRateLimitedWriter wraps w with the given limiters, ignoring nil ones. It
+// returns w itself if there is nothing to limit.
+func newRateLimitedWriter(w io.Writer, limiters ...*rateLimiter) io.Writer {
+	var active []*rateLimiter
+	for _, l := range limiters {
+		if l != nil {
+			active = append(active, l)
+		}
+	}
+	if len(active) == 0 {
+		return w
+	}
+	return &rateLimitedWriter{w: w, limiters: active}
+}
+
+func (rw *rateLimitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), rateChunk)]
+		for _, l := range rw.limiters {
+			l.wait(len(chunk))
+		}
+		n, err := rw.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// rateLimitedConn throttles the visitor side of a relayed connection: reading
+// from it by the download limiters and writing to it by the upload limiters.
+type rateLimitedConn struct {
+	net.Conn
+	download []*rateLimiter
+	w        io.Writer
+}
+
+// CloseWrite half-closes the underlying connection.
+func (rc *rateLimitedConn) CloseWrite() error {
+	return closeWrite(rc.Conn)
+}
+
+func (rc *rateLimitedConn) Read(p []byte) (int, error) {
+	if len(p) > rateChunk {
+		p = p[:rateChunk]
+	}
+	n, err := rc.Conn.Read(p)
+	for _, l := range rc.download {
+		l.wait(n)
+	}
+	return n, err
+}
+
+func (rc *rateLimitedConn) Write(p []byte) (int, error) {
+	return rc.w.Write(p)
+}
+
+// parseRate parses a transfer rate such as "5MBps", "512KBps", "10Mbps" or a plain
+// number of bytes per second, and returns it in bytes per second. Uppercase B
+// means bytes and lowercase b means bits; K, M and G are decimal multiples and
+// KiB-style suffixes binary ones. An empty string means no limit.
+func parseRate(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return !unicode.IsDigit(r) && r != '.'
+	})
+	num, unit := s, ""
+	if i >= 0 {
+		num, unit = s[:i], strings.TrimSpace(s[i:])
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+
+	unit = strings.TrimSuffix(strings.TrimSuffix(unit, "ps"), "/s")
+	bits := strings.HasSuffix(unit, "b")
+	unit = strings.TrimRight(unit, "Bb")
+
+	multipliers := map[string]float64{
+		"": 1, "K": 1e3, "k": 1e3, "M": 1e6, "G": 1e9,
+		"Ki": 1 << 10, "Mi": 1 << 20, "Gi": 1 << 30,
+	}
+	m, ok := multipliers[unit]
+	if !ok {
+		return 0, fmt.Errorf("invalid rate unit in %q", s)
+	}
+	v *= m
+	if bits {
+		v /= 8
+	}
+	return int64(v), nil
+}
+
+// SetBandwidthLimits replaces the rate limits of the tunnel. Tunnel limits start
+// afresh; connections that are already being relayed keep the limits that were
+// in effect when they were accepted.
+// It is safe to call SetBandwidthLimits while the client is listening.
+func (c *Client) SetBandwidthLimits(l BandwidthLimits) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.limits = l
+	c.uploadLimiter = newRateLimiter(l.TunnelUpload)
+	c.downloadLimiter = newRateLimiter(l.TunnelDownload)
+}
+
+// connectionLimiters returns the limiters a new proxied connection is subject to
+// for download (visitor to local service) and upload (local service to visitor).
+func (c *Client) connectionLimiters() (download, upload []*rateLimiter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	download = []*rateLimiter{c.downloadLimiter, newRateLimiter(c.limits.ConnectionDownload)}
+	upload = []*rateLimiter{c.uploadLimiter, newRateLimiter(c.limits.ConnectionUpload)}
+	return download, upload
+}
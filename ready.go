@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// defaultReadyFile is where healthcheck looks for the ready file by default.
+var defaultReadyFile = filepath.Join(os.TempDir(), "jerusalem-ready")
+
+// writeReadyFile records that the tunnel is up by writing the PID of the
+// process and the remote port to path. It does nothing if path is empty.
+func writeReadyFile(path string, port uint16) error {
+	if path == "" {
+		return nil
+	}
+	data := fmt.Sprintf("%d %d\n", os.Getpid(), port)
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		return fmt.Errorf("failed to write ready file: %w", err)
+	}
+	return nil
+}
+
+// removeReadyFile removes the ready file when the tunnel goes down.
+func removeReadyFile(path string) {
+	if path != "" {
+		_ = os.Remove(path)
+	}
+}
+
+// checkReady reports the PID and remote port recorded in the ready file at path
+// if the process that wrote it is still running.
+func checkReady(path string) (pid int, port string, err error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, "", fmt.Errorf("%s not found", path)
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) != 2 {
+		return 0, "", fmt.Errorf("invalid ready file %s", path)
+	}
+	pid, err = strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid ready file %s: %w", path, err)
+	}
+	if !processAlive(pid) {
+		return 0, "", fmt.Errorf("process %d from %s is not running", pid, path)
+	}
+	return pid, fields[1], nil
+}
+
+// healthcheckCommand implements `healthcheck`, which exits with status 0 if the
+// tunnel is up according to the ready file and 1 otherwise, for use as a
+// Docker HEALTHCHECK.
+func healthcheckCommand(args []string) {
+	fs := flag.NewFlagSet("healthcheck", flag.ExitOnError)
+	readyFile := fs.String("ready-file", defaultReadyFile, "ready file written by the client")
+	_ = fs.Parse(args)
+
+	pid, port, err := checkReady(*readyFile)
+	if err != nil {
+		fmt.Printf("🔴 Not ready: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("🟢 Ready (PID %d, remote port %s)\n", pid, port)
+}
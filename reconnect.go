@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"hash/fnv"
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	// defaultReconnectDelay is the initial upper bound of the reconnect delay.
+	defaultReconnectDelay = time.Second
+	// defaultReconnectMaxDelay caps the reconnect delay as it doubles.
+	defaultReconnectMaxDelay = time.Minute
+	// maxConcurrentReconnects bounds the control connections being established
+	// at once by this process, so a process running many tunnels does not open
+	// all of them in the same instant when the server comes back.
+	maxConcurrentReconnects = 4
+)
+
+// reconnectSlots holds a token for each reconnect attempt in progress.
+var reconnectSlots = make(chan struct{}, maxConcurrentReconnects)
+
+// backoff computes the delays between reconnect attempts. The delays are drawn
+// uniformly from zero to an exponentially growing ceiling ("full jitter") by a
+// random source seeded with the client ID, so the clients of a fleet spread
+// out when a server restart disconnects all of them at once, while the
+// sequence of one client is reproducible.
+type backoff struct {
+	base, max time.Duration
+	ceiling   time.Duration
+	rng       *rand.Rand
+}
+
+// newBackoff creates a backoff for clientID starting at base and doubling up
+// to max.
+func newBackoff(clientID string, base, max time.Duration) *backoff {
+	h := fnv.New64a()
+	h.Write([]byte(clientID))
+	return &backoff{base: base, max: max, ceiling: base, rng: rand.New(rand.NewPCG(h.Sum64(), 0))}
+}
+
+// next returns the delay before the next attempt after an attempt, or the
+// loss of the connection, failed with err. If the server asked to retry after
+// some time with a ServerError, the client waits at least that long.
+func (b *backoff) next(err error) time.Duration {
+	delay := b.jitter(b.ceiling)
+	b.ceiling = min(b.ceiling*2, b.max)
+	var serr *ServerError
+	if errors.As(err, &serr) && serr.RetryAfter > delay {
+		delay = serr.RetryAfter + b.jitter(b.base)
+	}
+	return delay
+}
+
+// jitter returns a random duration in [0, d).
+func (b *backoff) jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(b.rng.Int64N(int64(d)))
+}
+
+// dialLimited connects a new client for config like newClientFromConfig, but
+// waits while maxConcurrentReconnects other connections are being established.
+func dialLimited(config *Config) (*Client, error) {
+	reconnectSlots <- struct{}{}
+	defer func() { <-reconnectSlots }()
+	return newClientFromConfig(config)
+}
@@ -0,0 +1,23 @@
+package main
+
+// RejectCapability is the capability offered in the hello message to refuse
+// connection requests: the client answers a request it will not relay with a
+// reject message on the control connection, naming the connection in "reject"
+// and why in "error", so the server closes the visitor at once instead of
+// waiting for an accept that never comes.
+const RejectCapability = "reject"
+
+// rejectConnection reports the connection request pc, refused with err, to
+// OnError and the audit log and refuses it to the server if the server
+// accepted RejectCapability. Servers without it drop the visitor once they
+// stop waiting for the accept message.
+func (c *Client) rejectConnection(pc *proxyConn, err error) {
+	c.hooks.onError(err)
+	c.recordAudit(pc, AuditRejected, err)
+	if pc.preview || !c.rejects {
+		return
+	}
+	if serr := c.cc.Send(ClientMessage{Type: MtReject, Reject: pc.id, Error: err.Error()}); serr != nil {
+		c.logger.Printf("⚠️ Failed to refuse connection %s: %v\n", pc.id, serr)
+	}
+}
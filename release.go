@@ -0,0 +1,38 @@
+package main
+
+import (
+	"runtime/debug"
+	"time"
+)
+
+// releaseTimeout bounds how long sending the goodbye message may block, so a
+// dead server cannot hold up shutdown.
+const releaseTimeout = time.Second
+
+// release tells the server that the client is going away so it can free the
+// public port immediately instead of waiting for the control connection to time
+// out. It is best effort: the message is sent at most once and errors are only
+// logged, as the control connection is closed right after anyway.
+func (c *Client) release() {
+	c.released.Do(func() {
+		_ = c.cc.conn.SetWriteDeadline(time.Now().Add(releaseTimeout))
+		if err := c.cc.Send(ClientMessage{Type: MtGoodbye, Goodbye: c.rp}); err != nil {
+			c.logger.Printf("Failed to release remote port %d: %v\n", c.rp, err)
+		}
+	})
+}
+
+// releaseOnPanic is deferred by the goroutines of a Client. If the goroutine
+// panics, the stack is logged, the public port is released and the control
+// connection is closed before the panic is propagated, so a crashing client does
+// not leave a stale port behind on the server.
+func (c *Client) releaseOnPanic() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	c.logger.Printf("❌ Panic: %v\n%s", r, debug.Stack())
+	c.release()
+	c.cc.Close()
+	panic(r)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// authenticator returns the Authenticator of new handshakes, nil without one.
+func (c *Client) authenticator() *Authenticator {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.auth
+}
+
+// SetSecrets changes the secrets of the handshakes of new data connections
+// and reconnects to primary, falling back to secondary if the server refuses
+// it, like WithRotatingSecret. The control connection, which authenticated
+// already, is kept, so rotating the secret does not interrupt the tunnel. It
+// does nothing on a client that signs challenges with a private key or sends
+// an access token.
+func (c *Client) SetSecrets(primary, secondary string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.auth == nil || c.auth.key != nil || c.auth.token != nil {
+		return
+	}
+	auth := NewRotatingAuthenticator(primary, secondary)
+	auth.strict = c.strictAuth
+	if auth.secondary != nil {
+		auth.secondary.strict = c.strictAuth
+	}
+	c.auth = auth
+}
+
+// authenticate performs the client handshake with auth on rc and returns the
+// authenticated connection and the port offered by the server. If the server
+// refuses the secret and auth has a secondary one, a new connection is
+// authenticated with that instead, and it is tried first from then on. A
+// session token issued by the server is kept for data connections. On error,
+// rc and any new connection are closed.
+func (c *Client) authenticate(ctx context.Context, auth *Authenticator, rc *Codec) (*Codec, uint16, error) {
+	msg, err := auth.handshake(ctx, rc, c.cid)
+	if err == nil {
+		c.storeSession(msg)
+		return rc, msg.Port, nil
+	}
+	rc.Close()
+	if !errors.Is(err, ErrAuthFailed) || auth.secondary == nil {
+		return nil, 0, err
+	}
+
+	conn, dialErr := c.dial(ctx)
+	if dialErr != nil {
+		return nil, 0, err
+	}
+	next := NewCodec(conn)
+	next.faults = rc.faults
+	alt := auth.swapped()
+	if msg, err = alt.handshake(ctx, next, c.cid); err != nil {
+		next.Close()
+		return nil, 0, err
+	}
+	c.storeSession(msg)
+	c.mu.Lock()
+	if c.auth == auth {
+		c.auth = alt
+		c.logger.Println("⚠️ The server refused the secret key but accepted the other one, trying that first from now on")
+	}
+	c.mu.Unlock()
+	return next, msg.Port, nil
+}
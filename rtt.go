@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RTTCapability is the capability offered in the hello message to measure the
+// round-trip time on heartbeats: the client answers every heartbeat of the
+// server with a heartbeat carrying a sequence number in "ping", which the
+// server echoes right away in the "pong" field of a heartbeat.
+const RTTCapability = "rtt"
+
+// rttProbe tracks the heartbeat ping in flight and the last round-trip time.
+type rttProbe struct {
+	mu   sync.Mutex
+	seq  uint64
+	sent time.Time
+	last atomic.Int64 // Nanoseconds, 0 until the first pong.
+}
+
+// onHeartbeat handles a heartbeat of the server: a pong completes the
+// measurement of the ping it answers, any other heartbeat is answered with a
+// new ping.
+func (c *Client) onHeartbeat(msg ServerMessage) {
+	if !c.measureRTT {
+		return
+	}
+	p := &c.rtt
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if msg.Pong != 0 {
+		if msg.Pong == p.seq {
+			p.last.Store(int64(time.Since(p.sent)))
+		}
+		return
+	}
+	p.seq++
+	p.sent = time.Now()
+	if err := c.cc.Send(ClientMessage{Type: MtHeartbeat, Ping: p.seq}); err != nil {
+		c.logger.Printf("⚠️ Failed to send heartbeat ping: %v\n", err)
+	}
+}
+
+// RTT returns the round-trip time to the server measured on the last
+// heartbeat, or zero if the server does not support the measurement or has
+// not answered yet.
+func (c *Client) RTT() time.Duration {
+	return time.Duration(c.rtt.last.Load())
+}
+
+// pingResult is the outcome of probing a server once.
+type pingResult struct {
+	connect   time.Duration // Time to open the TCP connection, about one round trip.
+	handshake time.Duration // Time from connecting until the server assigned a port.
+	err       error
+}
+
+// pingServer opens a connection to addr and authenticates on it like a data
+// connection, measuring how long both steps take; a TLS handshake with tlsCfg,
+// if not nil, counts towards the handshake. The connection is closed before
+// the hello exchange, so no tunnel is opened.
+func pingServer(addr string, auth *Authenticator, clientID string, timeouts Timeouts, tlsCfg *tls.Config) pingResult {
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", addr, timeouts.dial())
+	if err != nil {
+		return pingResult{err: err}
+	}
+	defer conn.Close()
+	res := pingResult{connect: time.Since(start)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeouts.handshake())
+	defer cancel()
+	if tlsCfg != nil {
+		host, _, _ := net.SplitHostPort(addr)
+		if conn, err = startTLS(ctx, conn, tlsFor(tlsCfg, host)); err != nil {
+			res.handshake = time.Since(start) - res.connect
+			res.err = err
+			return res
+		}
+		defer conn.Close()
+	}
+	cc := NewCodec(conn)
+	if auth != nil {
+		_, err = auth.PerformClientHandshake(ctx, cc, clientID)
+	} else {
+		var msg ServerMessage
+		err = cc.Recv(ctx, &msg)
+	}
+	res.handshake = time.Since(start) - res.connect
+	res.err = err
+	return res
+}
+
+// pingCommand implements `ping [--count n] [--interval d] [flags] [config]`,
+// which measures the connect and handshake latency to each configured server
+// and lists them fastest first, to help choosing the closest region. It exits
+// with a non-zero status if no server could be reached.
+func pingCommand(args []string) {
+	fs := flag.NewFlagSet("ping", flag.ExitOnError)
+	configPath := fs.String("config", "", "config file (.yaml, .toml or .json)")
+	count := fs.Int("count", 3, "number of probes per server")
+	interval := fs.Duration("interval", time.Second, "time between probes")
+	registerConfigFlags(fs)
+	_ = fs.Parse(args)
+
+	configFile := *configPath
+	if configFile == "" && fs.NArg() > 0 {
+		configFile = fs.Arg(0)
+	}
+	applyConfigFlags(fs)
+	var config Config
+	if err := loadConfig(&config, configFile); err != nil {
+		configFatalf("❌ Failed to read config file: %v", err)
+	}
+	addrs, err := serverEndpoints(&config)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	auth := configAuthenticator(&config)
+
+	type summary struct {
+		addr               string
+		ok                 int
+		connect, handshake time.Duration // Averages over the successful probes.
+		minConnect         time.Duration
+		maxConnect         time.Duration
+	}
+	var results []summary
+	for _, addr := range addrs {
+		s := summary{addr: addr}
+		for i := 0; i < *count; i++ {
+			if i > 0 {
+				time.Sleep(*interval)
+			}
+			res := pingServer(addr, auth, config.ClientID, config.Timeouts, config.TLS.clientConfig())
+			if res.err != nil {
+				fmt.Printf("❌ %s: %v\n", addr, res.err)
+				continue
+			}
+			fmt.Printf("🔍 %s: connect %s, handshake %s\n", addr, res.connect.Round(time.Microsecond), res.handshake.Round(time.Microsecond))
+			if s.ok == 0 || res.connect < s.minConnect {
+				s.minConnect = res.connect
+			}
+			s.maxConnect = max(s.maxConnect, res.connect)
+			s.connect += res.connect
+			s.handshake += res.handshake
+			s.ok++
+		}
+		if s.ok > 0 {
+			s.connect /= time.Duration(s.ok)
+			s.handshake /= time.Duration(s.ok)
+			results = append(results, s)
+		}
+	}
+	if len(results) == 0 {
+		fmt.Println("❌ No server could be reached")
+		os.Exit(1)
+	}
+
+	sort.SliceStable(results, func(i, j int) bool { return results[i].connect < results[j].connect })
+	fmt.Println()
+	for _, s := range results {
+		fmt.Printf("%s: %d/%d probes, RTT min/avg/max %s/%s/%s, handshake avg %s\n", s.addr, s.ok, *count,
+			s.minConnect.Round(time.Microsecond), s.connect.Round(time.Microsecond), s.maxConnect.Round(time.Microsecond),
+			s.handshake.Round(time.Microsecond))
+	}
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// listenResult is the outcome of a client's Listen call.
+type listenResult struct {
+	client *Client
+	err    error
+}
+
+// runner owns the active client of the CLI and replaces it when the configuration
+// is reloaded. Clients that were replaced keep draining their in-flight
+// connections in the background while the new client already serves requests.
+type runner struct {
+	configFile string
+	done       chan listenResult
+	retiring   sync.WaitGroup // Replaced clients that are still draining.
+	stop       chan struct{}  // Closed by Shutdown to abort reconnecting.
+	stopOnce   sync.Once
+
+	mu          sync.Mutex // Guards config, client, preview and the flags below.
+	config      Config
+	client      *Client
+	preview     net.Listener // Local preview listener, if enabled.
+	tunnels     *tunnelSet   // Extra tunnels of the main runner, nil for the others.
+	redialing   bool         // Whether the control connection is being re-established.
+	offSchedule bool         // Whether the schedule closed the tunnel, see watchSchedule.
+	paused      bool         // Whether new connections are refused, see setPaused.
+	gaveUp      error        // Why reconnecting was given up, nil if it was not.
+}
+
+// newRunner creates a runner for an already connected client.
+func newRunner(config Config, client *Client, configFile string) *runner {
+	r := &runner{
+		configFile: configFile,
+		done:       make(chan listenResult, 1),
+		stop:       make(chan struct{}),
+		config:     config,
+		client:     client,
+	}
+	r.watchQuota(&config)
+	return r
+}
+
+// run listens with the active client until it is shut down. If the control
+// connection of the active client is lost, it reconnects with backoff; results
+// of replaced clients are ignored. If the schedule closed it, it is reopened at
+// the next window. The ready file is removed while the tunnel is down.
+func (r *runner) run() {
+	r.listen(r.current())
+	for res := range r.done {
+		if res.client != r.current() {
+			continue
+		}
+		r.mu.Lock()
+		removeReadyFile(r.config.ReadyFile)
+		r.mu.Unlock()
+		if r.isOffSchedule() {
+			if !r.reopen(res.client) {
+				return
+			}
+			continue
+		}
+		if res.err == nil || !r.redial(res.client, res.err) {
+			return
+		}
+	}
+}
+
+// redial replaces the client old, whose control connection was lost with err,
+// with a newly connected one, to the next server if several are configured. Attempts are spaced out by a backoff seeded with
+// the client ID, honour a retry-after hint of the server and are limited to
+// maxConcurrentReconnects at once. It returns false if the runner was shut
+// down in the meantime, or if it gave up, see retry.
+func (r *runner) redial(old *Client, err error) bool {
+	log.Printf("⚠️ Control connection lost: %v", err)
+	notify.tunnel(EventTunnelDown, old, err)
+	servers.disconnected(old.ServerAddr())
+	return r.retry(old, err)
+}
+
+// retry connects again with backoff after connecting failed with err and
+// replaces old with the new client, see redial. While the schedule keeps the
+// tunnel closed, it waits for the next window. It gives up, recording why in
+// r.gaveUp, when the server refuses the credentials, unless auth-retry-cooldown
+// is set, in which case it waits at least that long before trying them again,
+// and after reconnect-max-attempts failed attempts in a row, if set.
+func (r *runner) retry(old *Client, err error) bool {
+	r.mu.Lock()
+	b := newBackoff(r.config.ClientID, r.config.ReconnectDelay, r.config.ReconnectMax)
+	r.redialing = true
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		r.redialing = false
+		r.mu.Unlock()
+	}()
+	for attempts := 0; ; attempts++ {
+		r.mu.Lock()
+		limit, cooldown := r.config.ReconnectLimit, r.config.AuthCooldown
+		r.mu.Unlock()
+		if limit > 0 && attempts >= limit {
+			log.Printf("❌ Failed to reconnect %d times in a row, giving up", attempts)
+			r.giveUp(err)
+			return false
+		}
+		delay := b.next(err)
+		if errors.Is(err, ErrAuthFailed) && delay < cooldown {
+			delay = cooldown
+		}
+		log.Printf("🔁 Reconnecting in %s", delay.Round(time.Millisecond))
+		select {
+		case <-time.After(delay):
+		case <-r.stop:
+			return false
+		}
+		if r.isOffSchedule() && !r.awaitWindow() {
+			return false
+		}
+
+		r.mu.Lock()
+		config := r.config
+		r.mu.Unlock()
+		var client *Client
+		if client, err = dialLimited(&config); err != nil {
+			if errors.Is(err, ErrAuthFailed) {
+				notify.tunnel(EventAuthFailed, nil, err)
+				if config.AuthCooldown == 0 {
+					log.Printf("❌ Failed to reconnect, not retrying with the same credentials: %v", err)
+					r.giveUp(err)
+					return false
+				}
+			}
+			log.Printf("❌ Failed to reconnect: %v", err)
+			continue
+		}
+		select {
+		case <-r.stop:
+			_ = client.Close()
+			return false
+		default:
+		}
+		if r.isOffSchedule() {
+			_ = client.Close()
+			continue
+		}
+		r.replace(old, client, config)
+		log.Printf("✅ Reconnected on remote port %d", client.RemotePort())
+		notify.tunnel(EventReconnected, client, nil)
+		printTunnelEvent(&config, "reconnected", client)
+		return true
+	}
+}
+
+// giveUp records that reconnecting was given up after err.
+func (r *runner) giveUp(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.gaveUp = err
+}
+
+// gaveUpReason returns why reconnecting was given up, nil if it was not.
+func (r *runner) gaveUpReason() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.gaveUp
+}
+
+// listen starts client.Listen in the background and reports its result on r.done.
+func (r *runner) listen(client *Client) {
+	go func() {
+		r.done <- listenResult{client: client, err: client.Listen()}
+	}()
+}
+
+// current returns the active client.
+func (r *runner) current() *Client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.client
+}
+
+// state describes the state of the tunnel in one word: connected, draining,
+// maintenance, paused, degraded (the local service is down), reconnecting or
+// scheduled (closed until the next schedule window).
+func (r *runner) state() string {
+	r.mu.Lock()
+	c, redialing, offSchedule := r.client, r.redialing, r.offSchedule
+	r.mu.Unlock()
+	maintenance, _ := c.maintenanceState()
+	switch {
+	case offSchedule:
+		return "scheduled"
+	case redialing:
+		return "reconnecting"
+	case c.isDraining():
+		return "draining"
+	case maintenance:
+		return "maintenance"
+	case c.Paused():
+		return "paused"
+	case c.isDegraded():
+		return "degraded"
+	}
+	return "connected"
+}
+
+// Shutdown closes the preview listener, gracefully stops the active client and
+// the extra tunnels and waits, within the same deadline, for replaced clients
+// that are still draining.
+func (r *runner) Shutdown(ctx context.Context) error {
+	r.stopOnce.Do(func() { close(r.stop) })
+	r.setPreview(nil)
+	r.retiring.Add(1)
+	go func() {
+		defer r.retiring.Done()
+		r.tunnels.shutdown(ctx)
+	}()
+	err := r.current().Shutdown(ctx)
+
+	done := make(chan struct{})
+	go func() {
+		r.retiring.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+	return err
+}
+
+// handleReloadSignals reloads the configuration every time SIGHUP is received.
+func (r *runner) handleReloadSignals() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	for range sigs {
+		_ = r.reload()
+	}
+}
+
+// reload re-reads the config file and applies the changes at runtime.
+// A new local target, maintenance setting, bandwidth or connection limit,
+// health check, idle timeout, access control lists, PROXY protocol setting and
+// preview port are applied in place.
+// Changing the server, client ID or secret, or compression, multiplexing, the
+// codec or the label, which are negotiated per session, or the timeouts, the
+// pipeline or the traffic quota, which connections are set up with, establishes a new control connection; the old client is shut down gracefully once the new one is up,
+// so established connections are not cut. On any error the running
+// configuration is kept, and the error is logged and returned.
+func (r *runner) reload() error {
+	if r.configFile == "" {
+		log.Println("⚠️ No config file to reload")
+		return errors.New("no config file to reload")
+	}
+	return r.refresh()
+}
+
+// refresh loads the configuration again, from the config file if there is one,
+// and applies the changes like reload.
+func (r *runner) refresh() error {
+	var next Config
+	if err := loadConfig(&next, r.configFile); err != nil {
+		log.Printf("❌ Reload failed, keeping current configuration: %v", err)
+		return err
+	}
+	return r.apply(next)
+}
+
+// apply changes the running configuration to next like reload. Everything
+// that can fail is loaded before anything changes, so a failed reload leaves
+// the tunnels as they were. The extra tunnels are then brought in line with
+// next, see tunnelSet.apply.
+func (r *runner) apply(next Config) error {
+	r.mu.Lock()
+	cur, client, offSchedule := r.config, r.client, r.offSchedule
+	r.mu.Unlock()
+	keepPromptedValues(&next, &cur)
+	if next.Quota == cur.Quota {
+		next.quota = cur.quota // The traffic relayed so far keeps counting.
+	}
+	page, err := maintenancePage(&next)
+	if err != nil {
+		log.Printf("❌ Reload failed, keeping current configuration: %v", err)
+		return err
+	}
+	r.tunnels.apply(next)
+	if offSchedule {
+		// There is no client to change; the next window connects with next.
+		r.mu.Lock()
+		r.config = next
+		r.mu.Unlock()
+		log.Println("🔁 Configuration reloaded, applied when the schedule window opens")
+		return nil
+	}
+
+	secretsChanged := next.SecretKey != cur.SecretKey || next.SecondaryKey != cur.SecondaryKey
+	if next.Server != cur.Server || next.ServerPort != cur.ServerPort || next.ClientID != cur.ClientID ||
+		(secretsChanged && (next.SecretKey == "" || cur.SecretKey == "")) ||
+		!next.PrivateKey.Equal(cur.PrivateKey) || next.OIDC != cur.OIDC || next.StrictHandshake != cur.StrictHandshake || !next.TLS.equal(cur.TLS) ||
+		next.Compression != cur.Compression || next.Multiplex != cur.Multiplex || next.Codec != cur.Codec || next.Label != cur.Label ||
+		next.Timeouts != cur.Timeouts || !slices.Equal(next.Pipeline, cur.Pipeline) || next.PipelineSecret != cur.PipelineSecret ||
+		next.Quota != cur.Quota {
+		return r.reconnect(client, next)
+	}
+
+	if secretsChanged && next.PrivateKey == nil && !next.OIDC.enabled() {
+		client.SetSecrets(next.SecretKey, next.SecondaryKey)
+		log.Println("🔁 Secret keys changed, new connections authenticate with them")
+	}
+	if next.LocalHost != cur.LocalHost || next.LocalPort != cur.LocalPort {
+		client.SetLocalTarget(next.LocalHost, next.LocalPort)
+		log.Printf("🔁 Local target changed to %s:%d", next.LocalHost, next.LocalPort)
+	}
+	setMaintenance(client, &next, page)
+	if next.Bandwidth != cur.Bandwidth {
+		client.SetBandwidthLimits(next.Bandwidth)
+		log.Println("🔁 Bandwidth limits changed")
+	}
+	if next.MaxConnections != cur.MaxConnections || next.QueueTimeout != cur.QueueTimeout {
+		client.SetMaxConnections(next.MaxConnections, next.QueueTimeout)
+		log.Printf("🔁 Connection limit changed to %d", next.MaxConnections)
+	}
+	if next.HealthCheck != cur.HealthCheck {
+		client.SetHealthCheck(next.HealthCheck)
+		log.Println("🔁 Health check changed")
+	}
+	if next.IdleTimeout != cur.IdleTimeout {
+		client.SetIdleTimeout(next.IdleTimeout)
+		log.Printf("🔁 Idle timeout changed to %s", next.IdleTimeout)
+	}
+	if !next.Access.equal(cur.Access) {
+		client.SetAccessControl(next.Access)
+		log.Println("🔁 Access control lists changed")
+	}
+	if next.ProxyProtocol != cur.ProxyProtocol {
+		client.SetProxyProtocol(next.ProxyProtocol)
+		log.Printf("🔁 PROXY protocol changed to %q", next.ProxyProtocol)
+	}
+	if !next.Schedule.equal(cur.Schedule) {
+		log.Println("🔁 Schedule changed")
+	}
+	if next.PreviewPort != cur.PreviewPort {
+		if err := r.setPreviewPort(next.PreviewPort); err != nil {
+			log.Printf("❌ %v", err)
+		}
+	}
+
+	r.mu.Lock()
+	r.config = next
+	r.mu.Unlock()
+	log.Println("🔁 Configuration reloaded")
+	return nil
+}
+
+// reconnect replaces old with a client connected using config.
+func (r *runner) reconnect(old *Client, config Config) error {
+	client, err := dialLimited(&config)
+	if err != nil {
+		log.Printf("❌ Reload failed, keeping current connection: %v", err)
+		return err
+	}
+	r.replace(old, client, config)
+	log.Println("🔁 Configuration reloaded, control connection re-established")
+	return nil
+}
+
+// replace makes client, connected using config, the active client and shuts
+// old down gracefully in the background.
+func (r *runner) replace(old, client *Client, config Config) {
+	r.mu.Lock()
+	r.config = config
+	r.client = client
+	client.SetPaused(r.paused)
+	r.mu.Unlock()
+	r.watchQuota(&config)
+	r.listen(client)
+	if err := writeReadyFile(config.ReadyFile, client.RemotePort()); err != nil {
+		log.Printf("⚠️ %v", err)
+	}
+
+	r.retiring.Add(1)
+	go func() {
+		defer r.retiring.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+		defer cancel()
+		if err := old.Shutdown(ctx); err != nil {
+			log.Printf("⚠️ Shutdown of previous connection: %v", err)
+		}
+	}()
+}
+
+// keepPromptedValues copies values that are missing from next, because they were
+// entered interactively rather than read from the config file, from cur.
+func keepPromptedValues(next, cur *Config) {
+	if next.Server == "" {
+		next.Server = cur.Server
+	}
+	if next.ServerPort == 0 {
+		next.ServerPort = cur.ServerPort
+	}
+	if next.ClientID == "" {
+		next.ClientID = cur.ClientID
+	}
+	if next.SecretKey == "" {
+		next.SecretKey = cur.SecretKey
+	}
+	if next.LocalHost == "" {
+		next.LocalHost = cur.LocalHost
+	}
+	if next.LocalPort == 0 {
+		next.LocalPort = cur.LocalPort
+	}
+}
+
+// renewVaultSecrets fetches the secrets referenced with vault:// again when two
+// thirds of their lease have passed, so a rotated secret key is picked up
+// before the old one expires. It returns at once if the secrets do not expire.
+func (r *runner) renewVaultSecrets() {
+	for {
+		r.mu.Lock()
+		lease := r.config.VaultLease
+		r.mu.Unlock()
+		if lease <= 0 {
+			return
+		}
+		time.Sleep(lease * 2 / 3)
+		log.Println("🔁 Vault lease expiring, fetching secrets again")
+		_ = r.refresh()
+	}
+}
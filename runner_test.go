@@ -0,0 +1,33 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"client/tunneltest"
+)
+
+func TestFailedReloadKeepsClient(t *testing.T) {
+	srv := newServer(t, func() (*tunneltest.Server, error) { return tunneltest.NewServer("secret") })
+	c := connect(t, srv, WithSecret("secret"))
+	host, port := c.LocalTarget()
+	cur := Config{SecretKey: "secret", LocalHost: host, LocalPort: port}
+	r := newRunner(cur, c, "")
+
+	next := cur
+	next.SecretKey, next.LocalPort = "rotated", port+1
+	next.Maintenance, next.MaintenancePage = true, filepath.Join(t.TempDir(), "missing.html")
+	if err := r.apply(next); err == nil {
+		t.Fatal("reload with a missing maintenance page succeeded")
+	}
+	if h, p := c.LocalTarget(); h != host || p != port {
+		t.Fatalf("local target changed to %s:%d by a failed reload", h, p)
+	}
+	if enabled, _ := c.maintenanceState(); enabled {
+		t.Fatal("maintenance mode enabled by a failed reload")
+	}
+	echo(t, visit(t, srv, c), "still the old secret")
+	if r.config.LocalPort != port {
+		t.Fatal("the failed reload replaced the running configuration")
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// scheduleCheckInterval bounds how long the runner sleeps before looking at
+// the schedule again, so a schedule changed on reload applies within it.
+const scheduleCheckInterval = time.Minute
+
+// weekdays maps the day names accepted in a schedule to time.Weekday.
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// window is a daily time range during which the tunnel is open. A range that
+// ends before it starts runs past midnight and belongs to the day it starts.
+type window struct {
+	days       [7]bool // Indexed by time.Weekday.
+	start, end int     // Minutes after midnight; end may be 24*60.
+}
+
+// Schedule is a set of time windows during which the tunnel is open; outside
+// them the control connection is kept closed. An empty schedule is always open.
+type Schedule struct {
+	windows []window
+	loc     *time.Location
+	spec    string // The windows as configured, to tell schedules apart.
+}
+
+// parseSchedule parses windows such as "09:00-18:00 Mon-Fri", "Sat,Sun
+// 10:00-14:00" or "22:00-06:00" (every day) in the time zone tz, which is an
+// IANA name or empty or "Local" for the system zone.
+func parseSchedule(specs []string, tz string) (Schedule, error) {
+	s := Schedule{loc: time.Local, spec: tz + "|" + strings.Join(specs, ";")}
+	if tz != "" && !strings.EqualFold(tz, "local") {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return Schedule{}, fmt.Errorf("invalid schedule-timezone %q: %w", tz, err)
+		}
+		s.loc = loc
+	}
+	for _, spec := range specs {
+		w, err := parseWindow(spec)
+		if err != nil {
+			return Schedule{}, fmt.Errorf("invalid schedule window %q: %w", spec, err)
+		}
+		s.windows = append(s.windows, w)
+	}
+	return s, nil
+}
+
+// parseWindow parses one window: a time range and optionally the days it
+// applies to, in either order.
+func parseWindow(spec string) (window, error) {
+	var w window
+	var haveTimes, haveDays bool
+	for _, field := range strings.Fields(spec) {
+		if strings.Contains(field, ":") {
+			if haveTimes {
+				return w, fmt.Errorf("more than one time range")
+			}
+			from, to, ok := strings.Cut(field, "-")
+			if !ok {
+				return w, fmt.Errorf("time range %q must look like 09:00-18:00", field)
+			}
+			var err error
+			if w.start, err = parseClock(from, false); err != nil {
+				return w, err
+			}
+			if w.end, err = parseClock(to, true); err != nil {
+				return w, err
+			}
+			if w.start == w.end {
+				return w, fmt.Errorf("time range %q is empty", field)
+			}
+			haveTimes = true
+			continue
+		}
+		if err := parseDays(field, &w.days); err != nil {
+			return w, err
+		}
+		haveDays = true
+	}
+	if !haveTimes {
+		return w, fmt.Errorf("missing time range such as 09:00-18:00")
+	}
+	if !haveDays {
+		w.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	return w, nil
+}
+
+// parseClock parses HH:MM into minutes after midnight. 24:00 is accepted as
+// the end of a range.
+func parseClock(s string, end bool) (int, error) {
+	hh, mm, ok := strings.Cut(s, ":")
+	h, herr := strconv.Atoi(hh)
+	m, merr := strconv.Atoi(mm)
+	if !ok || herr != nil || merr != nil || h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && (m != 0 || !end)) {
+		return 0, fmt.Errorf("invalid time %q, use HH:MM", s)
+	}
+	return h*60 + m, nil
+}
+
+// parseDays marks the days of a list such as "Mon-Fri" or "Sat,Sun" in days.
+func parseDays(s string, days *[7]bool) error {
+	for _, item := range strings.Split(s, ",") {
+		from, to, isRange := strings.Cut(item, "-")
+		first, ok := weekdays[strings.ToLower(from)]
+		if !ok {
+			return fmt.Errorf("unknown day %q, use Mon, Tue, Wed, Thu, Fri, Sat or Sun", from)
+		}
+		last := first
+		if isRange {
+			if last, ok = weekdays[strings.ToLower(to)]; !ok {
+				return fmt.Errorf("unknown day %q, use Mon, Tue, Wed, Thu, Fri, Sat or Sun", to)
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// readSchedule fills config.Schedule from the schedule and schedule-timezone
+// keys.
+func readSchedule(config *Config) error {
+	var err error
+	config.Schedule, err = parseSchedule(readStringList("schedule"), viper.GetString("schedule-timezone"))
+	return err
+}
+
+// enabled reports whether the schedule has any windows.
+func (s Schedule) enabled() bool {
+	return len(s.windows) > 0
+}
+
+// equal reports whether s and o were configured the same.
+func (s Schedule) equal(o Schedule) bool {
+	return s.spec == o.spec
+}
+
+// intervals returns the windows of the days around t as concrete time ranges.
+func (s Schedule) intervals(t time.Time) [][2]time.Time {
+	var ranges [][2]time.Time
+	t = t.In(s.loc)
+	for offset := -1; offset <= 7; offset++ {
+		y, m, d := t.AddDate(0, 0, offset).Date()
+		day := time.Date(y, m, d, 0, 0, 0, 0, s.loc)
+		for _, w := range s.windows {
+			if !w.days[day.Weekday()] {
+				continue
+			}
+			end := w.end
+			if end < w.start {
+				end += 24 * 60
+			}
+			ranges = append(ranges, [2]time.Time{
+				time.Date(y, m, d, 0, w.start, 0, 0, s.loc),
+				time.Date(y, m, d, 0, end, 0, 0, s.loc),
+			})
+		}
+	}
+	return ranges
+}
+
+// open reports whether t falls into a window. It also returns when that
+// changes: the end of the window if t is in one, otherwise the start of the
+// next one. The time is zero if it does not change within a week.
+func (s Schedule) open(t time.Time) (bool, time.Time) {
+	if !s.enabled() {
+		return true, time.Time{}
+	}
+	ranges := s.intervals(t)
+	in := func(at time.Time) (time.Time, bool) {
+		var end time.Time
+		for _, r := range ranges {
+			if !at.Before(r[0]) && at.Before(r[1]) && r[1].After(end) {
+				end = r[1]
+			}
+		}
+		return end, !end.IsZero()
+	}
+	if end, ok := in(t); ok {
+		// Follow adjoining windows, such as one ending at 24:00 and the next
+		// day's starting at 00:00.
+		for next, ok := in(end); ok; next, ok = in(end) {
+			if end = next; end.Sub(t) > 7*24*time.Hour {
+				return true, time.Time{}
+			}
+		}
+		return true, end
+	}
+	var start time.Time
+	for _, r := range ranges {
+		if r[0].After(t) && (start.IsZero() || r[0].Before(start)) {
+			start = r[0]
+		}
+	}
+	return false, start
+}
+
+// waitForSchedule blocks until the schedule returned by schedule is open,
+// calling it again at least every scheduleCheckInterval. It returns false if
+// stop is closed first.
+func waitForSchedule(schedule func() Schedule, stop <-chan struct{}) bool {
+	logged := false
+	for {
+		open, at := schedule().open(time.Now())
+		if open {
+			return true
+		}
+		if !logged {
+			if at.IsZero() {
+				log.Println("🌙 Outside the schedule, no window opens within a week")
+			} else {
+				log.Printf("🌙 Outside the schedule, opening the tunnel at %s", at.Format(time.RFC1123))
+			}
+			logged = true
+		}
+		wait := scheduleCheckInterval
+		if !at.IsZero() {
+			wait = min(wait, time.Until(at))
+		}
+		select {
+		case <-time.After(wait):
+		case <-stop:
+			return false
+		}
+	}
+}
+
+// schedule returns the schedule of the running configuration.
+func (r *runner) schedule() Schedule {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.config.Schedule
+}
+
+// isOffSchedule reports whether the tunnel was closed by the schedule.
+func (r *runner) isOffSchedule() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.offSchedule
+}
+
+// watchSchedule closes the tunnel when its schedule window ends, shutting the
+// active client down gracefully; run then reopens it at the next window. It
+// returns once the runner is shut down.
+func (r *runner) watchSchedule() {
+	for {
+		wait := scheduleCheckInterval
+		if open, at := r.schedule().open(time.Now()); !open && !r.isOffSchedule() {
+			r.closeForSchedule()
+		} else if open && !at.IsZero() {
+			wait = min(wait, time.Until(at))
+		}
+		select {
+		case <-time.After(wait):
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// closeForSchedule shuts the active client down at the end of a window.
+func (r *runner) closeForSchedule() {
+	r.mu.Lock()
+	r.offSchedule = true
+	c, timeout := r.client, r.config.ShutdownTimeout
+	r.mu.Unlock()
+	log.Printf("🌙 Schedule window ended, closing the tunnel (draining connections up to %v)", timeout)
+	notify.tunnel(EventTunnelDown, c, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := c.Shutdown(ctx); err != nil {
+		log.Printf("⚠️ Shutdown: %v", err)
+	}
+}
+
+// awaitWindow waits for the next schedule window after the tunnel was closed
+// by the schedule. It returns false if the runner was shut down first.
+func (r *runner) awaitWindow() bool {
+	if !waitForSchedule(r.schedule, r.stop) {
+		return false
+	}
+	r.mu.Lock()
+	r.offSchedule = false
+	r.mu.Unlock()
+	log.Println("☀️ Schedule window opened, connecting")
+	return true
+}
+
+// reopen waits for the next schedule window and connects again, replacing
+// old. It returns false if the runner was shut down in the meantime or it
+// gave up, see retry.
+func (r *runner) reopen(old *Client) bool {
+	if !r.awaitWindow() {
+		return false
+	}
+	r.mu.Lock()
+	config := r.config
+	r.mu.Unlock()
+	client, err := dialLimited(&config)
+	if err != nil {
+		if errors.Is(err, ErrAuthFailed) {
+			notify.tunnel(EventAuthFailed, nil, err)
+			if config.AuthCooldown == 0 {
+				log.Printf("❌ Failed to connect, not retrying with the same credentials: %v", err)
+				r.giveUp(err)
+				return false
+			}
+		}
+		log.Printf("❌ Failed to connect: %v", err)
+		return r.retry(old, err)
+	}
+	select {
+	case <-r.stop:
+		_ = client.Close()
+		return false
+	default:
+	}
+	r.replace(old, client, config)
+	log.Printf("✅ Connected on remote port %d", client.RemotePort())
+	notify.tunnel(EventTunnelUp, client, nil)
+	printTunnelEvent(&config, "connected", client)
+	return true
+}
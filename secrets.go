@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// readSecretKeyFile loads config.SecretKey from the secret-key-file key if no
+// secret key is set directly, so the key can come from a mounted secret. The
+// file is read again on every reload, which allows the key to be rotated.
+func readSecretKeyFile(config *Config, path string) error {
+	if config.SecretKey != "" || path == "" {
+		return nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read secret-key-file: %w", err)
+	}
+	config.SecretKey = strings.TrimSpace(string(b))
+	if config.SecretKey == "" {
+		return fmt.Errorf("secret-key-file %s is empty", path)
+	}
+	return nil
+}
+
+// readSecretFromStdin reads the secret key from the first line of standard
+// input. On a terminal the user is prompted and the input is not echoed.
+func readSecretFromStdin() (string, error) {
+	if isTerminal(os.Stdin) {
+		return promptSecretInput("Secret key 🔑 (64 chars)")
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", fmt.Errorf("failed to read secret key from stdin: %w", err)
+	}
+	secret := strings.TrimSpace(line)
+	if secret == "" {
+		return "", errors.New("no secret key on stdin")
+	}
+	return secret, nil
+}
+
+// promptSecretInput asks for a secret on the terminal without echoing it.
+func promptSecretInput(fieldName string) (string, error) {
+	fmt.Printf("➡️ Enter %s: ", fieldName)
+	b, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", fieldName, err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+// runServiceCommand is only available on Windows; use --daemon or a systemd
+// unit on other platforms.
+func runServiceCommand(args []string) error {
+	return errors.New("Windows services are only supported on Windows, use --daemon or systemd instead")
+}
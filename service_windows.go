@@ -0,0 +1,257 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const (
+	serviceName        = "JerusalemClient"
+	serviceDisplayName = "Jerusalem Tunnel Client"
+	serviceDescription = "Exposes a local service through a Jerusalem tunnel server."
+	serviceEventID     = 1
+)
+
+// runServiceCommand implements `service install|uninstall|start|stop|run`.
+// install registers the current executable with the service control manager so
+// that it is started automatically with the given config file, restarted after
+// failures, and logs to the Windows event log.
+func runServiceCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: service install <config>|uninstall|start|stop|run <config>")
+	}
+
+	switch args[0] {
+	case "install":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: service install <config>")
+		}
+		return installService(args[1])
+	case "uninstall":
+		return uninstallService()
+	case "start":
+		return startService()
+	case "stop":
+		return stopService()
+	case "run":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: service run <config>")
+		}
+		return svc.Run(serviceName, &clientService{configFile: args[1]})
+	default:
+		return fmt.Errorf("unknown service command %q", args[0])
+	}
+}
+
+// installService registers the service with automatic start and restart-on-failure
+// recovery actions, and creates the event log source.
+func installService(configFile string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate executable: %w", err)
+	}
+	configFile, err = filepath.Abs(configFile)
+	if err != nil {
+		return fmt.Errorf("failed to resolve config path: %w", err)
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", serviceName)
+	}
+
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: serviceDisplayName,
+		Description: serviceDescription,
+		StartType:   mgr.StartAutomatic,
+	}, "service", "run", configFile)
+	if err != nil {
+		return fmt.Errorf("failed to create service: %w", err)
+	}
+	defer s.Close()
+
+	recovery := []mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 5 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: 30 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: time.Minute},
+	}
+	if err := s.SetRecoveryActions(recovery, uint32((24 * time.Hour).Seconds())); err != nil {
+		return fmt.Errorf("failed to set recovery actions: %w", err)
+	}
+	if err := s.SetRecoveryActionsOnNonCrashFailures(true); err != nil {
+		return fmt.Errorf("failed to set recovery actions: %w", err)
+	}
+
+	if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		_ = s.Delete()
+		return fmt.Errorf("failed to register event log source: %w", err)
+	}
+	return nil
+}
+
+// uninstallService removes the service and its event log source.
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed: %w", serviceName, err)
+	}
+	defer s.Close()
+
+	if err := s.Delete(); err != nil {
+		return fmt.Errorf("failed to delete service: %w", err)
+	}
+	return eventlog.Remove(serviceName)
+}
+
+// startService asks the service control manager to start the service.
+func startService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed: %w", serviceName, err)
+	}
+	defer s.Close()
+
+	return s.Start()
+}
+
+// stopService asks the service to stop and waits for it to do so.
+func stopService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed: %w", serviceName, err)
+	}
+	defer s.Close()
+
+	status, err := s.Control(svc.Stop)
+	if err != nil {
+		return fmt.Errorf("failed to stop service: %w", err)
+	}
+
+	deadline := time.Now().Add(defaultShutdownTimeout + 10*time.Second)
+	for status.State != svc.Stopped {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for service to stop")
+		}
+		time.Sleep(300 * time.Millisecond)
+		if status, err = s.Query(); err != nil {
+			return fmt.Errorf("failed to query service: %w", err)
+		}
+	}
+	return nil
+}
+
+// clientService runs the client under the service control manager.
+type clientService struct {
+	configFile string
+}
+
+// Execute connects the client and relays traffic until the service is stopped.
+// A non-zero exit code is returned when the client fails so the recovery
+// actions restart it.
+func (s *clientService) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+
+	if elog, err := eventlog.Open(serviceName); err == nil {
+		defer elog.Close()
+		setLogOutput(&eventLogWriter{elog: elog})
+	}
+
+	var config Config
+	if err := loadConfig(&config, s.configFile); err != nil {
+		log.Printf("❌ Failed to read config file: %v", err)
+		return true, exitConfigError
+	}
+	client, err := newClientFromConfig(&config)
+	if err != nil {
+		log.Printf("❌ Failed to create client: %v", err)
+		return true, uint32(exitCode(err))
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- client.Listen()
+	}()
+
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case err := <-errc:
+			if err != nil {
+				log.Printf("❌ Failed to listen: %v", err)
+				return true, uint32(exitCode(err))
+			}
+			return false, 0
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				changes <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				changes <- svc.Status{State: svc.StopPending}
+				ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+				if err := client.Shutdown(ctx); err != nil {
+					log.Printf("⚠️ Shutdown: %v", err)
+				}
+				cancel()
+				<-errc
+				return false, 0
+			}
+		}
+	}
+}
+
+// eventLogWriter adapts the Windows event log to the standard logger.
+type eventLogWriter struct {
+	elog *eventlog.Log
+}
+
+func (w *eventLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(string(p))
+	var err error
+	switch {
+	case strings.Contains(msg, "❌"):
+		err = w.elog.Error(serviceEventID, msg)
+	case strings.Contains(msg, "⚠️"):
+		err = w.elog.Warning(serviceEventID, msg)
+	default:
+		err = w.elog.Info(serviceEventID, msg)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
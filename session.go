@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// sessionExpiryMargin is how long before it expires a session token is no
+// longer used, so it does not expire during a handshake.
+const sessionExpiryMargin = 5 * time.Second
+
+// storeSession keeps the session token issued in msg, the message of a server
+// accepting a handshake, for authenticating data connections. Servers that
+// issue none leave the current one, if any, in place.
+func (c *Client) storeSession(msg ServerMessage) {
+	if msg.SessionToken == "" {
+		return
+	}
+	session := NewSessionAuthenticator(msg.SessionToken)
+	session.strict = c.strictAuth
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.session = session
+	c.sessionExpiry = time.Time{}
+	if msg.SessionTTL > 0 {
+		c.sessionExpiry = time.Now().Add(time.Duration(msg.SessionTTL) * time.Second)
+	}
+}
+
+// sessionAuthenticator returns the Authenticator of the session token, nil if
+// the server issued none or it is about to expire.
+func (c *Client) sessionAuthenticator() *Authenticator {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.session == nil || !c.sessionExpiry.IsZero() && time.Until(c.sessionExpiry) < sessionExpiryMargin {
+		return nil
+	}
+	return c.session
+}
+
+// dropSession forgets the session token of session, unless a newer one has
+// replaced it in the meantime.
+func (c *Client) dropSession(session *Authenticator) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.session == session {
+		c.session = nil
+	}
+}
+
+// authenticateData performs the client handshake of a data connection on rc.
+// With a valid session token, rc is authenticated with that, so the secret,
+// private key or access token of auth is only used by the control connection
+// and to get a new session token once it expired. If the server refuses the
+// session token, it is dropped and a new connection is authenticated with
+// auth. The server may renew the token in either handshake. On error, rc and any new connection are closed.
+func (c *Client) authenticateData(ctx context.Context, auth *Authenticator, rc *Codec) (*Codec, error) {
+	if session := c.sessionAuthenticator(); session != nil {
+		msg, err := session.handshake(ctx, rc, c.cid)
+		if err == nil {
+			c.storeSession(msg)
+			return rc, nil
+		}
+		rc.Close()
+		if !errors.Is(err, ErrAuthFailed) {
+			return nil, err
+		}
+		c.dropSession(session)
+		c.logger.Printf("⚠️ The server refused the session token (%v), authenticating with the credentials again", err)
+
+		conn, err := c.dial(ctx)
+		if err != nil {
+			return nil, err
+		}
+		next := NewCodec(conn)
+		next.faults = rc.faults
+		rc = next
+	}
+	rc, _, err := c.authenticate(ctx, auth, rc)
+	return rc, err
+}
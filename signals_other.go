@@ -0,0 +1,18 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// pauseSignal and resumeSignal pause and resume the tunnel, see
+// handlePauseSignals.
+var pauseSignal, resumeSignal os.Signal = syscall.SIGUSR1, syscall.SIGUSR2
+
+// shutdownDeadline returns how long in-flight connections may drain after sig.
+func shutdownDeadline(sig os.Signal, timeout time.Duration) time.Duration {
+	return timeout
+}
@@ -0,0 +1,30 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// pauseSignal and resumeSignal are not available on Windows; use the pause
+// and resume commands or the admin API instead.
+var pauseSignal, resumeSignal os.Signal
+
+// consoleCloseGrace is how long the client may take to shut down after a console
+// close, logoff or system shutdown event. Windows terminates the process about
+// five seconds after delivering these events, so the drain has to finish first.
+const consoleCloseGrace = 4 * time.Second
+
+// shutdownDeadline returns how long in-flight connections may drain after sig.
+//
+// The Go runtime delivers Ctrl+C and Ctrl+Break as os.Interrupt, which can take
+// the full timeout, and console close, logoff and shutdown events as
+// syscall.SIGTERM, which must fit within consoleCloseGrace.
+func shutdownDeadline(sig os.Signal, timeout time.Duration) time.Duration {
+	if sig == syscall.SIGTERM && timeout > consoleCloseGrace {
+		return consoleCloseGrace
+	}
+	return timeout
+}
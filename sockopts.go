@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// tuneConn applies the TCP keepalive and TCP_NODELAY settings of the client to
+// conn, a connection to the server or the local service. Connections that are
+// not TCP, such as those of a custom dialer, are left as they are, as are the
+// settings left at their defaults.
+func (c *Client) tuneConn(conn net.Conn) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	switch {
+	case c.keepAlive > 0:
+		_ = tc.SetKeepAlive(true)
+		_ = tc.SetKeepAlivePeriod(c.keepAlive)
+	case c.keepAlive < 0:
+		_ = tc.SetKeepAlive(false)
+	}
+	if !c.noDelay {
+		_ = tc.SetNoDelay(false)
+	}
+}
+
+// readSocketOptions reads bind-address, prefer-ipv4, prefer-ipv6,
+// tcp-keepalive and tcp-nodelay into config. The keepalive interval is 0 if it is not set, which keeps the default
+// of the Go runtime, and -1 if it is set to 0 or off.
+func readSocketOptions(config *Config) error {
+	if s := viper.GetString("bind-address"); s != "" {
+		ip, err := resolveBindAddress(s)
+		if err != nil {
+			return err
+		}
+		config.BindAddress = ip
+	}
+	switch v4, v6 := viper.GetBool("prefer-ipv4"), viper.GetBool("prefer-ipv6"); {
+	case v4 && v6:
+		return fmt.Errorf("prefer-ipv4 and prefer-ipv6 cannot both be set")
+	case v4:
+		config.PreferIP = PreferIPv4
+	case v6:
+		config.PreferIP = PreferIPv6
+	}
+	config.NoDelay = !viper.IsSet("tcp-nodelay") || viper.GetBool("tcp-nodelay")
+	switch s := viper.GetString("tcp-keepalive"); s {
+	case "":
+		config.KeepAlive = 0
+	case "0", "off":
+		config.KeepAlive = -1
+	default:
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid tcp-keepalive %q, use an interval such as 30s or off", s)
+		}
+		config.KeepAlive = d
+	}
+	return nil
+}
+
+// resolveBindAddress returns the IP address s, or the first address of the
+// network interface named s, preferring IPv4.
+func resolveBindAddress(s string) (net.IP, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		return ip, nil
+	}
+	iface, err := net.InterfaceByName(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bind-address %q, use an IP address or interface name: %w", s, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the addresses of interface %s: %w", s, err)
+	}
+	var found net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			return ipNet.IP, nil
+		}
+		if found == nil {
+			found = ipNet.IP
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("interface %s has no usable address to bind to", s)
+	}
+	return found, nil
+}
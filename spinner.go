@@ -0,0 +1,15 @@
+//go:build !minimal
+
+package main
+
+import (
+	"time"
+
+	"github.com/briandowns/spinner"
+)
+
+// newSpinner returns the progress spinner Listen draws while it waits for
+// server messages.
+func newSpinner() progressSpinner {
+	return spinner.New(spinner.CharSets[39], 100*time.Millisecond)
+}
@@ -0,0 +1,14 @@
+//go:build minimal
+
+package main
+
+// noSpinner is the spinner of the minimal build, which draws nothing.
+type noSpinner struct{}
+
+func (noSpinner) Start() {}
+func (noSpinner) Stop()  {}
+
+// newSpinner returns a spinner that draws nothing.
+func newSpinner() progressSpinner {
+	return noSpinner{}
+}
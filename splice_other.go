@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// spliceSupported reports whether relayed connections can be copied with
+// splice. It is only implemented on Linux.
+const spliceSupported = false
+
+// spliceRelay does nothing on platforms without splice, leaving the copy to
+// the buffered relay.
+func spliceRelay(w *countingWriter, dst, src net.Conn) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// srvScheme prefixes server entries that name a DNS SRV record, e.g.
+	// srv+_jerusalem._tcp.example.com, instead of a host.
+	srvScheme = "srv+"
+	// defaultSRVRefresh is how often SRV records are resolved again while
+	// connected.
+	defaultSRVRefresh = 5 * time.Minute
+)
+
+// lookupSRV resolves SRV records; it is a variable so it can be replaced in
+// tests.
+var lookupSRV = net.LookupSRV
+
+// resolveSRV returns the host:port addresses of the targets of the SRV
+// records of name, in the order of their priority and, within a priority, of
+// a random choice weighted by their weight.
+func resolveSRV(name string) ([]string, error) {
+	_, records, err := lookupSRV("", "", name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve SRV records of %s: %w", name, err)
+	}
+	var addrs []string
+	for _, rec := range records {
+		if rec.Target == "." {
+			// A target of "." means the service is decidedly not available.
+			continue
+		}
+		addrs = append(addrs, net.JoinHostPort(strings.TrimSuffix(rec.Target, "."), strconv.Itoa(int(rec.Port))))
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no servers in the SRV records of %s", name)
+	}
+	return addrs, nil
+}
+
+// watchSRV resolves the SRV records of the server list again every
+// srv-refresh while the client runs. If the server the client is connected to
+// is no longer among them, because the server fleet was rotated, the control
+// connection is re-established with one of the current servers while
+// established connections drain. It returns at once if no server is given as
+// an SRV record.
+func (r *runner) watchSRV() {
+	for {
+		r.mu.Lock()
+		config, client := r.config, r.client
+		r.mu.Unlock()
+		if !strings.Contains(config.Server, srvScheme) {
+			return
+		}
+		select {
+		case <-time.After(config.SRVRefresh):
+		case <-r.stop:
+			return
+		}
+
+		addrs, err := serverEndpoints(&config)
+		if err != nil {
+			log.Printf("⚠️ %v", err)
+			continue
+		}
+		if r.current() != client || slices.Contains(addrs, client.ServerAddr()) {
+			continue
+		}
+		log.Printf("🔁 Server %s is no longer in the SRV records, moving to %s", client.ServerAddr(), strings.Join(addrs, ", "))
+		servers.disconnected(client.ServerAddr())
+		r.reconnect(client, config)
+	}
+}
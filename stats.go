@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a point-in-time view of the traffic relayed by a client.
+type Stats struct {
+	BytesIn           int64            // Bytes relayed from visitors to the local service.
+	BytesOut          int64            // Bytes relayed from the local service to visitors.
+	ActiveConnections int              // Proxied connections currently open.
+	TotalConnections  int64            // Proxied connections requested since the client connected.
+	Rejected          int64            // Requests rejected because of the connection limit.
+	Denied            int64            // Requests from visitors denied by access control.
+	Uptime            time.Duration    // Time since the control connection was established.
+	Handshakes        int64            // Data connections dialed and authenticated.
+	AvgHandshake      time.Duration    // Average time to dial and authenticate a data connection.
+	Pooled            int64            // Connections accepted on a data connection from the pool.
+	RTT               time.Duration    // Round-trip time measured on the last heartbeat, see Client.RTT.
+	Connections       []ConnectionInfo // The active connections, oldest first.
+}
+
+// totals accumulates the counters of connections that have finished.
+type totals struct {
+	conns    atomic.Int64
+	in       atomic.Int64
+	out      atomic.Int64
+	rejected atomic.Int64
+	denied   atomic.Int64
+
+	handshakes    atomic.Int64
+	handshakeTime atomic.Int64 // Nanoseconds spent in all handshakes.
+	pooled        atomic.Int64 // Connections accepted on a pooled data connection.
+}
+
+// Stats returns the traffic counters of the client, covering both finished and
+// active connections. It is safe to call from any goroutine.
+func (c *Client) Stats() Stats {
+	// Totals and the registry are read under the same lock so that a connection
+	// finishing concurrently is counted exactly once.
+	c.mu.Lock()
+	s := Stats{
+		BytesIn:          c.totals.in.Load(),
+		BytesOut:         c.totals.out.Load(),
+		TotalConnections: c.totals.conns.Load(),
+		Rejected:         c.totals.rejected.Load(),
+		Denied:           c.totals.denied.Load(),
+		Handshakes:       c.totals.handshakes.Load(),
+		Pooled:           c.totals.pooled.Load(),
+		Uptime:           time.Since(c.started),
+		RTT:              c.RTT(),
+		Connections:      c.connectionInfosLocked(),
+	}
+	c.mu.Unlock()
+
+	if s.Handshakes > 0 {
+		s.AvgHandshake = time.Duration(c.totals.handshakeTime.Load() / s.Handshakes)
+	}
+	s.ActiveConnections = len(s.Connections)
+	for _, ci := range s.Connections {
+		s.BytesIn += ci.BytesIn
+		s.BytesOut += ci.BytesOut
+	}
+	return s
+}
+
+// formatBytes formats n using binary units.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statusRefresh is how often the files of the status directory are updated.
+const statusRefresh = time.Second
+
+// statusDir publishes the live status of the tunnel as one small file per
+// value in a directory, in the manner of procfs, so shell scripts and
+// monitoring agents can read it with cat:
+//
+//	<dir>/<tunnel>/state   connected, draining, maintenance, degraded or reconnecting
+//	<dir>/<tunnel>/port    remote port
+//	<dir>/<tunnel>/server  address of the server
+//	<dir>/<tunnel>/bytes   bytes relayed in and out, separated by a space
+//	<dir>/<tunnel>/connections  number of active connections
+//	<dir>/<tunnel>/rtt     round-trip time to the server in microseconds, 0 if unknown
+//	<dir>/<tunnel>/pid     PID of the client
+//
+// The directory is removed when the client stops.
+type statusDir struct {
+	path string
+	r    *runner
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startStatusDir creates the status directory of the tunnel named name below
+// dir and keeps it updated from r until Stop is called.
+func startStatusDir(dir, name string, r *runner) (*statusDir, error) {
+	s := &statusDir{
+		path: filepath.Join(dir, statusName(name)),
+		r:    r,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if err := os.MkdirAll(s.path, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create status directory: %w", err)
+	}
+	if err := s.update(); err != nil {
+		return nil, err
+	}
+	go func() {
+		defer close(s.done)
+		t := time.NewTicker(statusRefresh)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				_ = s.update()
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+	return s, nil
+}
+
+// statusName returns name, the label or client ID of the tunnel, made safe
+// for use as a directory name.
+func statusName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '_'
+	}, name)
+	if strings.Trim(name, ".") == "" {
+		return "tunnel"
+	}
+	return name
+}
+
+// update writes the current values to the files of the status directory.
+func (s *statusDir) update() error {
+	c := s.r.current()
+	stats := c.Stats()
+	files := map[string]string{
+		"state":       s.r.state(),
+		"port":        strconv.Itoa(int(c.RemotePort())),
+		"server":      c.ServerAddr(),
+		"bytes":       fmt.Sprintf("%d %d", stats.BytesIn, stats.BytesOut),
+		"connections": strconv.Itoa(stats.ActiveConnections),
+		"rtt":         strconv.FormatInt(stats.RTT.Microseconds(), 10),
+		"pid":         strconv.Itoa(os.Getpid()),
+	}
+	for name, value := range files {
+		if err := writeFileAtomic(filepath.Join(s.path, name), value+"\n"); err != nil {
+			return fmt.Errorf("failed to update status directory: %w", err)
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic replaces the file at path with data, so readers never see
+// a partially written value.
+func writeFileAtomic(path, data string) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(data), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Stop stops updating and removes the status directory of the tunnel.
+func (s *statusDir) Stop() {
+	close(s.stop)
+	<-s.done
+	_ = os.RemoveAll(s.path)
+}
@@ -0,0 +1,42 @@
+package main
+
+import "time"
+
+// defaultDialTimeout bounds dialing the local service, and dialing the server
+// unless a dial timeout is configured.
+const defaultDialTimeout = 2 * time.Minute
+
+// Timeouts bounds the network operations of a client. Zero fields use the
+// defaults.
+type Timeouts struct {
+	// Dial bounds dialing the server, for the control connection and every
+	// data connection. It defaults to two minutes.
+	Dial time.Duration
+	// Handshake bounds waiting for the server during authentication and the
+	// hello exchange, on the control connection and every data connection. It
+	// defaults to NetworkTimeout.
+	Handshake time.Duration
+	// Read is the longest the control connection may stay silent before it is
+	// considered lost. It must exceed the heartbeat interval of the server. By
+	// default the client waits forever.
+	Read time.Duration
+	// Write bounds sending a message on the control connection. By default the
+	// client waits forever.
+	Write time.Duration
+}
+
+// dial returns the dial timeout.
+func (t Timeouts) dial() time.Duration {
+	if t.Dial > 0 {
+		return t.Dial
+	}
+	return defaultDialTimeout
+}
+
+// handshake returns the handshake timeout.
+func (t Timeouts) handshake() time.Duration {
+	if t.Handshake > 0 {
+		return t.Handshake
+	}
+	return NetworkTimeout
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// errPinMismatch is returned when no certificate of the server matches a pin.
+var errPinMismatch = errors.New("no certificate of the server matches a pin-sha256")
+
+// TLSSettings configures the TLS transport of the control and data
+// connections.
+type TLSSettings struct {
+	Enabled    bool
+	ServerName string   // Name verified in the certificate, the server host if empty.
+	CAFile     string   // PEM file of CAs to trust instead of the system roots, if set.
+	Pins       []string // Base64 SHA-256 hashes of the SubjectPublicKeyInfo the server may present.
+
+	roots *x509.CertPool
+	pins  [][]byte
+}
+
+// readTLS reads tls, tls-server-name, tls-ca-file and pin-sha256 into config.
+// Pins may carry a "sha256//" prefix, as accepted by curl.
+func readTLS(config *Config) error {
+	s := TLSSettings{
+		Enabled:    viper.GetBool("tls"),
+		ServerName: viper.GetString("tls-server-name"),
+		CAFile:     viper.GetString("tls-ca-file"),
+	}
+	for _, pin := range readStringList("pin-sha256") {
+		pin = strings.TrimPrefix(pin, "sha256//")
+		h, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(h) != sha256.Size {
+			return fmt.Errorf("invalid pin-sha256 %q, use the base64 SHA-256 hash of the server's public key", pin)
+		}
+		s.Pins = append(s.Pins, pin)
+		s.pins = append(s.pins, h)
+	}
+	if !s.Enabled && (len(s.Pins) > 0 || s.ServerName != "" || s.CAFile != "") {
+		return fmt.Errorf("pin-sha256, tls-server-name and tls-ca-file require tls: true")
+	}
+	if s.CAFile != "" {
+		b, err := os.ReadFile(s.CAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read tls-ca-file: %w", err)
+		}
+		s.roots = x509.NewCertPool()
+		if !s.roots.AppendCertsFromPEM(b) {
+			return fmt.Errorf("tls-ca-file %s contains no PEM certificates", s.CAFile)
+		}
+	}
+	config.TLS = s
+	return nil
+}
+
+// equal reports whether s and o were configured the same.
+func (s TLSSettings) equal(o TLSSettings) bool {
+	return s.Enabled == o.Enabled && s.ServerName == o.ServerName && s.CAFile == o.CAFile && slices.Equal(s.Pins, o.Pins)
+}
+
+// clientConfig returns the TLS configuration of s, nil if TLS is disabled.
+func (s TLSSettings) clientConfig() *tls.Config {
+	if !s.Enabled {
+		return nil
+	}
+	cfg := &tls.Config{ServerName: s.ServerName, RootCAs: s.roots, MinVersion: tls.VersionTLS12}
+	if len(s.pins) > 0 {
+		cfg.VerifyConnection = verifyPins(s.pins)
+	}
+	return cfg
+}
+
+// verifyPins returns a check that accepts a connection if the public key of a
+// certificate in one of its verified chains hashes to one of pins, so a
+// certificate issued by a compromised CA for the server name is not enough to
+// impersonate the server. Pinning the key of the issuing CA is allowed too.
+func verifyPins(pins [][]byte) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		chains := cs.VerifiedChains
+		if len(chains) == 0 {
+			chains = [][]*x509.Certificate{cs.PeerCertificates}
+		}
+		for _, chain := range chains {
+			for _, cert := range chain {
+				h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				if slices.ContainsFunc(pins, func(pin []byte) bool { return bytes.Equal(pin, h[:]) }) {
+					return nil
+				}
+			}
+		}
+		if len(cs.PeerCertificates) > 0 {
+			h := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+			return fmt.Errorf("%w, it presented sha256//%s", errPinMismatch, base64.StdEncoding.EncodeToString(h[:]))
+		}
+		return errPinMismatch
+	}
+}
+
+// WithTLS wraps the control and data connections in TLS configured by cfg, so
+// they are encrypted and the server is authenticated by its certificate. If
+// cfg sets no ServerName, the host of the server address is verified.
+func WithTLS(cfg *tls.Config) Option {
+	return func(c *Client) {
+		c.tls = cfg
+	}
+}
+
+// tlsFor returns cfg for connecting to host: a copy naming host as the server
+// if cfg does not name one, with a session cache so data connections resume
+// the session of the control connection.
+func tlsFor(cfg *tls.Config, host string) *tls.Config {
+	cfg = cfg.Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	if cfg.ClientSessionCache == nil {
+		cfg.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+	return cfg
+}
+
+// startTLS performs the TLS handshake on conn, giving up when ctx ends. conn
+// is closed if the handshake fails.
+func startTLS(ctx context.Context, conn net.Conn, cfg *tls.Config) (net.Conn, error) {
+	tc := tls.Client(conn, cfg)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake with %s failed: %w", conn.RemoteAddr(), err)
+	}
+	return tc, nil
+}
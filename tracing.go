@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	mrand "math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	// traceQueue bounds the finished spans waiting to be exported; spans are
+	// dropped while it is full, so a slow collector never holds up the tunnel.
+	traceQueue = 4096
+	// traceBatch is the most spans sent in one export request.
+	traceBatch = 512
+	// traceFlushInterval is how long finished spans wait for a batch to fill.
+	traceFlushInterval = 5 * time.Second
+	// traceTimeout bounds an export request.
+	traceTimeout = 10 * time.Second
+	// defaultServiceName is the service.name of the exported spans unless
+	// OTEL_SERVICE_NAME is set.
+	defaultServiceName = "jerusalem-client"
+)
+
+// Span kinds of OTLP.
+const (
+	spanKindInternal = 1
+	spanKindClient   = 3
+)
+
+// TracingSettings configures the export of OpenTelemetry spans of the
+// connection lifecycle over OTLP/HTTP with JSON encoding.
+type TracingSettings struct {
+	Endpoint    string            // URL spans are posted to, such as http://localhost:4318/v1/traces; tracing is off if empty.
+	Headers     map[string]string // Sent with each export request, such as the API key of a tracing service.
+	SampleRatio float64           // Fraction of the connections that are traced, from 0 to 1.
+	ServiceName string            // service.name of the exported spans.
+}
+
+// readTracing reads otlp-endpoint, otlp-headers and trace-sample-ratio into
+// config. Like the OpenTelemetry SDKs, it falls back to the standard
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT, OTEL_EXPORTER_OTLP_ENDPOINT,
+// OTEL_EXPORTER_OTLP_HEADERS and OTEL_SERVICE_NAME environment variables.
+func readTracing(config *Config) error {
+	s := TracingSettings{
+		Endpoint:    viper.GetString("otlp-endpoint"),
+		Headers:     make(map[string]string),
+		SampleRatio: 1,
+		ServiceName: os.Getenv("OTEL_SERVICE_NAME"),
+	}
+	if s.ServiceName == "" {
+		s.ServiceName = defaultServiceName
+	}
+	switch {
+	case s.Endpoint != "":
+		s.Endpoint = tracesURL(s.Endpoint)
+	case os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != "":
+		s.Endpoint = os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	case os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "":
+		s.Endpoint = tracesURL(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"))
+	}
+	if s.Endpoint != "" {
+		if u, err := url.Parse(s.Endpoint); err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("invalid otlp-endpoint %q, use an http or https URL", s.Endpoint)
+		}
+	}
+
+	headers := readStringList("otlp-headers")
+	if len(headers) == 0 && os.Getenv("OTEL_EXPORTER_OTLP_HEADERS") != "" {
+		headers = strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",")
+	}
+	for _, h := range headers {
+		k, v, ok := strings.Cut(h, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return fmt.Errorf("invalid otlp-headers entry %q, use name=value", h)
+		}
+		if uv, err := url.QueryUnescape(strings.TrimSpace(v)); err == nil {
+			v = uv
+		}
+		s.Headers[strings.TrimSpace(k)] = v
+	}
+
+	if viper.IsSet("trace-sample-ratio") {
+		s.SampleRatio = viper.GetFloat64("trace-sample-ratio")
+		if s.SampleRatio < 0 || s.SampleRatio > 1 {
+			return fmt.Errorf("trace-sample-ratio must be between 0 and 1")
+		}
+	}
+	config.Tracing = s
+	return nil
+}
+
+// tracesURL returns the traces URL of the OTLP/HTTP endpoint base: its
+// /v1/traces path, unless base names a path already.
+func tracesURL(base string) string {
+	u, err := url.Parse(base)
+	if err != nil || strings.Trim(u.Path, "/") != "" {
+		return base
+	}
+	return strings.TrimSuffix(base, "/") + "/v1/traces"
+}
+
+// Tracer records spans of the phases of relayed connections and exports them
+// in the background. Its methods do nothing on a nil *Tracer, except that
+// every connection is traced for a debug capture in progress.
+type Tracer struct {
+	settings TracingSettings
+	http     http.Client
+
+	mu     sync.Mutex // Guards closed and sending on queue.
+	closed bool
+	queue  chan otlpSpan
+	done   chan struct{}
+}
+
+// tracer is the tracer of the CLI, nil unless an OTLP endpoint is configured.
+var tracer *Tracer
+
+// NewTracer starts exporting spans as configured by s. It returns nil if s
+// names no endpoint.
+func NewTracer(s TracingSettings) *Tracer {
+	if s.Endpoint == "" {
+		return nil
+	}
+	t := &Tracer{
+		settings: s,
+		http:     http.Client{Timeout: traceTimeout},
+		queue:    make(chan otlpSpan, traceQueue),
+		done:     make(chan struct{}),
+	}
+	go t.export()
+	return t
+}
+
+// span is an operation being traced. Its methods do nothing on a nil *span,
+// which is what a connection that is not sampled has.
+type span struct {
+	t       *Tracer       // Exports the span, nil if only debug records it.
+	debug   *debugCapture // Records the span, if a capture was in progress.
+	traceID [16]byte
+	id      [8]byte
+	parent  [8]byte
+	name    string
+	kind    int
+	start   time.Time
+
+	mu    sync.Mutex // Guards attrs.
+	attrs []otlpKeyValue
+}
+
+// start begins the root span of a new trace, or returns nil if the trace is
+// neither sampled nor captured for debugging.
+func (t *Tracer) start(name string) *span {
+	dc := debugging.Load()
+	if t == nil || mrand.Float64() >= t.settings.SampleRatio {
+		if t = nil; dc == nil {
+			return nil
+		}
+	}
+	s := &span{t: t, debug: dc, name: name, kind: spanKindInternal, start: time.Now()}
+	_, _ = rand.Read(s.traceID[:])
+	_, _ = rand.Read(s.id[:])
+	return s
+}
+
+// child begins a span of kind as part of the operation of s.
+func (s *span) child(name string, kind int) *span {
+	if s == nil {
+		return nil
+	}
+	c := &span{t: s.t, debug: s.debug, traceID: s.traceID, parent: s.id, name: name, kind: kind, start: time.Now()}
+	_, _ = rand.Read(c.id[:])
+	return c
+}
+
+// set records the attribute key of s. value is a string, a bool or an integer.
+func (s *span) set(key string, value any) {
+	if s == nil {
+		return
+	}
+	var v otlpAnyValue
+	switch value := value.(type) {
+	case string:
+		v.StringValue = &value
+	case bool:
+		v.BoolValue = &value
+	case int:
+		n := strconv.Itoa(value)
+		v.IntValue = &n
+	case int64:
+		n := strconv.FormatInt(value, 10)
+		v.IntValue = &n
+	case uint16:
+		n := strconv.Itoa(int(value))
+		v.IntValue = &n
+	default:
+		str := fmt.Sprint(value)
+		v.StringValue = &str
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, otlpKeyValue{Key: key, Value: v})
+}
+
+// end finishes s, with an error status if err is not nil, and queues it for
+// export.
+func (s *span) end(err error) {
+	if s == nil {
+		return
+	}
+	now := time.Now()
+	s.mu.Lock()
+	sp := otlpSpan{
+		TraceID:    hex.EncodeToString(s.traceID[:]),
+		SpanID:     hex.EncodeToString(s.id[:]),
+		Name:       s.name,
+		Kind:       s.kind,
+		Start:      strconv.FormatInt(s.start.UnixNano(), 10),
+		End:        strconv.FormatInt(now.UnixNano(), 10),
+		Attributes: s.attrs,
+	}
+	s.mu.Unlock()
+	if s.parent != [8]byte{} {
+		sp.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	if err != nil {
+		sp.Status = &otlpStatus{Code: 2, Message: err.Error()}
+	}
+	if s.t != nil {
+		s.t.enqueue(sp)
+	}
+	s.debug.span(sp, now.Sub(s.start))
+}
+
+// enqueue queues sp for export, dropping it if the queue is full or the
+// tracer has been closed.
+func (t *Tracer) enqueue(sp otlpSpan) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.queue <- sp:
+	default:
+	}
+}
+
+// export sends the queued spans in batches until the queue is closed.
+func (t *Tracer) export() {
+	defer close(t.done)
+	tick := time.NewTicker(traceFlushInterval)
+	defer tick.Stop()
+	var batch []otlpSpan
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.send(batch); err != nil {
+			log.Printf("⚠️ Failed to export %d spans: %v", len(batch), err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case sp, ok := <-t.queue:
+			if !ok {
+				flush()
+				return
+			}
+			if batch = append(batch, sp); len(batch) >= traceBatch {
+				flush()
+			}
+		case <-tick.C:
+			flush()
+		}
+	}
+}
+
+// send posts spans to the collector in an OTLP export request.
+func (t *Tracer) send(spans []otlpSpan) error {
+	service := t.settings.ServiceName
+	req := otlpExportRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{
+			{Key: "service.name", Value: otlpAnyValue{StringValue: &service}},
+			{Key: "service.version", Value: otlpAnyValue{StringValue: &version}},
+		}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: defaultServiceName, Version: version}, Spans: spans}},
+	}}}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	hreq, err := http.NewRequest(http.MethodPost, t.settings.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	for k, v := range t.settings.Headers {
+		hreq.Header.Set(k, v)
+	}
+	resp, err := t.http.Do(hreq)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// Close stops recording spans and waits, within ctx, for the queued ones to
+// be exported.
+func (t *Tracer) Close(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.queue)
+	}
+	t.mu.Unlock()
+	select {
+	case <-t.done:
+	case <-ctx.Done():
+	}
+}
+
+// The OTLP/JSON encoding of an export request, see
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding. IDs are
+// hex encoded and 64-bit integers are strings.
+type (
+	otlpExportRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name    string `json:"name"`
+		Version string `json:"version,omitempty"`
+	}
+	otlpSpan struct {
+		TraceID      string         `json:"traceId"`
+		SpanID       string         `json:"spanId"`
+		ParentSpanID string         `json:"parentSpanId,omitempty"`
+		Name         string         `json:"name"`
+		Kind         int            `json:"kind"`
+		Start        string         `json:"startTimeUnixNano"`
+		End          string         `json:"endTimeUnixNano"`
+		Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+		Status       *otlpStatus    `json:"status,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string       `json:"key"`
+		Value otlpAnyValue `json:"value"`
+	}
+	otlpAnyValue struct {
+		StringValue *string `json:"stringValue,omitempty"`
+		BoolValue   *bool   `json:"boolValue,omitempty"`
+		IntValue    *string `json:"intValue,omitempty"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+)
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Transcript events.
+const (
+	EvSessionStart    = "session-start"
+	EvSessionEnd      = "session-end"
+	EvConnectionOpen  = "connection-open"
+	EvConnectionClose = "connection-close"
+)
+
+// TranscriptRecord is one line of a session transcript.
+//
+// Records are hash-chained: Prev holds the MAC of the previous record and MAC is
+// an HMAC-SHA256, keyed with the client secret, over the record encoded with an
+// empty MAC. Removing, reordering or editing any record breaks the chain.
+type TranscriptRecord struct {
+	Seq        uint64    `json:"seq"`
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"`
+	Connection string    `json:"connection,omitempty"`
+	BytesIn    int64     `json:"bytesIn,omitempty"`  // Bytes from the visitor to the local service.
+	BytesOut   int64     `json:"bytesOut,omitempty"` // Bytes from the local service to the visitor.
+	Detail     string    `json:"detail,omitempty"`
+	Prev       string    `json:"prev"`
+	MAC        string    `json:"mac,omitempty"`
+}
+
+// Transcript writes a tamper-evident record of a tunnel session, one JSON
+// record per line, to its own file. A nil *Transcript discards all records, so
+// callers do not need to check whether transcripts are enabled.
+type Transcript struct {
+	path string
+	key  []byte
+
+	mu   sync.Mutex // Guards the fields below.
+	f    *os.File   // Opened lazily by the first record.
+	seq  uint64
+	prev string
+}
+
+// NewTranscript creates a transcript for a new session of client cid in dir.
+// The file is named after the client ID and the session start time and is only
+// created when the first record is written. Records are signed with secret.
+func NewTranscript(dir, cid, secret string) *Transcript {
+	name := fmt.Sprintf("%s-%s.jsonl", cid, time.Now().UTC().Format("20060102T150405.000000000Z"))
+	return &Transcript{
+		path: filepath.Join(dir, name),
+		key:  transcriptKey(secret),
+	}
+}
+
+// transcriptKey derives the transcript signing key from the client secret.
+func transcriptKey(secret string) []byte {
+	h := sha256.Sum256([]byte("jerusalem-transcript:" + secret))
+	return h[:]
+}
+
+// Record appends rec to the transcript, filling in its sequence number, time
+// and chain fields.
+func (t *Transcript) Record(rec TranscriptRecord) error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.f == nil {
+		if err := os.MkdirAll(filepath.Dir(t.path), 0o700); err != nil {
+			return fmt.Errorf("failed to create transcript directory: %w", err)
+		}
+		f, err := os.OpenFile(t.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return fmt.Errorf("failed to open transcript: %w", err)
+		}
+		t.f = f
+	}
+
+	t.seq++
+	rec.Seq = t.seq
+	rec.Time = time.Now().UTC()
+	rec.Prev = t.prev
+	mac, err := signRecord(t.key, rec)
+	if err != nil {
+		return err
+	}
+	rec.MAC = mac
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := t.f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write transcript: %w", err)
+	}
+	t.prev = mac
+	return nil
+}
+
+// Close closes the transcript file.
+func (t *Transcript) Close() error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.f == nil {
+		return nil
+	}
+	return t.f.Close()
+}
+
+// signRecord computes the MAC of rec, ignoring any MAC it already carries.
+func signRecord(key []byte, rec TranscriptRecord) (string, error) {
+	rec.MAC = ""
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return "", err
+	}
+	m := hmac.New(sha256.New, key)
+	m.Write(b)
+	return hex.EncodeToString(m.Sum(nil)), nil
+}
+
+// VerifyTranscript checks the chain and signatures of the transcript read from r.
+// It returns the number of valid records, or an error describing the first
+// record that does not verify.
+func VerifyTranscript(r io.Reader, secret string) (int, error) {
+	key := transcriptKey(secret)
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var prev string
+	n := 0
+	for sc.Scan() {
+		var rec TranscriptRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return n, fmt.Errorf("record %d is not valid JSON: %w", n+1, err)
+		}
+		if rec.Seq != uint64(n+1) {
+			return n, fmt.Errorf("record %d has sequence number %d", n+1, rec.Seq)
+		}
+		if rec.Prev != prev {
+			return n, fmt.Errorf("record %d does not chain to the previous record", n+1)
+		}
+		mac, err := signRecord(key, rec)
+		if err != nil {
+			return n, err
+		}
+		if !hmac.Equal([]byte(mac), []byte(rec.MAC)) {
+			return n, fmt.Errorf("record %d has an invalid signature", n+1)
+		}
+		prev = rec.MAC
+		n++
+	}
+	return n, sc.Err()
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+var (
+	// errTunnelExists is returned when adding a tunnel under a name in use.
+	errTunnelExists = errors.New("tunnel already exists")
+	// errNoSuchTunnel is returned when removing a tunnel that is not running.
+	errNoSuchTunnel = errors.New("no such tunnel")
+)
+
+// TunnelSpec defines an extra tunnel, opened next to the main one with its own
+// control connection. Every other setting is shared with the main tunnel.
+type TunnelSpec struct {
+	LocalHost  string `json:"localHost,omitempty"`  // Local host, that of the main tunnel if empty.
+	LocalPort  uint16 `json:"localPort"`            // Local port connections are forwarded to.
+	RemotePort uint16 `json:"remotePort,omitempty"` // Public port to ask for, if any.
+	Label      string `json:"label,omitempty"`      // Session label, the tunnel name if empty.
+
+	MaxBytesPerDay int64 `json:"maxBytesPerDay,omitempty"` // Daily traffic quota, that of the main tunnel if zero.
+	MaxBytesTotal  int64 `json:"maxBytesTotal,omitempty"`  // Total traffic quota, that of the main tunnel if zero.
+}
+
+// readTunnels fills config.Tunnels from the tunnels map of the config file.
+func readTunnels(config *Config) error {
+	config.Tunnels = nil
+	for name := range viper.GetStringMap("tunnels") {
+		sub := viper.Sub("tunnels." + name)
+		if sub == nil {
+			return fmt.Errorf("invalid tunnel %q, expected local-port and optionally local-host, remote-port, label, max-bytes-per-day and max-bytes-total", name)
+		}
+		spec := TunnelSpec{
+			LocalHost: sub.GetString("local-host"),
+			Label:     sub.GetString("label"),
+		}
+		for _, port := range []struct {
+			key string
+			p   *uint16
+		}{{"local-port", &spec.LocalPort}, {"remote-port", &spec.RemotePort}} {
+			n := sub.GetInt(port.key)
+			if n < 0 || n > 65535 {
+				return fmt.Errorf("invalid %s %d of tunnel %q, use a port number between 1 and 65535", port.key, n, name)
+			}
+			*port.p = uint16(n)
+		}
+		for _, limit := range []struct {
+			key string
+			n   *int64
+		}{{"max-bytes-per-day", &spec.MaxBytesPerDay}, {"max-bytes-total", &spec.MaxBytesTotal}} {
+			n, err := parseRate(sub.GetString(limit.key))
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid %s %q of tunnel %q, use a size such as 10GB", limit.key, sub.GetString(limit.key), name)
+			}
+			*limit.n = n
+		}
+		if err := spec.validate(name); err != nil {
+			return err
+		}
+		if config.Tunnels == nil {
+			config.Tunnels = make(map[string]TunnelSpec)
+		}
+		config.Tunnels[name] = spec
+	}
+	return nil
+}
+
+// validate reports an error if the tunnel name cannot be used with spec.
+func (spec TunnelSpec) validate(name string) error {
+	if name == "" || strings.ContainsAny(name, "/ ") {
+		return fmt.Errorf("invalid tunnel name %q, use a name without slashes or spaces", name)
+	}
+	if spec.LocalPort == 0 {
+		return fmt.Errorf("tunnel %q needs a local-port", name)
+	}
+	if spec.MaxBytesPerDay < 0 || spec.MaxBytesTotal < 0 {
+		return fmt.Errorf("invalid traffic quota of tunnel %q, use a positive number of bytes", name)
+	}
+	return nil
+}
+
+// tunnelConfig derives the configuration of the extra tunnel name from that of
+// the main tunnel. Settings that belong to the process as a whole, such as the
+// ready file, the preview port and the extra tunnels themselves, are cleared.
+func tunnelConfig(main Config, name string, spec TunnelSpec) Config {
+	config := main
+	config.Tunnel, config.Tunnels = name, nil
+	config.LocalPort, config.RemotePort = spec.LocalPort, spec.RemotePort
+	if spec.LocalHost != "" {
+		config.LocalHost = spec.LocalHost
+	}
+	config.Label = spec.Label
+	if config.Label == "" {
+		config.Label = name
+	}
+	if spec.MaxBytesPerDay != 0 {
+		config.Quota.PerDay = spec.MaxBytesPerDay
+	}
+	if spec.MaxBytesTotal != 0 {
+		config.Quota.Total = spec.MaxBytesTotal
+	}
+	config.quota = nil // Each tunnel counts its own traffic.
+	config.ReadyFile, config.PortFile, config.PreviewPort = "", "", ""
+	return config
+}
+
+// extraTunnel is a running extra tunnel.
+type extraTunnel struct {
+	spec    TunnelSpec
+	runner  *runner
+	fromAPI bool // Added on the admin API rather than in the config file.
+}
+
+// tunnelSet runs the extra tunnels of the main runner, each with its own
+// runner, so they reconnect independently and adding or removing one leaves
+// the others undisturbed. Its methods do nothing on a nil set.
+type tunnelSet struct {
+	ops sync.Mutex // Serialises adding and removing tunnels.
+
+	mu      sync.Mutex // Guards tunnels and paused.
+	tunnels map[string]*extraTunnel
+	paused  bool           // Whether the tunnels are paused, see runner.setPaused.
+	wg      sync.WaitGroup // Runners that have not returned yet.
+}
+
+// newTunnelSet creates an empty set of extra tunnels.
+func newTunnelSet() *tunnelSet {
+	return &tunnelSet{tunnels: make(map[string]*extraTunnel)}
+}
+
+// apply brings the tunnels defined in the config file in line with main:
+// tunnels that were removed from it are closed, new ones opened and changed
+// ones reopened, while the others get the shared settings of main applied like
+// on reload. Tunnels added on the admin API are left alone.
+func (s *tunnelSet) apply(main Config) {
+	if s == nil {
+		return
+	}
+	s.ops.Lock()
+	defer s.ops.Unlock()
+	s.mu.Lock()
+	running := make(map[string]*extraTunnel, len(s.tunnels))
+	for name, t := range s.tunnels {
+		running[name] = t
+	}
+	s.mu.Unlock()
+
+	for name, t := range running {
+		if _, ok := main.Tunnels[name]; !ok && !t.fromAPI {
+			s.stop(name, t, main)
+		}
+	}
+	for _, name := range sortedTunnelNames(main.Tunnels) {
+		spec := main.Tunnels[name]
+		t, ok := running[name]
+		if ok && t.spec == spec {
+			_ = t.runner.apply(tunnelConfig(main, name, spec))
+			continue
+		}
+		if ok {
+			s.stop(name, t, main)
+		}
+		if err := s.start(main, name, spec, false); err != nil {
+			log.Printf("❌ %v", err)
+		}
+	}
+}
+
+// add opens the extra tunnel name, defined by spec, on behalf of the admin API.
+func (s *tunnelSet) add(main Config, name string, spec TunnelSpec) (*runner, error) {
+	if err := spec.validate(name); err != nil {
+		return nil, err
+	}
+	s.ops.Lock()
+	defer s.ops.Unlock()
+	if s.get(name) != nil {
+		return nil, fmt.Errorf("%w: %s", errTunnelExists, name)
+	}
+	if err := s.start(main, name, spec, true); err != nil {
+		return nil, err
+	}
+	return s.get(name), nil
+}
+
+// remove closes the extra tunnel name, on behalf of the admin API.
+func (s *tunnelSet) remove(main Config, name string) error {
+	s.ops.Lock()
+	defer s.ops.Unlock()
+	s.mu.Lock()
+	t := s.tunnels[name]
+	s.mu.Unlock()
+	if t == nil {
+		return fmt.Errorf("%w: %s", errNoSuchTunnel, name)
+	}
+	s.stop(name, t, main)
+	return nil
+}
+
+// addTunnel opens the extra tunnel name next to those of r, sharing the
+// running configuration of r.
+func (r *runner) addTunnel(name string, spec TunnelSpec) (*runner, error) {
+	r.mu.Lock()
+	config := r.config
+	r.mu.Unlock()
+	return r.tunnels.add(config, name, spec)
+}
+
+// removeTunnel closes the extra tunnel name of r.
+func (r *runner) removeTunnel(name string) error {
+	r.mu.Lock()
+	config := r.config
+	r.mu.Unlock()
+	return r.tunnels.remove(config, name)
+}
+
+// setPaused pauses or resumes the extra tunnels, and those opened later.
+func (s *tunnelSet) setPaused(paused bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paused = paused
+	for _, t := range s.tunnels {
+		t.runner.setPaused(paused)
+	}
+}
+
+// get returns the runner of the extra tunnel name, nil if it is not running.
+func (s *tunnelSet) get(name string) *runner {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t := s.tunnels[name]; t != nil {
+		return t.runner
+	}
+	return nil
+}
+
+// runners returns the runners of the extra tunnels, ordered by name.
+func (s *tunnelSet) runners() []*runner {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.tunnels))
+	for name := range s.tunnels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	runners := make([]*runner, 0, len(names))
+	for _, name := range names {
+		runners = append(runners, s.tunnels[name].runner)
+	}
+	return runners
+}
+
+// start connects the extra tunnel name and runs it until it is stopped. s.ops
+// must be held.
+func (s *tunnelSet) start(main Config, name string, spec TunnelSpec, fromAPI bool) error {
+	config := tunnelConfig(main, name, spec)
+	client, err := dialLimited(&config)
+	if err != nil {
+		return fmt.Errorf("failed to open tunnel %s: %w", name, err)
+	}
+	r := newRunner(config, client, "")
+	t := &extraTunnel{spec: spec, runner: r, fromAPI: fromAPI}
+	s.mu.Lock()
+	s.tunnels[name] = t
+	if s.paused {
+		// Under mu, so a concurrent resume cannot be missed.
+		r.setPaused(true)
+	}
+	s.mu.Unlock()
+	log.Printf("✅ Tunnel %s open on remote port %d", name, client.RemotePort())
+	notify.tunnel(EventTunnelUp, client, nil)
+	printTunnelEvent(&config, "connected", client)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		r.run()
+		// A tunnel that gave up reconnecting is no longer running.
+		s.mu.Lock()
+		if s.tunnels[name] == t {
+			delete(s.tunnels, name)
+			log.Printf("⚠️ Tunnel %s stopped", name)
+		}
+		s.mu.Unlock()
+	}()
+	return nil
+}
+
+// stop closes the extra tunnel t, letting its connections drain in the
+// background for the shutdown timeout of main. s.ops must be held.
+func (s *tunnelSet) stop(name string, t *extraTunnel, main Config) {
+	s.mu.Lock()
+	if s.tunnels[name] == t {
+		delete(s.tunnels, name)
+	}
+	s.mu.Unlock()
+	log.Printf("🛑 Closing tunnel %s", name)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), main.ShutdownTimeout)
+		defer cancel()
+		if err := t.runner.Shutdown(ctx); err != nil {
+			log.Printf("⚠️ Shutdown of tunnel %s: %v", name, err)
+		}
+		notify.tunnel(EventTunnelDown, t.runner.current(), nil)
+	}()
+}
+
+// shutdown closes all extra tunnels and waits, within ctx, for them to drain.
+func (s *tunnelSet) shutdown(ctx context.Context) {
+	if s == nil {
+		return
+	}
+	s.ops.Lock()
+	s.mu.Lock()
+	tunnels := s.tunnels
+	s.tunnels = make(map[string]*extraTunnel)
+	s.mu.Unlock()
+	s.ops.Unlock()
+	for _, t := range tunnels {
+		go func() {
+			if err := t.runner.Shutdown(ctx); err != nil {
+				log.Printf("⚠️ Shutdown of tunnel %s: %v", t.runner.config.Tunnel, err)
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// sortedTunnelNames returns the names of tunnels in order.
+func sortedTunnelNames(tunnels map[string]TunnelSpec) []string {
+	names := make([]string, 0, len(tunnels))
+	for name := range tunnels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"client/tunneltest"
+)
+
+func TestTunnelQuotas(t *testing.T) {
+	srv := newServer(t, func() (*tunneltest.Server, error) { return tunneltest.NewServer("secret") })
+	host, port, _ := net.SplitHostPort(srv.Addr())
+	sp, _ := strconv.Atoi(port)
+	main := Config{Server: host, ServerPort: uint16(sp), ClientID: "test", SecretKey: "secret", NoSpinner: true,
+		LocalHost: "127.0.0.1", LocalPort: startEcho(t), Quota: Quota{Total: 4}}
+	db := tunnelConfig(main, "db", TunnelSpec{LocalPort: startEcho(t), MaxBytesPerDay: 1000})
+	if want := (Quota{PerDay: 1000, Total: 4}); db.Quota != want {
+		t.Fatalf("tunnel db has quota %+v, want %+v", db.Quota, want)
+	}
+
+	clients := make(map[string]*Client)
+	for name, config := range map[string]*Config{"main": &main, "db": &db} {
+		c, err := newClientFromConfig(config, WithLogger(log.New(io.Discard, "", 0)))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		go func() { _ = c.Listen() }()
+		t.Cleanup(func() { c.Close() })
+		clients[name] = c
+	}
+	if main.quota == nil || db.quota == nil || main.quota == db.quota {
+		t.Fatal("the tunnels do not count their traffic separately")
+	}
+
+	// The main tunnel uses up its quota; the db tunnel is not affected.
+	conn := visit(t, srv, clients["main"])
+	echo(t, conn, "four")
+	conn.Close()
+	deadline := time.Now().Add(testTimeout)
+	for main.quota.Exceeded() == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n, err := visit(t, srv, clients["main"]).Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("visitor of the main tunnel read %d, %v after its quota was used up, want EOF", n, err)
+	}
+	echo(t, visit(t, srv, clients["db"]), "db still accepts connections")
+}
@@ -0,0 +1,736 @@
+// Package tunneltest provides an in-process implementation of the server side
+// of the Jerusalem tunnel protocol, so the client can be integration tested
+// without a real jerusalem server.
+//
+// The server speaks the JSON protocol only. Of the optional capabilities it
+// accepts the round-trip time measurement on heartbeats and refused connection
+// requests, and zstd compression and multiplexing if enabled on the Server;
+// otherwise clients fall back to one authenticated data connection per
+// visitor.
+//
+// Usage example:
+//
+//	srv, err := tunneltest.NewServer("secret")
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	defer srv.Close()
+//
+//	// Connect the client to srv.Addr() with the same secret, then
+//	conn, err := srv.DialVisitor(remotePort)
+package tunneltest
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/yamux"
+	"github.com/klauspost/compress/zstd"
+)
+
+// maxClockSkew is how far the timestamp of an answer may be from the time of
+// the server.
+const maxClockSkew = 5 * time.Minute
+
+// message is the union of the client and server messages of the protocol.
+type message struct {
+	Type         string    `json:"type"`
+	Challenge    uuid.UUID `json:"challenge,omitempty"`
+	Authenticate string    `json:"authenticate,omitempty"`
+	Signature    string    `json:"signature,omitempty"`
+	Fingerprint  string    `json:"keyFingerprint,omitempty"`
+	Token        string    `json:"token,omitempty"`
+	Session      bool      `json:"session,omitempty"`
+	SessionToken string    `json:"sessionToken,omitempty"`
+	SessionTTL   int       `json:"sessionTtl,omitempty"`
+	Nonce        string    `json:"nonce,omitempty"`
+	Timestamp    int64     `json:"timestamp,omitempty"`
+	Proof        string    `json:"proof,omitempty"`
+	ClientID     string    `json:"clientId,omitempty"`
+	Hello        uint16    `json:"hello,omitempty"`
+	Port         uint16    `json:"port,omitempty"`
+	Accept       uuid.UUID `json:"accept,omitempty"`
+	Reject       uuid.UUID `json:"reject,omitempty"`
+	Connection   uuid.UUID `json:"connection,omitempty"`
+	Visitor      string    `json:"visitor,omitempty"`
+	Goodbye      uint16    `json:"goodbye,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	Version      int       `json:"version,omitempty"`
+	Label        string    `json:"label,omitempty"`
+	Capabilities []string  `json:"capabilities,omitempty"`
+	Ping         uint64    `json:"ping,omitempty"`
+	Pong         uint64    `json:"pong,omitempty"`
+}
+
+// Tunnel describes a client connected to the server.
+type Tunnel struct {
+	ClientID string // Client ID sent in the authenticate message, if any.
+	Label    string // Session label sent in the hello message, if any.
+	Port     uint16 // Public port assigned to the client.
+}
+
+// Server is an in-process tunnel server listening on the loopback interface.
+// Each client that completes the hello exchange gets its own public listener,
+// and every visitor connecting to it is announced to the client and relayed
+// over the data connection the client opens for it.
+//
+// The exported fields must be set before the first call to Addr, which
+// starts accepting clients.
+type Server struct {
+	// HeartbeatInterval is how often heartbeats are sent on the control
+	// connections; zero disables them.
+	HeartbeatInterval time.Duration
+	// SessionTTL is how long the issued session tokens are valid, rounded
+	// down to seconds; zero disables session tokens.
+	SessionTTL time.Duration
+	// Compression makes the server accept zstd compression of the data
+	// connections of clients that offer it.
+	Compression bool
+	// Multiplex makes the server accept multiplexing the data connections of
+	// clients that offer it over one yamux session.
+	Multiplex bool
+
+	key      []byte                       // Key the challenge answers are checked with, nil if none.
+	keys     map[string]ed25519.PublicKey // Keys signatures are checked with, by fingerprint.
+	tokens   func(token string) bool      // Reports whether an access token is valid, nil if none are accepted.
+	listener net.Listener
+	start    sync.Once // Starts accepting clients.
+	wg       sync.WaitGroup
+
+	mu       sync.Mutex
+	tunnels  map[uint16]*tunnel
+	pending  map[uuid.UUID]visitor // Visitors waiting for their data connection.
+	sessions map[string]session    // Issued session tokens.
+	conns    map[net.Conn]struct{} // Open connections, closed by Close.
+	resumed  int                   // Connections authenticated with a session token.
+	closed   bool
+}
+
+// visitor is a visitor waiting for the data connection of its tunnel.
+type visitor struct {
+	conn net.Conn
+	t    *tunnel
+}
+
+// session is an issued session token.
+type session struct {
+	clientID string
+	expiry   time.Time
+}
+
+// tunnel is the state of a connected client.
+type tunnel struct {
+	Tunnel
+	compressed bool // Data connections are zstd streams.
+	control    net.Conn
+	public     net.Listener
+	encMu      sync.Mutex // Guards enc.
+	enc        *json.Encoder
+}
+
+// NewServer starts a server on a free port of 127.0.0.1. If secret is not
+// empty, clients must answer a challenge with it, covering a nonce and a
+// timestamp, and the server proves knowing it on success, as with a real
+// server; otherwise clients are accepted without authentication.
+func NewServer(secret string) (*Server, error) {
+	var key []byte
+	if secret != "" {
+		h := sha256.Sum256([]byte(secret))
+		key = h[:]
+	}
+	return newServer(key, nil)
+}
+
+// NewKeyServer starts a server like NewServer that authenticates clients by
+// an Ed25519 signature of the challenge made with the private key of one of
+// keys, as with public-key authentication on a real server.
+func NewKeyServer(keys ...ed25519.PublicKey) (*Server, error) {
+	byFingerprint := make(map[string]ed25519.PublicKey, len(keys))
+	for _, k := range keys {
+		h := sha256.Sum256(k)
+		byFingerprint["SHA256:"+base64.RawStdEncoding.EncodeToString(h[:])] = k
+	}
+	return newServer(nil, byFingerprint)
+}
+
+// NewTokenServer starts a server like NewServer that authenticates clients by
+// an access token of an identity provider, accepting the tokens valid reports
+// true for, with the answer keyed by the token.
+func NewTokenServer(valid func(token string) bool) (*Server, error) {
+	s, err := newServer(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.tokens = valid
+	return s, nil
+}
+
+// newServer starts a server checking answers with key or signatures with keys.
+func newServer(key []byte, keys map[string]ed25519.PublicKey) (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+	s := &Server{
+		key:      key,
+		keys:     keys,
+		listener: l,
+		tunnels:  make(map[uint16]*tunnel),
+		pending:  make(map[uuid.UUID]visitor),
+		sessions: make(map[string]session),
+		conns:    make(map[net.Conn]struct{}),
+	}
+	return s, nil
+}
+
+// Addr returns the host:port of the control port, to connect clients to, and
+// starts accepting them on the first call.
+func (s *Server) Addr() string {
+	s.start.Do(func() {
+		s.wg.Add(1)
+		go s.serve()
+	})
+	return s.listener.Addr().String()
+}
+
+// Tunnels returns the clients that are currently connected.
+func (s *Server) Tunnels() []Tunnel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tunnels := make([]Tunnel, 0, len(s.tunnels))
+	for _, t := range s.tunnels {
+		tunnels = append(tunnels, t.Tunnel)
+	}
+	return tunnels
+}
+
+// SessionAuthentications returns how many connections authenticated with a
+// session token rather than the credentials of the client.
+func (s *Server) SessionAuthentications() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.resumed
+}
+
+// DialVisitor connects to the public port, like a visitor of the tunnel would.
+func (s *Server) DialVisitor(port uint16) (net.Conn, error) {
+	return net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))))
+}
+
+// SendError sends an error message with text to the client of the tunnel on
+// port, which reports it to OnError and keeps listening. Follow it with
+// CloseTunnel to end the session like a server does after a fatal error; Listen
+// then returns the error.
+func (s *Server) SendError(port uint16, text string) error {
+	t, err := s.tunnel(port)
+	if err != nil {
+		return err
+	}
+	return t.send(message{Type: "Error", Error: text})
+}
+
+// CloseTunnel closes the control connection and the public listener of the
+// tunnel on port, as if the server had dropped the client.
+func (s *Server) CloseTunnel(port uint16) error {
+	t, err := s.tunnel(port)
+	if err != nil {
+		return err
+	}
+	s.remove(t)
+	return nil
+}
+
+// Close stops the server, closing every tunnel and connection, and waits for
+// its goroutines to return.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	tunnels := make([]*tunnel, 0, len(s.tunnels))
+	for _, t := range s.tunnels {
+		tunnels = append(tunnels, t)
+	}
+	for id := range s.pending {
+		delete(s.pending, id)
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	err := s.listener.Close()
+	for _, t := range tunnels {
+		s.remove(t)
+	}
+	s.wg.Wait()
+	return err
+}
+
+// tunnel returns the tunnel on port.
+func (s *Server) tunnel(port uint16) (*tunnel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tunnels[port]
+	if !ok {
+		return nil, fmt.Errorf("no tunnel on port %d", port)
+	}
+	return t, nil
+}
+
+// remove closes t and forgets it.
+func (s *Server) remove(t *tunnel) {
+	s.mu.Lock()
+	if s.tunnels[t.Port] == t {
+		delete(s.tunnels, t.Port)
+	}
+	s.mu.Unlock()
+	t.public.Close()
+	t.control.Close()
+}
+
+// serve accepts control and data connections.
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		if !s.track(conn) {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.untrack(conn)
+			s.handle(conn)
+		}()
+	}
+}
+
+// track records conn as open, so Close closes it. It closes conn and reports
+// false if the server is closed already.
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		conn.Close()
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+// untrack forgets conn, which was closed.
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+// handle authenticates conn and serves it as a control connection after a
+// hello message, relays a visitor over it after an accept message, or serves
+// it as a multiplexed session after a multiplex message.
+func (s *Server) handle(conn net.Conn) {
+	enc := json.NewEncoder(conn)
+	dec := json.NewDecoder(conn)
+	var msg message
+
+	var clientID string
+	if s.key != nil || s.keys != nil || s.tokens != nil {
+		challenge := uuid.New()
+		capabilities := []string{"nonce"}
+		if s.tokens != nil {
+			capabilities = append(capabilities, "token")
+		}
+		ttl := s.SessionTTL / time.Second * time.Second
+		if ttl > 0 {
+			capabilities = append(capabilities, "session")
+		}
+		if err := enc.Encode(message{Type: "Challenge", Challenge: challenge, Capabilities: capabilities}); err != nil {
+			conn.Close()
+			return
+		}
+		var key []byte
+		ok := false
+		if err := dec.Decode(&msg); err == nil && msg.Type == "Authenticate" {
+			key, ok = s.authenticated(challenge, msg)
+		}
+		if !ok {
+			_ = enc.Encode(message{Type: "Error", Error: "invalid secret"})
+			conn.Close()
+			return
+		}
+		clientID = msg.ClientID
+		reply := message{Type: "FreePort"}
+		if key != nil {
+			m := hmac.New(sha256.New, key)
+			m.Write([]byte("server"))
+			m.Write(answered(challenge, msg))
+			reply.Proof = hex.EncodeToString(m.Sum(nil))
+		}
+		if ttl > 0 && !msg.Session {
+			reply.SessionToken, reply.SessionTTL = s.issueSession(clientID, ttl), int(ttl/time.Second)
+		}
+		if err := enc.Encode(reply); err != nil {
+			conn.Close()
+			return
+		}
+	}
+
+	if err := dec.Decode(&msg); err != nil {
+		conn.Close()
+		return
+	}
+	switch msg.Type {
+	case "Hello":
+		s.serveControl(conn, enc, dec, Tunnel{ClientID: clientID, Label: msg.Label}, msg.Capabilities)
+	case "Accept":
+		s.relay(conn, dec, msg.Accept)
+	case "Multiplex":
+		s.serveMux(conn, dec)
+	default:
+		_ = enc.Encode(message{Type: "Error", Error: "unexpected message " + msg.Type})
+		conn.Close()
+	}
+}
+
+// answered returns the material the authenticate message msg answers or
+// signs: challenge, the nonce and the timestamp.
+func answered(challenge uuid.UUID, msg message) []byte {
+	data := append(append([]byte(nil), challenge[:]...), msg.Nonce...)
+	return binary.BigEndian.AppendUint64(data, uint64(msg.Timestamp))
+}
+
+// authenticated reports whether the authenticate message msg answers
+// challenge with the secret, signs it with one of the keys of the server,
+// carries a valid token and answers with it, or answers with a session token
+// issued to the client. It returns the key the answer is keyed by, to prove
+// knowing it to the client, or nil for a signature.
+// Answers must cover a nonce and a timestamp at most maxClockSkew away.
+func (s *Server) authenticated(challenge uuid.UUID, msg message) ([]byte, bool) {
+	if msg.Nonce == "" || time.Since(time.Unix(msg.Timestamp, 0)).Abs() > maxClockSkew {
+		return nil, false
+	}
+	data := answered(challenge, msg)
+	if msg.Session {
+		key, ok := s.validSession(msg.ClientID, data, msg.Authenticate)
+		if ok {
+			s.mu.Lock()
+			s.resumed++
+			s.mu.Unlock()
+		}
+		return key, ok
+	}
+	if s.tokens != nil {
+		h := sha256.Sum256([]byte(msg.Token))
+		return h[:], msg.Token != "" && s.tokens(msg.Token) && validAnswer(h[:], data, msg.Authenticate)
+	}
+	if s.keys == nil {
+		return s.key, validAnswer(s.key, data, msg.Authenticate)
+	}
+	key, ok := s.keys[msg.Fingerprint]
+	sig, err := hex.DecodeString(msg.Signature)
+	return nil, ok && err == nil && ed25519.Verify(key, data, sig)
+}
+
+// issueSession returns a new session token of clientID, valid for ttl.
+func (s *Server) issueSession(clientID string, ttl time.Duration) string {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	token := hex.EncodeToString(b)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[token] = session{clientID: clientID, expiry: time.Now().Add(ttl)}
+	return token
+}
+
+// validSession reports whether answer is the HMAC-SHA256 of data keyed by a
+// session token issued to clientID that has not expired, and returns the key.
+func (s *Server) validSession(clientID string, data []byte, answer string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for token, sess := range s.sessions {
+		if time.Now().After(sess.expiry) {
+			delete(s.sessions, token)
+			continue
+		}
+		h := sha256.Sum256([]byte(token))
+		if sess.clientID == clientID && validAnswer(h[:], data, answer) {
+			return h[:], true
+		}
+	}
+	return nil, false
+}
+
+// validAnswer reports whether answer is the HMAC-SHA256 of data keyed by key.
+func validAnswer(key, data []byte, answer string) bool {
+	b, err := hex.DecodeString(answer)
+	if err != nil {
+		return false
+	}
+	m := hmac.New(sha256.New, key)
+	m.Write(data)
+	return hmac.Equal(m.Sum(nil), b)
+}
+
+// serveControl opens the public listener of a new tunnel, replies to the
+// hello message with the offered capabilities it supports and then announces
+// visitors, echoes heartbeat pings and closes refused visitors until the
+// client disconnects or says goodbye.
+func (s *Server) serveControl(conn net.Conn, enc *json.Encoder, dec *json.Decoder, info Tunnel, capabilities []string) {
+	public, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		_ = enc.Encode(message{Type: "Error", Error: err.Error()})
+		conn.Close()
+		return
+	}
+	info.Port = uint16(public.Addr().(*net.TCPAddr).Port)
+	t := &tunnel{Tunnel: info, control: conn, public: public, enc: enc}
+	accepted := []string{"rtt", "reject"}
+	if s.Compression {
+		accepted = append(accepted, "zstd")
+	}
+	if s.Multiplex {
+		accepted = append(accepted, "yamux")
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		public.Close()
+		conn.Close()
+		return
+	}
+	s.tunnels[info.Port] = t
+	interval := s.HeartbeatInterval
+	s.mu.Unlock()
+	defer s.remove(t)
+
+	reply := message{Type: "Hello", Hello: info.Port, Version: 1}
+	for _, c := range accepted {
+		if slices.Contains(capabilities, c) {
+			reply.Capabilities = append(reply.Capabilities, c)
+		}
+	}
+	t.compressed = slices.Contains(reply.Capabilities, "zstd")
+	if err := t.send(reply); err != nil {
+		return
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.acceptVisitors(t)
+	}()
+	if interval > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			t.heartbeat(interval, done)
+		}()
+	}
+
+	for {
+		var msg message
+		if err := dec.Decode(&msg); err != nil || msg.Type == "Goodbye" {
+			return
+		}
+		switch {
+		case msg.Type == "Heartbeat" && msg.Ping != 0:
+			if err := t.send(message{Type: "Heartbeat", Pong: msg.Ping}); err != nil {
+				return
+			}
+		case msg.Type == "Reject":
+			s.mu.Lock()
+			v, ok := s.pending[msg.Reject]
+			delete(s.pending, msg.Reject)
+			s.mu.Unlock()
+			if ok {
+				v.conn.Close()
+			}
+		}
+	}
+}
+
+// acceptVisitors announces every visitor of t to its client.
+func (s *Server) acceptVisitors(t *tunnel) {
+	for {
+		conn, err := t.public.Accept()
+		if err != nil {
+			return
+		}
+		if !s.track(conn) {
+			return
+		}
+		id := uuid.New()
+		s.mu.Lock()
+		s.pending[id] = visitor{conn: conn, t: t}
+		s.mu.Unlock()
+		if err := t.send(message{Type: "Connection", Connection: id, Visitor: conn.RemoteAddr().String()}); err != nil {
+			s.mu.Lock()
+			delete(s.pending, id)
+			s.mu.Unlock()
+			s.untrack(conn)
+			conn.Close()
+			return
+		}
+	}
+}
+
+// serveMux serves the multiplexed session a client opened on conn: every
+// stream starts with an accept message and then relays its visitor.
+func (s *Server) serveMux(conn net.Conn, dec *json.Decoder) {
+	defer conn.Close()
+	cfg := yamux.DefaultConfig()
+	cfg.LogOutput = io.Discard
+	sess, err := yamux.Server(&bufferedConn{Conn: conn, r: remainder(dec, conn)}, cfg)
+	if err != nil {
+		return
+	}
+	defer sess.Close()
+	for {
+		stream, err := sess.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			dec := json.NewDecoder(stream)
+			var msg message
+			if err := dec.Decode(&msg); err != nil || msg.Type != "Accept" {
+				stream.Close()
+				return
+			}
+			s.relay(stream, dec, msg.Accept)
+		}()
+	}
+}
+
+// bufferedConn is a net.Conn whose reads come from r.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (bc *bufferedConn) Read(p []byte) (int, error) {
+	return bc.r.Read(p)
+}
+
+// remainder returns a reader of what follows the last message decoded by dec
+// from conn: the data dec buffered, without the newline that terminates the
+// message, followed by conn.
+func remainder(dec *json.Decoder, conn net.Conn) io.Reader {
+	buffered, _ := io.ReadAll(dec.Buffered())
+	return io.MultiReader(bytes.NewReader(bytes.TrimPrefix(buffered, []byte("\n"))), conn)
+}
+
+// relay copies data between the data connection conn, whose accept message
+// dec decoded, and the visitor id, decompressing and compressing it if the
+// tunnel of the visitor uses compression.
+func (s *Server) relay(conn net.Conn, dec *json.Decoder, id uuid.UUID) {
+	defer conn.Close()
+	s.mu.Lock()
+	v, ok := s.pending[id]
+	delete(s.pending, id)
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	defer s.untrack(v.conn)
+	defer v.conn.Close()
+
+	// The decoder may have read past the accept message.
+	var remote io.Reader = remainder(dec, conn)
+	var w io.Writer = conn
+	finish := func() { closeWrite(conn) }
+	if v.t.compressed {
+		zr, err := zstd.NewReader(remote, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return
+		}
+		defer zr.Close()
+		zw, err := zstd.NewWriter(conn, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return
+		}
+		remote, w = zr, &flushWriter{zw}
+		finish = func() {
+			_ = zw.Close()
+			closeWrite(conn)
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(v.conn, remote)
+		closeWrite(v.conn)
+		close(done)
+	}()
+	_, _ = io.Copy(w, v.conn)
+	finish()
+	<-done
+}
+
+// flushWriter flushes the zstd stream after every write, so interactive
+// protocols are not held up.
+type flushWriter struct {
+	zw *zstd.Encoder
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.zw.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, fw.zw.Flush()
+}
+
+// closeWrite shuts down the sending side of conn if it supports it.
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	}
+}
+
+// send writes msg to the control connection of t.
+func (t *tunnel) send(msg message) error {
+	t.encMu.Lock()
+	defer t.encMu.Unlock()
+	if err := t.enc.Encode(msg); err != nil {
+		return fmt.Errorf("failed to send %s message: %w", msg.Type, err)
+	}
+	return nil
+}
+
+// heartbeat sends heartbeats to the client of t every interval until done is
+// closed.
+func (t *tunnel) heartbeat(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := t.send(message{Type: "Heartbeat"}); err != nil {
+				return
+			}
+		}
+	}
+}
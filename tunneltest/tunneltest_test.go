@@ -0,0 +1,221 @@
+package tunneltest
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// peer is one connection of a hand-written client, speaking the JSON protocol.
+type peer struct {
+	conn net.Conn
+	enc  *json.Encoder
+	dec  *json.Decoder
+}
+
+// dial connects a new peer to srv, answering the challenge with secret if the
+// server sends one.
+func dial(t *testing.T, srv *Server, secret string) *peer {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	p := &peer{conn: conn, enc: json.NewEncoder(conn), dec: json.NewDecoder(conn)}
+	if secret == "" {
+		return p
+	}
+	challenge := p.recv(t)
+	if challenge.Type != "Challenge" {
+		t.Fatalf("got %s message, want Challenge", challenge.Type)
+	}
+	nonce, ts := "0123456789abcdef", time.Now().Unix()
+	data := append(append([]byte(nil), challenge.Challenge[:]...), nonce...)
+	data = binary.BigEndian.AppendUint64(data, uint64(ts))
+	key := sha256.Sum256([]byte(secret))
+	m := hmac.New(sha256.New, key[:])
+	m.Write(data)
+	p.send(t, message{Type: "Authenticate", Authenticate: hex.EncodeToString(m.Sum(nil)), Nonce: nonce, Timestamp: ts, ClientID: "test"})
+	m = hmac.New(sha256.New, key[:])
+	m.Write([]byte("server"))
+	m.Write(data)
+	if reply := p.recv(t); reply.Type != "FreePort" || reply.Proof != hex.EncodeToString(m.Sum(nil)) {
+		t.Fatalf("got %+v, want FreePort with the proof of the key", reply)
+	}
+	return p
+}
+
+func (p *peer) send(t *testing.T, msg message) {
+	t.Helper()
+	if err := p.enc.Encode(msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (p *peer) recv(t *testing.T) message {
+	t.Helper()
+	_ = p.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg message
+	if err := p.dec.Decode(&msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// open sends the hello message on p and returns the public port of the tunnel.
+func (p *peer) open(t *testing.T, capabilities ...string) (uint16, message) {
+	t.Helper()
+	p.send(t, message{Type: "Hello", Version: 1, Label: "web", Capabilities: capabilities})
+	hello := p.recv(t)
+	if hello.Type != "Hello" || hello.Hello == 0 {
+		t.Fatalf("got %+v, want Hello with a port", hello)
+	}
+	return hello.Hello, hello
+}
+
+func TestRelay(t *testing.T) {
+	srv, err := NewServer("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	control := dial(t, srv, "secret")
+	port, _ := control.open(t)
+	if tunnels := srv.Tunnels(); len(tunnels) != 1 || tunnels[0].Port != port || tunnels[0].ClientID != "test" || tunnels[0].Label != "web" {
+		t.Fatalf("got tunnels %+v", tunnels)
+	}
+
+	v, err := srv.DialVisitor(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	conn := control.recv(t)
+	if conn.Type != "Connection" || conn.Visitor == "" {
+		t.Fatalf("got %+v, want Connection", conn)
+	}
+
+	data := dial(t, srv, "secret")
+	data.send(t, message{Type: "Accept", Accept: conn.Connection})
+	if _, err := v.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(data.conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("data connection read %q, %v, want ping", buf, err)
+	}
+	if _, err := data.conn.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(v, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("visitor read %q, %v, want pong", buf, err)
+	}
+}
+
+func TestWrongSecret(t *testing.T) {
+	srv, err := NewServer("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	p := &peer{conn: conn, enc: json.NewEncoder(conn), dec: json.NewDecoder(conn)}
+	p.recv(t)
+	p.send(t, message{Type: "Authenticate", Authenticate: "00", Nonce: "n", Timestamp: time.Now().Unix()})
+	if reply := p.recv(t); reply.Type != "Error" {
+		t.Fatalf("got %+v, want Error", reply)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	srv, err := NewServer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.Compression = true
+
+	_, hello := dial(t, srv, "").open(t, "zstd", "yamux", "rtt", "msgpack")
+	if got := hello.Capabilities; len(got) != 2 || got[0] != "rtt" || got[1] != "zstd" {
+		t.Fatalf("accepted capabilities %v, want [rtt zstd]", got)
+	}
+}
+
+func TestHeartbeatAndReject(t *testing.T) {
+	srv, err := NewServer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.HeartbeatInterval = 10 * time.Millisecond
+
+	control := dial(t, srv, "")
+	port, _ := control.open(t, "rtt", "reject")
+	if hb := control.recv(t); hb.Type != "Heartbeat" {
+		t.Fatalf("got %+v, want Heartbeat", hb)
+	}
+	control.send(t, message{Type: "Heartbeat", Ping: 7})
+	for {
+		if msg := control.recv(t); msg.Type == "Heartbeat" && msg.Pong == 7 {
+			break
+		}
+	}
+
+	v, err := srv.DialVisitor(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	var conn message
+	for conn.Type != "Connection" {
+		conn = control.recv(t)
+	}
+	control.send(t, message{Type: "Reject", Reject: conn.Connection, Error: "too many connections"})
+	_ = v.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := v.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("visitor read %d, %v after reject, want EOF", n, err)
+	}
+}
+
+func TestCloseEndsConnections(t *testing.T) {
+	srv, err := NewServer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	control := dial(t, srv, "")
+	port, _ := control.open(t)
+	v, err := srv.DialVisitor(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	conn := control.recv(t)
+	dial(t, srv, "").send(t, message{Type: "Accept", Accept: conn.Connection})
+
+	done := make(chan error, 1)
+	go func() { done <- srv.Close() }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return while a visitor was relayed")
+	}
+	_ = v.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := v.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("visitor read %v after Close, want the connection closed", err)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// minSecretLength is the shortest secret key validate accepts. Shorter keys
+// are accepted by the client, but can be guessed from a recorded handshake.
+const minSecretLength = 16
+
+// validateCommand implements `validate [--profile name] [--dry-run] <config>`,
+// which checks that the config file can be read and contains everything
+// needed to connect, that the server names resolve and that the secret key is
+// long enough. With --dry-run it also authenticates with each server, without
+// opening a tunnel. Every problem found is listed, and the exit status is
+// exitConfigError if there is any, or 1 if only a dry-run handshake failed, so
+// it can gate CI pipelines.
+func validateCommand(args []string) {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	profile := fs.String("profile", "", "named profile of the config file to validate")
+	dryRun := fs.Bool("dry-run", false, "also authenticate with each server, without opening a tunnel")
+	_ = fs.Parse(args)
+	if *profile != "" {
+		viper.Set("profile", *profile)
+	}
+
+	var config Config
+	if err := loadConfig(&config, fs.Arg(0)); err != nil {
+		configFatalf("❌ Failed to read config file: %v", err)
+	}
+	code := exitConfigError
+	problems := validateConfig(&config)
+	if *dryRun && len(problems) == 0 {
+		code, problems = 1, dryRunHandshakes(&config)
+	}
+	if len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Printf("❌ %s\n", p)
+		}
+		os.Exit(code)
+	}
+	fmt.Println("✅ Configuration is valid")
+}
+
+// validateConfig returns the problems of a configuration that was read
+// successfully: missing keys, a short secret key and servers that cannot be
+// resolved.
+func validateConfig(config *Config) []string {
+	var problems []string
+	if missing := missingConfigKeys(config); len(missing) > 0 {
+		problems = append(problems, "Configuration is incomplete, missing: "+strings.Join(missing, ", "))
+	}
+	if n := len(config.SecretKey); n > 0 && n < minSecretLength {
+		problems = append(problems, fmt.Sprintf("The secret key is %d characters long, use at least %d", n, minSecretLength))
+	}
+	if config.Server == "" {
+		return problems
+	}
+	addrs, err := serverEndpoints(config)
+	if err != nil {
+		return append(problems, err.Error())
+	}
+	for _, addr := range addrs {
+		host, _, _ := net.SplitHostPort(addr)
+		if net.ParseIP(host) != nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), config.Timeouts.dial())
+		_, err := net.DefaultResolver.LookupHost(ctx, host)
+		cancel()
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Failed to resolve server %s: %v", host, err))
+		}
+	}
+	return problems
+}
+
+// dryRunHandshakes authenticates with each server of config like a data
+// connection does and returns the servers that failed.
+func dryRunHandshakes(config *Config) []string {
+	addrs, err := serverEndpoints(config)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	auth := configAuthenticator(config)
+	var problems []string
+	for _, addr := range addrs {
+		res := pingServer(addr, auth, config.ClientID, config.Timeouts, config.TLS.clientConfig())
+		if res.err != nil {
+			problems = append(problems, fmt.Sprintf("Handshake with %s failed: %v", addr, res.err))
+			continue
+		}
+		fmt.Printf("🔍 Authenticated with %s in %s\n", addr, (res.connect + res.handshake).Round(time.Microsecond))
+	}
+	return problems
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// vaultScheme prefixes config values that are references to a Vault secret,
+// of the form vault://<path>#<field>, e.g. vault://secret/data/jerusalem#secret-key.
+const vaultScheme = "vault://"
+
+// vaultClient reads secrets from the HTTP API of a HashiCorp Vault server.
+type vaultClient struct {
+	addr      string
+	token     string
+	namespace string
+	http      http.Client
+}
+
+// vaultSecret is the part of a Vault read response the client uses.
+type vaultSecret struct {
+	LeaseDuration int                    `json:"lease_duration"`
+	Data          map[string]interface{} `json:"data"`
+	Auth          *struct {
+		ClientToken string `json:"client_token"`
+	} `json:"auth"`
+	Errors []string `json:"errors"`
+}
+
+// readVaultSecrets replaces the secret key and client ID with the referenced
+// Vault secrets if they are vault:// references, and sets config.VaultLease to
+// the shortest lease of the secrets read, so they can be fetched again before
+// the lease runs out. Each secret path is read only once.
+func readVaultSecrets(config *Config) error {
+	config.VaultLease = 0
+	refs := []*string{&config.SecretKey, &config.ClientID, &config.SecondaryKey}
+	var vc *vaultClient
+	read := make(map[string]*vaultSecret)
+	for i, value := range refs {
+		if !strings.HasPrefix(*value, vaultScheme) {
+			continue
+		}
+		if vc == nil {
+			var err error
+			if vc, err = newVaultClient(); err != nil {
+				return err
+			}
+		}
+		path, field, _ := strings.Cut(strings.TrimPrefix(*value, vaultScheme), "#")
+		if field == "" {
+			field = []string{"secret-key", "client-id"}[i]
+		}
+		secret, ok := read[path]
+		if !ok {
+			var err error
+			if secret, err = vc.read(path); err != nil {
+				return err
+			}
+			read[path] = secret
+		}
+		resolved, err := secret.field(field)
+		if err != nil {
+			return fmt.Errorf("failed to read %s from Vault: %w", *value, err)
+		}
+		*value = resolved
+		lease := time.Duration(secret.LeaseDuration) * time.Second
+		if lease > 0 && (config.VaultLease == 0 || lease < config.VaultLease) {
+			config.VaultLease = lease
+		}
+	}
+	return nil
+}
+
+// newVaultClient creates a client for the server at vault-addr (or VAULT_ADDR).
+// It authenticates with vault-token (or VAULT_TOKEN), or else logs in with the
+// AppRole vault-role-id and vault-secret-id.
+func newVaultClient() (*vaultClient, error) {
+	vc := &vaultClient{
+		addr:      strings.TrimSuffix(vaultSetting("vault-addr", "VAULT_ADDR"), "/"),
+		token:     vaultSetting("vault-token", "VAULT_TOKEN"),
+		namespace: vaultSetting("vault-namespace", "VAULT_NAMESPACE"),
+		http:      http.Client{Timeout: NetworkTimeout},
+	}
+	if vc.addr == "" {
+		return nil, errors.New("vault:// reference used but vault-addr is not set")
+	}
+	if vc.token != "" {
+		return vc, nil
+	}
+	roleID := vaultSetting("vault-role-id", "VAULT_ROLE_ID")
+	secretID := vaultSetting("vault-secret-id", "VAULT_SECRET_ID")
+	if roleID == "" {
+		return nil, errors.New("vault:// reference used but neither vault-token nor vault-role-id is set")
+	}
+	body, _ := json.Marshal(map[string]string{"role_id": roleID, "secret_id": secretID})
+	resp, err := vc.do(http.MethodPost, "auth/approle/login", body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to log in to Vault with AppRole: %w", err)
+	}
+	if resp.Auth == nil || resp.Auth.ClientToken == "" {
+		return nil, errors.New("failed to log in to Vault with AppRole: no token in response")
+	}
+	vc.token = resp.Auth.ClientToken
+	return vc, nil
+}
+
+// vaultSetting returns the config key, falling back to the standard Vault
+// environment variable.
+func vaultSetting(key, env string) string {
+	if v := viper.GetString(key); v != "" {
+		return v
+	}
+	return os.Getenv(env)
+}
+
+// read reads the secret at path.
+func (vc *vaultClient) read(path string) (*vaultSecret, error) {
+	secret, err := vc.do(http.MethodGet, path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s from Vault: %w", path, err)
+	}
+	return secret, nil
+}
+
+// do sends a request to the Vault API endpoint path and decodes the response.
+func (vc *vaultClient) do(method, path string, body []byte) (*vaultSecret, error) {
+	req, err := http.NewRequest(method, vc.addr+"/v1/"+strings.TrimPrefix(path, "/"), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if vc.token != "" {
+		req.Header.Set("X-Vault-Token", vc.token)
+	}
+	if vc.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", vc.namespace)
+	}
+	resp, err := vc.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var secret vaultSecret
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return nil, fmt.Errorf("failed to decode response (%s): %w", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if len(secret.Errors) > 0 {
+			return nil, fmt.Errorf("%s: %s", resp.Status, strings.Join(secret.Errors, "; "))
+		}
+		return nil, errors.New(resp.Status)
+	}
+	return &secret, nil
+}
+
+// field returns the string value of name in the secret. Secrets of a KV
+// version 2 engine, which nest the values in another "data" object, are
+// supported as well.
+func (s *vaultSecret) field(name string) (string, error) {
+	data := s.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+	v, ok := data[name]
+	if !ok {
+		return "", fmt.Errorf("no field %q", name)
+	}
+	str, ok := v.(string)
+	if !ok || str == "" {
+		return "", fmt.Errorf("field %q is not a non-empty string", name)
+	}
+	return str, nil
+}
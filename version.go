@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build metadata, overridden at build time with
+//
+//	go build -ldflags "-X main.version=1.2.3 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+//
+// When left unset, commit and build date fall back to the VCS information
+// embedded by the Go toolchain.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// BuildInfo describes the binary and the protocol features it supports.
+type BuildInfo struct {
+	Version     string   `json:"version"`
+	Commit      string   `json:"commit,omitempty"`
+	BuildDate   string   `json:"buildDate,omitempty"`
+	GoVersion   string   `json:"goVersion"`
+	Platform    string   `json:"platform"`
+	Transports  []string `json:"transports"`
+	Codecs      []string `json:"codecs"`
+	Compression []string `json:"compression"`
+}
+
+// currentBuildInfo collects the build metadata of the running binary.
+func currentBuildInfo() BuildInfo {
+	bi := BuildInfo{
+		Version:     version,
+		Commit:      commit,
+		BuildDate:   buildDate,
+		GoVersion:   runtime.Version(),
+		Platform:    runtime.GOOS + "/" + runtime.GOARCH,
+		Transports:  []string{"tcp", MuxCapability},
+		Codecs:      []string{"json", MsgpackCodec},
+		Compression: []string{ZstdCompression},
+	}
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && bi.Commit == "":
+				bi.Commit = s.Value
+			case s.Key == "vcs.time" && bi.BuildDate == "":
+				bi.BuildDate = s.Value
+			}
+		}
+	}
+	return bi
+}
+
+// printVersion writes the build metadata to stdout, either as a single line
+// or as indented JSON.
+func printVersion(asJSON bool) error {
+	bi := currentBuildInfo()
+	if asJSON {
+		b, err := json.MarshalIndent(bi, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+
+	fmt.Printf("jerusalem-client %s", bi.Version)
+	if bi.Commit != "" {
+		fmt.Printf(" (%s)", bi.Commit)
+	}
+	fmt.Printf(" %s %s\n", bi.GoVersion, bi.Platform)
+	return nil
+}
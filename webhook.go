@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Events posted to the notification webhook.
+const (
+	EventTunnelUp        = "tunnel.up"
+	EventTunnelDown      = "tunnel.down"
+	EventReconnected     = "tunnel.reconnected"
+	EventAuthFailed      = "auth.failed"
+	EventConnectionsHigh = "connections.high"
+	EventConnectionsOK   = "connections.normal"
+	EventQuotaExceeded   = "quota.exceeded"
+)
+
+const (
+	// webhookTimeout bounds each delivery of an event.
+	webhookTimeout = 5 * time.Second
+	// webhookQueue is the number of events waiting for delivery; further
+	// events are dropped while the webhook is slow or down.
+	webhookQueue = 64
+)
+
+// Notifications configures the webhook the CLI posts tunnel events to.
+type Notifications struct {
+	WebhookURL          string // URL events are posted to as JSON, empty to disable.
+	ConnectionThreshold int    // Active connections at which connections.high is posted, 0 to disable.
+}
+
+// readNotifications fills config.Notifications from the notifications.* keys.
+func readNotifications(config *Config) error {
+	config.Notifications = Notifications{
+		WebhookURL:          viper.GetString("notifications.webhook-url"),
+		ConnectionThreshold: viper.GetInt("notifications.connection-threshold"),
+	}
+	if config.Notifications.ConnectionThreshold < 0 {
+		return fmt.Errorf("notifications.connection-threshold must not be negative")
+	}
+	return nil
+}
+
+// webhookEvent is the JSON body posted for an event. Text repeats it as a
+// sentence, which is what chat webhooks such as Slack's display.
+type webhookEvent struct {
+	Event             string    `json:"event"`
+	Time              time.Time `json:"time"`
+	Text              string    `json:"text"`
+	ClientID          string    `json:"clientId,omitempty"`
+	Label             string    `json:"label,omitempty"`
+	Server            string    `json:"server,omitempty"`
+	RemotePort        uint16    `json:"remotePort,omitempty"`
+	ActiveConnections int       `json:"activeConnections,omitempty"`
+	Error             string    `json:"error,omitempty"`
+}
+
+// notifier posts tunnel events to a webhook in the background, so a slow
+// webhook never holds up the tunnel. Its methods do nothing on a nil notifier.
+type notifier struct {
+	url       string
+	threshold int
+	clientID  string
+	label     string
+	http      http.Client
+
+	mu     sync.Mutex // Guards closed and sending on queue.
+	closed bool
+	queue  chan webhookEvent
+	done   chan struct{}
+
+	active atomic.Int64 // Relayed connections across all clients of the CLI.
+	high   atomic.Bool  // Whether connections.high was posted last.
+}
+
+// notify is the notifier of the CLI, nil unless a webhook is configured.
+var notify *notifier
+
+// startNotifier starts posting the events of the tunnel of config to its
+// webhook. It returns nil if no webhook is configured.
+func startNotifier(config *Config) *notifier {
+	if config.Notifications.WebhookURL == "" {
+		return nil
+	}
+	n := &notifier{
+		url:       config.Notifications.WebhookURL,
+		threshold: config.Notifications.ConnectionThreshold,
+		clientID:  config.ClientID,
+		label:     config.Label,
+		http:      http.Client{Timeout: webhookTimeout},
+		queue:     make(chan webhookEvent, webhookQueue),
+		done:      make(chan struct{}),
+	}
+	go n.deliver()
+	return n
+}
+
+// tunnel posts a tunnel event about client c. c may be nil if the tunnel
+// could not be established, and err nil if there is no error to report.
+func (n *notifier) tunnel(event string, c *Client, err error) {
+	if n == nil {
+		return
+	}
+	e := webhookEvent{Event: event}
+	if c != nil {
+		e.Server, e.RemotePort = c.ServerAddr(), c.RemotePort()
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	name := n.name()
+	if c != nil && c.Label() != "" {
+		name = c.Label() // Names the extra tunnel c belongs to.
+	}
+	switch event {
+	case EventTunnelUp:
+		e.Text = fmt.Sprintf("🟢 Tunnel %s is up on remote port %d of %s", name, e.RemotePort, e.Server)
+	case EventReconnected:
+		e.Text = fmt.Sprintf("🔁 Tunnel %s reconnected on remote port %d of %s", name, e.RemotePort, e.Server)
+	case EventAuthFailed:
+		e.Text = fmt.Sprintf("❌ Tunnel %s was refused by the server: %v", name, err)
+	default:
+		e.Text = fmt.Sprintf("🔴 Tunnel %s is down", name)
+		if err != nil {
+			e.Text += ": " + err.Error()
+		}
+	}
+	n.post(e)
+}
+
+// name returns how the tunnel is called in event texts.
+func (n *notifier) name() string {
+	if n.label != "" {
+		return n.label
+	}
+	return n.clientID
+}
+
+// quotaExceeded posts quota.exceeded for err, the traffic quota of the tunnel
+// of c being used up, saying whether the tunnel is closed because of it.
+func (n *notifier) quotaExceeded(c *Client, err error, closing bool) {
+	if n == nil {
+		return
+	}
+	action := "stopped accepting connections"
+	if closing {
+		action = "is closing"
+	}
+	name := n.name()
+	if c != nil && c.Label() != "" {
+		name = c.Label()
+	}
+	n.post(webhookEvent{Event: EventQuotaExceeded, Error: err.Error(),
+		Text: fmt.Sprintf("🚫 Tunnel %s %s: %v", name, action, err)})
+}
+
+// connectionOpened counts a relayed connection, posting connections.high when
+// the threshold is reached.
+func (n *notifier) connectionOpened(ConnectionInfo) {
+	if n == nil {
+		return
+	}
+	active := int(n.active.Add(1))
+	if n.threshold > 0 && active >= n.threshold && n.high.CompareAndSwap(false, true) {
+		n.post(webhookEvent{Event: EventConnectionsHigh, ActiveConnections: active,
+			Text: fmt.Sprintf("⚠️ %d active connections reached the threshold of %d", active, n.threshold)})
+	}
+}
+
+// connectionClosed counts a finished connection, posting connections.normal
+// once the number of active connections has fallen below the threshold again.
+func (n *notifier) connectionClosed(ConnectionInfo, error) {
+	if n == nil {
+		return
+	}
+	active := int(n.active.Add(-1))
+	if n.threshold > 0 && active < n.threshold && n.high.CompareAndSwap(true, false) {
+		n.post(webhookEvent{Event: EventConnectionsOK, ActiveConnections: active,
+			Text: fmt.Sprintf("✅ Active connections are back below the threshold of %d", n.threshold)})
+	}
+}
+
+// post queues e for delivery, dropping it if the queue is full or the
+// notifier has been closed.
+func (n *notifier) post(e webhookEvent) {
+	e.Time = time.Now().UTC()
+	e.ClientID, e.Label = n.clientID, n.label
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return
+	}
+	select {
+	case n.queue <- e:
+	default:
+		log.Printf("⚠️ Webhook queue full, dropping %s event", e.Event)
+	}
+}
+
+// deliver posts the queued events in order until the queue is closed.
+func (n *notifier) deliver() {
+	defer close(n.done)
+	for e := range n.queue {
+		if err := n.send(e); err != nil {
+			log.Printf("⚠️ Failed to post %s event to webhook: %v", e.Event, err)
+		}
+	}
+}
+
+// send posts e to the webhook.
+func (n *notifier) send(e webhookEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	resp, err := n.http.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// Close stops accepting events and waits, within ctx, for the queued ones to
+// be delivered.
+func (n *notifier) Close(ctx context.Context) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	if !n.closed {
+		n.closed = true
+		close(n.queue)
+	}
+	n.mu.Unlock()
+	select {
+	case <-n.done:
+	case <-ctx.Done():
+	}
+}